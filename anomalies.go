@@ -0,0 +1,410 @@
+package stats
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"time"
+
+	sq "github.com/Masterminds/squirrel"
+)
+
+const (
+	// DayStatsTable is the day_stats table name
+	DayStatsTable = "day_stats"
+
+	// AnomalyPeriodDay is the period of anomalies found in a day's imported reports
+	AnomalyPeriodDay = "day"
+	// AnomalyPeriodMonth is the period of anomalies found in a month's instance reports
+	AnomalyPeriodMonth = "month"
+
+	// AnomalyMetricReports is the number of reports
+	AnomalyMetricReports = "reports"
+	// AnomalyMetricInstances is the number of distinct instances
+	AnomalyMetricInstances = "instances"
+	// AnomalyMetricJenkinsVersions is the distribution of instances across Jenkins versions
+	AnomalyMetricJenkinsVersions = "jenkinsVersions"
+	// AnomalyMetricPlugins is the distribution of installs across plugins
+	AnomalyMetricPlugins = "plugins"
+
+	// minBaselinePeriods is the fewest previous periods needed to compare a period to
+	minBaselinePeriods = 3
+)
+
+// AnomalyThresholds configures how far a day or month can be from its baseline before it's flagged
+type AnomalyThresholds struct {
+	// Volume is the largest fraction the report and instance counts can differ from the baseline by, e.g. 0.3 for 30%
+	Volume float64
+	// Distribution is the largest total variation distance, from 0 to 1, between the Jenkins version or plugin
+	// distribution and the baseline's
+	Distribution float64
+	// BaselineDays is the number of previous days a day is compared to
+	BaselineDays int
+	// BaselineMonths is the number of previous months a month is compared to
+	BaselineMonths int
+}
+
+// DefaultAnomalyThresholds returns the thresholds used if none are specified
+func DefaultAnomalyThresholds() AnomalyThresholds {
+	return AnomalyThresholds{
+		Volume:         0.3,
+		Distribution:   0.15,
+		BaselineDays:   14,
+		BaselineMonths: 6,
+	}
+}
+
+// PeriodStats are the numbers for a day or month which are compared to a baseline
+type PeriodStats struct {
+	Reports         uint64
+	Instances       uint64
+	JenkinsVersions map[string]uint64
+	Plugins         map[string]uint64
+}
+
+// Anomaly is a metric for a day or month which deviates sharply from the baseline of previous days or months
+type Anomaly struct {
+	Period string `json:"period"`
+	// Key is the day, as YYYY-MM-DD, or month, as YYYY-MM
+	Key    string `json:"key"`
+	Metric string `json:"metric"`
+	// Value and Baseline are the counts for volume metrics, and are omitted for distributions
+	Value    float64 `json:"value,omitempty"`
+	Baseline float64 `json:"baseline,omitempty"`
+	// Deviation is the fractional difference from the baseline for volume metrics, and the total variation distance
+	// for distributions
+	Deviation float64 `json:"deviation"`
+	Threshold float64 `json:"threshold"`
+}
+
+// AnomaliesReport is written to the anomalies file
+type AnomaliesReport struct {
+	Anomalies []Anomaly `json:"anomalies"`
+}
+
+// DayStats accumulates the numbers for each day of imported reports. Only the first report from each instance on a
+// day is included in the Jenkins version and plugin distributions.
+type DayStats struct {
+	days map[string]*dayStatsAccumulator
+}
+
+type dayStatsAccumulator struct {
+	stats     PeriodStats
+	instances map[string]bool
+}
+
+// NewDayStats returns an empty DayStats
+func NewDayStats() *DayStats {
+	return &DayStats{days: map[string]*dayStatsAccumulator{}}
+}
+
+// Add counts a report on the UTC day of its timestamp, whatever the reporting timezone is. The daily report files are UTC
+// days, so a day is complete once its file is imported, rather than also needing part of the next file, which may not
+// have been imported yet. Reports without a valid timestamp are ignored, and reports which would be skipped on import
+// are only included in the report count.
+func (ds *DayStats) Add(r *JSONReport) {
+	ts, err := r.Timestamp()
+	if err != nil {
+		return
+	}
+	day := ts.UTC().Format(fieldDayLayout)
+	acc, ok := ds.days[day]
+	if !ok {
+		acc = &dayStatsAccumulator{
+			stats:     PeriodStats{JenkinsVersions: map[string]uint64{}, Plugins: map[string]uint64{}},
+			instances: map[string]bool{},
+		}
+		ds.days[day] = acc
+	}
+	acc.stats.Reports++
+
+	version, reason := checkReport(r)
+	if reason != "" || acc.instances[r.Install] {
+		return
+	}
+	acc.instances[r.Install] = true
+	acc.stats.Instances++
+	acc.stats.JenkinsVersions[version]++
+	for _, p := range countablePlugins(r) {
+		acc.stats.Plugins[p.Name]++
+	}
+}
+
+// Days returns the days with reports, in order
+func (ds *DayStats) Days() []string {
+	var days []string
+	for d := range ds.days {
+		days = append(days, d)
+	}
+	sort.Strings(days)
+	return days
+}
+
+// Save adds the numbers to those already in the day_stats table. Instances reporting in more than one batch of reports
+// for the same day, such as in two files, are counted once for each.
+func (ds *DayStats) Save(db sq.BaseRunner) error {
+	for _, day := range ds.Days() {
+		existing, err := getDayStats(db, day)
+		if err != nil {
+			return err
+		}
+		merged := ds.days[day].stats
+		if existing != nil {
+			merged = PeriodStats{
+				Reports:         existing.Reports + merged.Reports,
+				Instances:       existing.Instances + merged.Instances,
+				JenkinsVersions: addCounts(existing.JenkinsVersions, merged.JenkinsVersions),
+				Plugins:         addCounts(existing.Plugins, merged.Plugins),
+			}
+		}
+
+		jenkinsVersions, err := json.Marshal(merged.JenkinsVersions)
+		if err != nil {
+			return err
+		}
+		plugins, err := json.Marshal(merged.Plugins)
+		if err != nil {
+			return err
+		}
+		_, err = PSQL(db).Insert(DayStatsTable).
+			Columns("day", "reports", "instances", "jenkins_versions", "plugins").
+			Values(day, merged.Reports, merged.Instances, jenkinsVersions, plugins).
+			Suffix("on conflict (day) do update set reports = excluded.reports, instances = excluded.instances, " +
+				"jenkins_versions = excluded.jenkins_versions, plugins = excluded.plugins").
+			Exec()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// DetectDayAnomalies compares each of the days, as YYYY-MM-DD, with the days before it in the day_stats table
+func DetectDayAnomalies(db sq.BaseRunner, days []string, thresholds AnomalyThresholds) ([]Anomaly, error) {
+	var anomalies []Anomaly
+	for _, day := range days {
+		current, err := getDayStats(db, day)
+		if err != nil {
+			return nil, err
+		}
+		if current == nil {
+			continue
+		}
+
+		t, err := time.Parse(fieldDayLayout, day)
+		if err != nil {
+			return nil, err
+		}
+		var baseline []PeriodStats
+		for i := 1; i <= thresholds.BaselineDays; i++ {
+			prev, err := getDayStats(db, t.AddDate(0, 0, -i).Format(fieldDayLayout))
+			if err != nil {
+				return nil, err
+			}
+			if prev != nil {
+				baseline = append(baseline, *prev)
+			}
+		}
+
+		anomalies = append(anomalies, DetectAnomalies(AnomalyPeriodDay, day, *current, baseline, thresholds)...)
+	}
+	return anomalies, nil
+}
+
+// DetectMonthAnomalies compares a month's instance reports with the months before it
+func DetectMonthAnomalies(db sq.BaseRunner, co CountOptions, year, month int, thresholds AnomalyThresholds) ([]Anomaly, error) {
+	current, err := monthStats(db, co, year, month)
+	if err != nil {
+		return nil, err
+	}
+
+	var baseline []PeriodStats
+	start := startDateForYearMonth(year, month, co.Location)
+	for i := 1; i <= thresholds.BaselineMonths; i++ {
+		prevMonth := start.AddDate(0, -i, 0)
+		prev, err := monthStats(db, co, prevMonth.Year(), int(prevMonth.Month()))
+		if err != nil {
+			return nil, err
+		}
+		if prev.Instances > 0 {
+			baseline = append(baseline, prev)
+		}
+	}
+
+	return DetectAnomalies(AnomalyPeriodMonth, fmt.Sprintf("%04d-%02d", year, month), current, baseline, thresholds), nil
+}
+
+// DetectAnomalies compares a period's numbers with those of previous periods. Report and instance counts are compared
+// to the median of the baseline, and the Jenkins version and plugin distributions to the baseline's combined
+// distributions. Nothing is flagged if there are fewer than three baseline periods.
+func DetectAnomalies(period, key string, current PeriodStats, baseline []PeriodStats, thresholds AnomalyThresholds) []Anomaly {
+	if len(baseline) < minBaselinePeriods {
+		return nil
+	}
+
+	var anomalies []Anomaly
+
+	volumes := map[string]func(PeriodStats) uint64{
+		AnomalyMetricReports:   func(s PeriodStats) uint64 { return s.Reports },
+		AnomalyMetricInstances: func(s PeriodStats) uint64 { return s.Instances },
+	}
+	for _, metric := range []string{AnomalyMetricReports, AnomalyMetricInstances} {
+		var values []uint64
+		for _, b := range baseline {
+			// Periods from before a metric was recorded have no value for it, rather than a real zero.
+			if v := volumes[metric](b); v > 0 {
+				values = append(values, v)
+			}
+		}
+		if len(values) < minBaselinePeriods {
+			continue
+		}
+		median := medianOf(values)
+		value := float64(volumes[metric](current))
+		deviation := math.Abs(value-median) / median
+		if deviation > thresholds.Volume {
+			anomalies = append(anomalies, Anomaly{Period: period, Key: key, Metric: metric, Value: value, Baseline: median,
+				Deviation: deviation, Threshold: thresholds.Volume})
+		}
+	}
+
+	distributions := map[string]func(PeriodStats) map[string]uint64{
+		AnomalyMetricJenkinsVersions: func(s PeriodStats) map[string]uint64 { return s.JenkinsVersions },
+		AnomalyMetricPlugins:         func(s PeriodStats) map[string]uint64 { return s.Plugins },
+	}
+	for _, metric := range []string{AnomalyMetricJenkinsVersions, AnomalyMetricPlugins} {
+		combined := map[string]uint64{}
+		for _, b := range baseline {
+			combined = addCounts(combined, distributions[metric](b))
+		}
+		currentDist := distributions[metric](current)
+		if len(combined) == 0 || len(currentDist) == 0 {
+			continue
+		}
+		distance := totalVariationDistance(currentDist, combined)
+		if distance > thresholds.Distribution {
+			anomalies = append(anomalies, Anomaly{Period: period, Key: key, Metric: metric, Deviation: distance,
+				Threshold: thresholds.Distribution})
+		}
+	}
+
+	return anomalies
+}
+
+// WriteAnomaliesFile writes the anomalies to a JSON file
+func WriteAnomaliesFile(filename string, anomalies []Anomaly) error {
+	report := AnomaliesReport{Anomalies: anomalies}
+	if report.Anomalies == nil {
+		report.Anomalies = []Anomaly{}
+	}
+	return writeJSONFile(filename, report)
+}
+
+func getDayStats(db sq.BaseRunner, day string) (*PeriodStats, error) {
+	var s PeriodStats
+	var jenkinsVersions, plugins []byte
+	err := PSQL(db).Select("reports", "instances", "jenkins_versions", "plugins").
+		From(DayStatsTable).
+		Where(sq.Eq{"day": day}).
+		QueryRow().
+		Scan(&s.Reports, &s.Instances, &jenkinsVersions, &plugins)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(jenkinsVersions, &s.JenkinsVersions); err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(plugins, &s.Plugins); err != nil {
+		return nil, err
+	}
+	return &s, nil
+}
+
+// monthStats gets the numbers for a month from the instance reports, and the number of reports from report_days
+func monthStats(db sq.BaseRunner, co CountOptions, year, month int) (PeriodStats, error) {
+	var s PeriodStats
+
+	start := startDateForYearMonth(year, month, co.Location)
+	err := PSQL(db).Select("coalesce(sum(reports), 0)").
+		From(ReportDaysTable).
+		Where(sq.GtOrEq{"day": start.Format(fieldDayLayout)}).
+		Where(sq.Lt{"day": start.AddDate(0, 1, 0).Format(fieldDayLayout)}).
+		QueryRow().
+		Scan(&s.Reports)
+	if err != nil {
+		return s, err
+	}
+
+	totals, err := TotalsForMonth(db, co, year, month)
+	if err != nil {
+		return s, err
+	}
+	s.Instances = totals.Instances
+
+	installCount, err := GetInstallCountForVersions(db, co, year, month)
+	if err != nil {
+		return s, err
+	}
+	s.JenkinsVersions = installCount.Installations
+
+	pluginNumbers, err := GetLatestPluginNumbers(db, co, year, month)
+	if err != nil {
+		return s, err
+	}
+	s.Plugins = pluginNumbers.Plugins
+
+	return s, nil
+}
+
+func addCounts(a, b map[string]uint64) map[string]uint64 {
+	sum := make(map[string]uint64, len(a))
+	for k, v := range a {
+		sum[k] = v
+	}
+	for k, v := range b {
+		sum[k] += v
+	}
+	return sum
+}
+
+func medianOf(values []uint64) float64 {
+	sorted := append([]uint64(nil), values...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	mid := len(sorted) / 2
+	if len(sorted)%2 == 0 {
+		return float64(sorted[mid-1]+sorted[mid]) / 2
+	}
+	return float64(sorted[mid])
+}
+
+// totalVariationDistance is half the sum of the differences between the proportions of each key in two distributions,
+// from 0 for identical distributions to 1 for ones with nothing in common
+func totalVariationDistance(a, b map[string]uint64) float64 {
+	var totalA, totalB float64
+	for _, v := range a {
+		totalA += float64(v)
+	}
+	for _, v := range b {
+		totalB += float64(v)
+	}
+	if totalA == 0 || totalB == 0 {
+		return 0
+	}
+
+	var sum float64
+	for k, v := range a {
+		sum += math.Abs(float64(v)/totalA - float64(b[k])/totalB)
+	}
+	for k, v := range b {
+		if _, ok := a[k]; !ok {
+			sum += float64(v) / totalB
+		}
+	}
+	return sum / 2
+}
@@ -0,0 +1,98 @@
+package stats_test
+
+import (
+	"fmt"
+	"testing"
+
+	stats "github.com/jenkins-infra/jenkins-usage-stats"
+	"github.com/jenkins-infra/jenkins-usage-stats/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDetectAnomalies(t *testing.T) {
+	thresholds := stats.DefaultAnomalyThresholds()
+
+	normal := stats.PeriodStats{
+		Reports:         1000,
+		Instances:       900,
+		JenkinsVersions: map[string]uint64{"2.303.1": 500, "2.289.3": 400},
+		Plugins:         map[string]uint64{"git": 800, "workflow-job": 700},
+	}
+	baseline := []stats.PeriodStats{normal, normal, normal}
+
+	t.Run("normal", func(t *testing.T) {
+		current := normal
+		current.Reports = 1100
+		assert.Empty(t, stats.DetectAnomalies(stats.AnomalyPeriodDay, "2022-06-04", current, baseline, thresholds))
+	})
+
+	t.Run("truncated", func(t *testing.T) {
+		current := stats.PeriodStats{
+			Reports:         300,
+			Instances:       280,
+			JenkinsVersions: map[string]uint64{"2.303.1": 150, "2.289.3": 130},
+			Plugins:         map[string]uint64{"git": 250, "workflow-job": 220},
+		}
+		anomalies := stats.DetectAnomalies(stats.AnomalyPeriodDay, "2022-06-04", current, baseline, thresholds)
+		require.Len(t, anomalies, 2)
+		assert.Equal(t, stats.Anomaly{Period: stats.AnomalyPeriodDay, Key: "2022-06-04", Metric: stats.AnomalyMetricReports,
+			Value: 300, Baseline: 1000, Deviation: 0.7, Threshold: 0.3}, anomalies[0])
+		assert.Equal(t, stats.AnomalyMetricInstances, anomalies[1].Metric)
+	})
+
+	t.Run("distribution", func(t *testing.T) {
+		current := normal
+		current.JenkinsVersions = map[string]uint64{"2.303.1": 100, "2.289.3": 100, "2.2.0": 700}
+		anomalies := stats.DetectAnomalies(stats.AnomalyPeriodMonth, "2022-06", current, baseline, thresholds)
+		require.Len(t, anomalies, 1)
+		assert.Equal(t, stats.AnomalyMetricJenkinsVersions, anomalies[0].Metric)
+		assert.InDelta(t, 700.0/900.0, anomalies[0].Deviation, 0.0001)
+	})
+
+	t.Run("not enough baseline", func(t *testing.T) {
+		assert.Empty(t, stats.DetectAnomalies(stats.AnomalyPeriodDay, "2022-06-04", stats.PeriodStats{Reports: 1}, baseline[:2], thresholds))
+	})
+}
+
+func TestDayStatsUTCDays(t *testing.T) {
+	// 03:00 UTC on July 1st is still June 30th with the legacy boundary, but it's in the file for July 1st.
+	dayStats := stats.NewDayStats()
+	dayStats.Add(&stats.JSONReport{Install: "instance", TimestampString: "01/Jul/2022:03:00:00 +0000", Version: "2.303.1"})
+	assert.Equal(t, []string{"2022-07-01"}, dayStats.Days())
+}
+
+func TestDetectDayAnomalies(t *testing.T) {
+	db, closeFunc := testutil.DBForTest(t)
+	defer closeFunc()
+
+	dayStats := stats.NewDayStats()
+	for day := 1; day <= 5; day++ {
+		reports := 10
+		if day == 5 {
+			reports = 2
+		}
+		for i := 0; i < reports; i++ {
+			dayStats.Add(&stats.JSONReport{
+				Install:         fmt.Sprintf("instance-%d", i),
+				TimestampString: fmt.Sprintf("%02d/Jun/2022:12:00:00 +0000", day),
+				Version:         "2.303.1",
+				Plugins:         []stats.JSONPlugin{{Name: "git", Version: "4.0"}},
+			})
+		}
+		// A second report from the same instance counts as a report, but not as another instance.
+		dayStats.Add(&stats.JSONReport{Install: "instance-0", TimestampString: fmt.Sprintf("%02d/Jun/2022:13:00:00 +0000", day), Version: "2.303.1"})
+	}
+	require.NoError(t, dayStats.Save(db))
+	assert.Equal(t, []string{"2022-06-01", "2022-06-02", "2022-06-03", "2022-06-04", "2022-06-05"}, dayStats.Days())
+
+	anomalies, err := stats.DetectDayAnomalies(db, dayStats.Days(), stats.DefaultAnomalyThresholds())
+	require.NoError(t, err)
+	require.Len(t, anomalies, 2)
+	assert.Equal(t, "2022-06-05", anomalies[0].Key)
+	assert.Equal(t, stats.AnomalyMetricReports, anomalies[0].Metric)
+	assert.Equal(t, float64(3), anomalies[0].Value)
+	assert.Equal(t, float64(11), anomalies[0].Baseline)
+	assert.Equal(t, stats.AnomalyMetricInstances, anomalies[1].Metric)
+	assert.Equal(t, float64(10), anomalies[1].Baseline)
+}
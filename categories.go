@@ -0,0 +1,93 @@
+package stats
+
+import (
+	_ "embed"
+	"fmt"
+	"io/ioutil"
+	"regexp"
+
+	"gopkg.in/yaml.v2"
+)
+
+var (
+	//go:embed etc/job-categories.yml
+	// DefaultJobCategoriesConfig is the YAML configuration used for job categories if no other configuration is specified.
+	DefaultJobCategoriesConfig string
+)
+
+// JobCategories maps job type names to categories, such as "Freestyle" or "Pipeline"
+type JobCategories struct {
+	Default    string        `yaml:"default"`
+	Categories []JobCategory `yaml:"categories"`
+}
+
+// JobCategory is a single category and the patterns for the job type names it contains
+type JobCategory struct {
+	Name     string   `yaml:"name"`
+	Patterns []string `yaml:"patterns"`
+
+	compiled []*regexp.Regexp
+}
+
+// ParseJobCategories parses and validates YAML job category configuration
+func ParseJobCategories(data []byte) (*JobCategories, error) {
+	jc := &JobCategories{}
+	if err := yaml.UnmarshalStrict(data, jc); err != nil {
+		return nil, err
+	}
+	if jc.Default == "" {
+		return nil, fmt.Errorf("job categories must specify a default category")
+	}
+
+	for i, c := range jc.Categories {
+		if c.Name == "" {
+			return nil, fmt.Errorf("job category %d has no name", i)
+		}
+		if c.Name == jc.Default {
+			return nil, fmt.Errorf("job category %s is also the default category", c.Name)
+		}
+		for _, p := range c.Patterns {
+			re, err := regexp.Compile("^(?:" + p + ")$")
+			if err != nil {
+				return nil, fmt.Errorf("invalid pattern %s for job category %s: %w", p, c.Name, err)
+			}
+			jc.Categories[i].compiled = append(jc.Categories[i].compiled, re)
+		}
+	}
+
+	return jc, nil
+}
+
+// LoadJobCategories reads job category configuration from a YAML file, or returns the default configuration if the
+// filename is empty
+func LoadJobCategories(filename string) (*JobCategories, error) {
+	if filename == "" {
+		return ParseJobCategories([]byte(DefaultJobCategoriesConfig))
+	}
+	data, err := ioutil.ReadFile(filename) // #nosec
+	if err != nil {
+		return nil, err
+	}
+	return ParseJobCategories(data)
+}
+
+// CategoryFor returns the category for a job type name
+func (jc *JobCategories) CategoryFor(jobType string) string {
+	for _, c := range jc.Categories {
+		for _, re := range c.compiled {
+			if re.MatchString(jobType) {
+				return c.Name
+			}
+		}
+	}
+	return jc.Default
+}
+
+// Names returns all category names, in configuration order, followed by the default category
+func (jc *JobCategories) Names() []string {
+	var names []string
+	for _, c := range jc.Categories {
+		names = append(names, c.Name)
+	}
+	return append(names, jc.Default)
+}
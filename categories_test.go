@@ -0,0 +1,51 @@
+package stats_test
+
+import (
+	"testing"
+
+	stats "github.com/jenkins-infra/jenkins-usage-stats"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestJobCategories(t *testing.T) {
+	categories, err := stats.LoadJobCategories("")
+	require.NoError(t, err)
+
+	testCases := map[string]string{
+		"hudson-model-FreeStyleProject":                                         "Freestyle",
+		"org-jenkinsci-plugins-workflow-job-WorkflowJob":                        "Pipeline",
+		"org-jenkinsci-plugins-workflow-multibranch-WorkflowMultiBranchProject": "Multibranch",
+		"com-cloudbees-hudson-plugins-folder-Folder":                            "Folder/Organization",
+		"jenkins-branch-OrganizationFolder":                                     "Folder/Organization",
+		"hudson-matrix-MatrixProject":                                           "Matrix",
+		"hudson-maven-MavenModuleSet":                                           "Maven",
+		"com-tikal-jenkins-plugins-multijob-MultiJobProject":                    "Other",
+		"hudson-model-ExternalJob":                                              "Other",
+	}
+
+	for jobType, expected := range testCases {
+		t.Run(jobType, func(t *testing.T) {
+			assert.Equal(t, expected, categories.CategoryFor(jobType))
+		})
+	}
+
+	assert.Equal(t, []string{"Freestyle", "Pipeline", "Multibranch", "Folder/Organization", "Matrix", "Maven", "Other"}, categories.Names())
+}
+
+func TestParseJobCategoriesErrors(t *testing.T) {
+	testCases := map[string]string{
+		"no default":       "categories:\n  - name: Freestyle\n    patterns: [hudson-model-FreeStyleProject]\n",
+		"default reused":   "default: Freestyle\ncategories:\n  - name: Freestyle\n",
+		"invalid pattern":  "default: Other\ncategories:\n  - name: Broken\n    patterns: ['(']\n",
+		"unknown field":    "default: Other\nunknown: true\n",
+		"unnamed category": "default: Other\ncategories:\n  - patterns: [foo]\n",
+	}
+
+	for name, config := range testCases {
+		t.Run(name, func(t *testing.T) {
+			_, err := stats.ParseJobCategories([]byte(config))
+			assert.Error(t, err)
+		})
+	}
+}
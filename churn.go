@@ -0,0 +1,219 @@
+package stats
+
+import (
+	"sort"
+
+	sq "github.com/Masterminds/squirrel"
+	"github.com/lib/pq"
+)
+
+const (
+	// DefaultChurnTop is the default number of plugins and plugin pairs listed by removals
+	DefaultChurnTop = 20
+
+	// maxCoRemovedPlugins is the most plugins an instance can remove in a month for them to count as removed together.
+	// Instances removing more than this are usually being rebuilt, which says nothing about the plugins.
+	maxCoRemovedPlugins = 25
+)
+
+// PluginChurn is how many instances added and removed a plugin from one month to the next
+type PluginChurn struct {
+	Name    string `json:"name"`
+	Added   uint64 `json:"added"`
+	Removed uint64 `json:"removed"`
+}
+
+// PluginCoRemoval is how many instances removed both of a pair of plugins in the same month
+type PluginCoRemoval struct {
+	Plugins   [2]string `json:"plugins"`
+	Instances uint64    `json:"instances"`
+	// Share is the fraction of the instances removing the less often removed plugin of the pair which removed both
+	Share float64 `json:"share"`
+}
+
+// PluginChurnReport is the plugins added and removed by instances counted in both a month and the month before it
+type PluginChurnReport struct {
+	Year  int `json:"year"`
+	Month int `json:"month"`
+	// Instances is the number of instances counted in both months
+	Instances uint64 `json:"instances"`
+	// Plugins is the churn of each plugin added or removed by any instance, ordered by name
+	Plugins []PluginChurn `json:"plugins"`
+	// TopRemovals are the most removed plugins, most removed first
+	TopRemovals []PluginChurn `json:"topRemovals"`
+	// CoRemovals are the plugin pairs most often removed together, most often first
+	CoRemovals []PluginCoRemoval `json:"coRemovals"`
+}
+
+// PluginChurnCounter counts the plugins instances added and removed between two monthly reports
+type PluginChurnCounter struct {
+	instances  uint64
+	churn      map[string]*PluginChurn
+	coRemovals map[[2]string]uint64
+}
+
+// NewPluginChurnCounter returns an empty PluginChurnCounter
+func NewPluginChurnCounter() *PluginChurnCounter {
+	return &PluginChurnCounter{
+		churn:      map[string]*PluginChurn{},
+		coRemovals: map[[2]string]uint64{},
+	}
+}
+
+// Add records the difference between an instance's plugin names in one month and the next
+func (pc *PluginChurnCounter) Add(prev, cur []string) {
+	pc.instances++
+
+	prevSet := map[string]bool{}
+	for _, p := range prev {
+		prevSet[p] = true
+	}
+	curSet := map[string]bool{}
+	for _, p := range cur {
+		curSet[p] = true
+	}
+
+	for p := range curSet {
+		if !prevSet[p] {
+			pc.pluginChurn(p).Added++
+		}
+	}
+	var removed []string
+	for p := range prevSet {
+		if !curSet[p] {
+			pc.pluginChurn(p).Removed++
+			removed = append(removed, p)
+		}
+	}
+
+	if len(removed) > maxCoRemovedPlugins {
+		return
+	}
+	sort.Strings(removed)
+	for i := range removed {
+		for j := i + 1; j < len(removed); j++ {
+			pc.coRemovals[[2]string{removed[i], removed[j]}]++
+		}
+	}
+}
+
+func (pc *PluginChurnCounter) pluginChurn(name string) *PluginChurn {
+	c, ok := pc.churn[name]
+	if !ok {
+		c = &PluginChurn{Name: name}
+		pc.churn[name] = c
+	}
+	return c
+}
+
+// Report returns the churn for the month, with the top plugins and plugin pairs by removals. Pairs need to have been
+// removed together by at least two instances to be listed.
+func (pc *PluginChurnCounter) Report(year, month, top int) *PluginChurnReport {
+	report := &PluginChurnReport{
+		Year:        year,
+		Month:       month,
+		Instances:   pc.instances,
+		Plugins:     []PluginChurn{},
+		TopRemovals: []PluginChurn{},
+		CoRemovals:  []PluginCoRemoval{},
+	}
+
+	for _, c := range pc.churn {
+		report.Plugins = append(report.Plugins, *c)
+		if c.Removed > 0 {
+			report.TopRemovals = append(report.TopRemovals, *c)
+		}
+	}
+	sort.Slice(report.Plugins, func(i, j int) bool {
+		return report.Plugins[i].Name < report.Plugins[j].Name
+	})
+	sort.Slice(report.TopRemovals, func(i, j int) bool {
+		if report.TopRemovals[i].Removed != report.TopRemovals[j].Removed {
+			return report.TopRemovals[i].Removed > report.TopRemovals[j].Removed
+		}
+		return report.TopRemovals[i].Name < report.TopRemovals[j].Name
+	})
+	if len(report.TopRemovals) > top {
+		report.TopRemovals = report.TopRemovals[:top]
+	}
+
+	for pair, count := range pc.coRemovals {
+		if count < 2 {
+			continue
+		}
+		fewest := pc.churn[pair[0]].Removed
+		if r := pc.churn[pair[1]].Removed; r < fewest {
+			fewest = r
+		}
+		report.CoRemovals = append(report.CoRemovals, PluginCoRemoval{
+			Plugins:   pair,
+			Instances: count,
+			Share:     float64(count) / float64(fewest),
+		})
+	}
+	sort.Slice(report.CoRemovals, func(i, j int) bool {
+		a, b := report.CoRemovals[i], report.CoRemovals[j]
+		if a.Instances != b.Instances {
+			return a.Instances > b.Instances
+		}
+		if a.Plugins[0] != b.Plugins[0] {
+			return a.Plugins[0] < b.Plugins[0]
+		}
+		return a.Plugins[1] < b.Plugins[1]
+	})
+	if len(report.CoRemovals) > top {
+		report.CoRemovals = report.CoRemovals[:top]
+	}
+
+	return report
+}
+
+// GetPluginChurn compares the plugins of each instance counted in both a month and the month before it, and reports
+// how many instances added and removed each plugin, listing the top plugins and pairs of plugins by removals. Plugins
+// are compared by name, so upgrades aren't churn.
+func GetPluginChurn(db sq.BaseRunner, co CountOptions, year, month, top int) (*PluginChurnReport, error) {
+	idToPlugin, err := pluginIDsToPlugin(db)
+	if err != nil {
+		return nil, err
+	}
+
+	prevMonth := startDateForYearMonth(year, month, co.Location).AddDate(0, -1, 0)
+	rows, err := PSQL(db).Select("prev.plugins", "cur.plugins").
+		From(InstanceReportsTable + " cur").
+		Join(InstanceReportsTable + " prev on prev.instance_id = cur.instance_id").
+		Where(sq.Eq{"cur.year": year, "cur.month": month}).
+		Where(sq.Eq{"prev.year": prevMonth.Year(), "prev.month": int(prevMonth.Month())}).
+		Where(countedInstances("cur", co.ExcludeQuarantined)).
+		Where(countedInstances("prev", co.ExcludeQuarantined)).
+		Query()
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = rows.Close()
+	}()
+
+	names := func(ids pq.Int64Array) []string {
+		var n []string
+		for _, id := range ids {
+			if p, ok := idToPlugin[uint64(id)]; ok {
+				n = append(n, p.Name)
+			}
+		}
+		return n
+	}
+
+	counter := NewPluginChurnCounter()
+	for rows.Next() {
+		var prev, cur pq.Int64Array
+		if err := rows.Scan(&prev, &cur); err != nil {
+			return nil, err
+		}
+		counter.Add(names(prev), names(cur))
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return counter.Report(year, month, top), nil
+}
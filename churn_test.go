@@ -0,0 +1,57 @@
+package stats_test
+
+import (
+	"fmt"
+	"testing"
+
+	stats "github.com/jenkins-infra/jenkins-usage-stats"
+	"github.com/jenkins-infra/jenkins-usage-stats/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPluginChurnCounter(t *testing.T) {
+	counter := stats.NewPluginChurnCounter()
+	counter.Add([]string{"git", "cvs", "svn"}, []string{"git", "workflow-job"})
+	counter.Add([]string{"git", "cvs", "svn"}, []string{"git"})
+	counter.Add([]string{"git", "cvs"}, []string{"git", "cvs", "workflow-job"})
+	// Upgrades show up as the same plugin twice, which isn't churn.
+	counter.Add([]string{"git", "git"}, []string{"git"})
+
+	report := counter.Report(2022, 6, 1)
+	assert.Equal(t, uint64(4), report.Instances)
+	assert.Equal(t, []stats.PluginChurn{
+		{Name: "cvs", Removed: 2},
+		{Name: "svn", Removed: 2},
+		{Name: "workflow-job", Added: 2},
+	}, report.Plugins)
+	assert.Equal(t, []stats.PluginChurn{{Name: "cvs", Removed: 2}}, report.TopRemovals)
+	assert.Equal(t, []stats.PluginCoRemoval{{Plugins: [2]string{"cvs", "svn"}, Instances: 2, Share: 1}}, report.CoRemovals)
+}
+
+func TestGetPluginChurn(t *testing.T) {
+	db, closeFunc := testutil.DBForTest(t)
+	defer closeFunc()
+
+	cache := stats.NewStatsCache()
+	add := func(install string, month string, day int, plugins ...string) {
+		r := testReport(install, day, "2.303.1", "Linux", plugins...)
+		r.TimestampString = fmt.Sprintf("%02d/%s/2022:12:00:00 +0000", day, month)
+		require.NoError(t, stats.AddIndividualReport(db, cache, r))
+	}
+	for day := 1; day <= 2; day++ {
+		add("a", "May", day, "git", "cvs")
+		add("a", "Jun", day, "git", "ldap")
+		add("b", "May", day, "git", "cvs")
+		add("b", "Jun", day, "git")
+		// c wasn't counted in May, so it isn't compared.
+		add("c", "Jun", day, "git")
+	}
+	add("c", "May", 1, "cvs")
+
+	report, err := stats.GetPluginChurn(db, stats.CountOptions{}, 2022, 6, stats.DefaultChurnTop)
+	require.NoError(t, err)
+	assert.Equal(t, uint64(2), report.Instances)
+	assert.Equal(t, []stats.PluginChurn{{Name: "cvs", Removed: 2}, {Name: "ldap", Added: 1}}, report.Plugins)
+	assert.Empty(t, report.CoRemovals)
+}
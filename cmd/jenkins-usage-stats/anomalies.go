@@ -0,0 +1,25 @@
+package main
+
+import (
+	stats "github.com/jenkins-infra/jenkins-usage-stats"
+	"github.com/spf13/cobra"
+)
+
+// anomalyFlags are the anomaly detection thresholds which can be set on the command line
+type anomalyFlags struct {
+	Volume       float64
+	Distribution float64
+}
+
+func (af *anomalyFlags) addFlags(cmd *cobra.Command) {
+	defaults := stats.DefaultAnomalyThresholds()
+	cmd.Flags().Float64Var(&af.Volume, "anomaly-volume-threshold", defaults.Volume, "Largest fraction report and instance counts can differ from the baseline by before being flagged")
+	cmd.Flags().Float64Var(&af.Distribution, "anomaly-distribution-threshold", defaults.Distribution, "Largest distance, from 0 to 1, between the Jenkins version or plugin distributions and the baseline before being flagged")
+}
+
+func (af *anomalyFlags) thresholds() stats.AnomalyThresholds {
+	thresholds := stats.DefaultAnomalyThresholds()
+	thresholds.Volume = af.Volume
+	thresholds.Distribution = af.Distribution
+	return thresholds
+}
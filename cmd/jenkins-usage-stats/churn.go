@@ -0,0 +1,116 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	stats "github.com/jenkins-infra/jenkins-usage-stats"
+	"github.com/spf13/cobra"
+)
+
+// ChurnOptions is the configuration for the churn command
+type ChurnOptions struct {
+	Database string
+	Start    string
+	End      string
+	Top      int
+	Output   string
+}
+
+// NewChurnCmd returns the churn command
+func NewChurnCmd() *cobra.Command {
+	options := &ChurnOptions{}
+
+	cobraCmd := &cobra.Command{
+		Use:   "churn",
+		Short: "Report plugins installed and removed by instances each month",
+		Long: `Compare the plugins of each instance counted in both a month and the month before it, and report how many
+instances added and removed each plugin, the most removed plugins, and the pairs of plugins most often removed together.
+Plugins commonly removed together may have been deprecated or replaced.`,
+		Run: func(cmd *cobra.Command, args []string) {
+			if err := options.runChurn(); err != nil {
+				fmt.Println(err)
+				os.Exit(1)
+			}
+		},
+		DisableAutoGenTag: true,
+	}
+
+	cobraCmd.Flags().StringVar(&options.Database, "database", "", "Database URL to report from")
+	_ = cobraCmd.MarkFlagRequired("database")
+	cobraCmd.Flags().StringVar(&options.Start, "start", "", "First month to report on, as YYYY-MM. Defaults to the previous month.")
+	cobraCmd.Flags().StringVar(&options.End, "end", "", "Last month to report on, as YYYY-MM. Defaults to the start month.")
+	cobraCmd.Flags().IntVar(&options.Top, "top", stats.DefaultChurnTop, "Number of plugins and plugin pairs to list by removals")
+	cobraCmd.Flags().StringVar(&options.Output, "output", "table", "Output format: table or json")
+
+	return cobraCmd
+}
+
+func (co *ChurnOptions) runChurn() error {
+	if co.Output != "table" && co.Output != "json" {
+		return fmt.Errorf("unknown output format %s, must be table or json", co.Output)
+	}
+
+	var startYear, startMonth int
+	var err error
+	if co.Start == "" {
+		startYear, startMonth = stats.PreviousMonth(time.Now(), reportingLocation)
+	} else if startYear, startMonth, err = parseYearMonth(co.Start); err != nil {
+		return err
+	}
+	endYear, endMonth := startYear, startMonth
+	if co.End != "" {
+		if endYear, endMonth, err = parseYearMonth(co.End); err != nil {
+			return err
+		}
+	}
+	if startYear*12+startMonth > endYear*12+endMonth {
+		return fmt.Errorf("start month %s is after end month %s", co.Start, co.End)
+	}
+
+	db, closeFunc, err := getDatabase(co.Database)
+	if err != nil {
+		return err
+	}
+	defer closeFunc()
+
+	var reports []*stats.PluginChurnReport
+	for ym := startYear*12 + startMonth - 1; ym <= endYear*12+endMonth-1; ym++ {
+		report, err := stats.GetPluginChurn(db, stats.CountOptions{Location: reportingLocation}, ym/12, ym%12+1, co.Top)
+		if err != nil {
+			return err
+		}
+		reports = append(reports, report)
+	}
+
+	if co.Output == "json" {
+		asJSON, err := json.MarshalIndent(reports, "", "    ")
+		if err != nil {
+			return err
+		}
+		fmt.Println(string(asJSON))
+		return nil
+	}
+
+	for _, r := range reports {
+		fmt.Printf("%04d-%02d: %d instances in both months\n\n", r.Year, r.Month, r.Instances)
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		_, _ = fmt.Fprintln(w, "PLUGIN\tREMOVED\tADDED")
+		for _, c := range r.TopRemovals {
+			_, _ = fmt.Fprintf(w, "%s\t%d\t%d\n", c.Name, c.Removed, c.Added)
+		}
+		_, _ = fmt.Fprintln(w)
+		_, _ = fmt.Fprintln(w, "REMOVED TOGETHER\tINSTANCES\tSHARE")
+		for _, c := range r.CoRemovals {
+			_, _ = fmt.Fprintf(w, "%s, %s\t%d\t%.2f\n", c.Plugins[0], c.Plugins[1], c.Instances, c.Share)
+		}
+		if err := w.Flush(); err != nil {
+			return err
+		}
+		fmt.Println()
+	}
+	return nil
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	stats "github.com/jenkins-infra/jenkins-usage-stats"
+	"github.com/spf13/cobra"
+)
+
+// EnrichOptions is the configuration for the enrich command
+type EnrichOptions struct {
+	Database       string
+	UpdateCenter   string
+	PluginVersions string
+}
+
+// NewEnrichCmd returns the enrich command
+func NewEnrichCmd() *cobra.Command {
+	options := &EnrichOptions{}
+
+	cobraCmd := &cobra.Command{
+		Use:   "enrich",
+		Short: "Add plugin metadata from a local update center snapshot",
+		Long: `Load plugin titles, labels, deprecations, required core versions and release dates from a local copy of
+update-center.json, and optionally the release dates of every plugin version from plugin-versions.json. Plugins in the
+usage data which aren't in the update center are recorded as no longer distributed. The metadata replaces any from an
+earlier run, and is used by report --plugin-metadata.`,
+		Example: `  # Enrich from snapshots downloaded from the update site
+  curl -sSLO https://updates.jenkins.io/current/update-center.actual.json
+  curl -sSLO https://updates.jenkins.io/current/plugin-versions.json
+  jenkins-usage-stats enrich --database "$DATABASE_URL" --update-center update-center.actual.json --plugin-versions plugin-versions.json`,
+		Run: func(cmd *cobra.Command, args []string) {
+			if err := options.runEnrich(); err != nil {
+				fmt.Println(err)
+				os.Exit(1)
+			}
+		},
+		DisableAutoGenTag: true,
+	}
+
+	cobraCmd.Flags().StringVar(&options.Database, "database", "", "Database URL to store plugin metadata in")
+	_ = cobraCmd.MarkFlagRequired("database")
+	cobraCmd.Flags().StringVar(&options.UpdateCenter, "update-center", "", "update-center.json file to load plugin metadata from")
+	_ = cobraCmd.MarkFlagRequired("update-center")
+	cobraCmd.Flags().StringVar(&options.PluginVersions, "plugin-versions", "", "plugin-versions.json file to load release dates of older plugin versions from")
+
+	return cobraCmd
+}
+
+func (eo *EnrichOptions) runEnrich() error {
+	uc, err := stats.LoadUpdateCenter(eo.UpdateCenter)
+	if err != nil {
+		return err
+	}
+	var versions *stats.PluginVersionsFile
+	if eo.PluginVersions != "" {
+		versions, err = stats.LoadPluginVersions(eo.PluginVersions)
+		if err != nil {
+			return err
+		}
+	}
+
+	db, closeFunc, err := getDatabase(eo.Database)
+	if err != nil {
+		return err
+	}
+	defer closeFunc()
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	result, err := stats.EnrichPlugins(tx, uc, versions)
+	if err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	fmt.Printf("enriched %d distributed and %d no longer distributed plugins, %d deprecated, with %d plugin version release dates\n",
+		result.Distributed, result.NotDistributed, result.Deprecated, result.Releases)
+	return nil
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	stats "github.com/jenkins-infra/jenkins-usage-stats"
+	"github.com/spf13/cobra"
+)
+
+// ExportOptions contains the configuration for exporting instance reports
+type ExportOptions struct {
+	Database        string
+	Output          string
+	Start           string
+	End             string
+	HashInstanceIDs bool
+	Salt            string
+
+	ExcludeQuarantined bool
+}
+
+// NewExportCmd returns the export command
+func NewExportCmd() *cobra.Command {
+	options := &ExportOptions{}
+
+	cobraCmd := &cobra.Command{
+		Use:   "export",
+		Short: "Export instance reports for a range of months to a Parquet file",
+		Run: func(_ *cobra.Command, args []string) {
+			if err := options.runExport(); err != nil {
+				fmt.Println(err)
+				os.Exit(1)
+			}
+		},
+		DisableAutoGenTag: true,
+	}
+
+	cobraCmd.Flags().StringVar(&options.Database, "database", "", "Database URL to export from")
+	_ = cobraCmd.MarkFlagRequired("database")
+	cobraCmd.Flags().StringVar(&options.Output, "output", "", "Parquet file to write")
+	_ = cobraCmd.MarkFlagRequired("output")
+	cobraCmd.Flags().StringVar(&options.Start, "start", "", "First month to export, as YYYY-MM. Defaults to the previous month.")
+	cobraCmd.Flags().StringVar(&options.End, "end", "", "Last month to export, as YYYY-MM. Defaults to the start month.")
+	cobraCmd.Flags().BoolVar(&options.HashInstanceIDs, "hash-instance-ids", false, "Replace instance IDs with a salted hash")
+	cobraCmd.Flags().StringVar(&options.Salt, "salt", "", "Salt for --hash-instance-ids. Defaults to a random salt for each export.")
+	cobraCmd.Flags().BoolVar(&options.ExcludeQuarantined, "exclude-quarantined", false, "Leave instances quarantined for a month out of that month's reports")
+
+	return cobraCmd
+}
+
+func (eo *ExportOptions) runExport() error {
+	opts := stats.ExportOptions{
+		HashInstanceIDs: eo.HashInstanceIDs,
+		Salt:            eo.Salt,
+		CountOptions:    stats.CountOptions{ExcludeQuarantined: eo.ExcludeQuarantined, Location: reportingLocation},
+	}
+
+	var err error
+	if eo.Start == "" {
+		opts.StartYear, opts.StartMonth = stats.PreviousMonth(time.Now(), reportingLocation)
+	} else if opts.StartYear, opts.StartMonth, err = parseYearMonth(eo.Start); err != nil {
+		return err
+	}
+	if eo.End == "" {
+		opts.EndYear, opts.EndMonth = opts.StartYear, opts.StartMonth
+	} else if opts.EndYear, opts.EndMonth, err = parseYearMonth(eo.End); err != nil {
+		return err
+	}
+
+	db, closeFunc, err := getDatabase(eo.Database)
+	if err != nil {
+		return err
+	}
+	defer closeFunc()
+
+	// Write to a temporary file next to the output, and only replace the output once the export has succeeded, so a
+	// failed export doesn't leave a truncated file behind.
+	tmpFile := filepath.Join(filepath.Dir(eo.Output), "."+filepath.Base(eo.Output)+".tmp")
+	f, err := os.Create(tmpFile) //nolint:gosec
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = f.Close()
+		_ = os.Remove(tmpFile)
+	}()
+
+	startTime := time.Now()
+	count, err := stats.ExportParquet(db, f, opts)
+	if err != nil {
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmpFile, eo.Output); err != nil {
+		return err
+	}
+
+	fmt.Printf("Exported %d instance reports to %s, in %s\n", count, eo.Output, time.Since(startTime))
+	return nil
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	stats "github.com/jenkins-infra/jenkins-usage-stats"
+	"github.com/spf13/cobra"
+)
+
+// FieldsOptions is the configuration for the fields command
+type FieldsOptions struct {
+	Database string
+	Start    string
+	End      string
+	Output   string
+}
+
+// NewFieldsCmd returns the fields command
+func NewFieldsCmd() *cobra.Command {
+	options := &FieldsOptions{}
+
+	cobraCmd := &cobra.Command{
+		Use:   "fields",
+		Short: "Report fields in imported reports which aren't recognized",
+		Long: `Report the fields, at the top level of reports and on their nodes, which were seen while importing but aren't
+recognized, with how many reports had each of them and on which days. New fields show up here when Jenkins starts
+sending new data, which may need to be added to the report format.`,
+		Run: func(cmd *cobra.Command, args []string) {
+			if err := options.runFields(); err != nil {
+				fmt.Println(err)
+				os.Exit(1)
+			}
+		},
+		DisableAutoGenTag: true,
+	}
+
+	cobraCmd.Flags().StringVar(&options.Database, "database", "", "Database URL to report from")
+	_ = cobraCmd.MarkFlagRequired("database")
+	cobraCmd.Flags().StringVar(&options.Start, "start", "", "First day to include, as YYYY-MM-DD. Defaults to 30 days before the end.")
+	cobraCmd.Flags().StringVar(&options.End, "end", "", "Last day to include, as YYYY-MM-DD. Defaults to today.")
+	cobraCmd.Flags().StringVar(&options.Output, "output", "table", "Output format: table or json")
+
+	return cobraCmd
+}
+
+func (fo *FieldsOptions) runFields() error {
+	if fo.Output != "table" && fo.Output != "json" {
+		return fmt.Errorf("unknown output format %s, must be table or json", fo.Output)
+	}
+
+	end := time.Now().UTC()
+	if fo.End != "" {
+		var err error
+		if end, err = parseDay(fo.End); err != nil {
+			return err
+		}
+	}
+	start := end.AddDate(0, 0, -30)
+	if fo.Start != "" {
+		var err error
+		if start, err = parseDay(fo.Start); err != nil {
+			return err
+		}
+	}
+
+	db, closeFunc, err := getDatabase(fo.Database)
+	if err != nil {
+		return err
+	}
+	defer closeFunc()
+
+	summaries, err := stats.UnknownFieldsReport(db, start, end)
+	if err != nil {
+		return err
+	}
+
+	if fo.Output == "json" {
+		asJSON, err := json.MarshalIndent(summaries, "", "    ")
+		if err != nil {
+			return err
+		}
+		fmt.Println(string(asJSON))
+		return nil
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	_, _ = fmt.Fprintln(w, "SCOPE\tFIELD\tFIRST SEEN\tLAST SEEN\tDAYS\tREPORTS\tPERCENT")
+	for _, s := range summaries {
+		_, _ = fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%d\t%d\t%.2f\n", s.Scope, s.Name, s.FirstSeen, s.LastSeen, s.Days, s.Reports, s.Percent)
+	}
+	return w.Flush()
+}
+
+func parseDay(s string) (time.Time, error) {
+	t, err := time.Parse("2006-01-02", s)
+	if err != nil {
+		return t, fmt.Errorf("invalid day %s, must be YYYY-MM-DD", s)
+	}
+	return t, nil
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	stats "github.com/jenkins-infra/jenkins-usage-stats"
+	"github.com/spf13/cobra"
+)
+
+// FreezeOptions is the configuration for the freeze command
+type FreezeOptions struct {
+	Database string
+	Month    string
+	Note     string
+	List     bool
+
+	ExcludeQuarantined bool
+}
+
+// NewFreezeCmd returns the freeze command
+func NewFreezeCmd() *cobra.Command {
+	options := &FreezeOptions{}
+
+	cobraCmd := &cobra.Command{
+		Use:   "freeze",
+		Short: "Store a month's report numbers so the published reports can be reproduced",
+		Long: `Compute a month's installs per Jenkins version and plugin, nodes per OS, jobs per type and instances per
+executor count, and store them as a new version of the month's snapshot. Run report with --frozen to generate the
+installations, latestNumbers and capabilities reports and the Jenkins version, plugin, node, job and executor charts of
+frozen months from their latest snapshot, even if late reports have since been imported or the normalization rules have
+changed, or with --diff-frozen to compare the latest snapshots with the numbers as they would be recomputed now. Other
+reports and charts, such as the JVM, servlet container and job category ones, aren't frozen and are always recomputed.`,
+		Example: `  # Freeze May 2022 after publishing its reports
+  jenkins-usage-stats freeze --database "$DATABASE_URL" --month 2022-05 --note "published 2022-06-02"`,
+		Run: func(cmd *cobra.Command, args []string) {
+			if err := options.runFreeze(); err != nil {
+				fmt.Println(err)
+				os.Exit(1)
+			}
+		},
+		DisableAutoGenTag: true,
+	}
+
+	cobraCmd.Flags().StringVar(&options.Database, "database", "", "Database URL to freeze numbers in")
+	_ = cobraCmd.MarkFlagRequired("database")
+	cobraCmd.Flags().StringVar(&options.Month, "month", "", "Month to freeze, as YYYY-MM. Defaults to the previous month.")
+	cobraCmd.Flags().StringVar(&options.Note, "note", "", "Note to store with the snapshot, such as why it was taken")
+	cobraCmd.Flags().BoolVar(&options.List, "list", false, "List the stored snapshots instead of freezing a month")
+	cobraCmd.Flags().BoolVar(&options.ExcludeQuarantined, "exclude-quarantined", false, "Leave instances quarantined for the month out of its numbers, as report --exclude-quarantined does")
+
+	return cobraCmd
+}
+
+func (fo *FreezeOptions) runFreeze() error {
+	var year, month int
+	var err error
+	if fo.Month == "" {
+		year, month = stats.PreviousMonth(time.Now(), reportingLocation)
+	} else if year, month, err = parseYearMonth(fo.Month); err != nil {
+		return err
+	}
+
+	db, closeFunc, err := getDatabase(fo.Database)
+	if err != nil {
+		return err
+	}
+	defer closeFunc()
+
+	if fo.List {
+		snapshots, err := stats.ReportSnapshots(db)
+		if err != nil {
+			return err
+		}
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		_, _ = fmt.Fprintln(w, "MONTH\tVERSION\tFROZEN AT\tEXCLUDE QUARANTINED\tTIMEZONE\tNOTE")
+		for _, s := range snapshots {
+			_, _ = fmt.Fprintf(w, "%04d-%02d\t%d\t%s\t%t\t%s\t%s\n", s.Year, s.Month, s.Version, s.FrozenAt.UTC().Format(time.RFC3339),
+				s.ExcludeQuarantined, s.Timezone, s.Note)
+		}
+		return w.Flush()
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	version, err := stats.FreezeMonth(tx, stats.CountOptions{ExcludeQuarantined: fo.ExcludeQuarantined, Location: reportingLocation}, year, month, fo.Note)
+	if err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	fmt.Printf("froze %04d-%02d as version %d\n", year, month, version)
+	return nil
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	stats "github.com/jenkins-infra/jenkins-usage-stats"
+	"github.com/spf13/cobra"
+)
+
+// HistoryShowOptions is the configuration for the history show command
+type HistoryShowOptions struct {
+	Database string
+	Output   string
+}
+
+// HistoryPruneOptions is the configuration for the history prune command
+type HistoryPruneOptions struct {
+	Database        string
+	RetentionMonths int
+	DryRun          bool
+}
+
+// NewHistoryCmd returns the history command
+func NewHistoryCmd() *cobra.Command {
+	cobraCmd := &cobra.Command{
+		Use:   "history",
+		Short: "Work with the per-instance report history kept with import --history",
+		Long: `Work with the per-instance report history kept by import and ingest-server with --history. Each time an
+instance's Jenkins version, JVM version, executors, plugins or nodes change, a new history entry is added, so the
+history shows when instances upgraded or installed and removed plugins.`,
+		DisableAutoGenTag: true,
+	}
+
+	cobraCmd.AddCommand(NewHistoryShowCmd())
+	cobraCmd.AddCommand(NewHistoryPruneCmd())
+
+	return cobraCmd
+}
+
+// NewHistoryShowCmd returns the history show command
+func NewHistoryShowCmd() *cobra.Command {
+	options := &HistoryShowOptions{}
+
+	cobraCmd := &cobra.Command{
+		Use:   "show INSTANCE_ID",
+		Short: "Show the history of an instance",
+		Args:  cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			if err := options.runHistoryShow(args[0]); err != nil {
+				fmt.Println(err)
+				os.Exit(1)
+			}
+		},
+		DisableAutoGenTag: true,
+	}
+
+	cobraCmd.Flags().StringVar(&options.Database, "database", "", "Database URL to read from")
+	_ = cobraCmd.MarkFlagRequired("database")
+	cobraCmd.Flags().StringVar(&options.Output, "output", "table", "Output format: table or json")
+
+	return cobraCmd
+}
+
+func (ho *HistoryShowOptions) runHistoryShow(instanceID string) error {
+	if ho.Output != "table" && ho.Output != "json" {
+		return fmt.Errorf("unknown output format %s, must be table or json", ho.Output)
+	}
+
+	db, closeFunc, err := getDatabase(ho.Database)
+	if err != nil {
+		return err
+	}
+	defer closeFunc()
+
+	history, err := stats.GetInstanceHistory(db, instanceID)
+	if err != nil {
+		return err
+	}
+
+	if ho.Output == "json" {
+		asJSON, err := json.MarshalIndent(history, "", "    ")
+		if err != nil {
+			return err
+		}
+		fmt.Println(string(asJSON))
+		return nil
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	_, _ = fmt.Fprintln(w, "FROM\tUNTIL\tREPORTS\tJENKINS\tJVM\tEXECUTORS\tPLUGINS")
+	for _, h := range history {
+		_, _ = fmt.Fprintf(w, "%s\t%s\t%d\t%s\t%s\t%d\t%d\n", h.ReportTime.Format(time.RFC3339), h.LastReportTime.Format(time.RFC3339),
+			h.Reports, h.JenkinsVersion, h.JVMVersion, h.Executors, len(h.Plugins))
+	}
+	return w.Flush()
+}
+
+// NewHistoryPruneCmd returns the history prune command
+func NewHistoryPruneCmd() *cobra.Command {
+	options := &HistoryPruneOptions{}
+
+	cobraCmd := &cobra.Command{
+		Use:   "prune",
+		Short: "Drop history from before the retention period",
+		Long: `Delete the history entries whose last report was before the most recent --retention-months months, including
+the current one. Entries which started before then but are still current are kept. History is stored in a partition per
+month of each entry's first report, in UTC, and partitions from before then are dropped once none of their entries are
+current.`,
+		Run: func(cmd *cobra.Command, args []string) {
+			if err := options.runHistoryPrune(); err != nil {
+				fmt.Println(err)
+				os.Exit(1)
+			}
+		},
+		DisableAutoGenTag: true,
+	}
+
+	cobraCmd.Flags().StringVar(&options.Database, "database", "", "Database URL to prune history in")
+	_ = cobraCmd.MarkFlagRequired("database")
+	cobraCmd.Flags().IntVar(&options.RetentionMonths, "retention-months", 24, "Number of months of history to keep, including the current one")
+	cobraCmd.Flags().BoolVar(&options.DryRun, "dry-run", false, "Show what would be deleted without deleting it")
+
+	return cobraCmd
+}
+
+func (ho *HistoryPruneOptions) runHistoryPrune() error {
+	db, closeFunc, err := getDatabase(ho.Database)
+	if err != nil {
+		return err
+	}
+	defer closeFunc()
+
+	// Show what was pruned even if it failed partway through.
+	pruned, err := stats.PruneReportHistory(db, ho.RetentionMonths, time.Now(), ho.DryRun)
+	verb := "deleted"
+	if ho.DryRun {
+		verb = "would delete"
+	}
+	for _, name := range pruned.Dropped {
+		fmt.Printf("%s all of %s\n", verb, name)
+	}
+	for _, name := range pruned.Trimmed {
+		fmt.Printf("%s the ended entries in %s, keeping the ones still current\n", verb, name)
+	}
+	fmt.Printf("%s %d entries\n", verb, pruned.Entries)
+	return err
+}
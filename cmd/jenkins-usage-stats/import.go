@@ -4,11 +4,11 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
-	"regexp"
 	"sort"
 	"strings"
 	"time"
 
+	sq "github.com/Masterminds/squirrel"
 	stats "github.com/jenkins-infra/jenkins-usage-stats"
 	"github.com/spf13/cobra"
 )
@@ -17,6 +17,33 @@ import (
 type ImportOptions struct {
 	Database  string
 	Directory string
+	Files     []string
+	Rules     string
+	DryRun    bool
+	Diff      bool
+	Weekly    bool
+	History   bool
+
+	IngestArchives bool
+
+	AnomaliesFile   string
+	FailOnAnomalies bool
+	Anomalies       anomalyFlags
+}
+
+// stdinName is the name stdin is recorded as in report_files
+const stdinName = "stdin"
+
+// importSource is a single file, or stdin, to import reports from
+type importSource struct {
+	// name and hash, the SHA-256 of the contents, are recorded in report_files so the same contents aren't imported
+	// twice, even from a different file or stdin. The name is stdinName for stdin.
+	name      string
+	hash      string
+	path      string
+	firstTime time.Time
+	// reports are only read ahead of time for stdin, since it can only be read once.
+	reports []*stats.JSONReport
 }
 
 // NewImportCmd returns the import command
@@ -26,6 +53,11 @@ func NewImportCmd() *cobra.Command {
 	cobraCmd := &cobra.Command{
 		Use:   "import",
 		Short: "Import instance reports",
+		Long: `Import instance reports from line-delimited JSON, either plain or gzip, zstd or bzip2 compressed.
+
+Reports can be read from every file in a directory with one of the extensions ` + strings.Join(stats.ReportFileExtensions, ", ") + `,
+from files given with --file, or from stdin with --file -. Files are imported in the order of their first report's
+timestamp, and the reports in each file are imported in timestamp order.`,
 		Run: func(cmd *cobra.Command, args []string) {
 			if err := options.runImport(); err != nil {
 				fmt.Println(err)
@@ -38,84 +70,278 @@ func NewImportCmd() *cobra.Command {
 	cobraCmd.Flags().StringVar(&options.Database, "database", "", "Database URL to import to")
 	_ = cobraCmd.MarkFlagRequired("database")
 	cobraCmd.Flags().StringVar(&options.Directory, "directory", "", "Directory to import from")
-	_ = cobraCmd.MarkFlagRequired("directory")
+	cobraCmd.Flags().StringSliceVar(&options.Files, "file", nil, "File to import from, or - for stdin. Can be repeated.")
+	cobraCmd.MarkFlagsOneRequired("directory", "file")
+	cobraCmd.Flags().StringVar(&options.Rules, "rules", "", "YAML file of normalization rules. Defaults to the built-in rules.")
+	cobraCmd.Flags().BoolVar(&options.DryRun, "dry-run", false, "Show what importing would do, without changing the database")
+	cobraCmd.Flags().BoolVar(&options.Diff, "diff", false, "With --dry-run, show what would happen for each report")
+	cobraCmd.Flags().BoolVar(&options.Weekly, "weekly", false, "Also keep the latest report for each instance in each week, for weekly reports")
+	cobraCmd.Flags().BoolVar(&options.History, "history", false, "Also keep the history of each instance's changes")
+	cobraCmd.Flags().BoolVar(&options.IngestArchives, "ingest-archives", false, "Also import ingest-server archives, when importing into a database the ingest server didn't write to")
+	cobraCmd.Flags().StringVar(&options.AnomaliesFile, "anomalies-file", "", "Write anomalies in the imported days, compared to the days before them, to this JSON file")
+	cobraCmd.Flags().BoolVar(&options.FailOnAnomalies, "fail-on-anomalies", false, "Fail if there are anomalies in the imported days")
+	options.Anomalies.addFlags(cobraCmd)
 
 	return cobraCmd
 }
 
 func (io *ImportOptions) runImport() error {
+	rules, err := useNormalizationRules(io.Rules)
+	if err != nil {
+		return err
+	}
+
 	db, closeFunc, err := getDatabase(io.Database)
 	if err != nil {
 		return err
 	}
 	defer closeFunc()
 
-	files, err := os.ReadDir(io.Directory)
+	sources, err := io.sources(db)
 	if err != nil {
 		return err
 	}
 
+	if io.DryRun {
+		return io.runDryRun(db, sources)
+	}
+
+	if err := stats.CheckReportingTimezone(db, reportingLocation, true); err != nil {
+		return err
+	}
+	if err := updateSortKeys(db); err != nil {
+		return err
+	}
+	if err := stats.RecordNormalizationRules(db, rules); err != nil {
+		return err
+	}
+
 	totalReports := 0
 
-	dateRe := regexp.MustCompile(`.*\.(\d\d\d\d\d\d\d\d).*`)
+	cache := stats.NewStatsCacheWithConfig(stats.ImportConfig{Location: reportingLocation, Weekly: io.Weekly, History: io.History})
+	importedDays := map[string]bool{}
 
-	sort.Slice(files, func(i, j int) bool {
-		if !files[i].IsDir() && strings.HasSuffix(files[i].Name(), ".gz") && !files[j].IsDir() && strings.HasSuffix(files[j].Name(), ".gz") {
-			iMatch := dateRe.FindStringSubmatch(files[i].Name())
-			if len(iMatch) > 1 {
-				iDate := iMatch[1]
-				if iDate == "" {
-					return true
-				}
-				jMatch := dateRe.FindStringSubmatch(files[j].Name())
-				if len(jMatch) > 1 {
-					jDate := jMatch[1]
-					if jDate == "" {
-						return true
-					}
-					return iDate < jDate
-				}
+	importStart := time.Now()
+
+	for _, src := range sources {
+		startedAt := time.Now()
+		jsonReports, err := src.load()
+		if err != nil {
+			return err
+		}
+		fmt.Printf("adding %d reports from %s\n", len(jsonReports), src.displayName())
+		totalReports += len(jsonReports)
+		fieldCounts := stats.NewFieldCounts(reportingLocation)
+		dayStats := stats.NewDayStats()
+		for _, jr := range jsonReports {
+			if err := stats.AddIndividualReport(db, cache, jr); err != nil {
+				return err
 			}
+			fieldCounts.Add(jr)
+			dayStats.Add(jr)
 		}
-		return true
-	})
+		if err := fieldCounts.Save(db); err != nil {
+			return err
+		}
+		if err := dayStats.Save(db); err != nil {
+			return err
+		}
+		for _, d := range dayStats.Days() {
+			importedDays[d] = true
+		}
+		if err := stats.MarkReportFileRead(db, src.name, src.hash); err != nil {
+			return err
+		}
+		fmt.Printf("imported in %s\n", time.Since(startedAt))
+	}
+
+	fmt.Println(cache.ReportTimes())
+	fmt.Printf("total reports: %d (time to import: %s)\n", totalReports, time.Since(importStart))
 
-	cache := stats.NewStatsCache()
+	return io.checkAnomalies(db, importedDays)
+}
 
-	importStart := time.Now()
+// checkAnomalies looks for anomalies in the imported days, writing them to the anomalies file if there is one
+func (io *ImportOptions) checkAnomalies(db sq.BaseRunner, importedDays map[string]bool) error {
+	if io.AnomaliesFile == "" && !io.FailOnAnomalies {
+		return nil
+	}
+
+	var days []string
+	for d := range importedDays {
+		days = append(days, d)
+	}
+	sort.Strings(days)
+
+	anomalies, err := stats.DetectDayAnomalies(db, days, io.Anomalies.thresholds())
+	if err != nil {
+		return err
+	}
+	for _, a := range anomalies {
+		fmt.Printf("anomaly on %s: %s deviates from the baseline by %.2f\n", a.Key, a.Metric, a.Deviation)
+	}
+	if io.AnomaliesFile != "" {
+		if err := stats.WriteAnomaliesFile(io.AnomaliesFile, anomalies); err != nil {
+			return err
+		}
+	}
+	if io.FailOnAnomalies && len(anomalies) > 0 {
+		return fmt.Errorf("found %d anomalies in the imported days", len(anomalies))
+	}
+	return nil
+}
+
+// runDryRun shows what importing the sources would do, without writing anything
+func (io *ImportOptions) runDryRun(db sq.BaseRunner, sources []*importSource) error {
+	dryRun := stats.NewDryRun(db, stats.ImportConfig{Location: reportingLocation})
+	totalReports := 0
 
-	for _, fi := range files {
-		if !fi.IsDir() && strings.HasSuffix(fi.Name(), ".gz") {
-			startedAt := time.Now()
-			alreadyRead, err := stats.ReportAlreadyRead(db, fi.Name())
+	for _, src := range sources {
+		jsonReports, err := src.load()
+		if err != nil {
+			return err
+		}
+		fmt.Printf("checking %d reports from %s\n", len(jsonReports), src.displayName())
+		totalReports += len(jsonReports)
+		for _, jr := range jsonReports {
+			plan, err := dryRun.Plan(jr)
 			if err != nil {
 				return err
 			}
-			if alreadyRead {
-				fmt.Printf("file %s already read\n", fi.Name())
-				continue
+			if io.Diff {
+				fmt.Println(plan)
+			}
+		}
+	}
+
+	fmt.Printf("total reports: %d\n", totalReports)
+	for _, action := range []string{stats.ReportActionInsert, stats.ReportActionUpdate, stats.ReportActionCountOnly, stats.ReportActionSkip} {
+		fmt.Printf("%s: %d\n", action, dryRun.Actions[action])
+	}
+	var reasons []string
+	for r := range dryRun.Reasons {
+		reasons = append(reasons, r)
+	}
+	sort.Strings(reasons)
+	for _, r := range reasons {
+		fmt.Printf("  %s: %d\n", r, dryRun.Reasons[r])
+	}
+	fmt.Printf("new Jenkins versions: %d\n", len(dryRun.NewJenkinsVersions))
+	fmt.Printf("new plugin versions: %d\n", len(dryRun.NewPlugins))
+
+	return nil
+}
+
+// load returns the reports from the source, in timestamp order
+func (src *importSource) load() ([]*stats.JSONReport, error) {
+	if src.path == "" {
+		return src.reports, nil
+	}
+	jsonReports, err := stats.ParseDailyJSON(src.path)
+	if err != nil {
+		return nil, err
+	}
+	stats.SortReportsByTime(jsonReports)
+	return jsonReports, nil
+}
+
+func (src *importSource) displayName() string {
+	if src.path == "" {
+		return src.name
+	}
+	return src.path
+}
+
+// sources finds the files to import which haven't already been imported, plus stdin if requested, ordered by the
+// timestamp of their first report
+func (io *ImportOptions) sources(db sq.BaseRunner) ([]*importSource, error) {
+	return findSources(io.Directory, io.Files, func(src *importSource) (bool, error) {
+		// The reports in ingest-server archives were already added by the ingest server, so importing them into the same
+		// database would count them twice.
+		if src.path != "" && stats.IsIngestArchive(src.path) && !io.IngestArchives {
+			fmt.Printf("%s is an ingest-server archive, skipping it without --ingest-archives\n", src.displayName())
+			return true, nil
+		}
+		alreadyRead, err := stats.ReportFileAlreadyRead(db, src.name, src.hash)
+		if alreadyRead {
+			fmt.Printf("%s already read\n", src.displayName())
+		}
+		return alreadyRead, err
+	})
+}
+
+// findSources finds the report files in the directory and the given files, plus stdin if one of the files is -, ordered
+// by the timestamp of their first report. If skip is given, the contents of each source are hashed, and sources for which
+// skip returns true are left out.
+func findSources(directory string, files []string, skip func(src *importSource) (bool, error)) ([]*importSource, error) {
+	var paths []string
+	if directory != "" {
+		entries, err := os.ReadDir(directory)
+		if err != nil {
+			return nil, err
+		}
+		for _, fi := range entries {
+			if !fi.IsDir() && stats.IsReportFile(fi.Name()) {
+				paths = append(paths, filepath.Join(directory, fi.Name()))
 			}
-			fn := filepath.Join(io.Directory, fi.Name())
-			jsonReports, err := stats.ParseDailyJSON(fn)
+		}
+	}
+	paths = append(paths, files...)
+
+	var sources []*importSource
+	seen := make(map[string]bool)
+	for _, p := range paths {
+		if p == "-" {
+			reports, hash, err := stats.ParseJSONReportsWithHash(os.Stdin)
 			if err != nil {
-				return err
+				return nil, err
 			}
-			fmt.Printf("adding %d reports from file %s\n", len(jsonReports), fi.Name())
-			totalReports += len(jsonReports)
-			for _, jr := range jsonReports {
-				if err := stats.AddIndividualReport(db, cache, jr); err != nil {
-					return err
+			stats.SortReportsByTime(reports)
+			src := &importSource{name: stdinName, hash: hash, reports: reports}
+			if skip != nil {
+				skipped, err := skip(src)
+				if err != nil {
+					return nil, err
+				}
+				if skipped || seen[src.hash] {
+					continue
 				}
+				seen[src.hash] = true
 			}
-			if err := stats.MarkReportRead(db, fi.Name()); err != nil {
-				return err
+			if len(reports) > 0 {
+				src.firstTime, _ = reports[0].Timestamp()
 			}
-			fmt.Printf("imported in %s\n", time.Since(startedAt))
+			sources = append(sources, src)
+			continue
 		}
+
+		src := &importSource{name: filepath.Base(p), path: p}
+		if skip != nil {
+			var err error
+			if src.hash, err = stats.ReportFileHash(p); err != nil {
+				return nil, fmt.Errorf("reading %s: %w", p, err)
+			}
+			skipped, err := skip(src)
+			if err != nil {
+				return nil, err
+			}
+			// The same contents can be given more than once, such as a file in the directory which is also given with --file.
+			if skipped || seen[src.hash] {
+				continue
+			}
+			seen[src.hash] = true
+		}
+		var err error
+		src.firstTime, err = stats.FirstReportTime(p)
+		if err != nil {
+			return nil, fmt.Errorf("reading %s: %w", p, err)
+		}
+		sources = append(sources, src)
 	}
 
-	fmt.Println(cache.ReportTimes())
-	fmt.Printf("total reports: %d (time to import: %s)\n", totalReports, time.Since(importStart))
+	sort.SliceStable(sources, func(i, j int) bool {
+		return sources[i].firstTime.Before(sources[j].firstTime)
+	})
 
-	return nil
+	return sources, nil
 }
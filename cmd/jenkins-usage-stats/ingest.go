@@ -0,0 +1,143 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	stats "github.com/jenkins-infra/jenkins-usage-stats"
+	"github.com/spf13/cobra"
+)
+
+// IngestServerOptions is the configuration for the ingest-server command
+type IngestServerOptions struct {
+	Database      string
+	Listen        string
+	BatchSize     int
+	FlushInterval time.Duration
+	QueueSize     int
+	MaxBodyBytes  int64
+	ArchiveDir    string
+	MaxSkew       time.Duration
+	Rules         string
+	Weekly        bool
+	History       bool
+}
+
+// NewIngestServerCmd returns the ingest-server command
+func NewIngestServerCmd(ctx context.Context) *cobra.Command {
+	options := &IngestServerOptions{}
+	defaults := stats.DefaultIngestOptions()
+
+	cobraCmd := &cobra.Command{
+		Use:   "ingest-server",
+		Short: "Accept usage reports over HTTP and import them",
+		Long: `Accept usage reports POSTed to /, one JSON object per line, optionally gzip encoded, and import them in batches.
+
+Reports are validated and normalized the same way as by the import command. Requests with reports whose timestamps
+are more than --max-timestamp-skew from the time they're received are rejected. If the queue of reports waiting to be
+written is full, requests are rejected with 503 Service Unavailable.`,
+		Run: func(cmd *cobra.Command, args []string) {
+			if err := options.runIngestServer(ctx); err != nil {
+				fmt.Println(err)
+				os.Exit(1)
+			}
+		},
+		DisableAutoGenTag: true,
+	}
+
+	cobraCmd.Flags().StringVar(&options.Database, "database", "", "Database URL to import to")
+	_ = cobraCmd.MarkFlagRequired("database")
+	cobraCmd.Flags().StringVar(&options.Listen, "listen", ":8081", "Address to listen on")
+	cobraCmd.Flags().IntVar(&options.BatchSize, "batch-size", defaults.BatchSize, "Maximum number of reports to write in one transaction")
+	cobraCmd.Flags().DurationVar(&options.FlushInterval, "flush-interval", defaults.FlushInterval, "Longest time a report waits before being written")
+	cobraCmd.Flags().IntVar(&options.QueueSize, "queue-size", defaults.QueueSize, "Number of reports which can be waiting to be written")
+	cobraCmd.Flags().Int64Var(&options.MaxBodyBytes, "max-body-bytes", defaults.MaxBodyBytes, "Largest request body accepted, after decompression")
+	cobraCmd.Flags().StringVar(&options.ArchiveDir, "archive-dir", "", "Directory to archive raw reports to, in daily gzip files which can be imported later into another database")
+	cobraCmd.Flags().DurationVar(&options.MaxSkew, "max-timestamp-skew", defaults.MaxTimestampSkew, "Furthest a report's timestamp can be from the time it's received, or 0 to accept any timestamp")
+	cobraCmd.Flags().StringVar(&options.Rules, "rules", "", "YAML file of normalization rules. Defaults to the built-in rules.")
+	cobraCmd.Flags().BoolVar(&options.Weekly, "weekly", false, "Also keep the latest report for each instance in each week, for weekly reports")
+	cobraCmd.Flags().BoolVar(&options.History, "history", false, "Also keep the history of each instance's changes")
+
+	return cobraCmd
+}
+
+func (io *IngestServerOptions) runIngestServer(ctx context.Context) error {
+	rules, err := useNormalizationRules(io.Rules)
+	if err != nil {
+		return err
+	}
+
+	db, closeFunc, err := getDatabase(io.Database)
+	if err != nil {
+		return err
+	}
+	defer closeFunc()
+
+	if err := stats.CheckReportingTimezone(db, reportingLocation, true); err != nil {
+		return err
+	}
+	if err := updateSortKeys(db); err != nil {
+		return err
+	}
+	if err := stats.RecordNormalizationRules(db, rules); err != nil {
+		return err
+	}
+
+	ingester := stats.NewIngester(db, stats.IngestOptions{
+		BatchSize:        io.BatchSize,
+		FlushInterval:    io.FlushInterval,
+		QueueSize:        io.QueueSize,
+		MaxBodyBytes:     io.MaxBodyBytes,
+		ArchiveDir:       io.ArchiveDir,
+		MaxTimestampSkew: io.MaxSkew,
+		ImportConfig:     stats.ImportConfig{Location: reportingLocation, Weekly: io.Weekly, History: io.History},
+	})
+
+	ctx, stop := signal.NotifyContext(ctx, os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	ingestCtx, cancelIngest := context.WithCancel(context.Background())
+	ingestDone := make(chan error, 1)
+	go func() {
+		ingestDone <- ingester.Run(ingestCtx)
+	}()
+
+	srv := &http.Server{
+		Addr:              io.Listen,
+		Handler:           ingester.Handler(),
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		_ = srv.Shutdown(shutdownCtx)
+	}()
+
+	fmt.Printf("accepting reports at %s\n", io.Listen)
+	serveErr := srv.ListenAndServe()
+	if errors.Is(serveErr, http.ErrServerClosed) {
+		serveErr = nil
+	}
+
+	// Stop accepting reports before writing out the ones already queued.
+	stop()
+	cancelIngest()
+	ingestErr := <-ingestDone
+
+	counts := ingester.Counts()
+	fmt.Printf("accepted: %d, rejected: %d, written: %d, failed: %d, invalid requests: %d\n",
+		counts.Accepted, counts.Rejected, counts.Written, counts.Failed, counts.InvalidRequests)
+
+	if serveErr != nil {
+		return serveErr
+	}
+	return ingestErr
+}
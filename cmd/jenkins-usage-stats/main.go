@@ -5,12 +5,16 @@ import (
 	"database/sql"
 	"fmt"
 	"os"
+	"time"
 
 	sq "github.com/Masterminds/squirrel"
-
+	stats "github.com/jenkins-infra/jenkins-usage-stats"
 	"github.com/spf13/cobra"
 )
 
+// reportingLocation is the timezone reporting periods start at midnight in, from --timezone
+var reportingLocation *time.Location
+
 func main() {
 	if err := run(context.Background()); err != nil {
 		fmt.Println(err)
@@ -28,20 +32,64 @@ func run(ctx context.Context) error {
 		DisableAutoGenTag: true,
 	}
 
+	var timezone string
+	rootCmd.PersistentFlags().StringVar(&timezone, "timezone", "", "Timezone reporting periods start at midnight in: an IANA name, a UTC offset like -0800, or "+
+		stats.LegacyReportingTimezone+" for the -0800 offset infra-statistics used. It's recorded by the first import, and must be the same for every command using the database. Defaults to UTC.")
+	rootCmd.PersistentPreRunE = func(cmd *cobra.Command, args []string) error {
+		loc, err := stats.ParseReportingTimezone(timezone)
+		if err != nil {
+			return err
+		}
+		reportingLocation = loc
+		return nil
+	}
+
 	rootCmd.AddCommand(NewImportCmd())
 	rootCmd.AddCommand(NewReportCmd())
 	rootCmd.AddCommand(NewFetchCmd(ctx))
+	rootCmd.AddCommand(NewServeCmd(ctx))
+	rootCmd.AddCommand(NewQueryCmd())
+	rootCmd.AddCommand(NewExportCmd())
+	rootCmd.AddCommand(NewIngestServerCmd(ctx))
+	rootCmd.AddCommand(NewValidateCmd())
+	rootCmd.AddCommand(NewFieldsCmd())
+	rootCmd.AddCommand(NewRulesCmd())
+	rootCmd.AddCommand(NewQuarantineCmd())
+	rootCmd.AddCommand(NewHistoryCmd())
+	rootCmd.AddCommand(NewChurnCmd())
+	rootCmd.AddCommand(NewEnrichCmd())
+	rootCmd.AddCommand(NewFreezeCmd())
 
 	return rootCmd.Execute()
 }
 
+// getDatabase opens the database, checking that its reports were added with the same --timezone
 func getDatabase(dbURL string) (sq.DBProxyBeginner, func(), error) {
 	rawDB, err := sql.Open("postgres", dbURL)
 	if err != nil {
 		return nil, nil, err
 	}
 
-	return sq.NewStmtCacheProxy(rawDB), func() {
+	db := sq.NewStmtCacheProxy(rawDB)
+	if err := stats.CheckReportingTimezone(db, reportingLocation, false); err != nil {
+		_ = rawDB.Close()
+		return nil, nil, err
+	}
+
+	return db, func() {
 		_ = rawDB.Close()
 	}, nil
 }
+
+// updateSortKeys sets the sort keys of any Jenkins versions added before they existed, since queries order versions by
+// them. It's run by the commands which add reports, so that commands which only read the database don't write to it.
+func updateSortKeys(db sq.BaseRunner) error {
+	updated, err := stats.UpdateJenkinsVersionSortKeys(db)
+	if err != nil {
+		return err
+	}
+	if updated > 0 {
+		fmt.Printf("set sort keys for %d Jenkins versions\n", updated)
+	}
+	return nil
+}
@@ -0,0 +1,238 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	stats "github.com/jenkins-infra/jenkins-usage-stats"
+	"github.com/spf13/cobra"
+)
+
+// QuarantineDetectOptions is the configuration for the quarantine detect command
+type QuarantineDetectOptions struct {
+	Database   string
+	Directory  string
+	Files      []string
+	DryRun     bool
+	Thresholds stats.QuarantineThresholds
+}
+
+// QuarantineListOptions is the configuration for the quarantine list command
+type QuarantineListOptions struct {
+	Database string
+	Month    string
+	Output   string
+}
+
+// QuarantineReleaseOptions is the configuration for the quarantine release command
+type QuarantineReleaseOptions struct {
+	Database string
+}
+
+// NewQuarantineCmd returns the quarantine command
+func NewQuarantineCmd() *cobra.Command {
+	cobraCmd := &cobra.Command{
+		Use:   "quarantine",
+		Short: "Find and manage instance IDs which look shared by more than one instance",
+		Long: `Find and manage instance IDs which look like they're shared by more than one real instance, such as from a cloned
+JENKINS_HOME or a shared image. Quarantined instances are left out of reports generated with --exclude-quarantined.`,
+		DisableAutoGenTag: true,
+	}
+
+	cobraCmd.AddCommand(NewQuarantineDetectCmd())
+	cobraCmd.AddCommand(NewQuarantineListCmd())
+	cobraCmd.AddCommand(NewQuarantineReleaseCmd())
+
+	return cobraCmd
+}
+
+// NewQuarantineDetectCmd returns the quarantine detect command
+func NewQuarantineDetectCmd() *cobra.Command {
+	options := &QuarantineDetectOptions{Thresholds: stats.DefaultQuarantineThresholds()}
+
+	cobraCmd := &cobra.Command{
+		Use:   "detect",
+		Short: "Quarantine suspicious instance IDs found in report files",
+		Long: `Read every report in the report files, whether or not they've been imported, and quarantine each instance ID which,
+in a month, reports more distinct Jenkins versions or controller configurations than allowed, or whose plugins change
+completely more often than allowed. All the reports for a month need to be read together, since only the latest report
+for each instance is kept when importing.`,
+		Run: func(cmd *cobra.Command, args []string) {
+			if err := options.runQuarantineDetect(); err != nil {
+				fmt.Println(err)
+				os.Exit(1)
+			}
+		},
+		DisableAutoGenTag: true,
+	}
+
+	cobraCmd.Flags().StringVar(&options.Database, "database", "", "Database URL to store quarantined instances in")
+	_ = cobraCmd.MarkFlagRequired("database")
+	cobraCmd.Flags().StringVar(&options.Directory, "directory", "", "Directory to read reports from")
+	cobraCmd.Flags().StringSliceVar(&options.Files, "file", nil, "File to read reports from, or - for stdin. Can be repeated.")
+	cobraCmd.MarkFlagsOneRequired("directory", "file")
+	cobraCmd.Flags().BoolVar(&options.DryRun, "dry-run", false, "Show the suspicious instances without quarantining them")
+	cobraCmd.Flags().IntVar(&options.Thresholds.MaxJenkinsVersions, "max-jenkins-versions", options.Thresholds.MaxJenkinsVersions, "Most distinct Jenkins versions an instance can report in a month")
+	cobraCmd.Flags().IntVar(&options.Thresholds.MaxControllers, "max-controllers", options.Thresholds.MaxControllers, "Most distinct controller OS and Java versions an instance can report in a month")
+	cobraCmd.Flags().IntVar(&options.Thresholds.MaxPluginSetChanges, "max-plugin-set-changes", options.Thresholds.MaxPluginSetChanges, "Most times an instance's plugins can change completely in a month")
+	cobraCmd.Flags().Float64Var(&options.Thresholds.PluginSetSimilarity, "plugin-set-similarity", options.Thresholds.PluginSetSimilarity, "Similarity, from 0 to 1, below which consecutive plugin sets are a complete change")
+
+	return cobraCmd
+}
+
+func (qo *QuarantineDetectOptions) runQuarantineDetect() error {
+	db, closeFunc, err := getDatabase(qo.Database)
+	if err != nil {
+		return err
+	}
+	defer closeFunc()
+
+	sources, err := findSources(qo.Directory, qo.Files, nil)
+	if err != nil {
+		return err
+	}
+
+	activity := stats.NewInstanceActivity(qo.Thresholds, reportingLocation)
+	for _, src := range sources {
+		jsonReports, err := src.load()
+		if err != nil {
+			return err
+		}
+		fmt.Printf("checking %d reports from %s\n", len(jsonReports), src.displayName())
+		for _, jr := range jsonReports {
+			activity.Add(jr)
+		}
+	}
+
+	suspicious := activity.Suspicious()
+	for _, si := range suspicious {
+		fmt.Printf("%s %04d-%02d: %s\n", si.InstanceID, si.Year, si.Month, strings.Join(si.Reasons, ", "))
+	}
+	if qo.DryRun {
+		fmt.Printf("found %d suspicious instances\n", len(suspicious))
+		return nil
+	}
+	quarantined, err := stats.QuarantineInstances(db, suspicious)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("quarantined %d instances, leaving out %d which were released\n", quarantined, len(suspicious)-quarantined)
+	return nil
+}
+
+// NewQuarantineListCmd returns the quarantine list command
+func NewQuarantineListCmd() *cobra.Command {
+	options := &QuarantineListOptions{}
+
+	cobraCmd := &cobra.Command{
+		Use:   "list",
+		Short: "List quarantined instances with the evidence against them",
+		Run: func(cmd *cobra.Command, args []string) {
+			if err := options.runQuarantineList(); err != nil {
+				fmt.Println(err)
+				os.Exit(1)
+			}
+		},
+		DisableAutoGenTag: true,
+	}
+
+	cobraCmd.Flags().StringVar(&options.Database, "database", "", "Database URL to read from")
+	_ = cobraCmd.MarkFlagRequired("database")
+	cobraCmd.Flags().StringVar(&options.Month, "month", "", "Only list instances quarantined for this month, as YYYY-MM. Defaults to every month.")
+	cobraCmd.Flags().StringVar(&options.Output, "output", "table", "Output format: table or json")
+
+	return cobraCmd
+}
+
+func (qo *QuarantineListOptions) runQuarantineList() error {
+	if qo.Output != "table" && qo.Output != "json" {
+		return fmt.Errorf("unknown output format %s, must be table or json", qo.Output)
+	}
+
+	var year, month int
+	if qo.Month != "" {
+		t, err := time.Parse("2006-01", qo.Month)
+		if err != nil {
+			return fmt.Errorf("invalid month %s, must be YYYY-MM", qo.Month)
+		}
+		year, month = t.Year(), int(t.Month())
+	}
+
+	db, closeFunc, err := getDatabase(qo.Database)
+	if err != nil {
+		return err
+	}
+	defer closeFunc()
+
+	instances, err := stats.GetQuarantinedInstances(db, year, month)
+	if err != nil {
+		return err
+	}
+
+	if qo.Output == "json" {
+		asJSON, err := json.MarshalIndent(instances, "", "    ")
+		if err != nil {
+			return err
+		}
+		fmt.Println(string(asJSON))
+		return nil
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	_, _ = fmt.Fprintln(w, "INSTANCE\tMONTH\tREASONS\tREPORTS\tJENKINS VERSIONS\tCONTROLLERS\tPLUGIN SET CHANGES")
+	for _, si := range instances {
+		_, _ = fmt.Fprintf(w, "%s\t%04d-%02d\t%s\t%d\t%d\t%d\t%d\n", si.InstanceID, si.Year, si.Month, strings.Join(si.Reasons, ", "),
+			si.Evidence.Reports, len(si.Evidence.JenkinsVersions), len(si.Evidence.Controllers), si.Evidence.PluginSetChanges)
+	}
+	return w.Flush()
+}
+
+// NewQuarantineReleaseCmd returns the quarantine release command
+func NewQuarantineReleaseCmd() *cobra.Command {
+	options := &QuarantineReleaseOptions{}
+
+	cobraCmd := &cobra.Command{
+		Use:   "release INSTANCE_ID...",
+		Short: "Release instances from quarantine, for every month",
+		Long: `Release instances from quarantine, for every month. Released instances aren't quarantined again by quarantine
+detect, so use this to dismiss false positives.`,
+		Args: cobra.MinimumNArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			if err := options.runQuarantineRelease(args); err != nil {
+				fmt.Println(err)
+				os.Exit(1)
+			}
+		},
+		DisableAutoGenTag: true,
+	}
+
+	cobraCmd.Flags().StringVar(&options.Database, "database", "", "Database URL to release instances in")
+	_ = cobraCmd.MarkFlagRequired("database")
+
+	return cobraCmd
+}
+
+func (qo *QuarantineReleaseOptions) runQuarantineRelease(instanceIDs []string) error {
+	db, closeFunc, err := getDatabase(qo.Database)
+	if err != nil {
+		return err
+	}
+	defer closeFunc()
+
+	for _, id := range instanceIDs {
+		months, err := stats.ReleaseQuarantinedInstance(db, id)
+		if err != nil {
+			return err
+		}
+		if months == 0 {
+			fmt.Printf("%s wasn't quarantined, but won't be quarantined from now on\n", id)
+			continue
+		}
+		fmt.Printf("released %s, quarantined for %d months\n", id, months)
+	}
+	return nil
+}
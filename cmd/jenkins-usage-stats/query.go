@@ -0,0 +1,139 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	stats "github.com/jenkins-infra/jenkins-usage-stats"
+	"github.com/spf13/cobra"
+)
+
+// QueryOptions contains the configuration for an ad-hoc usage query
+type QueryOptions struct {
+	Database      string
+	Start         string
+	End           string
+	Plugin        string
+	PluginVersion string
+	CoreVersion   string
+	JVMVersion    string
+	OS            string
+	GroupBy       string
+	Output        string
+}
+
+// NewQueryCmd returns the query command
+func NewQueryCmd() *cobra.Command {
+	options := &QueryOptions{}
+
+	cobraCmd := &cobra.Command{
+		Use:   "query",
+		Short: "Count instances matching filters, optionally grouped by a dimension",
+		Example: `  # Installs running git plugin 4.0 or later on Java 17, per month
+  jenkins-usage-stats query --database "$DB" --start 2022-01 --end 2022-06 --plugin git --plugin-version ">= 4.0" --jvm 17 --group-by month`,
+		Run: func(_ *cobra.Command, args []string) {
+			if err := options.runQuery(); err != nil {
+				fmt.Println(err)
+				os.Exit(1)
+			}
+		},
+		DisableAutoGenTag: true,
+	}
+
+	cobraCmd.Flags().StringVar(&options.Database, "database", "", "Database URL to query")
+	_ = cobraCmd.MarkFlagRequired("database")
+	cobraCmd.Flags().StringVar(&options.Start, "start", "", "First month to include, as YYYY-MM. Defaults to the previous month.")
+	cobraCmd.Flags().StringVar(&options.End, "end", "", "Last month to include, as YYYY-MM. Defaults to the start month.")
+	cobraCmd.Flags().StringVar(&options.Plugin, "plugin", "", "Only count instances with this plugin installed")
+	cobraCmd.Flags().StringVar(&options.PluginVersion, "plugin-version", "", "Version constraint for --plugin, such as \">= 4.0\"")
+	cobraCmd.Flags().StringVar(&options.CoreVersion, "core-version", "", "Version constraint for the Jenkins version, such as \">= 2.303, < 2.400\"")
+	cobraCmd.Flags().StringVar(&options.JVMVersion, "jvm", "", "Only count instances whose controller runs this Java version, such as 11 or 17")
+	cobraCmd.Flags().StringVar(&options.OS, "os", "", "Only count instances with at least one node on this OS")
+	cobraCmd.Flags().StringVar(&options.GroupBy, "group-by", "", fmt.Sprintf("Dimension to group counts by: %s", strings.Join(stats.GroupByDimensions, ", ")))
+	cobraCmd.Flags().StringVar(&options.Output, "output", "table", "Output format: table, csv or json")
+
+	return cobraCmd
+}
+
+func (qo *QueryOptions) runQuery() error {
+	if qo.Output != "table" && qo.Output != "csv" && qo.Output != "json" {
+		return fmt.Errorf("unknown output format %s, must be table, csv or json", qo.Output)
+	}
+
+	q := stats.UsageQuery{
+		Plugin:        qo.Plugin,
+		PluginVersion: qo.PluginVersion,
+		CoreVersion:   qo.CoreVersion,
+		JVMVersion:    qo.JVMVersion,
+		OS:            qo.OS,
+		GroupBy:       qo.GroupBy,
+		CountOptions:  stats.CountOptions{Location: reportingLocation},
+	}
+
+	var err error
+	if qo.Start == "" {
+		q.StartYear, q.StartMonth = stats.PreviousMonth(time.Now(), reportingLocation)
+	} else if q.StartYear, q.StartMonth, err = parseYearMonth(qo.Start); err != nil {
+		return err
+	}
+	if qo.End == "" {
+		q.EndYear, q.EndMonth = q.StartYear, q.StartMonth
+	} else if q.EndYear, q.EndMonth, err = parseYearMonth(qo.End); err != nil {
+		return err
+	}
+
+	if err := q.Validate(); err != nil {
+		return err
+	}
+
+	db, closeFunc, err := getDatabase(qo.Database)
+	if err != nil {
+		return err
+	}
+	defer closeFunc()
+
+	result, err := stats.RunUsageQuery(db, q)
+	if err != nil {
+		return err
+	}
+
+	switch qo.Output {
+	case "csv":
+		csv, err := result.ToCSV()
+		if err != nil {
+			return err
+		}
+		fmt.Print(csv)
+	case "json":
+		asJSON, err := json.MarshalIndent(result, "", "    ")
+		if err != nil {
+			return err
+		}
+		fmt.Println(string(asJSON))
+	default:
+		header := qo.GroupBy
+		if header == "" {
+			header = "-"
+		}
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		_, _ = fmt.Fprintf(w, "%s\tCOUNT\n", strings.ToUpper(header))
+		for _, r := range result.Rows {
+			_, _ = fmt.Fprintf(w, "%s\t%d\n", r.Key, r.Count)
+		}
+		return w.Flush()
+	}
+
+	return nil
+}
+
+func parseYearMonth(s string) (int, int, error) {
+	t, err := time.Parse("2006-01", s)
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid month %s, must be YYYY-MM", s)
+	}
+	return t.Year(), int(t.Month()), nil
+}
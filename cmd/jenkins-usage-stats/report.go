@@ -3,18 +3,38 @@ package main
 import (
 	"fmt"
 	"os"
+	"text/tabwriter"
 	"time"
 
+	sq "github.com/Masterminds/squirrel"
 	stats "github.com/jenkins-infra/jenkins-usage-stats"
 	"github.com/spf13/cobra"
 )
 
 // ReportOptions contains the configuration for actually outputting reports
 type ReportOptions struct {
-	Directory   string
-	Database    string
-	LatestYear  int
-	LatestMonth int
+	Directory     string
+	Database      string
+	LatestYear    int
+	LatestMonth   int
+	JobCategories string
+	TierReports   bool
+	SizeTiers     string
+
+	ExcludeQuarantined bool
+	Weeks              int
+	PluginChurn        bool
+	PluginMetadata     bool
+	Advisories         string
+	Frozen             bool
+	DiffFrozen         bool
+
+	MetricsFile            string
+	MetricsPluginThreshold uint64
+
+	AnomaliesFile   string
+	FailOnAnomalies bool
+	Anomalies       anomalyFlags
 }
 
 // NewReportCmd returns the report command
@@ -35,24 +55,83 @@ func NewReportCmd() *cobra.Command {
 
 	cobraCmd.Flags().StringVar(&options.Database, "database", "", "Database URL to import to")
 	_ = cobraCmd.MarkFlagRequired("database")
-	cobraCmd.Flags().StringVar(&options.Directory, "directory", "", "Directory to output to")
-	_ = cobraCmd.MarkFlagRequired("directory")
+	cobraCmd.Flags().StringVar(&options.Directory, "directory", "", "Directory to output to. Required unless --diff-frozen is set.")
 	cobraCmd.Flags().IntVar(&options.LatestYear, "latest-year", 0, "Year of latest data to include. Defaults to the year of the previous month of when this is running.")
 	cobraCmd.Flags().IntVar(&options.LatestMonth, "latest-month", 0, "Month of latest data to include. Defaults the previous month of when this is running.")
 	cobraCmd.MarkFlagsRequiredTogether("latest-year", "latest-month")
+	cobraCmd.Flags().BoolVar(&options.TierReports, "tier-reports", false, "Also generate reports for each instance size tier")
+	cobraCmd.Flags().StringVar(&options.SizeTiers, "size-tiers", "", "YAML file defining the instance size tiers. Defaults to the built-in tiers.")
+	cobraCmd.Flags().StringVar(&options.MetricsFile, "metrics-file", "", "Also write the latest month's numbers to this file in the Prometheus text format")
+	cobraCmd.Flags().Uint64Var(&options.MetricsPluginThreshold, "metrics-plugin-threshold", stats.DefaultMetricsPluginThreshold, "Minimum number of installs for a plugin to be included in --metrics-file")
+	cobraCmd.Flags().StringVar(&options.AnomaliesFile, "anomalies-file", "", "Also write anomalies in the latest month, compared to the months before it, to this JSON file")
+	cobraCmd.Flags().BoolVar(&options.FailOnAnomalies, "fail-on-anomalies", false, "Fail without generating reports if there are anomalies in the latest month")
+	options.Anomalies.addFlags(cobraCmd)
+	cobraCmd.Flags().StringVar(&options.JobCategories, "job-categories", "", "YAML file mapping job types to categories. Defaults to the built-in categories.")
+	cobraCmd.Flags().IntVar(&options.Weeks, "weeks", 0, "Also generate weekly Jenkins and plugin version reports for this many weeks up to the end of the latest month, from data imported with --weekly")
+	cobraCmd.Flags().BoolVar(&options.PluginChurn, "plugin-churn", false, "Also report the plugins added and removed by instances in the latest month")
+	cobraCmd.Flags().BoolVar(&options.PluginMetadata, "plugin-metadata", false, "Also report the installs of deprecated, no longer distributed, and over two year old plugin versions in the latest month, from metadata stored by enrich")
+	cobraCmd.Flags().StringVar(&options.Advisories, "advisories", "", "Also report how many instances ran versions affected by each security advisory in this YAML file, in every month since its publication")
+	cobraCmd.Flags().BoolVar(&options.Frozen, "frozen", false, "Generate the reports and charts built from the numbers stored with freeze from each frozen month's latest snapshot")
+	cobraCmd.Flags().BoolVar(&options.DiffFrozen, "diff-frozen", false, "Instead of generating reports, show how the numbers for each month stored with freeze differ from its latest snapshot if recomputed now")
+	cobraCmd.Flags().BoolVar(&options.ExcludeQuarantined, "exclude-quarantined", false, "Leave instances quarantined for a month out of that month's numbers")
 
 	return cobraCmd
 }
 
 func (ro *ReportOptions) runReport() error {
+	if ro.Directory == "" && !ro.DiffFrozen {
+		return fmt.Errorf("--directory is required")
+	}
+
 	db, closeFunc, err := getDatabase(ro.Database)
 	if err != nil {
 		return err
 	}
 	defer closeFunc()
 
+	if err := useStoredNormalizationRules(db); err != nil {
+		return err
+	}
+
+	if ro.DiffFrozen {
+		return ro.runDiffFrozen(db)
+	}
+
+	jobCategories, err := stats.LoadJobCategories(ro.JobCategories)
+	if err != nil {
+		return err
+	}
+
+	config := stats.ReportConfig{
+		CountOptions:           ro.countOptions(),
+		JobCategories:          jobCategories,
+		MetricsFile:            ro.MetricsFile,
+		MetricsPluginThreshold: ro.MetricsPluginThreshold,
+		AnomaliesFile:          ro.AnomaliesFile,
+		FailOnAnomalies:        ro.FailOnAnomalies,
+		AnomalyThresholds:      ro.Anomalies.thresholds(),
+		Weeks:                  ro.Weeks,
+		PluginChurn:            ro.PluginChurn,
+		PluginMetadata:         ro.PluginMetadata,
+		Frozen:                 ro.Frozen,
+	}
+
+	if ro.Advisories != "" {
+		config.SecurityAdvisories, err = stats.LoadSecurityAdvisories(ro.Advisories)
+		if err != nil {
+			return err
+		}
+	}
+
+	if ro.TierReports {
+		config.SizeTiers, err = stats.LoadSizeTiers(ro.SizeTiers)
+		if err != nil {
+			return err
+		}
+	}
+
 	startTime := time.Now()
-	err = stats.GenerateReport(db, ro.LatestYear, ro.LatestMonth, ro.Directory)
+	err = stats.GenerateReport(db, ro.LatestYear, ro.LatestMonth, ro.Directory, config)
 	if err != nil {
 		return err
 	}
@@ -60,3 +139,51 @@ func (ro *ReportOptions) runReport() error {
 	fmt.Printf("Reports generated to %s, in %s\n", ro.Directory, time.Since(startTime))
 	return nil
 }
+
+func (ro *ReportOptions) countOptions() stats.CountOptions {
+	return stats.CountOptions{ExcludeQuarantined: ro.ExcludeQuarantined, Location: reportingLocation}
+}
+
+func (ro *ReportOptions) runDiffFrozen(db sq.BaseRunner) error {
+	co := ro.countOptions()
+	snapshots, err := stats.ReportSnapshots(db)
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	_, _ = fmt.Fprintln(w, "MONTH\tAGGREGATE\tKEY\tFROZEN\tRECOMPUTED")
+	months, differing := 0, 0
+	for i, s := range snapshots {
+		// Only the latest version of each month is compared.
+		if i+1 < len(snapshots) && snapshots[i+1].Year == s.Year && snapshots[i+1].Month == s.Month {
+			continue
+		}
+		if ro.LatestYear > 0 && s.Year*12+s.Month > ro.LatestYear*12+ro.LatestMonth {
+			continue
+		}
+
+		frozen, err := stats.GetFrozenMonth(db, co, s.Year, s.Month, s.Version)
+		if err != nil {
+			return err
+		}
+		recomputed, err := stats.ComputeMonthlyAggregates(db, co, s.Year, s.Month)
+		if err != nil {
+			return err
+		}
+		months++
+		diffs := stats.DiffMonthlyAggregates(frozen, recomputed)
+		if len(diffs) > 0 {
+			differing++
+		}
+		for _, d := range diffs {
+			_, _ = fmt.Fprintf(w, "%04d-%02d\t%s\t%s\t%d\t%d\n", s.Year, s.Month, d.Aggregate, d.Key, d.Frozen, d.Recomputed)
+		}
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+
+	fmt.Printf("%d of %d frozen months differ when recomputed\n", differing, months)
+	return nil
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	sq "github.com/Masterminds/squirrel"
+	stats "github.com/jenkins-infra/jenkins-usage-stats"
+	"github.com/spf13/cobra"
+)
+
+// RulesTestOptions is the configuration for the rules test command
+type RulesTestOptions struct {
+	Rules string
+	Field string
+}
+
+// NewRulesCmd returns the rules command
+func NewRulesCmd() *cobra.Command {
+	cobraCmd := &cobra.Command{
+		Use:               "rules",
+		Short:             "Work with the normalization rules used when importing reports",
+		DisableAutoGenTag: true,
+	}
+
+	cobraCmd.AddCommand(NewRulesTestCmd())
+
+	return cobraCmd
+}
+
+// NewRulesTestCmd returns the rules test command
+func NewRulesTestCmd() *cobra.Command {
+	options := &RulesTestOptions{}
+
+	cobraCmd := &cobra.Command{
+		Use:   "test VALUE...",
+		Short: "Show how values would be normalized",
+		Example: `  # Which Java version is reported for a node with this JVM version
+  jenkins-usage-stats rules test --field jvmVersion 1.8.0_292 11.0.13`,
+		Args: cobra.MinimumNArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			if err := options.runRulesTest(args); err != nil {
+				fmt.Println(err)
+				os.Exit(1)
+			}
+		},
+		DisableAutoGenTag: true,
+	}
+
+	cobraCmd.Flags().StringVar(&options.Rules, "rules", "", "YAML file of normalization rules. Defaults to the built-in rules.")
+	cobraCmd.Flags().StringVar(&options.Field, "field", "", fmt.Sprintf("Field the values are for: %s", strings.Join(stats.RuleFields, ", ")))
+	_ = cobraCmd.MarkFlagRequired("field")
+
+	return cobraCmd
+}
+
+func (ro *RulesTestOptions) runRulesTest(values []string) error {
+	rules, err := stats.LoadNormalizationRules(ro.Rules)
+	if err != nil {
+		return err
+	}
+	if !isRuleField(ro.Field) {
+		return fmt.Errorf("unknown field %s, must be one of %s", ro.Field, strings.Join(stats.RuleFields, ", "))
+	}
+
+	fieldRules := rules.Rules(ro.Field)
+	for _, v := range values {
+		result := rules.Normalize(ro.Field, v)
+		switch {
+		case result.Rule < 0:
+			fmt.Printf("%q: unchanged, no rule matched\n", v)
+		case result.Dropped:
+			fmt.Printf("%q: dropped by rule %d (%s)\n", v, result.Rule, fieldRules[result.Rule].Match)
+		default:
+			fmt.Printf("%q -> %q by rule %d (%s)\n", v, result.Value, result.Rule, fieldRules[result.Rule].Match)
+		}
+	}
+
+	return nil
+}
+
+func isRuleField(field string) bool {
+	for _, f := range stats.RuleFields {
+		if f == field {
+			return true
+		}
+	}
+	return false
+}
+
+// useNormalizationRules loads the rules from a file, or the default rules if none is given, and uses them for parsing
+// and adding reports
+func useNormalizationRules(filename string) (*stats.NormalizationRules, error) {
+	rules, err := stats.LoadNormalizationRules(filename)
+	if err != nil {
+		return nil, err
+	}
+	stats.UseNormalizationRules(rules)
+	return rules, nil
+}
+
+// useStoredNormalizationRules uses the rules reports were last added to the database with, so that reports leave out
+// the same versions as the import did
+func useStoredNormalizationRules(db sq.BaseRunner) error {
+	rules, err := stats.StoredNormalizationRules(db)
+	if err != nil {
+		return err
+	}
+	stats.UseNormalizationRules(rules)
+	return nil
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	stats "github.com/jenkins-infra/jenkins-usage-stats"
+	"github.com/spf13/cobra"
+)
+
+// ServeOptions is the configuration for the serve command
+type ServeOptions struct {
+	Database      string
+	Listen        string
+	CacheTTL      time.Duration
+	JobCategories string
+
+	ExcludeQuarantined bool
+
+	MetricsPluginThreshold uint64
+}
+
+// NewServeCmd returns the serve command
+func NewServeCmd(ctx context.Context) *cobra.Command {
+	options := &ServeOptions{}
+
+	cobraCmd := &cobra.Command{
+		Use:   "serve",
+		Short: "Serve report data over a read-only HTTP JSON API",
+		Run: func(cmd *cobra.Command, args []string) {
+			if err := options.runServe(ctx); err != nil {
+				fmt.Println(err)
+				os.Exit(1)
+			}
+		},
+		DisableAutoGenTag: true,
+	}
+
+	cobraCmd.Flags().StringVar(&options.Database, "database", "", "Database URL to read from")
+	_ = cobraCmd.MarkFlagRequired("database")
+	cobraCmd.Flags().StringVar(&options.Listen, "listen", ":8080", "Address to listen on")
+	cobraCmd.Flags().DurationVar(&options.CacheTTL, "cache-ttl", time.Hour, "How long to cache responses in memory")
+	cobraCmd.Flags().Uint64Var(&options.MetricsPluginThreshold, "metrics-plugin-threshold", stats.DefaultMetricsPluginThreshold, "Minimum number of installs for a plugin to be included in /metrics")
+	cobraCmd.Flags().StringVar(&options.JobCategories, "job-categories", "", "YAML file mapping job types to categories. Defaults to the built-in categories.")
+	cobraCmd.Flags().BoolVar(&options.ExcludeQuarantined, "exclude-quarantined", false, "Leave instances quarantined for a month out of that month's numbers")
+
+	return cobraCmd
+}
+
+func (so *ServeOptions) runServe(ctx context.Context) error {
+	db, closeFunc, err := getDatabase(so.Database)
+	if err != nil {
+		return err
+	}
+	defer closeFunc()
+
+	if err := useStoredNormalizationRules(db); err != nil {
+		return err
+	}
+
+	jobCategories, err := stats.LoadJobCategories(so.JobCategories)
+	if err != nil {
+		return err
+	}
+
+	ctx, stop := signal.NotifyContext(ctx, os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	apiServer := stats.NewAPIServer(db, stats.CountOptions{ExcludeQuarantined: so.ExcludeQuarantined, Location: reportingLocation}, so.CacheTTL, jobCategories)
+	mux := http.NewServeMux()
+	mux.Handle(stats.APIPrefix+"/", apiServer.Handler())
+	mux.Handle("GET /metrics", apiServer.MetricsHandler(so.MetricsPluginThreshold))
+
+	srv := &http.Server{
+		Addr:              so.Listen,
+		Handler:           mux,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		_ = srv.Shutdown(shutdownCtx)
+	}()
+
+	fmt.Printf("serving API at %s%s\n", so.Listen, stats.APIPrefix)
+	if err := srv.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sort"
+
+	stats "github.com/jenkins-infra/jenkins-usage-stats"
+	"github.com/spf13/cobra"
+)
+
+// ValidateOptions is the configuration for the validate command
+type ValidateOptions struct {
+	Files []string
+}
+
+// NewValidateCmd returns the validate command
+func NewValidateCmd() *cobra.Command {
+	options := &ValidateOptions{}
+
+	cobraCmd := &cobra.Command{
+		Use:   "validate",
+		Short: "Check report files against the known report formats",
+		Long: `Check every report in the given files against the JSON schemas of the known report formats, in etc/schemas.
+
+For each file, the number of reports matching each format version is printed, along with the line number and field
+paths of the problems with any reports which don't match any format.`,
+		Run: func(cmd *cobra.Command, args []string) {
+			if err := options.runValidate(); err != nil {
+				fmt.Println(err)
+				os.Exit(1)
+			}
+		},
+		DisableAutoGenTag: true,
+	}
+
+	cobraCmd.Flags().StringSliceVar(&options.Files, "file", nil, "File to validate, or - for stdin. Can be repeated.")
+	_ = cobraCmd.MarkFlagRequired("file")
+
+	return cobraCmd
+}
+
+func (vo *ValidateOptions) runValidate() error {
+	formats, err := stats.DefaultReportFormats()
+	if err != nil {
+		return err
+	}
+
+	totalInvalid := 0
+	for _, fn := range vo.Files {
+		result, err := validateFile(formats, fn)
+		if err != nil {
+			return fmt.Errorf("reading %s: %w", fn, err)
+		}
+
+		for _, le := range result.Invalid {
+			fmt.Printf("%s:%d: %s\n", fn, le.Line, le.Err)
+		}
+		var versions []string
+		for v := range result.Versions {
+			versions = append(versions, v)
+		}
+		sort.Strings(versions)
+		for _, v := range versions {
+			fmt.Printf("%s: %d reports in format %s\n", fn, result.Versions[v], v)
+		}
+		fmt.Printf("%s: %d invalid reports\n", fn, len(result.Invalid))
+		totalInvalid += len(result.Invalid)
+	}
+
+	if totalInvalid > 0 {
+		return fmt.Errorf("%d invalid reports", totalInvalid)
+	}
+	return nil
+}
+
+func validateFile(formats *stats.ReportFormats, fn string) (*stats.ReportsValidation, error) {
+	if fn == "-" {
+		return formats.ValidateReports(os.Stdin)
+	}
+	f, err := os.Open(fn) // #nosec
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = f.Close()
+	}()
+	return formats.ValidateReports(f)
+}
@@ -16,6 +16,8 @@ import (
 const (
 	// JVMVersionsTable is the jvm_versions table name
 	JVMVersionsTable = "jvm_versions"
+	// JVMVendorsTable is the jvm_vendors table name
+	JVMVendorsTable = "jvm_vendors"
 	// OSTypesTable is the os_types table name
 	OSTypesTable = "os_types"
 	// JobTypesTable is the job_types table name
@@ -24,10 +26,18 @@ const (
 	PluginsTable = "plugins"
 	// JenkinsVersionsTable is the jenkins_versions table name
 	JenkinsVersionsTable = "jenkins_versions"
+	// ServletContainersTable is the servlet_containers table name
+	ServletContainersTable = "servlet_containers"
 	// InstanceReportsTable is the instance_reports table name
 	InstanceReportsTable = "instance_reports"
-
-	questionVersion = "???"
+	// SettingsTable is the settings table name
+	SettingsTable = "settings"
+
+	skipReasonInstallTooLong = "instance ID is longer than 64 characters"
+	skipReasonVersionTooLong = "Jenkins version is longer than 32 characters"
+	skipReasonVersionDropped = "Jenkins version is dropped by the normalization rules"
+	skipReasonNotNewer       = "not newer than the existing report for the month"
+	skipReasonNoJobs         = "no jobs"
 )
 
 // ReportFile records a daily report file which has been imported.
@@ -41,6 +51,13 @@ type JVMVersion struct {
 	Name string `db:"name"`
 }
 
+// JVMVendor represents a row in the jvm_vendors table
+type JVMVendor struct {
+	ID     uint64 `db:"id"`
+	Vendor string `db:"vendor"`
+	Name   string `db:"name"`
+}
+
 // OSType represents a row in the os_types table
 type OSType struct {
 	ID   uint64 `db:"id"`
@@ -66,20 +83,29 @@ type JenkinsVersion struct {
 	Version string `db:"version"`
 }
 
+// ServletContainer represents a row in the servlet_containers table
+type ServletContainer struct {
+	ID   uint64 `db:"id"`
+	Name string `db:"name"`
+}
+
 // InstanceReport is a record of an individual instance's most recent report in a given month
 type InstanceReport struct {
-	ID            uint64          `db:"id"`
-	InstanceID    string          `db:"instance_id"`
-	ReportTime    time.Time       `db:"report_time"`
-	Year          int             `db:"year"`
-	Month         int             `db:"month"`
-	Version       uint64          `db:"version"`
-	JVMVersionID  uint64          `db:"jvm_version_id"`
-	Executors     uint64          `db:"executors"`
-	CountForMonth uint64          `db:"count_for_month"`
-	Plugins       pq.Int64Array   `db:"plugins"`
-	Jobs          *JobsForReport  `db:"jobs"`
-	Nodes         *NodesForReport `db:"nodes"`
+	ID                 uint64              `db:"id"`
+	InstanceID         string              `db:"instance_id"`
+	ReportTime         time.Time           `db:"report_time"`
+	Year               int                 `db:"year"`
+	Month              int                 `db:"month"`
+	Version            uint64              `db:"version"`
+	JVMVersionID       uint64              `db:"jvm_version_id"`
+	JVMVendorID        uint64              `db:"jvm_vendor_id"`
+	ServletContainerID uint64              `db:"servlet_container_id"`
+	Executors          uint64              `db:"executors"`
+	CountForMonth      uint64              `db:"count_for_month"`
+	Plugins            pq.Int64Array       `db:"plugins"`
+	Jobs               *JobsForReport      `db:"jobs"`
+	Nodes              *NodesForReport     `db:"nodes"`
+	AgentJVMs          *AgentJVMsForReport `db:"agent_jvms"`
 }
 
 // PluginsForReport is a map of IDs from the "plugins" table seen on an instance report
@@ -118,6 +144,25 @@ func (n *NodesForReport) Scan(value interface{}) error {
 	return json.Unmarshal(b, &n)
 }
 
+// AgentJVMsForReport is a map of IDs from the "jvm_versions" table to counts of agents (i.e., non-controller nodes)
+// using that JVM version seen on an instance report
+type AgentJVMsForReport map[uint64]uint64
+
+// Value is used for marshalling to JSON
+func (a *AgentJVMsForReport) Value() (driver.Value, error) {
+	return json.Marshal(a)
+}
+
+// Scan is used for unmarshalling from JSON
+func (a *AgentJVMsForReport) Scan(value interface{}) error {
+	b, ok := value.([]byte)
+	if !ok {
+		return errors.New("type assertion to []byte failed")
+	}
+
+	return json.Unmarshal(b, &a)
+}
+
 // JobsForReport is a map of IDs from the "job_types" table to counts seen on an instance report
 type JobsForReport map[uint64]uint64
 
@@ -136,19 +181,42 @@ func (j *JobsForReport) Scan(value interface{}) error {
 	return json.Unmarshal(b, &j)
 }
 
-// DBCache contains caching for the stats db
+// ImportConfig contains optional configuration for how AddIndividualReport adds reports. Anything left unset uses the
+// defaults.
+type ImportConfig struct {
+	// Location is the timezone reporting periods start at midnight in, which decides the month a report is added to.
+	// It's UTC if nil.
+	Location *time.Location
+	// Weekly is whether to also keep the latest report for each instance in each ISO week, in the
+	// weekly_instance_reports table. A report is added to its week even if the instance already has a newer report for
+	// its month, so reports from earlier weeks don't need to be added first.
+	Weekly bool
+	// History is whether to also append each report which changes an instance's Jenkins version, JVM version,
+	// executors, plugins or nodes to the instance_report_history table. Reports which don't change anything extend the
+	// instance's latest history entry instead. A report is compared with the instance's latest history entry rather than
+	// its report for the month, so history is kept even when the monthly report isn't replaced.
+	History bool
+}
+
+// DBCache contains caching for the stats db, and the configuration reports are added with
 type DBCache struct {
-	jvmVersions     map[string]uint64
-	osTypes         map[string]uint64
-	jobTypes        map[string]uint64
-	jenkinsVersions map[string]uint64
-	plugins         map[string]map[string]uint64
-
-	getJVMVersionTime     time.Duration
-	getOSTypeTime         time.Duration
-	getJobTypeTime        time.Duration
-	getJenkinsVersionTime time.Duration
-	getPluginTime         time.Duration
+	config ImportConfig
+
+	jvmVersions       map[string]uint64
+	jvmVendors        map[string]map[string]uint64
+	osTypes           map[string]uint64
+	jobTypes          map[string]uint64
+	jenkinsVersions   map[string]uint64
+	plugins           map[string]map[string]uint64
+	servletContainers map[string]uint64
+
+	getJVMVersionTime       time.Duration
+	getJVMVendorTime        time.Duration
+	getOSTypeTime           time.Duration
+	getJobTypeTime          time.Duration
+	getJenkinsVersionTime   time.Duration
+	getPluginTime           time.Duration
+	getServletContainerTime time.Duration
 
 	getInstanceReportTime    time.Duration
 	insertInstanceReportTime time.Duration
@@ -164,10 +232,12 @@ type DBCache struct {
 // ReportTimes returns a string with function times
 func (sc *DBCache) ReportTimes() string {
 	return fmt.Sprintf(`GetJVMVersion: %s
+GetJVMVendor: %s
 GetOSType: %s
 GetJobType: %s
 GetJenkinsVersion: %s
 GetPlugin: %s
+GetServletContainer: %s
 GetInstanceReport: %s
 InsertInstanceReport: %s
 UpdateInstanceReport: %s
@@ -176,24 +246,34 @@ SkippedForInstall: %d
 SkippedForVersion: %d
 SkippedForTime: %d
 SkippedForJobs: %d
-`, sc.getJVMVersionTime.String(), sc.getOSTypeTime.String(), sc.getJobTypeTime.String(), sc.getJenkinsVersionTime.String(),
-		sc.getPluginTime.String(), sc.getInstanceReportTime.String(), sc.insertInstanceReportTime.String(), sc.updateInstanceReportTime.String(), sc.insertNewReportsTime.String(),
+`, sc.getJVMVersionTime.String(), sc.getJVMVendorTime.String(), sc.getOSTypeTime.String(), sc.getJobTypeTime.String(), sc.getJenkinsVersionTime.String(),
+		sc.getPluginTime.String(), sc.getServletContainerTime.String(), sc.getInstanceReportTime.String(), sc.insertInstanceReportTime.String(), sc.updateInstanceReportTime.String(), sc.insertNewReportsTime.String(),
 		sc.skippedForInstall, sc.skippedForVersion, sc.skippedForTime, sc.skippedForJobs)
 }
 
-// NewStatsCache initializes a cache
+// NewStatsCache initializes a cache, for adding reports with the default configuration
 func NewStatsCache() *DBCache {
+	return NewStatsCacheWithConfig(ImportConfig{})
+}
+
+// NewStatsCacheWithConfig initializes a cache, for adding reports with the given configuration
+func NewStatsCacheWithConfig(config ImportConfig) *DBCache {
 	return &DBCache{
+		config:                   config,
 		jvmVersions:              map[string]uint64{},
+		jvmVendors:               map[string]map[string]uint64{},
 		osTypes:                  map[string]uint64{},
 		jobTypes:                 map[string]uint64{},
 		jenkinsVersions:          map[string]uint64{},
 		plugins:                  map[string]map[string]uint64{},
+		servletContainers:        map[string]uint64{},
 		getJVMVersionTime:        0,
+		getJVMVendorTime:         0,
 		getOSTypeTime:            0,
 		getJobTypeTime:           0,
 		getJenkinsVersionTime:    0,
 		getPluginTime:            0,
+		getServletContainerTime:  0,
 		getInstanceReportTime:    0,
 		insertInstanceReportTime: 0,
 		updateInstanceReportTime: 0,
@@ -232,6 +312,42 @@ func GetJVMVersionID(db sq.BaseRunner, cache *DBCache, name string) (uint64, err
 	return 0, err
 }
 
+// GetJVMVendorID gets the ID for the row of this JVM vendor/name if it exists, and creates it and returns the ID if not
+func GetJVMVendorID(db sq.BaseRunner, cache *DBCache, vendor, name string) (uint64, error) {
+	start := time.Now()
+	defer func() {
+		cache.getJVMVendorTime += time.Since(start)
+	}()
+	if cachedVendor, ok := cache.jvmVendors[vendor]; ok {
+		if cachedName, ok := cachedVendor[name]; ok {
+			return cachedName, nil
+		}
+	} else {
+		cache.jvmVendors[vendor] = make(map[string]uint64)
+	}
+	var row JVMVendor
+	err := PSQL(db).Select("id").From(JVMVendorsTable).
+		Where(sq.Eq{"vendor": vendor}).
+		Where(sq.Eq{"name": name}).
+		QueryRow().
+		Scan(&row.ID)
+	if errors.Is(err, sql.ErrNoRows) {
+		var id uint64
+		q := PSQL(db).Insert(JVMVendorsTable).Columns("vendor", "name").Values(vendor, name).Suffix(`RETURNING "id"`)
+		err = q.QueryRow().Scan(&id)
+		if err != nil {
+			return 0, err
+		}
+		cache.jvmVendors[vendor][name] = id
+		return id, nil
+	}
+	if err == nil {
+		cache.jvmVendors[vendor][name] = row.ID
+		return row.ID, nil
+	}
+	return 0, err
+}
+
 // GetOSTypeID gets the ID for the row of this OS if it exists, and creates it and returns the ID if not
 func GetOSTypeID(db sq.BaseRunner, cache *DBCache, name string) (uint64, error) {
 	start := time.Now()
@@ -313,7 +429,7 @@ func GetJenkinsVersionID(db sq.BaseRunner, cache *DBCache, version string) (uint
 		Scan(&row.ID)
 	if errors.Is(err, sql.ErrNoRows) {
 		var id uint64
-		q := PSQL(db).Insert(JenkinsVersionsTable).Columns("version").Values(version).Suffix(`RETURNING "id"`)
+		q := PSQL(db).Insert(JenkinsVersionsTable).Columns("version", "sort_key").Values(version, JenkinsVersionSortKey(version)).Suffix(`RETURNING "id"`)
 		err = q.QueryRow().Scan(&id)
 		if err != nil {
 			return 0, err
@@ -364,19 +480,48 @@ func GetPluginID(db sq.BaseRunner, cache *DBCache, name, version string) (uint64
 	return 0, err
 }
 
+// GetServletContainerID gets the ID for the row of this servlet container if it exists, and creates it and returns the ID if not
+func GetServletContainerID(db sq.BaseRunner, cache *DBCache, name string) (uint64, error) {
+	start := time.Now()
+	defer func() {
+		cache.getServletContainerTime += time.Since(start)
+	}()
+	if name == "" {
+		name = "N/A"
+	}
+	if cached, ok := cache.servletContainers[name]; ok {
+		return cached, nil
+	}
+	var row ServletContainer
+	err := PSQL(db).Select("id").From(ServletContainersTable).
+		Where(sq.Eq{"name": name}).
+		QueryRow().
+		Scan(&row.ID)
+	if errors.Is(err, sql.ErrNoRows) {
+		var id uint64
+		q := PSQL(db).Insert(ServletContainersTable).Columns("name").Values(name).Suffix(`RETURNING "id"`)
+		err = q.QueryRow().Scan(&id)
+		if err != nil {
+			return 0, err
+		}
+		cache.servletContainers[name] = id
+		return id, nil
+	}
+	if err == nil {
+		cache.servletContainers[name] = row.ID
+		return row.ID, nil
+	}
+	return 0, err
+}
+
 // AddIndividualReport adds/updates the JSON report to the database, along with all related tables.
 func AddIndividualReport(db sq.BaseRunner, cache *DBCache, jsonReport *JSONReport) error {
-	// Short-circuit for a few weird cases where the instance ID is >64 characters or the Jenkins version is >32 characters
-	if len(jsonReport.Install) > 64 {
+	jenkinsVersion, reason := checkReport(jsonReport)
+	if reason == skipReasonInstallTooLong {
 		cache.skippedForInstall++
 		return nil
 	}
-	if len(jsonReport.Version) > 32 {
-		cache.skippedForVersion++
-		return nil
-	}
-	// Skip SNAPSHOT and weird ***/? Jenkins versions
-	if strings.Contains(jsonReport.Version, "SNAPSHOT") || strings.Contains(jsonReport.Version, "***") || strings.Contains(jsonReport.Version, "?") {
+	if reason != "" {
 		cache.skippedForVersion++
 		return nil
 	}
@@ -385,6 +530,7 @@ func AddIndividualReport(db sq.BaseRunner, cache *DBCache, jsonReport *JSONRepor
 	if err != nil {
 		return err
 	}
+	periodTime := ts.In(reportingLocation(cache.config.Location))
 
 	insertRow := false
 
@@ -397,8 +543,8 @@ func AddIndividualReport(db sq.BaseRunner, cache *DBCache, jsonReport *JSONRepor
 		Select("id", "count_for_month, report_time").
 		From(InstanceReportsTable).
 		Where(sq.Eq{"instance_id": jsonReport.Install}).
-		Where(sq.Eq{"year": ts.Year()}).
-		Where(sq.Eq{"month": ts.Month()}).
+		Where(sq.Eq{"year": periodTime.Year()}).
+		Where(sq.Eq{"month": periodTime.Month()}).
 		Query()
 	defer func() {
 		_ = rows.Close()
@@ -423,30 +569,20 @@ func AddIndividualReport(db sq.BaseRunner, cache *DBCache, jsonReport *JSONRepor
 
 	report.CountForMonth = prevReport.CountForMonth + 1
 	report.InstanceID = jsonReport.Install
-	report.Year = ts.Year()
-	report.Month = int(ts.Month())
-
-	// If we already have a report for this install at this time, skip it.
-	if prevReport.ReportTime == ts || ts.Before(prevReport.ReportTime) {
-		cache.skippedForTime++
-
-		if prevReport.CountForMonth == 1 {
-			q := PSQL(db).Update(InstanceReportsTable).
-				Where(sq.Eq{"id": prevReport.ID}).
-				Set("count_for_month", report.CountForMonth)
-
-			_, err = q.Exec()
-			if err != nil {
-				return err
-			}
+	report.Year = periodTime.Year()
+	report.Month = int(periodTime.Month())
 
-		}
-		return nil
+	// If we already have a report for this install at this time, skip it, unless it's still needed for its week or the
+	// history.
+	olderThanMonth := prevReport.ReportTime == ts || ts.Before(prevReport.ReportTime)
+	if olderThanMonth && !cache.config.Weekly && !cache.config.History {
+		return skipOlderReport(db, cache, &prevReport, report.CountForMonth)
 	}
 
 	newReportsStart := time.Now()
 
 	nodes := NodesForReport{}
+	agentJVMs := AgentJVMsForReport{}
 	for _, jsonNode := range jsonReport.Nodes {
 		if jsonNode.IsController {
 			jvmVersionID, err := GetJVMVersionID(db, cache, jsonNode.JVMVersion)
@@ -454,6 +590,18 @@ func AddIndividualReport(db sq.BaseRunner, cache *DBCache, jsonReport *JSONRepor
 				return err
 			}
 			report.JVMVersionID = jvmVersionID
+
+			jvmVendorID, err := GetJVMVendorID(db, cache, jsonNode.JVMVendor, jsonNode.JVMName)
+			if err != nil {
+				return err
+			}
+			report.JVMVendorID = jvmVendorID
+		} else {
+			agentJVMVersionID, err := GetJVMVersionID(db, cache, jsonNode.JVMVersion)
+			if err != nil {
+				return err
+			}
+			agentJVMs[agentJVMVersionID]++
 		}
 		// At least one report somehow screwed up and claims to have 32-bit max executors, so ignore that.
 		if jsonNode.Executors != 2147483647 {
@@ -470,6 +618,7 @@ func AddIndividualReport(db sq.BaseRunner, cache *DBCache, jsonReport *JSONRepor
 		nodes[osTypeID]++
 	}
 	report.Nodes = &nodes
+	report.AgentJVMs = &agentJVMs
 
 	if report.JVMVersionID == 0 {
 		jvmVersionID, err := GetJVMVersionID(db, cache, "N/A")
@@ -479,32 +628,36 @@ func AddIndividualReport(db sq.BaseRunner, cache *DBCache, jsonReport *JSONRepor
 		report.JVMVersionID = jvmVersionID
 	}
 
+	if report.JVMVendorID == 0 {
+		jvmVendorID, err := GetJVMVendorID(db, cache, "N/A", "N/A")
+		if err != nil {
+			return err
+		}
+		report.JVMVendorID = jvmVendorID
+	}
+
 	var pluginIDs pq.Int64Array
-	for _, jsonPlugin := range jsonReport.Plugins {
-		// Exclude weird cases where there's no real version for the plugin
-		if jsonPlugin.Version != questionVersion {
-			pluginID, err := GetPluginID(db, cache, jsonPlugin.Name, jsonPlugin.Version)
-			if err != nil {
-				return err
-			}
-			pluginIDs = append(pluginIDs, int64(pluginID))
+	for _, jsonPlugin := range countablePlugins(jsonReport) {
+		pluginID, err := GetPluginID(db, cache, jsonPlugin.Name, jsonPlugin.Version)
+		if err != nil {
+			return err
 		}
+		pluginIDs = append(pluginIDs, int64(pluginID))
 	}
 	report.Plugins = pluginIDs
 
 	jobs := JobsForReport{}
-	jobCount := uint64(0)
-	for jobType, count := range jsonReport.Jobs {
-		if count != 0 && !strings.HasPrefix(jobType, "private") {
-			jobTypeID, err := GetJobTypeID(db, cache, jobType)
-			if err != nil {
-				return err
-			}
-			jobs[jobTypeID] = count
-			jobCount += count
+	for jobType, count := range countableJobs(jsonReport) {
+		jobTypeID, err := GetJobTypeID(db, cache, jobType)
+		if err != nil {
+			return err
 		}
+		jobs[jobTypeID] = count
 	}
-	if jobCount == 0 {
+	if len(jobs) == 0 {
+		if olderThanMonth {
+			return skipOlderReport(db, cache, &prevReport, report.CountForMonth)
+		}
 		cache.skippedForJobs++
 		return nil
 	}
@@ -513,28 +666,52 @@ func AddIndividualReport(db sq.BaseRunner, cache *DBCache, jsonReport *JSONRepor
 
 	report.ReportTime = ts
 
-	jvID, err := GetJenkinsVersionID(db, cache, jsonReport.Version)
+	jvID, err := GetJenkinsVersionID(db, cache, jenkinsVersion)
 	if err != nil {
 		return err
 	}
 	report.Version = jvID
 
+	scID, err := GetServletContainerID(db, cache, jsonReport.ServletContainer)
+	if err != nil {
+		return err
+	}
+	report.ServletContainerID = scID
+
+	// The week's own latest report decides whether this replaces it, since the month's latest may be in a later week.
+	if cache.config.Weekly {
+		if err := addWeeklyReport(db, &report, cache.config.Location); err != nil {
+			return err
+		}
+	}
+	if cache.config.History {
+		if err := addHistoryReport(db, &report); err != nil {
+			return err
+		}
+	}
+	if olderThanMonth {
+		return skipOlderReport(db, cache, &prevReport, report.CountForMonth)
+	}
+
 	if insertRow {
 		insertStart := time.Now()
 		_, err = PSQL(db).Insert(InstanceReportsTable).
-			Columns("instance_id", "report_time", "year", "month", "version", "jvm_version_id",
-				"executors", "count_for_month", "plugins", "jobs", "nodes").
+			Columns("instance_id", "report_time", "year", "month", "version", "jvm_version_id", "jvm_vendor_id",
+				"servlet_container_id", "executors", "count_for_month", "plugins", "jobs", "nodes", "agent_jvms").
 			Values(report.InstanceID,
 				report.ReportTime,
 				report.Year,
 				report.Month,
 				report.Version,
 				report.JVMVersionID,
+				report.JVMVendorID,
+				report.ServletContainerID,
 				report.Executors,
 				report.CountForMonth,
 				report.Plugins,
 				report.Jobs,
-				report.Nodes).
+				report.Nodes,
+				report.AgentJVMs).
 			Exec()
 		if err != nil {
 			return err
@@ -548,10 +725,13 @@ func AddIndividualReport(db sq.BaseRunner, cache *DBCache, jsonReport *JSONRepor
 			Set("report_time", report.ReportTime).
 			Set("version", report.Version).
 			Set("jvm_version_id", report.JVMVersionID).
+			Set("jvm_vendor_id", report.JVMVendorID).
+			Set("servlet_container_id", report.ServletContainerID).
 			Set("executors", report.Executors).
 			Set("plugins", report.Plugins).
 			Set("jobs", report.Jobs).
-			Set("nodes", report.Nodes)
+			Set("nodes", report.Nodes).
+			Set("agent_jvms", report.AgentJVMs)
 
 		_, err = q.Exec()
 		cache.updateInstanceReportTime += time.Since(updateStart)
@@ -563,6 +743,69 @@ func AddIndividualReport(db sq.BaseRunner, cache *DBCache, jsonReport *JSONRepor
 	return nil
 }
 
+// skipOlderReport skips a report which isn't newer than the instance's report for its month, only counting it towards
+// the number of reports the instance sent that month
+func skipOlderReport(db sq.BaseRunner, cache *DBCache, prevReport *InstanceReport, countForMonth uint64) error {
+	cache.skippedForTime++
+
+	if prevReport.CountForMonth == 1 {
+		_, err := PSQL(db).Update(InstanceReportsTable).
+			Where(sq.Eq{"id": prevReport.ID}).
+			Set("count_for_month", countForMonth).
+			Exec()
+		return err
+	}
+	return nil
+}
+
+// checkReport returns the normalized Jenkins version of a report, or the reason it should be skipped without looking at
+// the database
+func checkReport(jsonReport *JSONReport) (string, string) {
+	// Short-circuit for a few weird cases where the instance ID is >64 characters or the Jenkins version is >32 characters
+	if len(jsonReport.Install) > 64 {
+		return "", skipReasonInstallTooLong
+	}
+	if len(jsonReport.Version) > 32 {
+		return "", skipReasonVersionTooLong
+	}
+	// Skip Jenkins versions dropped by the rules, such as SNAPSHOTs and weird ***/? versions
+	jenkinsVersion := normalizeValue(RuleFieldJenkinsVersion, jsonReport.Version)
+	if jenkinsVersion.Dropped {
+		return "", skipReasonVersionDropped
+	}
+	return jenkinsVersion.Value, ""
+}
+
+// countablePlugins returns the plugins on a report with their normalized versions, leaving out plugin versions dropped
+// by the rules, such as weird cases where there's no real version for the plugin
+func countablePlugins(jsonReport *JSONReport) []JSONPlugin {
+	var plugins []JSONPlugin
+	for _, p := range jsonReport.Plugins {
+		pluginVersion := normalizeValue(RuleFieldPluginVersion, p.Version)
+		if !pluginVersion.Dropped {
+			plugins = append(plugins, JSONPlugin{Name: p.Name, Version: pluginVersion.Value})
+		}
+	}
+	return plugins
+}
+
+// countablePluginVersion returns whether a stored plugin version is counted in reports, leaving out versions dropped by
+// the rules which were imported before the rules dropped them
+func countablePluginVersion(version string) bool {
+	return !normalizeValue(RuleFieldPluginVersion, version).Dropped
+}
+
+// countableJobs returns the job counts on a report, leaving out job types with no jobs and private job types
+func countableJobs(jsonReport *JSONReport) map[string]uint64 {
+	jobs := map[string]uint64{}
+	for jobType, count := range jsonReport.Jobs {
+		if count != 0 && !strings.HasPrefix(jobType, "private") {
+			jobs[jobType] = count
+		}
+	}
+	return jobs
+}
+
 // ReportAlreadyRead checks if a filename has already been read and processed
 func ReportAlreadyRead(db sq.BaseRunner, filename string) (bool, error) {
 	rows, err := PSQL(db).Select("count(*)").
@@ -598,11 +841,36 @@ func MarkReportRead(db sq.BaseRunner, filename string) error {
 	return err
 }
 
+// ReportFileAlreadyRead checks if a report file with the same contents has already been read and processed. Files
+// recorded before content hashes were kept are matched by name instead.
+func ReportFileAlreadyRead(db sq.BaseRunner, filename, hash string) (bool, error) {
+	var c int
+	err := PSQL(db).Select("count(*)").
+		From("report_files").
+		Where(sq.Or{
+			sq.Eq{"content_hash": hash},
+			sq.And{sq.Eq{"filename": filename}, sq.Eq{"content_hash": nil}},
+		}).
+		QueryRow().
+		Scan(&c)
+	if err != nil {
+		return false, err
+	}
+	return c > 0, nil
+}
+
+// MarkReportFileRead records that we've read and processed a report file with this name and contents
+func MarkReportFileRead(db sq.BaseRunner, filename, hash string) error {
+	_, err := PSQL(db).Insert("report_files").Columns("filename", "content_hash").Values(filename, hash).Exec()
+	return err
+}
+
 // PSQL is a postgresql squirrel statement builder
 func PSQL(db sq.BaseRunner) sq.StatementBuilderType {
 	return sq.StatementBuilder.PlaceholderFormat(sq.Dollar).RunWith(db)
 }
 
-func startDateForYearMonth(year int, month int) time.Time {
-	return time.Date(year, time.Month(month), 1, 0, 0, 0, 0, time.FixedZone("", 0))
+// startDateForYearMonth returns midnight on the first day of the month in loc, the reporting timezone
+func startDateForYearMonth(year int, month int, loc *time.Location) time.Time {
+	return time.Date(year, time.Month(month), 1, 0, 0, 0, 0, reportingLocation(loc))
 }
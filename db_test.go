@@ -38,6 +38,36 @@ func TestGetJVMVersionID(t *testing.T) {
 	assert.NotEqual(t, firstID, secondID)
 }
 
+func TestGetJVMVendorID(t *testing.T) {
+	db, closeFunc := testutil.DBForTest(t)
+	defer closeFunc()
+
+	cache := stats.NewStatsCache()
+
+	firstVendor := "Eclipse Adoptium"
+	secondVendor := "Amazon Corretto"
+	name := "HotSpot"
+
+	var fetchedVendor stats.JVMVendor
+	err := stats.PSQL(db).Select("id", "vendor", "name").From(stats.JVMVendorsTable).Where(sq.Eq{"vendor": firstVendor}).Where(sq.Eq{"name": name}).
+		QueryRow().Scan(&fetchedVendor.ID, &fetchedVendor.Vendor, &fetchedVendor.Name)
+	require.Equal(t, sql.ErrNoRows, err)
+
+	firstID, err := stats.GetJVMVendorID(db, cache, firstVendor, name)
+	require.NoError(t, err)
+	require.NoError(t, stats.PSQL(db).Select("id", "vendor", "name").From(stats.JVMVendorsTable).Where(sq.Eq{"vendor": firstVendor}).Where(sq.Eq{"name": name}).
+		QueryRow().Scan(&fetchedVendor.ID, &fetchedVendor.Vendor, &fetchedVendor.Name))
+	assert.Equal(t, firstID, fetchedVendor.ID)
+
+	secondID, err := stats.GetJVMVendorID(db, cache, secondVendor, name)
+	require.NoError(t, err)
+	assert.NotEqual(t, firstID, secondID)
+
+	otherNameID, err := stats.GetJVMVendorID(db, cache, firstVendor, "OpenJ9")
+	require.NoError(t, err)
+	assert.NotEqual(t, firstID, otherNameID)
+}
+
 func TestGetOSTypeID(t *testing.T) {
 	db, closeFunc := testutil.DBForTest(t)
 	defer closeFunc()
@@ -144,6 +174,31 @@ func TestGetPluginID(t *testing.T) {
 	assert.NotEqual(t, firstID, otherPluginID)
 }
 
+func TestGetServletContainerID(t *testing.T) {
+	db, closeFunc := testutil.DBForTest(t)
+	defer closeFunc()
+
+	cache := stats.NewStatsCache()
+
+	firstName := "Jetty 9"
+	secondName := "Tomcat 10"
+
+	var fetchedSC stats.ServletContainer
+	err := stats.PSQL(db).Select("id", "name").From(stats.ServletContainersTable).Where(sq.Eq{"name": firstName}).
+		QueryRow().Scan(&fetchedSC.ID, &fetchedSC.Name)
+	require.Equal(t, sql.ErrNoRows, err)
+
+	firstID, err := stats.GetServletContainerID(db, cache, firstName)
+	require.NoError(t, err)
+	require.NoError(t, stats.PSQL(db).Select("id", "name").From(stats.ServletContainersTable).Where(sq.Eq{"name": firstName}).
+		QueryRow().Scan(&fetchedSC.ID, &fetchedSC.Name))
+	assert.Equal(t, firstID, fetchedSC.ID)
+
+	secondID, err := stats.GetServletContainerID(db, cache, secondName)
+	require.NoError(t, err)
+	assert.NotEqual(t, firstID, secondID)
+}
+
 func TestAddIndividualReport(t *testing.T) {
 	db, closeFunc := testutil.DBForTest(t)
 	defer closeFunc()
@@ -207,6 +262,14 @@ func TestAddIndividualReport(t *testing.T) {
 		}
 	}
 
+	// The unchanged instance has a single agent, with no JVM version reported
+	naJVMID, err := stats.GetJVMVersionID(db, cache, "N/A")
+	require.NoError(t, err)
+	var agentJVMs stats.AgentJVMsForReport
+	require.NoError(t, stats.PSQL(db).Select("agent_jvms").From(stats.InstanceReportsTable).Where(sq.Eq{"instance_id": unchangedInstanceID}).
+		QueryRow().Scan(&agentJVMs))
+	assert.Equal(t, stats.AgentJVMsForReport{naJVMID: 1}, agentJVMs)
+
 	jobMap := *updatedFirstReport.Jobs
 	// There should be 11 MultiJobs in the initial report
 	assert.Equal(t, 11, int(jobMap[multiJobID]))
@@ -258,3 +321,28 @@ func TestAddIndividualReport(t *testing.T) {
 	// There should be 10 MatrixProjects
 	assert.Equal(t, 10, int(secondJobMap[matrixJobID]))
 }
+
+func TestReportFileAlreadyRead(t *testing.T) {
+	db, closeFunc := testutil.DBForTest(t)
+	defer closeFunc()
+
+	read, err := stats.ReportFileAlreadyRead(db, "a.json.gz", "hash-a")
+	require.NoError(t, err)
+	assert.False(t, read)
+
+	require.NoError(t, stats.MarkReportFileRead(db, "a.json.gz", "hash-a"))
+
+	// The same contents under another name are already read, and other contents under the same name aren't.
+	read, err = stats.ReportFileAlreadyRead(db, "b.json.gz", "hash-a")
+	require.NoError(t, err)
+	assert.True(t, read)
+	read, err = stats.ReportFileAlreadyRead(db, "a.json.gz", "hash-b")
+	require.NoError(t, err)
+	assert.False(t, read)
+
+	// Files recorded without a hash are matched by name.
+	require.NoError(t, stats.MarkReportRead(db, "legacy.json.gz"))
+	read, err = stats.ReportFileAlreadyRead(db, "legacy.json.gz", "hash-c")
+	require.NoError(t, err)
+	assert.True(t, read)
+}
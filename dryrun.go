@@ -0,0 +1,281 @@
+package stats
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	sq "github.com/Masterminds/squirrel"
+	"github.com/lib/pq"
+)
+
+const (
+	// ReportActionInsert is a report which would add a new instance report for its month
+	ReportActionInsert = "insert"
+	// ReportActionUpdate is a report which would replace the existing instance report for its month
+	ReportActionUpdate = "update"
+	// ReportActionCountOnly is a report which would only increment the count for the existing instance report
+	ReportActionCountOnly = "count-only"
+	// ReportActionSkip is a report which would change nothing
+	ReportActionSkip = "skip"
+)
+
+// ReportPlan is what adding a report would do
+type ReportPlan struct {
+	InstanceID string
+	Year       int
+	Month      int
+	ReportTime time.Time
+	Action     string
+	// Reason is why the report is skipped or only counted
+	Reason string
+	// Changes describes the differences from the existing instance report, for updates
+	Changes []string
+}
+
+func (p *ReportPlan) String() string {
+	s := fmt.Sprintf("%s %s %04d-%02d", p.Action, p.InstanceID, p.Year, p.Month)
+	if p.Reason != "" {
+		s += ": " + p.Reason
+	}
+	if len(p.Changes) > 0 {
+		s += ": " + strings.Join(p.Changes, "; ")
+	}
+	return s
+}
+
+// DryRun works out what adding reports would do, as AddIndividualReport would add them, without writing anything to the
+// database. Reports are planned as though the earlier ones had been added.
+type DryRun struct {
+	db        sq.BaseRunner
+	location  *time.Location
+	instances map[instanceMonthKey]*dryRunInstance
+
+	knownJenkinsVersions map[string]bool
+	knownPlugins         map[string]bool
+
+	// Actions is the number of reports for each action
+	Actions map[string]int
+	// Reasons is the number of reports skipped or only counted for each reason
+	Reasons map[string]int
+	// NewJenkinsVersions are the Jenkins versions which would be added to the jenkins_versions table
+	NewJenkinsVersions []string
+	// NewPlugins are the plugin names and versions which would be added to the plugins table, as name:version
+	NewPlugins []string
+}
+
+// instanceMonthKey identifies an instance's report for a month
+type instanceMonthKey struct {
+	instanceID string
+	year       int
+	month      int
+}
+
+// dryRunInstance is the parts of an instance report that changes are shown for
+type dryRunInstance struct {
+	countForMonth uint64
+	reportTime    time.Time
+	version       string
+	jvmVersion    string
+	executors     uint64
+	plugins       []string
+}
+
+// NewDryRun returns a DryRun starting from what's in the database, for adding reports with the given configuration
+func NewDryRun(db sq.BaseRunner, config ImportConfig) *DryRun {
+	return &DryRun{
+		db:                   db,
+		location:             reportingLocation(config.Location),
+		instances:            map[instanceMonthKey]*dryRunInstance{},
+		knownJenkinsVersions: map[string]bool{},
+		knownPlugins:         map[string]bool{},
+		Actions:              map[string]int{},
+		Reasons:              map[string]int{},
+	}
+}
+
+// Plan works out what adding a report would do, and records it as done for later reports
+func (d *DryRun) Plan(jsonReport *JSONReport) (*ReportPlan, error) {
+	plan := &ReportPlan{InstanceID: jsonReport.Install}
+
+	jenkinsVersion, reason := checkReport(jsonReport)
+	if reason != "" {
+		return d.record(plan, ReportActionSkip, reason), nil
+	}
+
+	ts, err := jsonReport.Timestamp()
+	if err != nil {
+		return nil, err
+	}
+	plan.ReportTime = ts
+	plan.Year = ts.In(d.location).Year()
+	plan.Month = int(ts.In(d.location).Month())
+
+	key := instanceMonthKey{instanceID: jsonReport.Install, year: plan.Year, month: plan.Month}
+	prev, err := d.existingInstance(key)
+	if err != nil {
+		return nil, err
+	}
+
+	if prev != nil && !ts.After(prev.reportTime) {
+		// AddIndividualReport only increments the count of older reports when there's only been one report so far.
+		if prev.countForMonth == 1 {
+			prev.countForMonth++
+			return d.record(plan, ReportActionCountOnly, skipReasonNotNewer), nil
+		}
+		return d.record(plan, ReportActionSkip, skipReasonNotNewer), nil
+	}
+
+	if len(countableJobs(jsonReport)) == 0 {
+		return d.record(plan, ReportActionSkip, skipReasonNoJobs), nil
+	}
+
+	next := &dryRunInstance{
+		countForMonth: 1,
+		reportTime:    ts,
+		version:       jenkinsVersion,
+		jvmVersion:    "N/A",
+	}
+	for _, n := range jsonReport.Nodes {
+		if n.IsController {
+			next.jvmVersion = n.JVMVersion
+		}
+		if n.Executors != 2147483647 {
+			next.executors += n.Executors
+		}
+	}
+	for _, p := range countablePlugins(jsonReport) {
+		next.plugins = append(next.plugins, p.Name+":"+p.Version)
+	}
+	sort.Strings(next.plugins)
+
+	if err := d.checkLookups(next); err != nil {
+		return nil, err
+	}
+
+	action := ReportActionInsert
+	if prev != nil {
+		action = ReportActionUpdate
+		next.countForMonth = prev.countForMonth + 1
+		plan.Changes = prev.changesTo(next)
+	}
+	d.instances[key] = next
+
+	return d.record(plan, action, ""), nil
+}
+
+func (d *DryRun) record(plan *ReportPlan, action, reason string) *ReportPlan {
+	plan.Action = action
+	plan.Reason = reason
+	d.Actions[action]++
+	if reason != "" {
+		d.Reasons[reason]++
+	}
+	return plan
+}
+
+// existingInstance returns the instance report for the month, either as planned so far or from the database, or nil if
+// there isn't one
+func (d *DryRun) existingInstance(key instanceMonthKey) (*dryRunInstance, error) {
+	if inst, ok := d.instances[key]; ok {
+		return inst, nil
+	}
+
+	inst := &dryRunInstance{}
+	var version, jvmVersion sql.NullString
+	var plugins pq.StringArray
+	err := PSQL(d.db).Select("ir.count_for_month", "ir.report_time", "jv.version", "jvm.name", "ir.executors",
+		"array(select p.name || ':' || p.version from "+PluginsTable+" p where p.id = any(ir.plugins) order by 1)").
+		From(InstanceReportsTable+" ir").
+		LeftJoin(JenkinsVersionsTable+" jv on jv.id = ir.version").
+		LeftJoin(JVMVersionsTable+" jvm on jvm.id = ir.jvm_version_id").
+		Where(sq.Eq{"ir.instance_id": key.instanceID}).
+		Where(sq.Eq{"ir.year": key.year}).
+		Where(sq.Eq{"ir.month": key.month}).
+		QueryRow().
+		Scan(&inst.countForMonth, &inst.reportTime, &version, &jvmVersion, &inst.executors, &plugins)
+	if errors.Is(err, sql.ErrNoRows) {
+		d.instances[key] = nil
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	inst.version = version.String
+	inst.jvmVersion = jvmVersion.String
+	inst.plugins = plugins
+	d.instances[key] = inst
+	return inst, nil
+}
+
+// checkLookups records the Jenkins version and plugins which aren't in the database or planned already
+func (d *DryRun) checkLookups(inst *dryRunInstance) error {
+	if _, ok := d.knownJenkinsVersions[inst.version]; !ok {
+		var c int
+		if err := PSQL(d.db).Select("count(*)").From(JenkinsVersionsTable).Where(sq.Eq{"version": inst.version}).QueryRow().Scan(&c); err != nil {
+			return err
+		}
+		d.knownJenkinsVersions[inst.version] = true
+		if c == 0 {
+			d.NewJenkinsVersions = append(d.NewJenkinsVersions, inst.version)
+		}
+	}
+
+	for _, p := range inst.plugins {
+		if _, ok := d.knownPlugins[p]; ok {
+			continue
+		}
+		name, version, _ := strings.Cut(p, ":")
+		var c int
+		if err := PSQL(d.db).Select("count(*)").From(PluginsTable).Where(sq.Eq{"name": name, "version": version}).QueryRow().Scan(&c); err != nil {
+			return err
+		}
+		d.knownPlugins[p] = true
+		if c == 0 {
+			d.NewPlugins = append(d.NewPlugins, p)
+		}
+	}
+	return nil
+}
+
+// changesTo describes the differences between two versions of an instance report
+func (inst *dryRunInstance) changesTo(next *dryRunInstance) []string {
+	var changes []string
+	if inst.version != next.version {
+		changes = append(changes, fmt.Sprintf("version %s -> %s", inst.version, next.version))
+	}
+	if inst.jvmVersion != next.jvmVersion {
+		changes = append(changes, fmt.Sprintf("jvm %s -> %s", inst.jvmVersion, next.jvmVersion))
+	}
+	if inst.executors != next.executors {
+		changes = append(changes, fmt.Sprintf("executors %d -> %d", inst.executors, next.executors))
+	}
+
+	prevPlugins := map[string]bool{}
+	for _, p := range inst.plugins {
+		prevPlugins[p] = true
+	}
+	nextPlugins := map[string]bool{}
+	for _, p := range next.plugins {
+		nextPlugins[p] = true
+	}
+	var pluginChanges []string
+	for _, p := range next.plugins {
+		if !prevPlugins[p] {
+			pluginChanges = append(pluginChanges, "+"+p)
+		}
+	}
+	for _, p := range inst.plugins {
+		if !nextPlugins[p] {
+			pluginChanges = append(pluginChanges, "-"+p)
+		}
+	}
+	if len(pluginChanges) > 0 {
+		changes = append(changes, "plugins "+strings.Join(pluginChanges, " "))
+	}
+
+	return changes
+}
@@ -0,0 +1,69 @@
+package stats_test
+
+import (
+	"path/filepath"
+	"testing"
+
+	stats "github.com/jenkins-infra/jenkins-usage-stats"
+	"github.com/jenkins-infra/jenkins-usage-stats/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDryRun(t *testing.T) {
+	db, closeFunc := testutil.DBForTest(t)
+	defer closeFunc()
+
+	baseReports, err := stats.ParseDailyJSON(filepath.Join("testdata", "base.json.gz"))
+	require.NoError(t, err)
+	laterReports, err := stats.ParseDailyJSON(filepath.Join("testdata", "day-later.json.gz"))
+	require.NoError(t, err)
+
+	countRows := func(table string) int {
+		var c int
+		require.NoError(t, stats.PSQL(db).Select("count(*)").From(table).QueryRow().Scan(&c))
+		return c
+	}
+
+	// Nothing in the database yet, so the base reports would both be inserted, and the later report would update one.
+	dryRun := stats.NewDryRun(db, stats.ImportConfig{})
+	for _, jr := range baseReports {
+		plan, err := dryRun.Plan(jr)
+		require.NoError(t, err)
+		assert.Equal(t, stats.ReportActionInsert, plan.Action)
+	}
+	plan, err := dryRun.Plan(laterReports[0])
+	require.NoError(t, err)
+	assert.Equal(t, stats.ReportActionUpdate, plan.Action)
+	assert.Contains(t, plan.Changes, "version 2.204.4 -> 2.204.5")
+
+	// Planning the same report again is skipped, since it's not newer.
+	plan, err = dryRun.Plan(laterReports[0])
+	require.NoError(t, err)
+	assert.Equal(t, stats.ReportActionSkip, plan.Action)
+
+	assert.Equal(t, map[string]int{stats.ReportActionInsert: 2, stats.ReportActionUpdate: 1, stats.ReportActionSkip: 1}, dryRun.Actions)
+	assert.ElementsMatch(t, []string{"2.204.4", "2.277.2", "2.204.5"}, dryRun.NewJenkinsVersions)
+	assert.NotEmpty(t, dryRun.NewPlugins)
+
+	assert.Equal(t, 0, countRows(stats.InstanceReportsTable))
+	assert.Equal(t, 0, countRows(stats.JenkinsVersionsTable))
+	assert.Equal(t, 0, countRows(stats.PluginsTable))
+
+	// Once the base reports are added, the dry run matches what adding the later report does.
+	cache := stats.NewStatsCache()
+	for _, jr := range baseReports {
+		require.NoError(t, stats.AddIndividualReport(db, cache, jr))
+	}
+
+	dryRun = stats.NewDryRun(db, stats.ImportConfig{})
+	plan, err = dryRun.Plan(baseReports[0])
+	require.NoError(t, err)
+	assert.Equal(t, stats.ReportActionCountOnly, plan.Action)
+
+	plan, err = dryRun.Plan(laterReports[0])
+	require.NoError(t, err)
+	assert.Equal(t, stats.ReportActionUpdate, plan.Action)
+	assert.Contains(t, plan.Changes, "version 2.204.4 -> 2.204.5")
+	assert.Equal(t, []string{"2.204.5"}, dryRun.NewJenkinsVersions)
+}
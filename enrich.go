@@ -0,0 +1,335 @@
+package stats
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"time"
+
+	sq "github.com/Masterminds/squirrel"
+	"github.com/lib/pq"
+)
+
+const (
+	// PluginMetadataTable is the plugin_metadata table name
+	PluginMetadataTable = "plugin_metadata"
+	// PluginVersionReleasesTable is the plugin_version_releases table name
+	PluginVersionReleasesTable = "plugin_version_releases"
+
+	// DefaultOldPluginVersionAge is how long ago a plugin version needs to have been released to be old
+	DefaultOldPluginVersionAge = 2 * 365 * 24 * time.Hour
+
+	deprecatedLabel = "deprecated"
+	buildDateLayout = "Jan 2, 2006"
+)
+
+// UpdateCenter is the parts of an update-center.json file used to enrich plugins
+type UpdateCenter struct {
+	GenerationTimestamp string                             `json:"generationTimestamp"`
+	Plugins             map[string]UpdateCenterPlugin      `json:"plugins"`
+	Deprecations        map[string]UpdateCenterDeprecation `json:"deprecations"`
+}
+
+// UpdateCenterPlugin is a plugin in an update-center.json file, at its latest version
+type UpdateCenterPlugin struct {
+	Name              string   `json:"name"`
+	Title             string   `json:"title"`
+	Version           string   `json:"version"`
+	Labels            []string `json:"labels"`
+	RequiredCore      string   `json:"requiredCore"`
+	BuildDate         string   `json:"buildDate"`
+	ReleaseTimestamp  string   `json:"releaseTimestamp"`
+	PreviousVersion   string   `json:"previousVersion"`
+	PreviousTimestamp string   `json:"previousTimestamp"`
+}
+
+// UpdateCenterDeprecation is the deprecation notice for a plugin in an update-center.json file
+type UpdateCenterDeprecation struct {
+	URL string `json:"url"`
+}
+
+// PluginVersionsFile is the parts of a plugin-versions.json file, which lists every release of each plugin, used to
+// enrich plugins
+type PluginVersionsFile struct {
+	Plugins map[string]map[string]PluginVersionRelease `json:"plugins"`
+}
+
+// PluginVersionRelease is a release of a plugin in a plugin-versions.json file
+type PluginVersionRelease struct {
+	Version          string `json:"version"`
+	RequiredCore     string `json:"requiredCore"`
+	BuildDate        string `json:"buildDate"`
+	ReleaseTimestamp string `json:"releaseTimestamp"`
+}
+
+// EnrichResult is what EnrichPlugins stored
+type EnrichResult struct {
+	// Distributed is the number of plugins in the update center
+	Distributed int
+	// NotDistributed is the number of plugins in the usage data or deprecations which aren't in the update center
+	NotDistributed int
+	// Deprecated is the number of deprecated plugins
+	Deprecated int
+	// Releases is the number of plugin versions with release times
+	Releases int
+}
+
+// PluginInstalls is the number of instances with a plugin, or a version of it, installed
+type PluginInstalls struct {
+	Name    string `json:"name"`
+	Title   string `json:"title,omitempty"`
+	Version string `json:"version,omitempty"`
+	// ReleaseTime is when the version was released, in milliseconds
+	ReleaseTime    int64  `json:"releaseTime,omitempty"`
+	DeprecationURL string `json:"deprecationUrl,omitempty"`
+	Installs       uint64 `json:"installs"`
+}
+
+// PluginHealthReport is the installs of plugins which may need attention in a month, according to the plugin metadata
+type PluginHealthReport struct {
+	Month int64 `json:"month"`
+	// Deprecated are the installs of deprecated plugins
+	Deprecated []PluginInstalls `json:"deprecated"`
+	// NotDistributed are the installs of plugins which are no longer in the update center
+	NotDistributed []PluginInstalls `json:"notDistributed"`
+	// OldVersions are the installs of plugin versions released more than the old version age before the end of the month
+	OldVersions []PluginInstalls `json:"oldVersions"`
+}
+
+// LoadUpdateCenter reads an update-center.json file, either plain JSON or wrapped in the updateCenter.post(...) call
+// the update site serves
+func LoadUpdateCenter(filename string) (*UpdateCenter, error) {
+	data, err := os.ReadFile(filename) // #nosec
+	if err != nil {
+		return nil, err
+	}
+	return ParseUpdateCenter(data)
+}
+
+// ParseUpdateCenter parses the contents of an update-center.json file
+func ParseUpdateCenter(data []byte) (*UpdateCenter, error) {
+	data = bytes.TrimSpace(data)
+	if prefix := []byte("updateCenter.post("); bytes.HasPrefix(data, prefix) {
+		data = bytes.TrimSuffix(bytes.TrimSuffix(bytes.TrimPrefix(data, prefix), []byte(";")), []byte(")"))
+	}
+	uc := &UpdateCenter{}
+	if err := json.Unmarshal(data, uc); err != nil {
+		return nil, fmt.Errorf("invalid update center JSON: %w", err)
+	}
+	if len(uc.Plugins) == 0 {
+		return nil, fmt.Errorf("update center JSON has no plugins")
+	}
+	return uc, nil
+}
+
+// LoadPluginVersions reads a plugin-versions.json file
+func LoadPluginVersions(filename string) (*PluginVersionsFile, error) {
+	data, err := os.ReadFile(filename) // #nosec
+	if err != nil {
+		return nil, err
+	}
+	pv := &PluginVersionsFile{}
+	if err := json.Unmarshal(data, pv); err != nil {
+		return nil, fmt.Errorf("invalid plugin versions JSON: %w", err)
+	}
+	return pv, nil
+}
+
+// EnrichPlugins replaces the plugin metadata with that from the update center, and adds the release times of plugin
+// versions from the update center and, if given, the plugin versions file. Plugins in the usage data or deprecations
+// which aren't in the update center are recorded as not distributed.
+func EnrichPlugins(db sq.BaseRunner, uc *UpdateCenter, versions *PluginVersionsFile) (EnrichResult, error) {
+	var result EnrichResult
+	now := time.Now().UTC()
+
+	if _, err := PSQL(db).Delete(PluginMetadataTable).Exec(); err != nil {
+		return result, err
+	}
+
+	for _, name := range sortedPluginNames(uc.Plugins) {
+		p := uc.Plugins[name]
+		deprecation, deprecated := uc.Deprecations[name]
+		for _, l := range p.Labels {
+			deprecated = deprecated || l == deprecatedLabel
+		}
+		var releaseTime *time.Time
+		if t, ok := parseReleaseTime(p.ReleaseTimestamp, p.BuildDate); ok {
+			releaseTime = &t
+		}
+		_, err := PSQL(db).Insert(PluginMetadataTable).
+			Columns("name", "title", "labels", "deprecated", "deprecation_url", "required_core", "latest_version", "release_time",
+				"distributed", "enriched_at").
+			Values(name, p.Title, pq.StringArray(p.Labels), deprecated, deprecation.URL, p.RequiredCore, p.Version, releaseTime, true, now).
+			Exec()
+		if err != nil {
+			return result, err
+		}
+		result.Distributed++
+		if deprecated {
+			result.Deprecated++
+		}
+
+		if releaseTime != nil {
+			if err := addPluginRelease(db, name, p.Version, *releaseTime, p.RequiredCore); err != nil {
+				return result, err
+			}
+			result.Releases++
+		}
+		if t, ok := parseReleaseTime(p.PreviousTimestamp, ""); ok && p.PreviousVersion != "" {
+			if err := addPluginRelease(db, name, p.PreviousVersion, t, ""); err != nil {
+				return result, err
+			}
+			result.Releases++
+		}
+	}
+
+	for name, deprecation := range uc.Deprecations {
+		if _, ok := uc.Plugins[name]; ok {
+			continue
+		}
+		_, err := PSQL(db).Insert(PluginMetadataTable).
+			Columns("name", "deprecated", "deprecation_url", "distributed", "enriched_at").
+			Values(name, true, deprecation.URL, false, now).
+			Exec()
+		if err != nil {
+			return result, err
+		}
+		result.NotDistributed++
+		result.Deprecated++
+	}
+
+	res, err := PSQL(db).Insert(PluginMetadataTable).
+		Columns("name", "distributed", "enriched_at").
+		Select(sq.Select("distinct name", "false").
+			Column(sq.Expr("?::timestamptz", now)).
+			From(PluginsTable).
+			Where(sq.Expr("name not in (select name from " + PluginMetadataTable + ")"))).
+		Exec()
+	if err != nil {
+		return result, err
+	}
+	added, err := res.RowsAffected()
+	if err != nil {
+		return result, err
+	}
+	result.NotDistributed += int(added)
+
+	if versions != nil {
+		for name, releases := range versions.Plugins {
+			for version, r := range releases {
+				t, ok := parseReleaseTime(r.ReleaseTimestamp, r.BuildDate)
+				if !ok {
+					continue
+				}
+				if err := addPluginRelease(db, name, version, t, r.RequiredCore); err != nil {
+					return result, err
+				}
+				result.Releases++
+			}
+		}
+	}
+
+	return result, nil
+}
+
+func addPluginRelease(db sq.BaseRunner, name, version string, releaseTime time.Time, requiredCore string) error {
+	_, err := PSQL(db).Insert(PluginVersionReleasesTable).
+		Columns("name", "version", "release_time", "required_core").
+		Values(name, version, releaseTime, requiredCore).
+		Suffix("on conflict (name, version) do update set release_time = excluded.release_time, " +
+			"required_core = coalesce(nullif(excluded.required_core, ''), " + PluginVersionReleasesTable + ".required_core)").
+		Exec()
+	return err
+}
+
+// parseReleaseTime parses a release timestamp, falling back to the build date for releases from before release
+// timestamps were recorded
+func parseReleaseTime(timestamp, buildDate string) (time.Time, bool) {
+	if t, err := time.Parse(time.RFC3339, timestamp); err == nil {
+		return t.UTC(), true
+	}
+	if t, err := time.Parse(buildDateLayout, buildDate); err == nil {
+		return t, true
+	}
+	return time.Time{}, false
+}
+
+func sortedPluginNames(plugins map[string]UpdateCenterPlugin) []string {
+	names := make([]string, 0, len(plugins))
+	for n := range plugins {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// GetPluginHealthReport gets the installs in a month of deprecated plugins, plugins which are no longer distributed,
+// and plugin versions released more than oldAge before the end of the month, most installed first
+func GetPluginHealthReport(db sq.BaseRunner, co CountOptions, year, month int, oldAge time.Duration) (*PluginHealthReport, error) {
+	report := &PluginHealthReport{Month: startDateForYearMonth(year, month, co.Location).UnixMilli()}
+
+	installs := func(stmt sq.SelectBuilder) ([]PluginInstalls, error) {
+		rows, err := stmt.
+			From("instance_reports i, unnest(i.plugins) pr(id)").
+			Join("plugins p on p.id = pr.id").
+			Where(sq.Eq{"i.year": year}).
+			Where(sq.Eq{"i.month": month}).
+			Where(countedInstances("i", co.ExcludeQuarantined)).
+			OrderBy("installs desc", "1").
+			Query()
+		if err != nil {
+			return nil, err
+		}
+		defer func() {
+			_ = rows.Close()
+		}()
+
+		counts := []PluginInstalls{}
+		for rows.Next() {
+			var pi PluginInstalls
+			var releaseTime *time.Time
+			if err := rows.Scan(&pi.Name, &pi.Title, &pi.Version, &releaseTime, &pi.DeprecationURL, &pi.Installs); err != nil {
+				return nil, err
+			}
+			if releaseTime != nil {
+				pi.ReleaseTime = releaseTime.UnixMilli()
+			}
+			counts = append(counts, pi)
+		}
+		return counts, rows.Err()
+	}
+
+	var err error
+	report.Deprecated, err = installs(PSQL(db).Select("p.name", "coalesce(m.title, '')", "''", "null::timestamptz",
+		"coalesce(m.deprecation_url, '')", "count(distinct i.instance_id) as installs").
+		Join(PluginMetadataTable+" m on m.name = p.name").
+		Where("m.deprecated").
+		GroupBy("p.name", "m.title", "m.deprecation_url"))
+	if err != nil {
+		return nil, err
+	}
+
+	report.NotDistributed, err = installs(PSQL(db).Select("p.name", "coalesce(m.title, '')", "''", "null::timestamptz",
+		"coalesce(m.deprecation_url, '')", "count(distinct i.instance_id) as installs").
+		Join(PluginMetadataTable+" m on m.name = p.name").
+		Where("not m.distributed").
+		GroupBy("p.name", "m.title", "m.deprecation_url"))
+	if err != nil {
+		return nil, err
+	}
+
+	cutoff := startDateForYearMonth(year, month, co.Location).AddDate(0, 1, 0).Add(-oldAge)
+	report.OldVersions, err = installs(PSQL(db).Select("p.name", "coalesce(m.title, '')", "p.version", "r.release_time", "''",
+		"count(*) as installs").
+		Join(PluginVersionReleasesTable+" r on r.name = p.name and r.version = p.version").
+		LeftJoin(PluginMetadataTable+" m on m.name = p.name").
+		Where(sq.Lt{"r.release_time": cutoff}).
+		GroupBy("p.name", "m.title", "p.version", "r.release_time"))
+	if err != nil {
+		return nil, err
+	}
+
+	return report, nil
+}
@@ -0,0 +1,65 @@
+package stats_test
+
+import (
+	"path/filepath"
+	"testing"
+
+	stats "github.com/jenkins-infra/jenkins-usage-stats"
+	"github.com/jenkins-infra/jenkins-usage-stats/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLoadUpdateCenter(t *testing.T) {
+	uc, err := stats.LoadUpdateCenter(filepath.Join("testdata", "update-center.json"))
+	require.NoError(t, err)
+
+	assert.Equal(t, "2022-08-01T00:00:00Z", uc.GenerationTimestamp)
+	assert.Len(t, uc.Plugins, 3)
+	assert.Equal(t, "Git", uc.Plugins["git"].Title)
+	assert.Equal(t, "4.11.3", uc.Plugins["git"].PreviousVersion)
+	assert.Equal(t, []string{"user", "deprecated"}, uc.Plugins["ldap"].Labels)
+	assert.Equal(t, "https://www.jenkins.io/redirect/plugin-deprecation/cvs", uc.Deprecations["cvs"].URL)
+
+	_, err = stats.ParseUpdateCenter([]byte(`{"plugins": {}}`))
+	assert.Error(t, err)
+}
+
+func TestGetPluginHealthReport(t *testing.T) {
+	db, closeFunc := testutil.DBForTest(t)
+	defer closeFunc()
+
+	cache := stats.NewStatsCache()
+	for day := 1; day <= 2; day++ {
+		require.NoError(t, stats.AddIndividualReport(db, cache, testReport("a", day, "2.303.1", "Linux", "cvs", "git", "ldap", "legacy")))
+		require.NoError(t, stats.AddIndividualReport(db, cache, testReport("b", day, "2.303.1", "Linux", "cvs", "git")))
+	}
+
+	uc, err := stats.LoadUpdateCenter(filepath.Join("testdata", "update-center.json"))
+	require.NoError(t, err)
+	versions := &stats.PluginVersionsFile{Plugins: map[string]map[string]stats.PluginVersionRelease{
+		"cvs": {"1.0": {BuildDate: "Jan 02, 2019"}},
+		"git": {"1.0": {ReleaseTimestamp: "2021-01-01T00:00:00.00Z"}},
+	}}
+	result, err := stats.EnrichPlugins(db, uc, versions)
+	require.NoError(t, err)
+	assert.Equal(t, stats.EnrichResult{Distributed: 3, NotDistributed: 2, Deprecated: 3, Releases: 6}, result)
+
+	report, err := stats.GetPluginHealthReport(db, stats.CountOptions{}, 2022, 6, stats.DefaultOldPluginVersionAge)
+	require.NoError(t, err)
+	assert.Equal(t, []stats.PluginInstalls{
+		{Name: "cvs", Title: "CVS", DeprecationURL: "https://www.jenkins.io/redirect/plugin-deprecation/cvs", Installs: 2},
+		{Name: "ldap", Title: "LDAP", Installs: 1},
+	}, report.Deprecated)
+	assert.Equal(t, []stats.PluginInstalls{{Name: "legacy", Installs: 1}}, report.NotDistributed)
+	require.Len(t, report.OldVersions, 1)
+	assert.Equal(t, "cvs", report.OldVersions[0].Name)
+	assert.Equal(t, "1.0", report.OldVersions[0].Version)
+	assert.Equal(t, uint64(2), report.OldVersions[0].Installs)
+
+	// Enriching again replaces the metadata rather than adding to it.
+	result, err = stats.EnrichPlugins(db, uc, nil)
+	require.NoError(t, err)
+	assert.Equal(t, 3, result.Distributed)
+	assert.Equal(t, 2, result.NotDistributed)
+}
@@ -0,0 +1,2 @@
+alter table instance_reports drop column if exists jvm_vendor_id;
+drop table jvm_vendors;
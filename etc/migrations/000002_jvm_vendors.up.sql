@@ -0,0 +1,9 @@
+create table if not exists jvm_vendors (
+    id int generated by default as identity primary key,
+    vendor text NOT NULL,
+    name text NOT NULL
+);
+
+create unique index jvm_vendors_vendor_and_name on jvm_vendors using btree(vendor, name);
+
+alter table instance_reports add column if not exists jvm_vendor_id int references jvm_vendors;
@@ -0,0 +1 @@
+alter table instance_reports drop column if exists agent_jvms;
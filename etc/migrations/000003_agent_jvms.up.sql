@@ -0,0 +1 @@
+alter table instance_reports add column if not exists agent_jvms jsonb;
@@ -0,0 +1,2 @@
+alter table instance_reports drop column if exists servlet_container_id;
+drop table servlet_containers;
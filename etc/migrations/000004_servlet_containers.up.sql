@@ -0,0 +1,8 @@
+create table if not exists servlet_containers (
+    id int generated by default as identity primary key,
+    name text NOT NULL
+);
+
+create unique index servlet_container_name on servlet_containers(name);
+
+alter table instance_reports add column if not exists servlet_container_id int references servlet_containers;
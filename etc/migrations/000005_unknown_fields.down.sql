@@ -0,0 +1,2 @@
+drop table if exists unknown_fields;
+drop table if exists report_days;
@@ -0,0 +1,14 @@
+create table if not exists report_days (
+    day date primary key,
+    reports bigint NOT NULL
+);
+
+create table if not exists unknown_fields (
+    day date NOT NULL,
+    scope text NOT NULL,
+    name text NOT NULL,
+    reports bigint NOT NULL,
+    primary key (day, scope, name)
+);
+
+create index unknown_fields_scope_name on unknown_fields(scope, name);
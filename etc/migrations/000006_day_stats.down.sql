@@ -0,0 +1 @@
+drop table if exists day_stats;
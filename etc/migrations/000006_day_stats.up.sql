@@ -0,0 +1,7 @@
+create table if not exists day_stats (
+    day date primary key,
+    reports bigint NOT NULL,
+    instances bigint NOT NULL,
+    jenkins_versions jsonb NOT NULL,
+    plugins jsonb NOT NULL
+);
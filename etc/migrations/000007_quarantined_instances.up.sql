@@ -0,0 +1,11 @@
+create table if not exists quarantined_instances (
+    instance_id varchar(64) NOT NULL,
+    year int NOT NULL,
+    month int NOT NULL,
+    reasons text[] NOT NULL,
+    evidence jsonb NOT NULL,
+    detected_at timestamptz NOT NULL,
+    primary key (instance_id, year, month)
+);
+
+create index quarantined_instances_year_month on quarantined_instances(year, month);
@@ -0,0 +1,3 @@
+drop index if exists instance_reports_quarter;
+
+alter table instance_reports drop column if exists quarter;
@@ -0,0 +1,4 @@
+alter table instance_reports add column if not exists quarter varchar(7)
+    generated always as (year::text || '-Q' || ((month - 1) / 3 + 1)::text) stored;
+
+create index instance_reports_quarter on instance_reports using btree(quarter);
@@ -0,0 +1 @@
+drop table if exists weekly_instance_reports;
@@ -0,0 +1,13 @@
+create table if not exists weekly_instance_reports (
+    instance_id varchar(64) not null,
+    week varchar(8) not null,
+    year smallint not null,
+    month smallint not null,
+    count_for_week int default 0,
+    report_time timestamptz not null,
+    version int references jenkins_versions,
+    plugins int[],
+    primary key (instance_id, week)
+);
+
+create index weekly_instance_reports_week on weekly_instance_reports using btree(week);
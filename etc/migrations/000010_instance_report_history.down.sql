@@ -0,0 +1 @@
+drop table if exists instance_report_history;
@@ -0,0 +1,12 @@
+create table if not exists instance_report_history (
+    instance_id varchar(64) not null,
+    report_time timestamptz not null,
+    last_report_time timestamptz not null,
+    reports int not null default 1,
+    version int references jenkins_versions,
+    jvm_version_id int references jvm_versions,
+    executors int default 0,
+    plugins int[],
+    nodes jsonb,
+    primary key (instance_id, report_time)
+) partition by range (report_time);
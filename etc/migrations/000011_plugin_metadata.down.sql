@@ -0,0 +1,2 @@
+drop table if exists plugin_version_releases;
+drop table if exists plugin_metadata;
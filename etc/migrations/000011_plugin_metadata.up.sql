@@ -0,0 +1,20 @@
+create table if not exists plugin_metadata (
+    name text primary key,
+    title text,
+    labels text[],
+    deprecated boolean not null default false,
+    deprecation_url text,
+    required_core text,
+    latest_version text,
+    release_time timestamptz,
+    distributed boolean not null default false,
+    enriched_at timestamptz not null
+);
+
+create table if not exists plugin_version_releases (
+    name text not null,
+    version text not null,
+    release_time timestamptz not null,
+    required_core text,
+    primary key (name, version)
+);
@@ -0,0 +1,3 @@
+drop index if exists jenkins_versions_sort_key;
+
+alter table jenkins_versions drop column if exists sort_key;
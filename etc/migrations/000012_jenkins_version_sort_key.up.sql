@@ -0,0 +1,3 @@
+alter table jenkins_versions add column if not exists sort_key text collate "C";
+
+create index jenkins_versions_sort_key on jenkins_versions using btree(sort_key);
@@ -0,0 +1,3 @@
+drop table if exists report_snapshot_aggregates;
+
+drop table if exists report_snapshots;
@@ -0,0 +1,18 @@
+create table if not exists report_snapshots (
+    year int NOT NULL,
+    month int NOT NULL,
+    version int NOT NULL,
+    frozen_at timestamptz NOT NULL,
+    note text,
+    primary key (year, month, version)
+);
+
+create table if not exists report_snapshot_aggregates (
+    year int NOT NULL,
+    month int NOT NULL,
+    version int NOT NULL,
+    aggregate text NOT NULL,
+    counts jsonb NOT NULL,
+    primary key (year, month, version, aggregate),
+    foreign key (year, month, version) references report_snapshots on delete cascade
+);
@@ -0,0 +1,9 @@
+drop index if exists report_files_filename;
+
+drop index if exists report_files_content_hash;
+
+delete from report_files a using report_files b where a.filename = b.filename and a.ctid > b.ctid;
+
+alter table report_files drop column if exists content_hash;
+
+alter table report_files add primary key (filename);
@@ -0,0 +1,7 @@
+alter table report_files add column if not exists content_hash text;
+
+alter table report_files drop constraint if exists report_files_pkey;
+
+create unique index report_files_content_hash on report_files using btree(content_hash);
+
+create index report_files_filename on report_files using btree(filename);
@@ -0,0 +1,5 @@
+create table if not exists released_instances (
+    instance_id varchar(64) NOT NULL,
+    released_at timestamptz NOT NULL,
+    primary key (instance_id)
+);
@@ -0,0 +1,5 @@
+create table if not exists settings (
+    name varchar(64) NOT NULL,
+    value text NOT NULL,
+    primary key (name)
+);
@@ -0,0 +1,2 @@
+alter table report_snapshots drop column if exists timezone;
+alter table report_snapshots drop column if exists exclude_quarantined;
@@ -0,0 +1,2 @@
+alter table report_snapshots add column if not exists exclude_quarantined boolean NOT NULL default false;
+alter table report_snapshots add column if not exists timezone text;
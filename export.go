@@ -0,0 +1,249 @@
+package stats
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"time"
+
+	sq "github.com/Masterminds/squirrel"
+	"github.com/lib/pq"
+	"github.com/parquet-go/parquet-go"
+)
+
+const exportBatchSize = 1000
+
+// ExportRow is a single instance report, with the lookup IDs resolved to names, as written by ExportParquet
+type ExportRow struct {
+	InstanceID       string           `parquet:"instance_id,dict"`
+	Year             int32            `parquet:"year"`
+	Month            int32            `parquet:"month"`
+	ReportTime       time.Time        `parquet:"report_time,timestamp(millisecond)"`
+	CountForMonth    int32            `parquet:"count_for_month"`
+	JenkinsVersion   string           `parquet:"jenkins_version,dict"`
+	JVMVersion       string           `parquet:"jvm_version,dict"`
+	JVMVendor        string           `parquet:"jvm_vendor,dict"`
+	JVMName          string           `parquet:"jvm_name,dict"`
+	ServletContainer string           `parquet:"servlet_container,dict"`
+	Executors        int32            `parquet:"executors"`
+	Plugins          []ExportPlugin   `parquet:"plugins,list"`
+	Jobs             map[string]int64 `parquet:"jobs"`
+	Nodes            map[string]int64 `parquet:"nodes"`
+	AgentJVMs        map[string]int64 `parquet:"agent_jvms"`
+}
+
+// ExportPlugin is a plugin name and version in an ExportRow
+type ExportPlugin struct {
+	Name    string `parquet:"name,dict"`
+	Version string `parquet:"version,dict"`
+}
+
+// ExportOptions configures ExportParquet
+type ExportOptions struct {
+	StartYear  int
+	StartMonth int
+	EndYear    int
+	EndMonth   int
+
+	// HashInstanceIDs replaces instance IDs with their HMAC-SHA256, keyed with the salt, so the data can be shared
+	// without exposing the real IDs. IDs are still consistent within a single export.
+	HashInstanceIDs bool
+	// Salt is used when hashing instance IDs. If empty, a random salt is generated for each export.
+	Salt string
+
+	// CountOptions are which instance reports are counted, and so exported
+	CountOptions
+}
+
+// ExportParquet writes the instance reports for a range of months to w in Parquet format, returning the number of rows
+// written. Only instances counted in the reports (i.e., with at least two reports in a month) are included.
+func ExportParquet(db sq.BaseRunner, w io.Writer, opts ExportOptions) (int, error) {
+	if opts.StartYear*12+opts.StartMonth > opts.EndYear*12+opts.EndMonth {
+		return 0, fmt.Errorf("start month %d-%02d is after end month %d-%02d", opts.StartYear, opts.StartMonth, opts.EndYear, opts.EndMonth)
+	}
+
+	salt := opts.Salt
+	if opts.HashInstanceIDs && salt == "" {
+		b := make([]byte, 32)
+		if _, err := rand.Read(b); err != nil {
+			return 0, err
+		}
+		salt = hex.EncodeToString(b)
+	}
+
+	mac := hmac.New(sha256.New, []byte(salt))
+
+	names, err := loadExportNames(db)
+	if err != nil {
+		return 0, err
+	}
+
+	rows, err := PSQL(db).Select("instance_id", "year", "month", "report_time", "count_for_month",
+		"coalesce(version, 0)", "coalesce(jvm_version_id, 0)", "coalesce(jvm_vendor_id, 0)",
+		"coalesce(servlet_container_id, 0)", "executors", "coalesce(plugins, '{}')", "coalesce(jobs, '{}'::jsonb)",
+		"coalesce(nodes, '{}'::jsonb)", "coalesce(agent_jvms, '{}'::jsonb)").
+		From(InstanceReportsTable).
+		Where(sq.Expr("year * 12 + month between ? and ?", opts.StartYear*12+opts.StartMonth, opts.EndYear*12+opts.EndMonth)).
+		Where(countedInstances(InstanceReportsTable, opts.ExcludeQuarantined)).
+		OrderBy("year", "month", "instance_id").
+		Query()
+	if err != nil {
+		return 0, err
+	}
+	defer func() {
+		_ = rows.Close()
+	}()
+
+	pw := parquet.NewGenericWriter[ExportRow](w, parquet.Compression(&parquet.Zstd))
+	batch := make([]ExportRow, 0, exportBatchSize)
+	total := 0
+
+	flush := func() error {
+		if _, err := pw.Write(batch); err != nil {
+			return err
+		}
+		total += len(batch)
+		batch = batch[:0]
+		return nil
+	}
+
+	for rows.Next() {
+		var ir InstanceReport
+		var plugins pq.Int64Array
+		jobs, nodes, agentJVMs := JobsForReport{}, NodesForReport{}, AgentJVMsForReport{}
+
+		err = rows.Scan(&ir.InstanceID, &ir.Year, &ir.Month, &ir.ReportTime, &ir.CountForMonth, &ir.Version,
+			&ir.JVMVersionID, &ir.JVMVendorID, &ir.ServletContainerID, &ir.Executors, &plugins, &jobs, &nodes, &agentJVMs)
+		if err != nil {
+			return total, err
+		}
+
+		row := ExportRow{
+			InstanceID:       ir.InstanceID,
+			Year:             int32(ir.Year),
+			Month:            int32(ir.Month),
+			ReportTime:       ir.ReportTime.UTC(),
+			CountForMonth:    int32(ir.CountForMonth),
+			JenkinsVersion:   names.jenkinsVersions[ir.Version],
+			JVMVersion:       names.jvmVersions[ir.JVMVersionID],
+			JVMVendor:        names.jvmVendors[ir.JVMVendorID].Vendor,
+			JVMName:          names.jvmVendors[ir.JVMVendorID].Name,
+			ServletContainer: names.servletContainers[ir.ServletContainerID],
+			Executors:        int32(ir.Executors),
+			Plugins:          make([]ExportPlugin, 0, len(plugins)),
+			Jobs:             namedCounts(jobs, names.jobTypes),
+			Nodes:            namedCounts(nodes, names.osTypes),
+			AgentJVMs:        namedCounts(agentJVMs, names.jvmVersions),
+		}
+		if opts.HashInstanceIDs {
+			mac.Reset()
+			_, _ = mac.Write([]byte(ir.InstanceID))
+			row.InstanceID = hex.EncodeToString(mac.Sum(nil))
+		}
+		for _, id := range plugins {
+			p := names.plugins[uint64(id)]
+			row.Plugins = append(row.Plugins, ExportPlugin{Name: p.Name, Version: p.Version})
+		}
+
+		batch = append(batch, row)
+		if len(batch) == exportBatchSize {
+			if err := flush(); err != nil {
+				return total, err
+			}
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return total, err
+	}
+	if err := flush(); err != nil {
+		return total, err
+	}
+
+	return total, pw.Close()
+}
+
+type exportNames struct {
+	jenkinsVersions   map[uint64]string
+	jvmVersions       map[uint64]string
+	jvmVendors        map[uint64]JVMVendor
+	servletContainers map[uint64]string
+	osTypes           map[uint64]string
+	jobTypes          map[uint64]string
+	plugins           map[uint64]Plugin
+}
+
+func loadExportNames(db sq.BaseRunner) (*exportNames, error) {
+	var err error
+	names := &exportNames{}
+
+	if names.jenkinsVersions, err = idToNameMap(db, JenkinsVersionsTable, "version"); err != nil {
+		return nil, err
+	}
+	if names.jvmVersions, err = idToNameMap(db, JVMVersionsTable, "name"); err != nil {
+		return nil, err
+	}
+	if names.servletContainers, err = idToNameMap(db, ServletContainersTable, "name"); err != nil {
+		return nil, err
+	}
+	if names.osTypes, err = idToNameMap(db, OSTypesTable, "name"); err != nil {
+		return nil, err
+	}
+	if names.jobTypes, err = idToNameMap(db, JobTypesTable, "name"); err != nil {
+		return nil, err
+	}
+	if names.plugins, err = pluginIDsToPlugin(db); err != nil {
+		return nil, err
+	}
+
+	names.jvmVendors = make(map[uint64]JVMVendor)
+	rows, err := PSQL(db).Select("id", "vendor", "name").From(JVMVendorsTable).Query()
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = rows.Close()
+	}()
+	for rows.Next() {
+		var v JVMVendor
+		if err := rows.Scan(&v.ID, &v.Vendor, &v.Name); err != nil {
+			return nil, err
+		}
+		names.jvmVendors[v.ID] = v
+	}
+
+	return names, rows.Err()
+}
+
+// idToNameMap returns a map of IDs to the value of the given column for a lookup table
+func idToNameMap(db sq.BaseRunner, table, column string) (map[uint64]string, error) {
+	rows, err := PSQL(db).Select("id", column).From(table).Query()
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = rows.Close()
+	}()
+
+	m := make(map[uint64]string)
+	for rows.Next() {
+		var id uint64
+		var name string
+		if err := rows.Scan(&id, &name); err != nil {
+			return nil, err
+		}
+		m[id] = name
+	}
+
+	return m, rows.Err()
+}
+
+func namedCounts(counts map[uint64]uint64, names map[uint64]string) map[string]int64 {
+	named := make(map[string]int64, len(counts))
+	for id, c := range counts {
+		named[names[id]] += int64(c)
+	}
+	return named
+}
@@ -0,0 +1,207 @@
+package stats
+
+import (
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+
+	sq "github.com/Masterminds/squirrel"
+)
+
+const (
+	// UnknownFieldsTable is the unknown_fields table name
+	UnknownFieldsTable = "unknown_fields"
+	// ReportDaysTable is the report_days table name
+	ReportDaysTable = "report_days"
+
+	// FieldScopeReport is the scope of fields at the top level of a report
+	FieldScopeReport = "report"
+	// FieldScopeNode is the scope of fields on a node in a report
+	FieldScopeNode = "node"
+
+	fieldDayLayout = "2006-01-02"
+)
+
+var (
+	// knownReportFields also has "stat", which every report has, set to 1, and which we don't use
+	knownReportFields = jsonFieldNames(reflect.TypeOf(JSONReport{}), "stat")
+	knownNodeFields   = jsonFieldNames(reflect.TypeOf(JSONNode{}))
+)
+
+// ReportField is a field in a report, either at the top level or on a node
+type ReportField struct {
+	Scope string
+	Name  string
+}
+
+// FieldCounts counts the reports seen each day, and how many of them had each unknown field
+type FieldCounts struct {
+	location *time.Location
+	reports  map[string]uint64
+	fields   map[string]map[ReportField]uint64
+}
+
+// FieldSummary is how often an unknown field was seen over a range of days
+type FieldSummary struct {
+	Scope     string `json:"scope"`
+	Name      string `json:"name"`
+	FirstSeen string `json:"firstSeen"`
+	LastSeen  string `json:"lastSeen"`
+	Days      int    `json:"days"`
+	Reports   uint64 `json:"reports"`
+	// Percent is the percentage of all reports on the days the field was seen which had the field
+	Percent float64 `json:"percent"`
+}
+
+// NewFieldCounts returns an empty FieldCounts, for days starting at midnight in loc
+func NewFieldCounts(loc *time.Location) *FieldCounts {
+	return &FieldCounts{
+		location: reportingLocation(loc),
+		reports:  map[string]uint64{},
+		fields:   map[string]map[ReportField]uint64{},
+	}
+}
+
+// Add counts a report, and its unknown fields, on the day of its timestamp in the reporting timezone given to
+// NewFieldCounts. Reports without a
+// valid timestamp are ignored.
+func (fc *FieldCounts) Add(r *JSONReport) {
+	ts, err := r.Timestamp()
+	if err != nil {
+		return
+	}
+	day := ts.In(fc.location).Format(fieldDayLayout)
+	fc.reports[day]++
+	if len(r.UnknownFields) == 0 {
+		return
+	}
+	if fc.fields[day] == nil {
+		fc.fields[day] = map[ReportField]uint64{}
+	}
+	for _, f := range r.UnknownFields {
+		fc.fields[day][f]++
+	}
+}
+
+// Save adds the counts to the report_days and unknown_fields tables
+func (fc *FieldCounts) Save(db sq.BaseRunner) error {
+	for day, count := range fc.reports {
+		_, err := PSQL(db).Insert(ReportDaysTable).
+			Columns("day", "reports").
+			Values(day, count).
+			Suffix("on conflict (day) do update set reports = " + ReportDaysTable + ".reports + excluded.reports").
+			Exec()
+		if err != nil {
+			return err
+		}
+	}
+	for day, fields := range fc.fields {
+		for f, count := range fields {
+			_, err := PSQL(db).Insert(UnknownFieldsTable).
+				Columns("day", "scope", "name", "reports").
+				Values(day, f.Scope, f.Name, count).
+				Suffix("on conflict (day, scope, name) do update set reports = " + UnknownFieldsTable + ".reports + excluded.reports").
+				Exec()
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// UnknownFieldsReport summarizes the unknown fields seen between two days, inclusive, most common first
+func UnknownFieldsReport(db sq.BaseRunner, start, end time.Time) ([]FieldSummary, error) {
+	rows, err := PSQL(db).Select("uf.scope", "uf.name", "min(uf.day)", "max(uf.day)", "count(*)", "sum(uf.reports)", "sum(rd.reports)").
+		From(UnknownFieldsTable+" as uf").
+		LeftJoin(ReportDaysTable+" as rd on rd.day = uf.day").
+		Where(sq.GtOrEq{"uf.day": start.Format(fieldDayLayout)}).
+		Where(sq.LtOrEq{"uf.day": end.Format(fieldDayLayout)}).
+		GroupBy("uf.scope", "uf.name").
+		Query()
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = rows.Close()
+	}()
+
+	var summaries []FieldSummary
+	for rows.Next() {
+		var s FieldSummary
+		var first, last time.Time
+		var dayReports *uint64
+		if err := rows.Scan(&s.Scope, &s.Name, &first, &last, &s.Days, &s.Reports, &dayReports); err != nil {
+			return nil, err
+		}
+		s.FirstSeen = first.Format(fieldDayLayout)
+		s.LastSeen = last.Format(fieldDayLayout)
+		if dayReports != nil && *dayReports > 0 {
+			s.Percent = float64(s.Reports) * 100 / float64(*dayReports)
+		}
+		summaries = append(summaries, s)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	sort.Slice(summaries, func(i, j int) bool {
+		if summaries[i].Reports != summaries[j].Reports {
+			return summaries[i].Reports > summaries[j].Reports
+		}
+		if summaries[i].Scope != summaries[j].Scope {
+			return summaries[i].Scope < summaries[j].Scope
+		}
+		return summaries[i].Name < summaries[j].Name
+	})
+
+	return summaries, nil
+}
+
+// unknownFields finds the fields in a parsed report, and on its nodes, which aren't in JSONReport or JSONNode
+func unknownFields(top map[string]interface{}) []ReportField {
+	var fields []ReportField
+	for k := range top {
+		if !knownReportFields[k] {
+			fields = append(fields, ReportField{Scope: FieldScopeReport, Name: k})
+		}
+	}
+
+	// Nodes which aren't objects will already have failed schema validation, so there's nothing to find.
+	nodes, _ := top["nodes"].([]interface{})
+	seen := map[string]bool{}
+	for _, n := range nodes {
+		node, _ := n.(map[string]interface{})
+		for k := range node {
+			if !knownNodeFields[k] && !seen[k] {
+				seen[k] = true
+				fields = append(fields, ReportField{Scope: FieldScopeNode, Name: k})
+			}
+		}
+	}
+
+	sort.Slice(fields, func(i, j int) bool {
+		if fields[i].Scope != fields[j].Scope {
+			return fields[i].Scope > fields[j].Scope
+		}
+		return fields[i].Name < fields[j].Name
+	})
+	return fields
+}
+
+// jsonFieldNames returns the names of the JSON fields of a struct type, plus any extra names
+func jsonFieldNames(t reflect.Type, extra ...string) map[string]bool {
+	names := map[string]bool{}
+	for _, name := range extra {
+		names[name] = true
+	}
+	for i := 0; i < t.NumField(); i++ {
+		tag := t.Field(i).Tag.Get("json")
+		name := strings.Split(tag, ",")[0]
+		if name != "" && name != "-" {
+			names[name] = true
+		}
+	}
+	return names
+}
@@ -0,0 +1,51 @@
+package stats_test
+
+import (
+	"testing"
+	"time"
+
+	stats "github.com/jenkins-infra/jenkins-usage-stats"
+	"github.com/jenkins-infra/jenkins-usage-stats/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestUnknownFieldsReport(t *testing.T) {
+	db, closeFunc := testutil.DBForTest(t)
+	defer closeFunc()
+
+	formats, err := stats.DefaultReportFormats()
+	require.NoError(t, err)
+
+	raw := []string{
+		`{"install":"a","timestamp":"30/Oct/2021:10:00:00 +0000","version":"2.303.1","newField":1,"nodes":[{"master":true,"newNodeField":1},{"newNodeField":2}]}`,
+		`{"install":"b","timestamp":"30/Oct/2021:11:00:00 +0000","version":"2.303.1","newField":2}`,
+		`{"install":"c","timestamp":"30/Oct/2021:12:00:00 +0000","version":"2.303.1"}`,
+		`{"install":"d","timestamp":"30/Oct/2021:13:00:00 +0000","version":"2.303.1"}`,
+		`{"install":"a","timestamp":"31/Oct/2021:10:00:00 +0000","version":"2.303.1","newField":1}`,
+	}
+
+	// Save the counts in two batches, as two imported files would be.
+	for _, batch := range [][]string{raw[:2], raw[2:]} {
+		fc := stats.NewFieldCounts(nil)
+		for _, line := range batch {
+			r, _, err := formats.Decode([]byte(line))
+			require.NoError(t, err)
+			fc.Add(r)
+		}
+		require.NoError(t, fc.Save(db))
+	}
+
+	summaries, err := stats.UnknownFieldsReport(db, time.Date(2021, time.October, 1, 0, 0, 0, 0, time.UTC), time.Date(2021, time.October, 31, 0, 0, 0, 0, time.UTC))
+	require.NoError(t, err)
+	assert.Equal(t, []stats.FieldSummary{
+		{Scope: stats.FieldScopeReport, Name: "newField", FirstSeen: "2021-10-30", LastSeen: "2021-10-31", Days: 2, Reports: 3, Percent: 60},
+		{Scope: stats.FieldScopeNode, Name: "newNodeField", FirstSeen: "2021-10-30", LastSeen: "2021-10-30", Days: 1, Reports: 1, Percent: 25},
+	}, summaries)
+
+	summaries, err = stats.UnknownFieldsReport(db, time.Date(2021, time.October, 31, 0, 0, 0, 0, time.UTC), time.Date(2021, time.October, 31, 0, 0, 0, 0, time.UTC))
+	require.NoError(t, err)
+	require.Len(t, summaries, 1)
+	assert.Equal(t, uint64(1), summaries[0].Reports)
+	assert.Equal(t, float64(100), summaries[0].Percent)
+}
@@ -0,0 +1,292 @@
+package stats
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	sq "github.com/Masterminds/squirrel"
+)
+
+const (
+	// ReportSnapshotsTable is the report_snapshots table name
+	ReportSnapshotsTable = "report_snapshots"
+	// ReportSnapshotAggregatesTable is the report_snapshot_aggregates table name
+	ReportSnapshotAggregatesTable = "report_snapshot_aggregates"
+
+	// AggregateJenkinsVersions is the number of instances running each Jenkins version
+	AggregateJenkinsVersions = "jenkins-versions"
+	// AggregatePlugins is the number of instances with each plugin installed
+	AggregatePlugins = "plugins"
+	// AggregateNodes is the number of nodes running each OS
+	AggregateNodes = "nodes"
+	// AggregateJobs is the number of jobs of each type
+	AggregateJobs = "jobs"
+	// AggregateExecutors is the number of instances with each number of executors
+	AggregateExecutors = "executors"
+)
+
+// Aggregates are the names of the aggregates stored in a snapshot, in the order they're compared
+var Aggregates = []string{AggregateJenkinsVersions, AggregatePlugins, AggregateNodes, AggregateJobs, AggregateExecutors}
+
+// MonthlyAggregates are the numbers for a month which its point-in-time reports and charts are generated from
+type MonthlyAggregates struct {
+	JenkinsVersions map[string]uint64
+	Plugins         map[string]uint64
+	Nodes           map[string]uint64
+	Jobs            map[string]uint64
+	Executors       map[string]uint64
+}
+
+// ReportSnapshot is a version of a month's aggregates frozen by FreezeMonth
+type ReportSnapshot struct {
+	Year     int
+	Month    int
+	Version  int
+	FrozenAt time.Time
+	Note     string
+	// ExcludeQuarantined is whether quarantined instances were left out of the aggregates
+	ExcludeQuarantined bool
+	// Timezone is the name of the timezone reporting periods started at midnight in, or empty for snapshots frozen
+	// before it was recorded
+	Timezone string
+}
+
+// AggregateDiff is a count which differs between a month's frozen and recomputed aggregates
+type AggregateDiff struct {
+	Aggregate  string `json:"aggregate"`
+	Key        string `json:"key"`
+	Frozen     uint64 `json:"frozen"`
+	Recomputed uint64 `json:"recomputed"`
+}
+
+func (ma *MonthlyAggregates) byName() map[string]*map[string]uint64 {
+	return map[string]*map[string]uint64{
+		AggregateJenkinsVersions: &ma.JenkinsVersions,
+		AggregatePlugins:         &ma.Plugins,
+		AggregateNodes:           &ma.Nodes,
+		AggregateJobs:            &ma.Jobs,
+		AggregateExecutors:       &ma.Executors,
+	}
+}
+
+// ComputeMonthlyAggregates computes a month's aggregates from the instance reports
+func ComputeMonthlyAggregates(db sq.BaseRunner, co CountOptions, year, month int) (*MonthlyAggregates, error) {
+	ma := &MonthlyAggregates{}
+
+	ir, err := GetInstallCountForVersions(db, co, year, month)
+	if err != nil {
+		return nil, err
+	}
+	ma.JenkinsVersions = ir.Installations
+
+	pr, err := GetLatestPluginNumbers(db, co, year, month)
+	if err != nil {
+		return nil, err
+	}
+	ma.Plugins = pr.Plugins
+
+	if ma.Nodes, err = OSCountsForMonth(db, co, year, month); err != nil {
+		return nil, err
+	}
+	if ma.Jobs, err = JobCountsForMonth(db, co, year, month); err != nil {
+		return nil, err
+	}
+	if ma.Executors, err = ExecutorCountsForMonth(db, co, year, month); err != nil {
+		return nil, err
+	}
+
+	return ma, nil
+}
+
+// FreezeMonth computes a month's aggregates and stores them as a new snapshot version, along with whether quarantined
+// instances are excluded and the reporting timezone, returning the version
+func FreezeMonth(db sq.BaseRunner, co CountOptions, year, month int, note string) (int, error) {
+	ma, err := ComputeMonthlyAggregates(db, co, year, month)
+	if err != nil {
+		return 0, err
+	}
+
+	var version int
+	err = PSQL(db).Select("coalesce(max(version), 0) + 1").
+		From(ReportSnapshotsTable).
+		Where(sq.Eq{"year": year, "month": month}).
+		QueryRow().
+		Scan(&version)
+	if err != nil {
+		return 0, err
+	}
+
+	_, err = PSQL(db).Insert(ReportSnapshotsTable).
+		Columns("year", "month", "version", "frozen_at", "note", "exclude_quarantined", "timezone").
+		Values(year, month, version, time.Now().UTC(), note, co.ExcludeQuarantined, ReportingTimezoneName(co.Location)).
+		Exec()
+	if err != nil {
+		return 0, err
+	}
+
+	byName := ma.byName()
+	for _, name := range Aggregates {
+		counts, err := json.Marshal(*byName[name])
+		if err != nil {
+			return 0, err
+		}
+		_, err = PSQL(db).Insert(ReportSnapshotAggregatesTable).
+			Columns("year", "month", "version", "aggregate", "counts").
+			Values(year, month, version, name, counts).
+			Exec()
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	return version, nil
+}
+
+// ReportSnapshots lists the frozen snapshots, ordered by month and version
+func ReportSnapshots(db sq.BaseRunner) ([]ReportSnapshot, error) {
+	rows, err := PSQL(db).Select("year", "month", "version", "frozen_at", "coalesce(note, '')", "exclude_quarantined",
+		"coalesce(timezone, '')").
+		From(ReportSnapshotsTable).
+		OrderBy("year", "month", "version").
+		Query()
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = rows.Close()
+	}()
+
+	var snapshots []ReportSnapshot
+	for rows.Next() {
+		var s ReportSnapshot
+		if err := rows.Scan(&s.Year, &s.Month, &s.Version, &s.FrozenAt, &s.Note, &s.ExcludeQuarantined, &s.Timezone); err != nil {
+			return nil, err
+		}
+		snapshots = append(snapshots, s)
+	}
+	return snapshots, rows.Err()
+}
+
+// GetFrozenMonth gets a version of a month's frozen aggregates, or the latest version if version is 0. If the month
+// hasn't been frozen, nil is returned. An error is returned if the snapshot was frozen with quarantined instances
+// excluded when co includes them, or the other way round, or in a different reporting timezone, since its numbers
+// would then be mixed with ones counted differently.
+func GetFrozenMonth(db sq.BaseRunner, co CountOptions, year, month, version int) (*MonthlyAggregates, error) {
+	query := PSQL(db).Select("version", "exclude_quarantined", "coalesce(timezone, '')").
+		From(ReportSnapshotsTable).
+		Where(sq.Eq{"year": year, "month": month})
+	if version == 0 {
+		query = query.OrderBy("version desc").Limit(1)
+	} else {
+		query = query.Where(sq.Eq{"version": version})
+	}
+	var exclude bool
+	var timezone string
+	err := query.QueryRow().Scan(&version, &exclude, &timezone)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if exclude != co.ExcludeQuarantined {
+		with := "without"
+		if exclude {
+			with = "with"
+		}
+		return nil, fmt.Errorf("snapshot %d of %04d-%02d was frozen %s --exclude-quarantined, so pass the same setting to use it",
+			version, year, month, with)
+	}
+	if timezone != "" && timezone != ReportingTimezoneName(co.Location) {
+		return nil, fmt.Errorf("snapshot %d of %04d-%02d was frozen with reporting periods starting at midnight in %s, not %s",
+			version, year, month, timezone, ReportingTimezoneName(co.Location))
+	}
+
+	rows, err := PSQL(db).Select("aggregate", "counts").
+		From(ReportSnapshotAggregatesTable).
+		Where(sq.Eq{"year": year, "month": month, "version": version}).
+		Query()
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = rows.Close()
+	}()
+
+	ma := &MonthlyAggregates{}
+	byName := ma.byName()
+	found := false
+	for rows.Next() {
+		var name string
+		var counts []byte
+		if err := rows.Scan(&name, &counts); err != nil {
+			return nil, err
+		}
+		dest, ok := byName[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown aggregate %s in snapshot %d of %04d-%02d", name, version, year, month)
+		}
+		if err := json.Unmarshal(counts, dest); err != nil {
+			return nil, err
+		}
+		found = true
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	if !found {
+		return nil, nil
+	}
+
+	for _, dest := range byName {
+		if *dest == nil {
+			*dest = map[string]uint64{}
+		}
+	}
+	return ma, nil
+}
+
+// DiffMonthlyAggregates returns the counts which differ between frozen and recomputed aggregates, ordered by aggregate
+// and key. Keys missing from one side count as 0.
+func DiffMonthlyAggregates(frozen, recomputed *MonthlyAggregates) []AggregateDiff {
+	diffs := []AggregateDiff{}
+	frozenByName, recomputedByName := frozen.byName(), recomputed.byName()
+	for _, name := range Aggregates {
+		f, r := *frozenByName[name], *recomputedByName[name]
+		keys := make(map[string]bool)
+		for k := range f {
+			keys[k] = true
+		}
+		for k := range r {
+			keys[k] = true
+		}
+
+		var aggregateDiffs []AggregateDiff
+		for k := range keys {
+			if f[k] != r[k] {
+				aggregateDiffs = append(aggregateDiffs, AggregateDiff{Aggregate: name, Key: k, Frozen: f[k], Recomputed: r[k]})
+			}
+		}
+		sort.Slice(aggregateDiffs, func(i, j int) bool {
+			return aggregateDiffs[i].Key < aggregateDiffs[j].Key
+		})
+		diffs = append(diffs, aggregateDiffs...)
+	}
+	return diffs
+}
+
+// monthlyAggregatesForReport gets a month's aggregates from its latest snapshot if useFrozen is set and it's been
+// frozen, and computes them otherwise
+func monthlyAggregatesForReport(db sq.BaseRunner, co CountOptions, year, month int, useFrozen bool) (*MonthlyAggregates, error) {
+	if useFrozen {
+		ma, err := GetFrozenMonth(db, co, year, month, 0)
+		if err != nil || ma != nil {
+			return ma, err
+		}
+	}
+	return ComputeMonthlyAggregates(db, co, year, month)
+}
@@ -0,0 +1,107 @@
+package stats_test
+
+import (
+	"testing"
+
+	stats "github.com/jenkins-infra/jenkins-usage-stats"
+	"github.com/jenkins-infra/jenkins-usage-stats/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDiffMonthlyAggregates(t *testing.T) {
+	frozen := &stats.MonthlyAggregates{
+		JenkinsVersions: map[string]uint64{"2.303.1": 10, "2.303.2": 5},
+		Plugins:         map[string]uint64{"git": 12},
+		Nodes:           map[string]uint64{"Linux": 20},
+		Jobs:            map[string]uint64{},
+		Executors:       map[string]uint64{"2": 15},
+	}
+	recomputed := &stats.MonthlyAggregates{
+		JenkinsVersions: map[string]uint64{"2.303.1": 11, "2.303.2": 5, "2.304": 1},
+		Plugins:         map[string]uint64{"git": 12},
+		Nodes:           map[string]uint64{"Linux": 20},
+		Jobs:            map[string]uint64{},
+		Executors:       map[string]uint64{},
+	}
+
+	assert.Equal(t, []stats.AggregateDiff{
+		{Aggregate: stats.AggregateJenkinsVersions, Key: "2.303.1", Frozen: 10, Recomputed: 11},
+		{Aggregate: stats.AggregateJenkinsVersions, Key: "2.304", Frozen: 0, Recomputed: 1},
+		{Aggregate: stats.AggregateExecutors, Key: "2", Frozen: 15, Recomputed: 0},
+	}, stats.DiffMonthlyAggregates(frozen, recomputed))
+	assert.Empty(t, stats.DiffMonthlyAggregates(frozen, frozen))
+}
+
+func TestFreezeMonth(t *testing.T) {
+	db, closeFunc := testutil.DBForTest(t)
+	defer closeFunc()
+
+	cache := stats.NewStatsCache()
+	for day := 1; day <= 2; day++ {
+		require.NoError(t, stats.AddIndividualReport(db, cache, testReport("a", day, "2.303.1", "Linux", "git")))
+		require.NoError(t, stats.AddIndividualReport(db, cache, testReport("b", day, "2.303.1", "Linux")))
+	}
+
+	frozen, err := stats.GetFrozenMonth(db, stats.CountOptions{}, 2022, 6, 0)
+	require.NoError(t, err)
+	assert.Nil(t, frozen)
+
+	version, err := stats.FreezeMonth(db, stats.CountOptions{}, 2022, 6, "published")
+	require.NoError(t, err)
+	assert.Equal(t, 1, version)
+
+	// A late report changes the recomputed numbers, but not the frozen ones.
+	require.NoError(t, stats.AddIndividualReport(db, cache, testReport("b", 3, "2.303.2", "Linux", "git")))
+
+	frozen, err = stats.GetFrozenMonth(db, stats.CountOptions{}, 2022, 6, 0)
+	require.NoError(t, err)
+	require.NotNil(t, frozen)
+	assert.Equal(t, map[string]uint64{"2.303.1": 2}, frozen.JenkinsVersions)
+	assert.Equal(t, map[string]uint64{"git": 1}, frozen.Plugins)
+	assert.Equal(t, map[string]uint64{"Linux": 2}, frozen.Nodes)
+
+	recomputed, err := stats.ComputeMonthlyAggregates(db, stats.CountOptions{}, 2022, 6)
+	require.NoError(t, err)
+	assert.Equal(t, []stats.AggregateDiff{
+		{Aggregate: stats.AggregateJenkinsVersions, Key: "2.303.1", Frozen: 2, Recomputed: 1},
+		{Aggregate: stats.AggregateJenkinsVersions, Key: "2.303.2", Frozen: 0, Recomputed: 1},
+		{Aggregate: stats.AggregatePlugins, Key: "git", Frozen: 1, Recomputed: 2},
+	}, stats.DiffMonthlyAggregates(frozen, recomputed))
+
+	version, err = stats.FreezeMonth(db, stats.CountOptions{}, 2022, 6, "")
+	require.NoError(t, err)
+	assert.Equal(t, 2, version)
+
+	latest, err := stats.GetFrozenMonth(db, stats.CountOptions{}, 2022, 6, 0)
+	require.NoError(t, err)
+	assert.Empty(t, stats.DiffMonthlyAggregates(latest, recomputed))
+	first, err := stats.GetFrozenMonth(db, stats.CountOptions{}, 2022, 6, 1)
+	require.NoError(t, err)
+	assert.Equal(t, frozen, first)
+
+	snapshots, err := stats.ReportSnapshots(db)
+	require.NoError(t, err)
+	require.Len(t, snapshots, 2)
+	assert.Equal(t, "published", snapshots[0].Note)
+	assert.False(t, snapshots[0].ExcludeQuarantined)
+	assert.Equal(t, "UTC", snapshots[0].Timezone)
+
+	// Snapshots can't be used with different settings to the ones they were frozen with.
+	excludeQuarantined := stats.CountOptions{ExcludeQuarantined: true}
+	_, err = stats.GetFrozenMonth(db, excludeQuarantined, 2022, 6, 0)
+	assert.EqualError(t, err, "snapshot 2 of 2022-06 was frozen without --exclude-quarantined, so pass the same setting to use it")
+
+	version, err = stats.FreezeMonth(db, excludeQuarantined, 2022, 6, "")
+	require.NoError(t, err)
+	excluded, err := stats.GetFrozenMonth(db, excludeQuarantined, 2022, 6, version)
+	require.NoError(t, err)
+	assert.Equal(t, latest, excluded)
+	_, err = stats.GetFrozenMonth(db, stats.CountOptions{}, 2022, 6, version)
+	assert.EqualError(t, err, "snapshot 3 of 2022-06 was frozen with --exclude-quarantined, so pass the same setting to use it")
+
+	legacy, err := stats.ParseReportingTimezone(stats.LegacyReportingTimezone)
+	require.NoError(t, err)
+	_, err = stats.GetFrozenMonth(db, stats.CountOptions{Location: legacy}, 2022, 6, 1)
+	assert.EqualError(t, err, "snapshot 1 of 2022-06 was frozen with reporting periods starting at midnight in UTC, not -0800")
+}
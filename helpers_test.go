@@ -0,0 +1,23 @@
+package stats_test
+
+import (
+	"fmt"
+
+	stats "github.com/jenkins-infra/jenkins-usage-stats"
+)
+
+// testReport returns a report for an instance on a day in June 2022, with one job, a controller on the OS, and the
+// plugins at version 1.0
+func testReport(install string, day int, version, os string, plugins ...string) *stats.JSONReport {
+	r := &stats.JSONReport{
+		Install:         install,
+		Jobs:            map[string]uint64{"hudson-model-FreeStyleProject": 1},
+		Nodes:           []stats.JSONNode{{IsController: true, OS: os, JVMVersion: "11.0.13", Executors: 2}},
+		TimestampString: fmt.Sprintf("%02d/Jun/2022:12:00:00 +0000", day),
+		Version:         version,
+	}
+	for _, p := range plugins {
+		r.Plugins = append(r.Plugins, stats.JSONPlugin{Name: p, Version: "1.0"})
+	}
+	return r
+}
@@ -0,0 +1,263 @@
+package stats
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+
+	sq "github.com/Masterminds/squirrel"
+	"github.com/lib/pq"
+)
+
+const (
+	// InstanceReportHistoryTable is the instance_report_history table name. It's partitioned by month of report time,
+	// in UTC, with partitions created as needed.
+	InstanceReportHistoryTable = "instance_report_history"
+
+	historyPartitionLayout = "2006_01"
+)
+
+// HistoryEntry is a state of an instance, from the first report in that state until the last one before it changed
+type HistoryEntry struct {
+	InstanceID     string    `json:"instanceId"`
+	ReportTime     time.Time `json:"reportTime"`
+	LastReportTime time.Time `json:"lastReportTime"`
+	// Reports is the number of reports in this state
+	Reports        int      `json:"reports"`
+	JenkinsVersion string   `json:"jenkinsVersion"`
+	JVMVersion     string   `json:"jvmVersion"`
+	Executors      uint64   `json:"executors"`
+	Plugins        []string `json:"plugins"`
+}
+
+// addHistoryReport appends a report to the instance's history, or extends its latest history entry if nothing's
+// changed. Reports which aren't newer than the latest history entry are ignored.
+func addHistoryReport(db sq.BaseRunner, report *InstanceReport) error {
+	if err := ensureHistoryPartition(db, report.ReportTime); err != nil {
+		return err
+	}
+
+	rows, err := PSQL(db).Select("report_time", "last_report_time", "version", "jvm_version_id", "executors", "plugins", "nodes").
+		From(InstanceReportHistoryTable).
+		Where(sq.Eq{"instance_id": report.InstanceID}).
+		OrderBy("report_time desc").
+		Limit(1).
+		Query()
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = rows.Close()
+	}()
+
+	var prev *InstanceReport
+	var prevLastReportTime time.Time
+	for rows.Next() {
+		prev = &InstanceReport{Nodes: &NodesForReport{}}
+		if err := rows.Scan(&prev.ReportTime, &prevLastReportTime, &prev.Version, &prev.JVMVersionID, &prev.Executors, &prev.Plugins, prev.Nodes); err != nil {
+			return err
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	if prev != nil && !report.ReportTime.After(prevLastReportTime) {
+		return nil
+	}
+
+	if prev != nil && sameHistoryState(prev, report) {
+		_, err = PSQL(db).Update(InstanceReportHistoryTable).
+			Set("last_report_time", report.ReportTime).
+			Set("reports", sq.Expr("reports + 1")).
+			Where(sq.Eq{"instance_id": report.InstanceID, "report_time": prev.ReportTime}).
+			Exec()
+		return err
+	}
+
+	_, err = PSQL(db).Insert(InstanceReportHistoryTable).
+		Columns("instance_id", "report_time", "last_report_time", "version", "jvm_version_id", "executors", "plugins", "nodes").
+		Values(report.InstanceID, report.ReportTime, report.ReportTime, report.Version, report.JVMVersionID, report.Executors, report.Plugins, report.Nodes).
+		Exec()
+	return err
+}
+
+// sameHistoryState checks whether two reports have the same Jenkins version, JVM version, executors, plugins and nodes
+func sameHistoryState(a, b *InstanceReport) bool {
+	if a.Version != b.Version || a.JVMVersionID != b.JVMVersionID || a.Executors != b.Executors {
+		return false
+	}
+	if !reflect.DeepEqual(sortedIDs(a.Plugins), sortedIDs(b.Plugins)) {
+		return false
+	}
+	var aNodes, bNodes NodesForReport
+	if a.Nodes != nil {
+		aNodes = *a.Nodes
+	}
+	if b.Nodes != nil {
+		bNodes = *b.Nodes
+	}
+	if len(aNodes) != len(bNodes) {
+		return false
+	}
+	for osType, count := range aNodes {
+		if bNodes[osType] != count {
+			return false
+		}
+	}
+	return true
+}
+
+func sortedIDs(ids pq.Int64Array) []int64 {
+	sorted := append([]int64{}, ids...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	return sorted
+}
+
+// ensureHistoryPartition creates the partition of instance_report_history for the month of the time, if it doesn't
+// exist yet. Whether it exists is checked in the database every time, rather than cached, since PruneReportHistory can
+// drop it while a long running ingest server is still adding late reports for its month.
+func ensureHistoryPartition(db sq.BaseRunner, t time.Time) error {
+	start := time.Date(t.UTC().Year(), t.UTC().Month(), 1, 0, 0, 0, 0, time.UTC)
+	name := InstanceReportHistoryTable + "_" + start.Format(historyPartitionLayout)
+
+	var exists bool
+	if err := PSQL(db).Select("to_regclass(?) is not null", name).QueryRow().Scan(&exists); err != nil {
+		return err
+	}
+	if exists {
+		return nil
+	}
+
+	_, err := db.Exec(fmt.Sprintf("create table if not exists %s partition of %s for values from ('%s') to ('%s')",
+		name, InstanceReportHistoryTable, start.Format(time.RFC3339), start.AddDate(0, 1, 0).Format(time.RFC3339)))
+	return err
+}
+
+// ReportHistoryPartitions returns the names of the partitions of instance_report_history, oldest first
+func ReportHistoryPartitions(db sq.BaseRunner) ([]string, error) {
+	rows, err := PSQL(db).Select("c.relname").
+		From("pg_inherits i").
+		Join("pg_class c on c.oid = i.inhrelid").
+		Join("pg_class p on p.oid = i.inhparent").
+		Where(sq.Eq{"p.relname": InstanceReportHistoryTable}).
+		OrderBy("c.relname").
+		Query()
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = rows.Close()
+	}()
+
+	var partitions []string
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return nil, err
+		}
+		partitions = append(partitions, name)
+	}
+	return partitions, rows.Err()
+}
+
+// HistoryPrune is what PruneReportHistory removed, or would remove
+type HistoryPrune struct {
+	// Dropped are the partitions which were dropped, since all of their entries ended before the retention period
+	Dropped []string
+	// Trimmed are the partitions which still have entries which were current during the retention period, so only the
+	// entries which ended before it were deleted
+	Trimmed []string
+	// Entries is the number of entries deleted, including those in dropped partitions
+	Entries int64
+}
+
+// PruneReportHistory deletes the instance_report_history entries whose last report was before the most recent
+// retentionMonths months, counting the month of now. Entries which started before then but are still current, such as
+// an instance which hasn't changed for years, are kept, so the instance's current state isn't lost. Partitions from
+// before the retention period are dropped once all of their entries have ended before it. With dryRun, nothing is
+// deleted, and what would be is returned.
+func PruneReportHistory(db sq.BaseRunner, retentionMonths int, now time.Time, dryRun bool) (HistoryPrune, error) {
+	var result HistoryPrune
+	if retentionMonths < 1 {
+		return result, fmt.Errorf("history must be kept for at least one month")
+	}
+	cutoff := time.Date(now.UTC().Year(), now.UTC().Month(), 1, 0, 0, 0, 0, time.UTC).AddDate(0, -(retentionMonths - 1), 0)
+
+	partitions, err := ReportHistoryPartitions(db)
+	if err != nil {
+		return result, err
+	}
+
+	for _, name := range partitions {
+		start, err := time.Parse(historyPartitionLayout, strings.TrimPrefix(name, InstanceReportHistoryTable+"_"))
+		if err != nil || !start.Before(cutoff) {
+			continue
+		}
+
+		var ended, current int64
+		err = PSQL(db).Select().
+			Column(sq.Expr("count(*) filter (where last_report_time < ?)", cutoff)).
+			Column(sq.Expr("count(*) filter (where last_report_time >= ?)", cutoff)).
+			From(name).
+			QueryRow().
+			Scan(&ended, &current)
+		if err != nil {
+			return result, err
+		}
+		result.Entries += ended
+
+		if current == 0 {
+			if !dryRun {
+				if _, err := db.Exec("drop table " + name); err != nil {
+					return result, err
+				}
+			}
+			result.Dropped = append(result.Dropped, name)
+			continue
+		}
+		if ended == 0 {
+			continue
+		}
+		if !dryRun {
+			if _, err := PSQL(db).Delete(name).Where(sq.Lt{"last_report_time": cutoff}).Exec(); err != nil {
+				return result, err
+			}
+		}
+		result.Trimmed = append(result.Trimmed, name)
+	}
+	return result, nil
+}
+
+// GetInstanceHistory returns the history of an instance, oldest first
+func GetInstanceHistory(db sq.BaseRunner, instanceID string) ([]HistoryEntry, error) {
+	rows, err := PSQL(db).Select("h.report_time", "h.last_report_time", "h.reports", "coalesce(jv.version, '')", "coalesce(jvm.name, '')",
+		"h.executors", "array(select p.name || ':' || p.version from "+PluginsTable+" p where p.id = any(h.plugins) order by 1)").
+		From(InstanceReportHistoryTable + " h").
+		LeftJoin(JenkinsVersionsTable + " jv on jv.id = h.version").
+		LeftJoin(JVMVersionsTable + " jvm on jvm.id = h.jvm_version_id").
+		Where(sq.Eq{"h.instance_id": instanceID}).
+		OrderBy("h.report_time").
+		Query()
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = rows.Close()
+	}()
+
+	var history []HistoryEntry
+	for rows.Next() {
+		entry := HistoryEntry{InstanceID: instanceID}
+		var plugins pq.StringArray
+		if err := rows.Scan(&entry.ReportTime, &entry.LastReportTime, &entry.Reports, &entry.JenkinsVersion, &entry.JVMVersion,
+			&entry.Executors, &plugins); err != nil {
+			return nil, err
+		}
+		entry.Plugins = plugins
+		history = append(history, entry)
+	}
+	return history, rows.Err()
+}
@@ -0,0 +1,105 @@
+package stats_test
+
+import (
+	"testing"
+	"time"
+
+	stats "github.com/jenkins-infra/jenkins-usage-stats"
+	"github.com/jenkins-infra/jenkins-usage-stats/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReportHistory(t *testing.T) {
+	db, closeFunc := testutil.DBForTest(t)
+	defer closeFunc()
+	cache := stats.NewStatsCacheWithConfig(stats.ImportConfig{History: true})
+
+	july := testReport("a", 1, "2.303.2", "Linux", "git")
+	july.TimestampString = "01/Jul/2022:12:00:00 +0000"
+	// c hasn't changed since June, so its June entry is still current in July.
+	stillCurrent := testReport("c", 2, "2.303.1", "Linux", "git")
+	stillCurrent.TimestampString = "02/Jul/2022:12:00:00 +0000"
+	for _, r := range []*stats.JSONReport{
+		testReport("a", 1, "2.303.1", "Linux", "git"),
+		// Nothing's changed, so this extends the first entry.
+		testReport("a", 2, "2.303.1", "Linux", "git"),
+		// Not newer, so this is ignored.
+		testReport("a", 2, "2.303.1", "Linux", "git"),
+		testReport("a", 3, "2.303.2", "Linux", "git", "ldap"),
+		testReport("a", 4, "2.303.2", "Linux", "ldap", "git"),
+		july,
+		testReport("b", 5, "2.303.1", "Linux", "git"),
+		testReport("c", 10, "2.303.1", "Linux", "git"),
+		stillCurrent,
+	} {
+		require.NoError(t, stats.AddIndividualReport(db, cache, r))
+	}
+
+	history, err := stats.GetInstanceHistory(db, "a")
+	require.NoError(t, err)
+	require.Len(t, history, 3)
+
+	assert.Equal(t, 2, history[0].Reports)
+	assert.Equal(t, "2.303.1", history[0].JenkinsVersion)
+	assert.True(t, history[0].ReportTime.Equal(time.Date(2022, time.June, 1, 12, 0, 0, 0, time.UTC)))
+	assert.True(t, history[0].LastReportTime.Equal(time.Date(2022, time.June, 2, 12, 0, 0, 0, time.UTC)))
+
+	assert.Equal(t, 2, history[1].Reports)
+	assert.Equal(t, "2.303.2", history[1].JenkinsVersion)
+	assert.Equal(t, []string{"git:1.0", "ldap:1.0"}, history[1].Plugins)
+
+	assert.Equal(t, 1, history[2].Reports)
+	assert.Equal(t, []string{"git:1.0"}, history[2].Plugins)
+
+	partitions, err := stats.ReportHistoryPartitions(db)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"instance_report_history_2022_06", "instance_report_history_2022_07"}, partitions)
+
+	now := time.Date(2022, time.July, 15, 0, 0, 0, 0, time.UTC)
+	pruned, err := stats.PruneReportHistory(db, 2, now, false)
+	require.NoError(t, err)
+	assert.Equal(t, stats.HistoryPrune{}, pruned)
+
+	// The June partition has c's entry, which is still current, so only the entries which ended in June would go.
+	pruned, err = stats.PruneReportHistory(db, 1, now, true)
+	require.NoError(t, err)
+	assert.Equal(t, stats.HistoryPrune{Trimmed: []string{"instance_report_history_2022_06"}, Entries: 3}, pruned)
+	history, err = stats.GetInstanceHistory(db, "a")
+	require.NoError(t, err)
+	assert.Len(t, history, 3)
+
+	_, err = stats.PruneReportHistory(db, 1, now, false)
+	require.NoError(t, err)
+	history, err = stats.GetInstanceHistory(db, "a")
+	require.NoError(t, err)
+	require.Len(t, history, 1)
+	assert.Equal(t, []string{"git:1.0"}, history[0].Plugins)
+	history, err = stats.GetInstanceHistory(db, "b")
+	require.NoError(t, err)
+	assert.Empty(t, history)
+	history, err = stats.GetInstanceHistory(db, "c")
+	require.NoError(t, err)
+	require.Len(t, history, 1)
+	assert.Equal(t, 2, history[0].Reports)
+
+	// By September, every entry has ended, so both partitions are dropped.
+	pruned, err = stats.PruneReportHistory(db, 1, time.Date(2022, time.September, 1, 0, 0, 0, 0, time.UTC), false)
+	require.NoError(t, err)
+	assert.Equal(t, stats.HistoryPrune{Dropped: []string{"instance_report_history_2022_06", "instance_report_history_2022_07"}, Entries: 2}, pruned)
+
+	// A late report for a dropped month recreates its partition, even with the same cache.
+	require.NoError(t, stats.AddIndividualReport(db, cache, testReport("d", 20, "2.303.1", "Linux", "git")))
+	partitions, err = stats.ReportHistoryPartitions(db)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"instance_report_history_2022_06"}, partitions)
+
+	// A report older than the instance's report for the month is still added to the history if it's newer than the
+	// history, such as when the month's report was added without keeping history.
+	require.NoError(t, stats.AddIndividualReport(db, stats.NewStatsCache(), testReport("e", 10, "2.303.2", "Linux", "git")))
+	require.NoError(t, stats.AddIndividualReport(db, cache, testReport("e", 5, "2.303.1", "Linux", "git")))
+	history, err = stats.GetInstanceHistory(db, "e")
+	require.NoError(t, err)
+	require.Len(t, history, 1)
+	assert.Equal(t, "2.303.1", history[0].JenkinsVersion)
+}
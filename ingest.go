@@ -0,0 +1,432 @@
+package stats
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ErrIngestQueueFull is returned by Ingester.Submit when there isn't room in the queue for the reports
+var ErrIngestQueueFull = errors.New("ingest queue is full")
+
+// IngestArchivePrefix is the start of the names of the daily files reports are archived to
+const IngestArchivePrefix = "ingest."
+
+// TxBeginner is a database which can start transactions, such as *sql.DB
+type TxBeginner interface {
+	Begin() (*sql.Tx, error)
+}
+
+// IngestOptions configures an Ingester
+type IngestOptions struct {
+	// BatchSize is the maximum number of reports written to the database in a single transaction
+	BatchSize int
+	// FlushInterval is the longest a report waits in the queue before its batch is written
+	FlushInterval time.Duration
+	// QueueSize is the number of reports which can be waiting to be written. Once it's full, submissions are rejected.
+	QueueSize int
+	// MaxBodyBytes is the largest request body accepted, after decompression
+	MaxBodyBytes int64
+	// ArchiveDir, if set, is where the raw reports are written, in daily gzip files which can be read by ParseDailyJSON
+	ArchiveDir string
+	// MaxTimestampSkew is how far a report's timestamp can be from the time it's received. Reports with timestamps
+	// further away are rejected, so they can't be backdated into months which have already been published. If it's 0,
+	// timestamps aren't checked.
+	MaxTimestampSkew time.Duration
+
+	// ImportConfig is how the reports are added to the database
+	ImportConfig
+}
+
+// DefaultIngestOptions returns the default IngestOptions
+func DefaultIngestOptions() IngestOptions {
+	return IngestOptions{
+		BatchSize:        500,
+		FlushInterval:    5 * time.Second,
+		QueueSize:        10000,
+		MaxBodyBytes:     10 << 20,
+		MaxTimestampSkew: time.Hour,
+	}
+}
+
+// IngestCounts are running totals of what an Ingester has done with the reports it's been sent
+type IngestCounts struct {
+	// Accepted is the number of reports queued to be written
+	Accepted uint64
+	// Rejected is the number of reports turned away because the queue was full
+	Rejected uint64
+	// Written is the number of reports added to the database
+	Written uint64
+	// Failed is the number of accepted reports which couldn't be added to the database
+	Failed uint64
+	// InvalidRequests is the number of requests turned away because their bodies couldn't be parsed. Their reports
+	// aren't counted anywhere else, since a body which can't be parsed can't be split into reports.
+	InvalidRequests uint64
+}
+
+// Ingester accepts individual usage reports, such as over HTTP, and adds them to the database in batches
+type Ingester struct {
+	db    TxBeginner
+	opts  IngestOptions
+	cache *DBCache
+
+	submitMu sync.Mutex
+	queue    chan ingestItem
+
+	archive *reportArchive
+
+	accepted atomic.Uint64
+	rejected atomic.Uint64
+	written  atomic.Uint64
+	failed   atomic.Uint64
+	invalid  atomic.Uint64
+}
+
+type ingestItem struct {
+	report *JSONReport
+	raw    []byte
+}
+
+// NewIngester creates an Ingester. Run must be called for reports to actually be written.
+func NewIngester(db TxBeginner, opts IngestOptions) *Ingester {
+	in := &Ingester{
+		db:    db,
+		opts:  opts,
+		cache: NewStatsCacheWithConfig(opts.ImportConfig),
+		queue: make(chan ingestItem, opts.QueueSize),
+	}
+	if opts.ArchiveDir != "" {
+		in.archive = &reportArchive{dir: opts.ArchiveDir}
+	}
+	return in
+}
+
+// Counts returns the running totals for the Ingester
+func (in *Ingester) Counts() IngestCounts {
+	return IngestCounts{
+		Accepted: in.accepted.Load(),
+		Rejected: in.rejected.Load(),
+		Written:  in.written.Load(),
+		Failed:   in.failed.Load(),
+
+		InvalidRequests: in.invalid.Load(),
+	}
+}
+
+// Submit queues reports to be written. Either all of the reports are queued, or, if there isn't room for all of them,
+// none are and ErrIngestQueueFull is returned.
+func (in *Ingester) Submit(reports []*JSONReport, raw [][]byte) error {
+	in.submitMu.Lock()
+	defer in.submitMu.Unlock()
+
+	// Only Run takes from the queue, so there can only be more room by the time we're sending.
+	if len(in.queue)+len(reports) > cap(in.queue) {
+		in.rejected.Add(uint64(len(reports)))
+		return ErrIngestQueueFull
+	}
+	for i, r := range reports {
+		in.queue <- ingestItem{report: r, raw: raw[i]}
+	}
+	in.accepted.Add(uint64(len(reports)))
+	return nil
+}
+
+// Run writes queued reports to the database until the context is cancelled, at which point the remaining queued
+// reports are written before it returns.
+func (in *Ingester) Run(ctx context.Context) error {
+	ticker := time.NewTicker(in.opts.FlushInterval)
+	defer ticker.Stop()
+
+	var batch []ingestItem
+	for {
+		select {
+		case item := <-in.queue:
+			batch = append(batch, item)
+			if len(batch) >= in.opts.BatchSize {
+				in.writeBatch(batch)
+				batch = nil
+			}
+		case <-ticker.C:
+			in.writeBatch(batch)
+			batch = nil
+		case <-ctx.Done():
+			for len(in.queue) > 0 {
+				batch = append(batch, <-in.queue)
+				if len(batch) >= in.opts.BatchSize {
+					in.writeBatch(batch)
+					batch = nil
+				}
+			}
+			in.writeBatch(batch)
+			return nil
+		}
+	}
+}
+
+// writeBatch adds the reports to the database in a single transaction, and archives them. Failures are logged and
+// counted rather than returned, so one bad batch doesn't stop ingestion.
+func (in *Ingester) writeBatch(batch []ingestItem) {
+	if len(batch) == 0 {
+		return
+	}
+
+	if in.archive != nil {
+		if err := in.archive.write(batch); err != nil {
+			fmt.Printf("archiving batch of %d reports: %s\n", len(batch), err)
+		}
+	}
+
+	failed, err := in.addReports(batch)
+	if err != nil {
+		// The cache may now have IDs for lookup rows which were rolled back, so start over with a new one.
+		in.cache = NewStatsCacheWithConfig(in.opts.ImportConfig)
+		in.failed.Add(uint64(len(batch)))
+		fmt.Printf("writing batch of %d reports: %s\n", len(batch), err)
+		return
+	}
+	in.failed.Add(uint64(failed))
+	in.written.Add(uint64(len(batch) - failed))
+}
+
+// addReports adds the reports to the database in a single transaction, returning how many failed. Each report is
+// added inside its own savepoint, so a report which fails is rolled back on its own and the rest of the batch, which
+// has already been accepted, is still written. An error is only returned if the whole batch failed.
+func (in *Ingester) addReports(batch []ingestItem) (int, error) {
+	tx, err := in.db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	fieldCounts := NewFieldCounts(in.opts.Location)
+	dayStats := NewDayStats()
+	failed := 0
+	for _, item := range batch {
+		if _, err := tx.Exec("SAVEPOINT ingest_report"); err != nil {
+			_ = tx.Rollback()
+			return 0, err
+		}
+		if err := AddIndividualReport(tx, in.cache, item.report); err != nil {
+			if _, rbErr := tx.Exec("ROLLBACK TO SAVEPOINT ingest_report"); rbErr != nil {
+				_ = tx.Rollback()
+				return 0, rbErr
+			}
+			// The cache may now have IDs for lookup rows which were rolled back, so start over with a new one.
+			in.cache = NewStatsCacheWithConfig(in.opts.ImportConfig)
+			failed++
+			fmt.Printf("writing report for %s: %s\n", item.report.Install, err)
+			continue
+		}
+		if _, err := tx.Exec("RELEASE SAVEPOINT ingest_report"); err != nil {
+			_ = tx.Rollback()
+			return 0, err
+		}
+		fieldCounts.Add(item.report)
+		dayStats.Add(item.report)
+	}
+	if err := fieldCounts.Save(tx); err != nil {
+		_ = tx.Rollback()
+		return 0, err
+	}
+	if err := dayStats.Save(tx); err != nil {
+		_ = tx.Rollback()
+		return 0, err
+	}
+	return failed, tx.Commit()
+}
+
+// Handler returns an http.Handler accepting POSTed reports, one JSON object per line, optionally gzip encoded.
+// Reports without a timestamp are given the time they were received, and requests with reports whose timestamps are
+// more than MaxTimestampSkew from it are rejected.
+func (in *Ingester) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			writeAPIError(w, http.StatusMethodNotAllowed, fmt.Errorf("method %s not allowed", r.Method))
+			return
+		}
+
+		reports, raw, err := ParseIngestBody(r.Body, in.opts.MaxBodyBytes, time.Now(), in.opts.MaxTimestampSkew)
+		if err != nil {
+			in.invalid.Add(1)
+			writeAPIError(w, http.StatusBadRequest, err)
+			return
+		}
+
+		if err := in.Submit(reports, raw); err != nil {
+			w.Header().Set("Retry-After", fmt.Sprintf("%d", int(in.opts.FlushInterval.Seconds())+1))
+			writeAPIError(w, http.StatusServiceUnavailable, err)
+			return
+		}
+
+		w.WriteHeader(http.StatusAccepted)
+	})
+}
+
+// ParseIngestBody reads line-delimited JSON reports, which may be compressed, from a request body no larger than
+// maxBytes once decompressed. Every report is validated and normalized. Reports without a timestamp are given the
+// received time, and reports with a timestamp more than maxSkew from it are rejected, unless maxSkew is 0. The raw JSON
+// for each report, with its timestamp, is also returned for archiving.
+func ParseIngestBody(body io.Reader, maxBytes int64, received time.Time, maxSkew time.Duration) ([]*JSONReport, [][]byte, error) {
+	reader, closeFunc, err := decompressedReader(body)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer closeFunc()
+
+	data, err := io.ReadAll(io.LimitReader(reader, maxBytes+1))
+	if err != nil {
+		return nil, nil, err
+	}
+	if int64(len(data)) > maxBytes {
+		return nil, nil, fmt.Errorf("body is larger than %d bytes", maxBytes)
+	}
+
+	formats, err := DefaultReportFormats()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	sBuffer := make([]byte, 0, bufio.MaxScanTokenSize)
+	scanner.Buffer(sBuffer, bufio.MaxScanTokenSize*50)
+
+	var reports []*JSONReport
+	var raw [][]byte
+	line := 0
+	for scanner.Scan() {
+		line++
+		trimmed := bytes.TrimSpace(scanner.Bytes())
+		if len(trimmed) == 0 {
+			continue
+		}
+
+		var fields map[string]json.RawMessage
+		if err := json.Unmarshal(trimmed, &fields); err != nil {
+			return nil, nil, fmt.Errorf("line %d: %w", line, err)
+		}
+		if _, ok := fields["timestamp"]; !ok {
+			fields["timestamp"], _ = json.Marshal(received.UTC().Format(JSONTimestampLayout))
+		}
+		// Compact the report onto a single line, with its timestamp, so it can be archived.
+		rawReport, err := json.Marshal(fields)
+		if err != nil {
+			return nil, nil, fmt.Errorf("line %d: %w", line, err)
+		}
+
+		r, _, err := formats.Decode(rawReport)
+		if err != nil {
+			return nil, nil, fmt.Errorf("line %d: %w", line, err)
+		}
+		if err := validateIngestedReport(r, received, maxSkew); err != nil {
+			return nil, nil, fmt.Errorf("line %d: %w", line, err)
+		}
+		NormalizeReport(r)
+
+		reports = append(reports, r)
+		raw = append(raw, rawReport)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, nil, err
+	}
+	if len(reports) == 0 {
+		return nil, nil, fmt.Errorf("no reports in body")
+	}
+
+	return reports, raw, nil
+}
+
+// validateIngestedReport checks what the report schemas can't
+func validateIngestedReport(r *JSONReport, received time.Time, maxSkew time.Duration) error {
+	if len(r.Install) > 64 {
+		return fmt.Errorf("install is longer than 64 characters")
+	}
+	ts, err := r.Timestamp()
+	if err != nil {
+		return fmt.Errorf("invalid timestamp %q", r.TimestampString)
+	}
+	if maxSkew > 0 && (ts.Before(received.Add(-maxSkew)) || ts.After(received.Add(maxSkew))) {
+		return fmt.Errorf("timestamp %q is more than %s from the time the report was received", r.TimestampString, maxSkew)
+	}
+	return nil
+}
+
+// IsIngestArchive returns whether a report file is one of the daily files reports are archived to. Its reports have
+// already been added to the database by the ingest server.
+func IsIngestArchive(filename string) bool {
+	return strings.HasPrefix(filepath.Base(filename), IngestArchivePrefix)
+}
+
+// reportArchive writes raw reports to a gzip file per day, named so the import command orders them correctly
+type reportArchive struct {
+	dir string
+}
+
+// write appends a batch of reports to the files for their days. Each file gets a single complete gzip member, written
+// at once, so a crash can't leave a partly written member which would make the rest of the file unreadable. Gzip
+// readers read the members of a file one after another.
+func (a *reportArchive) write(batch []ingestItem) error {
+	var days []string
+	members := make(map[string]*bytes.Buffer)
+	writers := make(map[string]*gzip.Writer)
+	for _, item := range batch {
+		ts, err := item.report.Timestamp()
+		if err != nil {
+			return err
+		}
+		day := ts.Format("20060102")
+		if _, ok := writers[day]; !ok {
+			days = append(days, day)
+			members[day] = &bytes.Buffer{}
+			writers[day] = gzip.NewWriter(members[day])
+		}
+		if _, err := writers[day].Write(append(item.raw, '\n')); err != nil {
+			return err
+		}
+	}
+
+	if err := os.MkdirAll(a.dir, 0755); err != nil { //nolint:gosec
+		return err
+	}
+	for _, day := range days {
+		if err := writers[day].Close(); err != nil {
+			return err
+		}
+		if err := a.appendMember(day, members[day].Bytes()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// appendMember appends a gzip member to the day's file, and syncs it to disk
+func (a *reportArchive) appendMember(day string, member []byte) error {
+	f, err := os.OpenFile(filepath.Join(a.dir, fmt.Sprintf("%s%s.json.gz", IngestArchivePrefix, day)), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644) //nolint:gosec
+	if err != nil {
+		return err
+	}
+	var errs []string
+	if _, err := f.Write(member); err != nil {
+		errs = append(errs, err.Error())
+	} else if err := f.Sync(); err != nil {
+		errs = append(errs, err.Error())
+	}
+	if err := f.Close(); err != nil {
+		errs = append(errs, err.Error())
+	}
+	if len(errs) > 0 {
+		return errors.New(strings.Join(errs, "; "))
+	}
+	return nil
+}
@@ -0,0 +1,170 @@
+package stats_test
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	sq "github.com/Masterminds/squirrel"
+	stats "github.com/jenkins-infra/jenkins-usage-stats"
+	"github.com/jenkins-infra/jenkins-usage-stats/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseIngestBody(t *testing.T) {
+	received := time.Date(2022, time.June, 3, 12, 30, 0, 0, time.UTC)
+
+	raw, err := os.ReadFile(filepath.Join("testdata", "base.json"))
+	require.NoError(t, err)
+	expected, err := stats.ParseDailyJSON(filepath.Join("testdata", "base.json"))
+	require.NoError(t, err)
+
+	t.Run("gzip", func(t *testing.T) {
+		var buf bytes.Buffer
+		zw := gzip.NewWriter(&buf)
+		_, err := zw.Write(raw)
+		require.NoError(t, err)
+		require.NoError(t, zw.Close())
+
+		// The reports were sent long before they're received here, so their timestamps aren't checked.
+		reports, rawReports, err := stats.ParseIngestBody(&buf, 1<<20, received, 0)
+		require.NoError(t, err)
+		assert.Equal(t, expected, reports)
+		assert.Len(t, rawReports, 2)
+
+		// The archived form of the reports must parse to the same thing.
+		archived, err := stats.ParseJSONReports(bytes.NewReader(bytes.Join(rawReports, []byte("\n"))))
+		require.NoError(t, err)
+		assert.Equal(t, expected, archived)
+	})
+
+	t.Run("missing timestamp", func(t *testing.T) {
+		reports, rawReports, err := stats.ParseIngestBody(strings.NewReader(`{"install":"abc","version":"2.303.1","jobs":{"hudson-model-FreeStyleProject":1}}`), 1<<20, received, time.Hour)
+		require.NoError(t, err)
+		require.Len(t, reports, 1)
+		ts, err := reports[0].Timestamp()
+		require.NoError(t, err)
+		assert.Equal(t, received, ts)
+		assert.Contains(t, string(rawReports[0]), `"timestamp":"03/Jun/2022:12:30:00 +0000"`)
+	})
+
+	for name, tc := range map[string]struct {
+		body    string
+		maxSize int64
+		err     string
+	}{
+		"no install":  {body: `{"version":"2.303.1"}`, err: "line 1: report does not match format 2: /: missing properties: 'install'"},
+		"no version":  {body: "\n" + `{"install":"abc"}`, err: "line 2: report does not match format 2: /: missing properties: 'version'"},
+		"bad time":    {body: `{"install":"abc","version":"2.303.1","timestamp":"yesterday"}`, err: "line 1: report does not match format 2: /timestamp: does not match pattern"},
+		"not json":    {body: `install=abc`, err: "line 1: invalid character"},
+		"empty":       {body: "\n\n", err: "no reports in body"},
+		"too large":   {body: `{"install":"abc","version":"2.303.1"}`, maxSize: 10, err: "body is larger than 10 bytes"},
+		"bad jobs":    {body: `{"install":"abc","version":"2.303.1","jobs":{"a":"many"}}`, err: "line 1: report does not match format 2: /jobs/a"},
+		"long ID":     {body: `{"install":"` + strings.Repeat("a", 65) + `","version":"2.303.1"}`, err: "line 1: install is longer than 64 characters"},
+		"bad numbers": {body: `{"install":"abc","version":"2.303.1","nodes":[{"executors":-4}]}`, err: "line 1: report does not match format 2: /nodes/0/executors: must be >= 0 but found -4"},
+		"backdated":   {body: `{"install":"abc","version":"2.303.1","timestamp":"31/May/2022:23:59:00 +0000"}`, err: `line 1: timestamp "31/May/2022:23:59:00 +0000" is more than 1h0m0s from the time the report was received`},
+		"future":      {body: `{"install":"abc","version":"2.303.1","timestamp":"03/Jun/2022:14:00:00 +0000"}`, err: "is more than 1h0m0s from the time"},
+	} {
+		t.Run(name, func(t *testing.T) {
+			maxSize := tc.maxSize
+			if maxSize == 0 {
+				maxSize = 1 << 20
+			}
+			_, _, err := stats.ParseIngestBody(strings.NewReader(tc.body), maxSize, received, time.Hour)
+			if assert.Error(t, err) {
+				assert.Contains(t, err.Error(), tc.err)
+			}
+		})
+	}
+}
+
+func TestIngesterHandler(t *testing.T) {
+	opts := stats.DefaultIngestOptions()
+	opts.QueueSize = 1
+	ingester := stats.NewIngester(nil, opts)
+	handler := ingester.Handler()
+
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+	assert.Equal(t, http.StatusMethodNotAllowed, rec.Code)
+
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/", strings.NewReader(`{"install":"abc"}`)))
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+
+	raw, err := os.ReadFile(filepath.Join("testdata", "base.json"))
+	require.NoError(t, err)
+
+	// The reports in the file are from long before now.
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/", bytes.NewReader(raw)))
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+
+	assert.Equal(t, stats.IngestCounts{InvalidRequests: 2}, ingester.Counts())
+
+	// There are two reports in the file, and only room for one in the queue.
+	opts.MaxTimestampSkew = 0
+	ingester = stats.NewIngester(nil, opts)
+	rec = httptest.NewRecorder()
+	ingester.Handler().ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/", bytes.NewReader(raw)))
+	assert.Equal(t, http.StatusServiceUnavailable, rec.Code)
+	assert.NotEmpty(t, rec.Header().Get("Retry-After"))
+	assert.Equal(t, stats.IngestCounts{Rejected: 2}, ingester.Counts())
+}
+
+func TestIngester(t *testing.T) {
+	db, closeFunc := testutil.DBForTest(t)
+	defer closeFunc()
+
+	archiveDir := t.TempDir()
+	opts := stats.DefaultIngestOptions()
+	opts.ArchiveDir = archiveDir
+	opts.MaxTimestampSkew = 0
+	ingester := stats.NewIngester(db, opts)
+
+	raw, err := os.ReadFile(filepath.Join("testdata", "base.json"))
+	require.NoError(t, err)
+
+	// Send the reports in separate batches, so each batch is appended to the archive as its own gzip member.
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	for _, line := range bytes.Split(bytes.TrimSpace(raw), []byte("\n")) {
+		rec := httptest.NewRecorder()
+		ingester.Handler().ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/", bytes.NewReader(line)))
+		require.Equal(t, http.StatusAccepted, rec.Code)
+		require.NoError(t, ingester.Run(ctx))
+	}
+
+	assert.Equal(t, stats.IngestCounts{Accepted: 2, Written: 2}, ingester.Counts())
+
+	var c int
+	require.NoError(t, stats.PSQL(db).Select("count(*)").From(stats.InstanceReportsTable).QueryRow().Scan(&c))
+	assert.Equal(t, 2, c)
+
+	// The day's numbers are added up across the batches.
+	var reports, instances int
+	require.NoError(t, stats.PSQL(db).Select("reports", "instances").From(stats.DayStatsTable).
+		Where(sq.Eq{"day": "2021-10-30"}).QueryRow().Scan(&reports, &instances))
+	assert.Equal(t, 2, reports)
+	assert.Equal(t, 2, instances)
+
+	expected, err := stats.ParseDailyJSON(filepath.Join("testdata", "base.json"))
+	require.NoError(t, err)
+	archived, err := stats.ParseDailyJSON(filepath.Join(archiveDir, "ingest.20211030.json.gz"))
+	require.NoError(t, err)
+	assert.Equal(t, expected, archived)
+}
+
+func TestIsIngestArchive(t *testing.T) {
+	assert.True(t, stats.IsIngestArchive(filepath.Join("archive", "ingest.20220603.json.gz")))
+	assert.False(t, stats.IsIngestArchive(filepath.Join("ingest.d", "20220603.json.gz")))
+	assert.False(t, stats.IsIngestArchive("usage.20220603.json.gz"))
+}
@@ -7,6 +7,9 @@ import (
 )
 
 const (
+	// JSONTimestampLayout is the time layout of the timestamp string in the raw reports
+	JSONTimestampLayout = "02/Jan/2006:15:04:05 -0700"
+
 	jsonReportDateRE = `(\d\d)\/(\w\w\w)\/(\d\d\d\d)\:(\d\d\:\d\d\:\d\d) ([\+\-]\d\d)(\d\d)`
 )
 
@@ -52,6 +55,9 @@ type JSONReport struct {
 	ServletContainer string            `json:"servletContainer,omitempty"`
 	TimestampString  string            `json:"timestamp"`
 	Version          string            `json:"version"`
+
+	// UnknownFields are the fields in the raw report, or on any of its nodes, which aren't recognized
+	UnknownFields []ReportField `json:"-"`
 }
 
 // Timestamp parses the raw timestamp string on a report
@@ -67,6 +73,10 @@ func (j *JSONReport) Timestamp() (time.Time, error) {
 func JSONTimestampToRFC3339(ts string) string {
 	re := regexp.MustCompile(jsonReportDateRE)
 	matches := re.FindAllStringSubmatch(ts, -1)
+	// Leave anything we don't recognize alone, so parsing it fails rather than panicking here.
+	if len(matches) == 0 {
+		return ts
+	}
 	return fmt.Sprintf("%s-%s-%sT%s%s:%s", matches[0][3], shortMonthToNumber[matches[0][2]], matches[0][1], matches[0][4], matches[0][5], matches[0][6])
 	/*	withoutZone := strings.TrimSuffix(ts, " +0000")
 		splitDateAndTime := strings.SplitN(withoutZone, ":", 2)
@@ -0,0 +1,222 @@
+package stats
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	sq "github.com/Masterminds/squirrel"
+)
+
+const (
+	// DefaultMetricsPluginThreshold is the minimum number of installs for a plugin to be included in the metrics, to
+	// keep the number of label values bounded.
+	DefaultMetricsPluginThreshold = 1000
+
+	metricsPrefix = "jenkins_usage_"
+)
+
+// MonthTotals is the total number of instances, nodes, jobs, and executors in a month
+type MonthTotals struct {
+	Instances uint64
+	Nodes     uint64
+	Jobs      uint64
+	Executors uint64
+}
+
+// WriteMetrics writes the usage numbers for a month in the Prometheus text exposition format. Only plugins with at
+// least pluginThreshold installs are included, or DefaultMetricsPluginThreshold if it's 0.
+func WriteMetrics(w io.Writer, db sq.BaseRunner, co CountOptions, year, month int, pluginThreshold uint64) error {
+	if pluginThreshold == 0 {
+		pluginThreshold = DefaultMetricsPluginThreshold
+	}
+	installCount, err := GetInstallCountForVersions(db, co, year, month)
+	if err != nil {
+		return err
+	}
+	latestNumbers, err := GetLatestPluginNumbers(db, co, year, month)
+	if err != nil {
+		return err
+	}
+	jvms, err := JVMCountsForMonth(db, co, year, month)
+	if err != nil {
+		return err
+	}
+	osFamilies, err := OSFamilyCountsForMonth(db, co, year, month)
+	if err != nil {
+		return err
+	}
+	totals, err := TotalsForMonth(db, co, year, month)
+	if err != nil {
+		return err
+	}
+
+	plugins := map[string]uint64{}
+	for p, c := range latestNumbers.Plugins {
+		if c >= pluginThreshold {
+			plugins[p] = c
+		}
+	}
+
+	var buf bytes.Buffer
+	writeGauge(&buf, "month_start_timestamp_seconds", "Start of the month these numbers are for, as a Unix timestamp", "",
+		map[string]uint64{"": uint64(startDateForYearMonth(year, month, co.Location).Unix())})
+	writeGauge(&buf, "installations", "Number of installations per Jenkins version", "version", installCount.Installations)
+	writeGauge(&buf, "plugin_installations", fmt.Sprintf("Number of installations per plugin, for plugins with at least %d installations", pluginThreshold), "plugin", plugins)
+	writeGauge(&buf, "jvm_installations", "Number of installations per controller Java version", "version", jvms)
+	writeGauge(&buf, "os_installations", "Number of installations with nodes on each operating system family", "os", osFamilies)
+	writeGauge(&buf, "instances", "Total number of instances", "", map[string]uint64{"": totals.Instances})
+	writeGauge(&buf, "nodes", "Total number of nodes, including controllers", "", map[string]uint64{"": totals.Nodes})
+	writeGauge(&buf, "jobs", "Total number of jobs", "", map[string]uint64{"": totals.Jobs})
+	writeGauge(&buf, "executors", "Total number of executors", "", map[string]uint64{"": totals.Executors})
+
+	_, err = w.Write(buf.Bytes())
+	return err
+}
+
+// WriteMetricsFile writes the metrics for a month to a file, such as for the node_exporter textfile collector. The file
+// is replaced atomically, so it is never read half-written.
+func WriteMetricsFile(filename string, db sq.BaseRunner, co CountOptions, year, month int, pluginThreshold uint64) error {
+	var buf bytes.Buffer
+	if err := WriteMetrics(&buf, db, co, year, month, pluginThreshold); err != nil {
+		return err
+	}
+
+	tmpFile := filepath.Join(filepath.Dir(filename), "."+filepath.Base(filename)+".tmp")
+	if err := writeFile(tmpFile, buf.Bytes()); err != nil {
+		return err
+	}
+	return os.Rename(tmpFile, filename)
+}
+
+// JVMCountsForMonth gets the number of instances running each controller Java version in a month
+func JVMCountsForMonth(db sq.BaseRunner, co CountOptions, year, month int) (map[string]uint64, error) {
+	rows, err := PSQL(db).Select("jv.name as n", "count(*)").
+		From("instance_reports i").
+		Join("jvm_versions jv on jv.id = i.jvm_version_id").
+		Where(sq.Eq{"i.year": year}).
+		Where(sq.Eq{"i.month": month}).
+		Where(countedInstances("i", co.ExcludeQuarantined)).
+		GroupBy("n").
+		Query()
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = rows.Close()
+	}()
+
+	jvmMap := make(map[string]uint64)
+
+	for rows.Next() {
+		var name string
+		var count uint64
+
+		err = rows.Scan(&name, &count)
+		if err != nil {
+			return nil, err
+		}
+		jvmMap[name] = count
+	}
+
+	return jvmMap, nil
+}
+
+// OSFamilyCountsForMonth gets the number of instances with nodes on each OS family in a month. An instance with nodes
+// on more than one OS in a family, such as two versions of Windows, is only counted once for it.
+func OSFamilyCountsForMonth(db sq.BaseRunner, co CountOptions, year, month int) (map[string]uint64, error) {
+	rows, err := PSQL(db).Select("i.instance_id", "o.name").Distinct().
+		From("instance_reports i, jsonb_each_text(i.nodes) nr").
+		Join("os_types o on o.id = nr.key::int").
+		Where(sq.Eq{"i.year": year}).
+		Where(sq.Eq{"i.month": month}).
+		Where(countedInstances("i", co.ExcludeQuarantined)).
+		Where("nr.value::int > 0").
+		Query()
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = rows.Close()
+	}()
+
+	families := make(map[string]map[string]bool)
+
+	for rows.Next() {
+		var instanceID, name string
+
+		err = rows.Scan(&instanceID, &name)
+		if err != nil {
+			return nil, err
+		}
+		family := osFamily(name)
+		if families[family] == nil {
+			families[family] = make(map[string]bool)
+		}
+		families[family][instanceID] = true
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	familyMap := make(map[string]uint64)
+	for family, instances := range families {
+		familyMap[family] = uint64(len(instances))
+	}
+	return familyMap, nil
+}
+
+// TotalsForMonth gets the total number of instances, nodes, jobs and executors in a month
+func TotalsForMonth(db sq.BaseRunner, co CountOptions, year, month int) (MonthTotals, error) {
+	var totals MonthTotals
+	err := PSQL(db).Select("count(*)",
+		"coalesce(sum("+nodeCountExpr+"), 0)",
+		"coalesce(sum("+jobCountExpr+"), 0)",
+		"coalesce(sum(i.executors), 0)").
+		From("instance_reports i").
+		Where(sq.Eq{"i.year": year}).
+		Where(sq.Eq{"i.month": month}).
+		Where(countedInstances("i", co.ExcludeQuarantined)).
+		QueryRow().
+		Scan(&totals.Instances, &totals.Nodes, &totals.Jobs, &totals.Executors)
+	return totals, err
+}
+
+// osFamily strips the architecture from an OS name, and groups all Windows versions together, so "Windows 7 (x86)"
+// becomes "Windows" and "Linux (amd64)" becomes "Linux".
+func osFamily(name string) string {
+	if idx := strings.Index(name, " ("); idx > 0 {
+		name = name[:idx]
+	}
+	if strings.HasPrefix(name, "Windows") {
+		return "Windows"
+	}
+	return name
+}
+
+func writeGauge(buf *bytes.Buffer, name, help, label string, values map[string]uint64) {
+	name = metricsPrefix + name
+	_, _ = fmt.Fprintf(buf, "# HELP %s %s\n# TYPE %s gauge\n", name, help, name)
+
+	var keys []string
+	for k := range values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		if label == "" {
+			_, _ = fmt.Fprintf(buf, "%s %d\n", name, values[k])
+		} else {
+			_, _ = fmt.Fprintf(buf, "%s{%s=\"%s\"} %d\n", name, label, escapeLabelValue(k), values[k])
+		}
+	}
+}
+
+func escapeLabelValue(v string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(v)
+}
@@ -3,104 +3,219 @@ package stats
 import (
 	"bufio"
 	"bytes"
+	"compress/bzip2"
 	"compress/gzip"
-	"encoding/json"
-	"io/ioutil"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"os"
+	"sort"
 	"strings"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
 )
 
 var (
-	hotspotAndMisc16Versions = []string{
-		// Until sometime in 2010, HotSpot and some other JVMs reported _their_ version number, not the Java version.
-		// So for those cases, we're just going to map them all to 1.6.
-
-		// HotSpot versions
-		"10.0-b19",
-		"10.0-b22",
-		"10.0-b23",
-		"10.0-b25",
-		"11.0-b11",
-		"11.0-b12",
-		"11.0-b15",
-		"11.0-b16",
-		"11.0-b17",
-		"11.2-b01",
-		"11.3-b02",
-		"13.0-b04",
-		"14.0-b01",
-		"14.0-b05",
-		"14.0-b08",
-		"14.0-b09",
-		"14.0-b10",
-		"14.0-b12",
-		"14.0-b15",
-		"14.0-b16",
-		"14.1-b02",
-		"14.2-b01",
-		"14.3-b01",
-		"16.0-b03",
-		"16.0-b08",
-		"16.0-b13",
-		"16.2-b04",
-		"16.3-b01",
-		"17.0-b14",
-		"17.0-b15",
-		"17.0-b16",
-		"17.0-b17",
-		"17.1-b03",
-		// IBM JVM
-		"2.3",
-		"2.4",
-		// SAP JVM
-		"5.1.0844",
-		"5.1.0909",
-	}
+	// ReportFileExtensions are the extensions of files which will be imported from a directory
+	ReportFileExtensions = []string{".gz", ".zst", ".bz2", ".json", ".jsonl"}
+
+	gzipMagic  = []byte{0x1f, 0x8b}
+	zstdMagic  = []byte{0x28, 0xb5, 0x2f, 0xfd}
+	bzip2Magic = []byte("BZh")
 )
 
-// ParseDailyJSON parses an individual day's gzipped JSON reports
+// ParseDailyJSON parses an individual day's JSON reports from a file, which may be plain or gzip, zstd or bzip2
+// compressed
 func ParseDailyJSON(filename string) ([]*JSONReport, error) {
-	gzippedJSON, err := ioutil.ReadFile(filename) // #nosec
+	f, err := os.Open(filename) // #nosec
 	if err != nil {
 		return nil, err
 	}
-	zReader, err := gzip.NewReader(bytes.NewReader(gzippedJSON))
+	defer func() {
+		_ = f.Close()
+	}()
+
+	return ParseJSONReports(f)
+}
+
+// ReportFileHash returns the hex SHA-256 of a report file's contents, which identifies it in report_files regardless of
+// its name or location
+func ReportFileHash(filename string) (string, error) {
+	f, err := os.Open(filename) // #nosec
 	if err != nil {
-		return nil, err
+		return "", err
 	}
+	defer func() {
+		_ = f.Close()
+	}()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
 
+// ParseJSONReportsWithHash parses line-delimited JSON reports like ParseJSONReports, and also returns the hex SHA-256
+// of all of the input, for input such as stdin which can only be read once
+func ParseJSONReportsWithHash(input io.Reader) ([]*JSONReport, string, error) {
+	h := sha256.New()
+	tee := io.TeeReader(input, h)
+	reports, err := ParseJSONReports(tee)
+	if err != nil {
+		return nil, "", err
+	}
+	if _, err := io.Copy(io.Discard, tee); err != nil {
+		return nil, "", err
+	}
+	return reports, hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// ParseJSONReports parses line-delimited JSON reports, such as from stdin, decompressing them first if they're gzip,
+// zstd or bzip2 compressed
+func ParseJSONReports(input io.Reader) ([]*JSONReport, error) {
 	var reports []*JSONReport
+	err := scanJSONReports(input, func(r *JSONReport) bool {
+		reports = append(reports, r)
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
 
-	scanner := bufio.NewScanner(zReader)
+	return reports, nil
+}
+
+// FirstReportTime returns the timestamp of the first valid report in a file, or the zero time if there are none. It's
+// used to order files without reading all of them.
+func FirstReportTime(filename string) (time.Time, error) {
+	f, err := os.Open(filename) // #nosec
+	if err != nil {
+		return time.Time{}, err
+	}
+	defer func() {
+		_ = f.Close()
+	}()
+
+	var first time.Time
+	err = scanJSONReports(f, func(r *JSONReport) bool {
+		ts, err := r.Timestamp()
+		if err != nil {
+			return true
+		}
+		first = ts
+		return false
+	})
+	return first, err
+}
+
+// SortReportsByTime sorts reports by their timestamps, oldest first. Reports with invalid timestamps are sorted last.
+func SortReportsByTime(reports []*JSONReport) {
+	times := make(map[*JSONReport]time.Time, len(reports))
+	for _, r := range reports {
+		if ts, err := r.Timestamp(); err == nil {
+			times[r] = ts
+		}
+	}
+	sort.SliceStable(reports, func(i, j int) bool {
+		ti, iOK := times[reports[i]]
+		tj, jOK := times[reports[j]]
+		if iOK && jOK {
+			return ti.Before(tj)
+		}
+		return iOK && !jOK
+	})
+}
+
+// IsReportFile returns true if the filename has one of the extensions used for report files
+func IsReportFile(filename string) bool {
+	for _, ext := range ReportFileExtensions {
+		if strings.HasSuffix(filename, ext) {
+			return true
+		}
+	}
+	return false
+}
+
+// scanJSONReports calls f with each report, normalized, until f returns false
+func scanJSONReports(input io.Reader, f func(*JSONReport) bool) error {
+	reader, closeFunc, err := decompressedReader(input)
+	if err != nil {
+		return err
+	}
+	defer closeFunc()
+
+	scanner := bufio.NewScanner(reader)
 	sBuffer := make([]byte, 0, bufio.MaxScanTokenSize)
 	scanner.Buffer(sBuffer, bufio.MaxScanTokenSize*50) // Otherwise long lines crash the scanner.
 
+	formats, err := DefaultReportFormats()
+	if err != nil {
+		return err
+	}
+
 	for scanner.Scan() {
-		var r *JSONReport
-		err = json.Unmarshal(scanner.Bytes(), &r)
+		if len(bytes.TrimSpace(scanner.Bytes())) == 0 {
+			continue
+		}
+		r, _, err := formats.Decode(scanner.Bytes())
 		if err != nil {
-			// If the error is a "cannot unmarshal number...", just skip this record. This is to deal with the range of
-			// possible weird executor count values we see, ranging from -4 to 2147483655 - i.e., 8 more than the max 32
-			// bit number. We're opting to just pay attention to positive values, and we don't really want to deal with
-			// bad data anyway.
-			if strings.Contains(err.Error(), "cannot unmarshal number") {
-				continue
-			}
-			// If the error is "cannot unmarshal array into Go struct field JSONReport.jobs of type uint64", we hit a
-			// weird case of the value for a job count being an array, so let's just ignore that record.
-			if strings.Contains(err.Error(), "cannot unmarshal array into Go struct field JSONReport.jobs of type uint64") {
+			// Skip reports which don't match any known format, such as those with negative executor counts, which
+			// we see ranging from -4 to 2147483655 - i.e., 8 more than the max 32 bit number. We don't really want to
+			// deal with bad data anyway. Anything which isn't even JSON means the file itself is bad, though.
+			var validationErr *ReportValidationError
+			if errors.As(err, &validationErr) {
 				continue
 			}
-			return nil, err
+			return err
+		}
+		NormalizeReport(r)
+		if !f(r) {
+			return nil
 		}
-		FilterPrivateFromReport(r)
-		standardizeJVMVersions(r)
-		reports = append(reports, r)
 	}
-	if err := scanner.Err(); err != nil {
-		return nil, err
+
+	return scanner.Err()
+}
+
+// decompressedReader detects gzip, zstd and bzip2 compressed input from its magic bytes, and returns a reader for the
+// decompressed data. Anything else is assumed to be uncompressed.
+func decompressedReader(input io.Reader) (io.Reader, func(), error) {
+	br := bufio.NewReader(input)
+	magic, err := br.Peek(4)
+	if err != nil && !errors.Is(err, io.EOF) {
+		return nil, nil, err
 	}
 
-	return reports, nil
+	switch {
+	case bytes.HasPrefix(magic, gzipMagic):
+		zReader, err := gzip.NewReader(br)
+		if err != nil {
+			return nil, nil, err
+		}
+		return zReader, func() { _ = zReader.Close() }, nil
+	case bytes.HasPrefix(magic, zstdMagic):
+		zReader, err := zstd.NewReader(br)
+		if err != nil {
+			return nil, nil, err
+		}
+		return zReader, zReader.Close, nil
+	case bytes.HasPrefix(magic, bzip2Magic):
+		return bzip2.NewReader(br), func() {}, nil
+	}
+
+	return br, func() {}, nil
+}
+
+// NormalizeReport removes private plugins from the report, and standardizes its JVM versions, vendors and servlet
+// container
+func NormalizeReport(r *JSONReport) {
+	FilterPrivateFromReport(r)
+	standardizeJVMVersions(r)
+	standardizeJVMVendors(r)
+	standardizeServletContainer(r)
 }
 
 // FilterPrivateFromReport removes private plugins from the report
@@ -114,33 +229,44 @@ func FilterPrivateFromReport(r *JSONReport) {
 	r.Plugins = plugins
 }
 
+// standardizeJVMVersions normalizes the JVM version on each node with the jvmVersion rules
 func standardizeJVMVersions(r *JSONReport) {
 	var nodes []JSONNode
 	for _, n := range r.Nodes {
-		fullVersion := hotspotJVMVersionToJavaVersion(n.JVMVersion)
-		if fullVersion == "" {
+		result := normalizeValue(RuleFieldJVMVersion, n.JVMVersion)
+		if result.Dropped {
 			n.JVMVersion = "N/A"
-		} else if fullVersion == "8" {
-			n.JVMVersion = "1.8"
-		} else if strings.HasPrefix(fullVersion, "1.") {
-			n.JVMVersion = fullVersion[0:3]
-			if n.JVMVersion == "1.9" {
-				n.JVMVersion = "9"
-			}
 		} else {
-			splitVersion := strings.Split(fullVersion, ".")
-			n.JVMVersion = splitVersion[0]
+			n.JVMVersion = result.Value
 		}
 		nodes = append(nodes, n)
 	}
 	r.Nodes = nodes
 }
 
-func hotspotJVMVersionToJavaVersion(input string) string {
-	for _, hv := range hotspotAndMisc16Versions {
-		if input == hv {
-			return "1.6"
-		}
+// standardizeJVMVendors normalizes the JVM vendor and name on each node with the jvmVendor and jvmName rules, so that
+// e.g. "Eclipse Adoptium" and "Temurin" builds are counted together.
+func standardizeJVMVendors(r *JSONReport) {
+	var nodes []JSONNode
+	for _, n := range r.Nodes {
+		n.JVMVendor = normalizeName(RuleFieldJVMVendor, n.JVMVendor)
+		n.JVMName = normalizeName(RuleFieldJVMName, n.JVMName)
+		nodes = append(nodes, n)
 	}
-	return input
+	r.Nodes = nodes
+}
+
+// normalizeName normalizes a value with the rules for the field, or returns "N/A" if a rule drops it
+func normalizeName(field, value string) string {
+	result := normalizeValue(field, value)
+	if result.Dropped {
+		return "N/A"
+	}
+	return result.Value
+}
+
+// standardizeServletContainer normalizes the servlet container with the servletContainer rules, into its product and
+// major version, such as "Jetty 9" for "jetty/9.4.25.v20191220".
+func standardizeServletContainer(r *JSONReport) {
+	r.ServletContainer = normalizeName(RuleFieldServletContainer, r.ServletContainer)
 }
@@ -1,6 +1,11 @@
 package stats_test
 
 import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"os"
 	"path/filepath"
 	"testing"
 	"time"
@@ -21,12 +26,124 @@ func TestParseDailyJSON(t *testing.T) {
 	assert.Len(t, reports[0].Plugins, 75)
 	assert.Equal(t, "1.8", reports[0].Nodes[0].JVMVersion)
 	assert.Equal(t, "1.6", reports[1].Nodes[0].JVMVersion)
+	assert.Equal(t, "Oracle", reports[0].Nodes[0].JVMVendor)
+	assert.Equal(t, "HotSpot", reports[0].Nodes[0].JVMName)
+	assert.Equal(t, "Ubuntu", reports[1].Nodes[0].JVMVendor)
+	assert.Equal(t, "HotSpot", reports[1].Nodes[0].JVMName)
+	assert.Equal(t, "N/A", reports[1].Nodes[1].JVMVendor)
+	assert.Equal(t, "Jetty 9", reports[0].ServletContainer)
 
 	ts, err := reports[0].Timestamp()
 	require.NoError(t, err)
 	assert.Equal(t, time.Date(2021, time.October, 30, 23, 59, 54, 0, time.UTC), ts)
 }
 
+// BenchmarkParseDailyJSON compares ParseDailyJSON, which checks every report against the format schemas, with
+// parseDailyJSONBaseline, which decodes the reports as ParseDailyJSON did before there were schemas.
+func BenchmarkParseDailyJSON(b *testing.B) {
+	filename := filepath.Join("testdata", "base.json.gz")
+
+	b.Run("Formats", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			if _, err := stats.ParseDailyJSON(filename); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+
+	b.Run("Baseline", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			if _, err := parseDailyJSONBaseline(filename); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+// parseDailyJSONBaseline decodes each report straight into a JSONReport, with no schema validation or unknown fields
+func parseDailyJSONBaseline(filename string) ([]*stats.JSONReport, error) {
+	gzippedJSON, err := os.ReadFile(filename) //nolint:gosec
+	if err != nil {
+		return nil, err
+	}
+	zReader, err := gzip.NewReader(bytes.NewReader(gzippedJSON))
+	if err != nil {
+		return nil, err
+	}
+
+	var reports []*stats.JSONReport
+
+	scanner := bufio.NewScanner(zReader)
+	sBuffer := make([]byte, 0, bufio.MaxScanTokenSize)
+	scanner.Buffer(sBuffer, bufio.MaxScanTokenSize*50)
+
+	for scanner.Scan() {
+		var r *stats.JSONReport
+		if err := json.Unmarshal(scanner.Bytes(), &r); err != nil {
+			return nil, err
+		}
+		stats.NormalizeReport(r)
+		reports = append(reports, r)
+	}
+	return reports, scanner.Err()
+}
+
+func TestParseDailyJSONFormats(t *testing.T) {
+	expected, err := stats.ParseDailyJSON(filepath.Join("testdata", "base.json.gz"))
+	require.NoError(t, err)
+
+	for _, fn := range []string{"base.json", "base.json.bz2", "base.json.zst"} {
+		t.Run(fn, func(t *testing.T) {
+			reports, err := stats.ParseDailyJSON(filepath.Join("testdata", fn))
+			require.NoError(t, err)
+			assert.Equal(t, expected, reports)
+		})
+	}
+}
+
+func TestParseJSONReports(t *testing.T) {
+	raw, err := os.ReadFile(filepath.Join("testdata", "base.json"))
+	require.NoError(t, err)
+
+	// Blank lines, such as a trailing newline in a .jsonl file, are ignored.
+	reports, err := stats.ParseJSONReports(bytes.NewReader(append(raw, []byte("\n\n")...)))
+	require.NoError(t, err)
+	assert.Len(t, reports, 2)
+}
+
+func TestParseJSONReportsWithHash(t *testing.T) {
+	filename := filepath.Join("testdata", "base.json")
+	expected, err := stats.ReportFileHash(filename)
+	require.NoError(t, err)
+
+	f, err := os.Open(filename)
+	require.NoError(t, err)
+	defer func() {
+		_ = f.Close()
+	}()
+
+	reports, hash, err := stats.ParseJSONReportsWithHash(f)
+	require.NoError(t, err)
+	assert.Len(t, reports, 2)
+	assert.Equal(t, expected, hash)
+}
+
+func TestReportOrdering(t *testing.T) {
+	first, err := stats.FirstReportTime(filepath.Join("testdata", "day-later.json.gz"))
+	require.NoError(t, err)
+	assert.Equal(t, time.Date(2021, time.October, 31, 23, 59, 54, 0, time.UTC), first)
+
+	reports := []*stats.JSONReport{
+		{Install: "later", TimestampString: "31/Oct/2021:23:59:54 +0000"},
+		{Install: "invalid", TimestampString: "yesterday"},
+		{Install: "earlier", TimestampString: "30/Oct/2021:23:59:54 +0000"},
+	}
+	stats.SortReportsByTime(reports)
+	assert.Equal(t, "earlier", reports[0].Install)
+	assert.Equal(t, "later", reports[1].Install)
+	assert.Equal(t, "invalid", reports[2].Install)
+}
+
 func TestFilterPrivateFromReport(t *testing.T) {
 	report := &stats.JSONReport{
 		Plugins: []stats.JSONPlugin{
@@ -0,0 +1,169 @@
+package stats
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	sq "github.com/Masterminds/squirrel"
+)
+
+const (
+	// PeriodMonth is a calendar month, with keys like 2022-06
+	PeriodMonth = "month"
+	// PeriodWeek is an ISO 8601 week, starting on Monday, with keys like 2022-W23
+	PeriodWeek = "week"
+
+	// LegacyReportingTimezone is the name for the fixed -0800 offset the infra-statistics reports used for month
+	// boundaries
+	LegacyReportingTimezone = "legacy"
+
+	// settingReportingTimezone is the name of the setting the reporting timezone is recorded in
+	settingReportingTimezone = "reporting_timezone"
+)
+
+// Periods are the reporting periods reports can be grouped by
+var Periods = []string{PeriodMonth, PeriodWeek}
+
+// ParseReportingTimezone parses the timezone reporting periods start at midnight in. This is either an IANA timezone
+// name, such as America/Los_Angeles, a fixed offset from UTC, such as -0800, or LegacyReportingTimezone. An empty string
+// is UTC.
+func ParseReportingTimezone(name string) (*time.Location, error) {
+	switch {
+	case name == "" || name == "UTC":
+		return time.FixedZone("", 0), nil
+	case name == LegacyReportingTimezone:
+		return time.FixedZone("-0800", -8*60*60), nil
+	case strings.HasPrefix(name, "+") || strings.HasPrefix(name, "-"):
+		t, err := time.Parse("-0700", name)
+		if err != nil {
+			return nil, fmt.Errorf("invalid UTC offset %s, must be like -0800", name)
+		}
+		_, offset := t.Zone()
+		return time.FixedZone(name, offset), nil
+	}
+	return time.LoadLocation(name)
+}
+
+// reportingLocation returns the timezone reporting periods start at midnight in, which is UTC if loc is nil
+func reportingLocation(loc *time.Location) *time.Location {
+	if loc == nil {
+		return time.UTC
+	}
+	return loc
+}
+
+// ReportingTimezoneName returns the name of the timezone reporting periods start at midnight in, which can be parsed by
+// ParseReportingTimezone. Timezones which are the same fixed offset, such as -0800 and LegacyReportingTimezone, have the
+// same name, and nil is UTC.
+func ReportingTimezoneName(loc *time.Location) string {
+	name := reportingLocation(loc).String()
+	if name == "" {
+		return "UTC"
+	}
+	return name
+}
+
+// CheckReportingTimezone returns an error if the reports in the database were assigned to reporting periods in a
+// different timezone to loc, since their months would then be mixed with months starting at other times. If record is
+// set and no timezone has been recorded yet, such as before the first import, loc is recorded.
+func CheckReportingTimezone(db sq.BaseRunner, loc *time.Location, record bool) error {
+	current := ReportingTimezoneName(loc)
+	if record {
+		_, err := PSQL(db).Insert(SettingsTable).
+			Columns("name", "value").
+			Values(settingReportingTimezone, current).
+			Suffix("on conflict (name) do nothing").
+			Exec()
+		if err != nil {
+			return err
+		}
+	}
+
+	var recorded string
+	err := PSQL(db).Select("value").
+		From(SettingsTable).
+		Where(sq.Eq{"name": settingReportingTimezone}).
+		QueryRow().
+		Scan(&recorded)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if recorded != current {
+		return fmt.Errorf("reports in this database were added with reporting periods starting at midnight in %s, not %s, so pass --timezone %s", recorded, current, recorded)
+	}
+	return nil
+}
+
+// PreviousMonth returns the year and month of the reporting month before the one the time is in, with reporting periods
+// starting at midnight in loc
+func PreviousMonth(t time.Time, loc *time.Location) (int, int) {
+	now := t.In(reportingLocation(loc))
+	prev := startDateForYearMonth(now.Year(), int(now.Month()), loc).AddDate(0, -1, 0)
+	return prev.Year(), int(prev.Month())
+}
+
+// PeriodKey returns the key of the reporting period a time is in, with reporting periods starting at midnight in loc
+func PeriodKey(period string, t time.Time, loc *time.Location) (string, error) {
+	t = t.In(reportingLocation(loc))
+	switch period {
+	case PeriodMonth:
+		return monthKey(t.Year(), int(t.Month())), nil
+	case PeriodWeek:
+		year, week := t.ISOWeek()
+		return fmt.Sprintf("%04d-W%02d", year, week), nil
+	}
+	return "", fmt.Errorf("unknown period %s, must be one of %s", period, strings.Join(Periods, ", "))
+}
+
+// PeriodStart returns the start of the reporting period with the key, with reporting periods starting at midnight in loc
+func PeriodStart(period, key string, loc *time.Location) (time.Time, error) {
+	var year, n int
+	var format string
+	switch period {
+	case PeriodMonth:
+		format = "%04d-%02d"
+	case PeriodWeek:
+		format = "%04d-W%02d"
+	default:
+		return time.Time{}, fmt.Errorf("unknown period %s, must be one of %s", period, strings.Join(Periods, ", "))
+	}
+	if _, err := fmt.Sscanf(key, format, &year, &n); err != nil || fmt.Sprintf(format, year, n) != key {
+		return time.Time{}, fmt.Errorf("invalid %s key %s", period, key)
+	}
+
+	if period == PeriodMonth {
+		if n < 1 || n > 12 {
+			return time.Time{}, fmt.Errorf("invalid %s key %s", period, key)
+		}
+		return startDateForYearMonth(year, n, loc), nil
+	}
+	// January 4th is always in the first ISO week of the year.
+	jan4 := time.Date(year, time.January, 4, 0, 0, 0, 0, reportingLocation(loc))
+	start := jan4.AddDate(0, 0, -((int(jan4.Weekday())+6)%7)+(n-1)*7)
+	if y, w := start.ISOWeek(); y != year || w != n {
+		return time.Time{}, fmt.Errorf("invalid %s key %s", period, key)
+	}
+	return start, nil
+}
+
+// PeriodEnd returns the start of the reporting period after the one with the key
+func PeriodEnd(period, key string, loc *time.Location) (time.Time, error) {
+	start, err := PeriodStart(period, key, loc)
+	if err != nil {
+		return start, err
+	}
+	if period == PeriodWeek {
+		return start.AddDate(0, 0, 7), nil
+	}
+	return start.AddDate(0, 1, 0), nil
+}
+
+func monthKey(year, month int) string {
+	return fmt.Sprintf("%04d-%02d", year, month)
+}
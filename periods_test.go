@@ -0,0 +1,139 @@
+package stats_test
+
+import (
+	"testing"
+	"time"
+
+	stats "github.com/jenkins-infra/jenkins-usage-stats"
+	"github.com/jenkins-infra/jenkins-usage-stats/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPeriodKey(t *testing.T) {
+	// 03:00 UTC on July 1st is still June 30th with the legacy boundary.
+	ts := time.Date(2022, time.July, 1, 3, 0, 0, 0, time.UTC)
+	for _, tc := range []struct {
+		timezone string
+		period   string
+		key      string
+	}{
+		{timezone: "", period: stats.PeriodMonth, key: "2022-07"},
+		{timezone: "", period: stats.PeriodWeek, key: "2022-W26"},
+		{timezone: stats.LegacyReportingTimezone, period: stats.PeriodMonth, key: "2022-06"},
+		{timezone: "America/Los_Angeles", period: stats.PeriodMonth, key: "2022-06"},
+		{timezone: "+0200", period: stats.PeriodMonth, key: "2022-07"},
+	} {
+		loc, err := stats.ParseReportingTimezone(tc.timezone)
+		require.NoError(t, err)
+
+		key, err := stats.PeriodKey(tc.period, ts, loc)
+		require.NoError(t, err)
+		assert.Equal(t, tc.key, key, "%s in %q", tc.period, tc.timezone)
+	}
+
+	_, err := stats.PeriodKey("fortnight", ts, nil)
+	assert.Error(t, err)
+	_, err = stats.ParseReportingTimezone("-25:00")
+	assert.Error(t, err)
+}
+
+func TestPeriodStart(t *testing.T) {
+	for _, tc := range []struct {
+		period string
+		key    string
+		start  time.Time
+		end    time.Time
+	}{
+		{period: stats.PeriodMonth, key: "2022-06",
+			start: time.Date(2022, time.June, 1, 0, 0, 0, 0, time.UTC), end: time.Date(2022, time.July, 1, 0, 0, 0, 0, time.UTC)},
+		// The first ISO week of 2021 starts on January 4th, and the first of 2020 in December 2019.
+		{period: stats.PeriodWeek, key: "2021-W01",
+			start: time.Date(2021, time.January, 4, 0, 0, 0, 0, time.UTC), end: time.Date(2021, time.January, 11, 0, 0, 0, 0, time.UTC)},
+		{period: stats.PeriodWeek, key: "2020-W01",
+			start: time.Date(2019, time.December, 30, 0, 0, 0, 0, time.UTC), end: time.Date(2020, time.January, 6, 0, 0, 0, 0, time.UTC)},
+		{period: stats.PeriodWeek, key: "2020-W53",
+			start: time.Date(2020, time.December, 28, 0, 0, 0, 0, time.UTC), end: time.Date(2021, time.January, 4, 0, 0, 0, 0, time.UTC)},
+	} {
+		start, err := stats.PeriodStart(tc.period, tc.key, nil)
+		require.NoError(t, err)
+		assert.True(t, tc.start.Equal(start), "start of %s: %s", tc.key, start)
+		end, err := stats.PeriodEnd(tc.period, tc.key, nil)
+		require.NoError(t, err)
+		assert.True(t, tc.end.Equal(end), "end of %s: %s", tc.key, end)
+	}
+
+	loc, err := stats.ParseReportingTimezone(stats.LegacyReportingTimezone)
+	require.NoError(t, err)
+	start, err := stats.PeriodStart(stats.PeriodMonth, "2022-06", loc)
+	require.NoError(t, err)
+	assert.True(t, time.Date(2022, time.June, 1, 8, 0, 0, 0, time.UTC).Equal(start))
+
+	for _, tc := range []struct{ period, key string }{
+		{stats.PeriodMonth, "2022-13"},
+		{stats.PeriodMonth, "2022-6"},
+		{stats.PeriodWeek, "2021-W53"},
+		{stats.PeriodWeek, "2022-06"},
+	} {
+		_, err := stats.PeriodStart(tc.period, tc.key, nil)
+		assert.Error(t, err, "%s %s", tc.period, tc.key)
+	}
+}
+
+func TestPreviousMonth(t *testing.T) {
+	year, month := stats.PreviousMonth(time.Date(2022, time.March, 31, 12, 0, 0, 0, time.UTC), nil)
+	assert.Equal(t, 2022, year)
+	assert.Equal(t, 2, month)
+
+	year, month = stats.PreviousMonth(time.Date(2022, time.January, 1, 0, 0, 0, 0, time.UTC), nil)
+	assert.Equal(t, 2021, year)
+	assert.Equal(t, 12, month)
+
+	// Midnight UTC on March 1st is still February with the legacy boundary.
+	legacy, err := stats.ParseReportingTimezone(stats.LegacyReportingTimezone)
+	require.NoError(t, err)
+	year, month = stats.PreviousMonth(time.Date(2022, time.March, 1, 0, 0, 0, 0, time.UTC), legacy)
+	assert.Equal(t, 2022, year)
+	assert.Equal(t, 1, month)
+}
+
+func TestReportingTimezoneName(t *testing.T) {
+	assert.Equal(t, "UTC", stats.ReportingTimezoneName(nil))
+	for timezone, name := range map[string]string{
+		"":                            "UTC",
+		"UTC":                         "UTC",
+		stats.LegacyReportingTimezone: "-0800",
+		"-0800":                       "-0800",
+		"America/Los_Angeles":         "America/Los_Angeles",
+	} {
+		loc, err := stats.ParseReportingTimezone(timezone)
+		require.NoError(t, err)
+		assert.Equal(t, name, stats.ReportingTimezoneName(loc), timezone)
+
+		// The name parses back to the same timezone.
+		loc, err = stats.ParseReportingTimezone(name)
+		require.NoError(t, err)
+		assert.Equal(t, name, stats.ReportingTimezoneName(loc), timezone)
+	}
+}
+
+func TestCheckReportingTimezone(t *testing.T) {
+	db, closeFunc := testutil.DBForTest(t)
+	defer closeFunc()
+
+	utc, err := stats.ParseReportingTimezone("")
+	require.NoError(t, err)
+	legacy, err := stats.ParseReportingTimezone(stats.LegacyReportingTimezone)
+	require.NoError(t, err)
+
+	// Nothing is recorded until a timezone is recorded, such as by the first import.
+	require.NoError(t, stats.CheckReportingTimezone(db, legacy, false))
+	require.NoError(t, stats.CheckReportingTimezone(db, utc, true))
+
+	assert.NoError(t, stats.CheckReportingTimezone(db, utc, false))
+	assert.NoError(t, stats.CheckReportingTimezone(db, nil, true))
+
+	assert.EqualError(t, stats.CheckReportingTimezone(db, legacy, false),
+		"reports in this database were added with reporting periods starting at midnight in UTC, not -0800, so pass --timezone UTC")
+	assert.Error(t, stats.CheckReportingTimezone(db, legacy, true))
+}
@@ -0,0 +1,343 @@
+package stats
+
+import (
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"math/bits"
+	"sort"
+	"time"
+
+	sq "github.com/Masterminds/squirrel"
+	"github.com/lib/pq"
+)
+
+const (
+	// QuarantinedInstancesTable is the quarantined_instances table name
+	QuarantinedInstancesTable = "quarantined_instances"
+	// ReleasedInstancesTable is the released_instances table name
+	ReleasedInstancesTable = "released_instances"
+
+	// QuarantineReasonJenkinsVersions is for instances reporting too many distinct Jenkins versions in a month
+	QuarantineReasonJenkinsVersions = "jenkins-versions"
+	// QuarantineReasonControllers is for instances reporting too many distinct controller configurations in a month
+	QuarantineReasonControllers = "controllers"
+	// QuarantineReasonPluginSets is for instances whose plugins change completely too often in a month
+	QuarantineReasonPluginSets = "plugin-sets"
+
+	pluginSignatureWords = 16
+)
+
+// QuarantineThresholds configures when an instance ID is considered suspicious in a month
+type QuarantineThresholds struct {
+	// MaxJenkinsVersions is the most distinct Jenkins versions an instance can report in a month
+	MaxJenkinsVersions int
+	// MaxControllers is the most distinct controller configurations, i.e. OS and Java version, an instance can report
+	// in a month
+	MaxControllers int
+	// MaxPluginSetChanges is the most times an instance's plugins can change completely in a month
+	MaxPluginSetChanges int
+	// PluginSetSimilarity is the similarity, from 0 to 1, below which consecutive plugin sets are a complete change
+	PluginSetSimilarity float64
+}
+
+// DefaultQuarantineThresholds returns the thresholds used if none are specified
+func DefaultQuarantineThresholds() QuarantineThresholds {
+	return QuarantineThresholds{
+		MaxJenkinsVersions:  3,
+		MaxControllers:      2,
+		MaxPluginSetChanges: 3,
+		PluginSetSimilarity: 0.5,
+	}
+}
+
+// QuarantineEvidence is what an instance reported in a month which made it suspicious
+type QuarantineEvidence struct {
+	Reports          int      `json:"reports"`
+	JenkinsVersions  []string `json:"jenkinsVersions"`
+	Controllers      []string `json:"controllers"`
+	PluginSetChanges int      `json:"pluginSetChanges"`
+}
+
+// SuspiciousInstance is an instance ID which looks like it's shared by more than one real instance in a month, such as
+// from a cloned JENKINS_HOME or a shared image
+type SuspiciousInstance struct {
+	InstanceID string             `json:"instanceId"`
+	Year       int                `json:"year"`
+	Month      int                `json:"month"`
+	Reasons    []string           `json:"reasons"`
+	Evidence   QuarantineEvidence `json:"evidence"`
+	DetectedAt time.Time          `json:"detectedAt"`
+}
+
+// InstanceActivity tracks what each instance reports in each month, to find suspicious instance IDs. Reports need to
+// be added in timestamp order.
+type InstanceActivity struct {
+	thresholds QuarantineThresholds
+	location   *time.Location
+	instances  map[instanceMonthKey]*instanceMonthActivity
+}
+
+type instanceMonthActivity struct {
+	reports          int
+	jenkinsVersions  map[string]bool
+	controllers      map[string]bool
+	pluginSetChanges int
+	// lastPlugins is a fixed size signature of the last report's plugin names, rather than the names themselves, to
+	// keep memory use down across a month of reports
+	lastPlugins *[pluginSignatureWords]uint64
+}
+
+// NewInstanceActivity returns an empty InstanceActivity, for months starting at midnight in loc
+func NewInstanceActivity(thresholds QuarantineThresholds, loc *time.Location) *InstanceActivity {
+	return &InstanceActivity{
+		thresholds: thresholds,
+		location:   reportingLocation(loc),
+		instances:  map[instanceMonthKey]*instanceMonthActivity{},
+	}
+}
+
+// Add records a report. Reports which would be skipped on import are ignored.
+func (ia *InstanceActivity) Add(r *JSONReport) {
+	version, reason := checkReport(r)
+	if reason != "" {
+		return
+	}
+	ts, err := r.Timestamp()
+	if err != nil {
+		return
+	}
+
+	ts = ts.In(ia.location)
+	key := instanceMonthKey{instanceID: r.Install, year: ts.Year(), month: int(ts.Month())}
+	activity, ok := ia.instances[key]
+	if !ok {
+		activity = &instanceMonthActivity{jenkinsVersions: map[string]bool{}, controllers: map[string]bool{}}
+		ia.instances[key] = activity
+	}
+	activity.reports++
+	activity.jenkinsVersions[version] = true
+	for _, n := range r.Nodes {
+		if n.IsController {
+			activity.controllers[fmt.Sprintf("%s, Java %s", n.OS, n.JVMVersion)] = true
+		}
+	}
+
+	signature := pluginSignature(r)
+	if activity.lastPlugins != nil && signatureSimilarity(activity.lastPlugins, signature) < ia.thresholds.PluginSetSimilarity {
+		activity.pluginSetChanges++
+	}
+	activity.lastPlugins = signature
+}
+
+// Suspicious returns the instances which exceed any of the thresholds in any month, ordered by month and instance ID
+func (ia *InstanceActivity) Suspicious() []SuspiciousInstance {
+	var suspicious []SuspiciousInstance
+	for key, activity := range ia.instances {
+		var reasons []string
+		if len(activity.jenkinsVersions) > ia.thresholds.MaxJenkinsVersions {
+			reasons = append(reasons, QuarantineReasonJenkinsVersions)
+		}
+		if len(activity.controllers) > ia.thresholds.MaxControllers {
+			reasons = append(reasons, QuarantineReasonControllers)
+		}
+		if activity.pluginSetChanges > ia.thresholds.MaxPluginSetChanges {
+			reasons = append(reasons, QuarantineReasonPluginSets)
+		}
+		if len(reasons) == 0 {
+			continue
+		}
+		suspicious = append(suspicious, SuspiciousInstance{
+			InstanceID: key.instanceID,
+			Year:       key.year,
+			Month:      key.month,
+			Reasons:    reasons,
+			Evidence: QuarantineEvidence{
+				Reports:          activity.reports,
+				JenkinsVersions:  sortedKeys(activity.jenkinsVersions),
+				Controllers:      sortedKeys(activity.controllers),
+				PluginSetChanges: activity.pluginSetChanges,
+			},
+		})
+	}
+
+	sort.Slice(suspicious, func(i, j int) bool {
+		if suspicious[i].Year != suspicious[j].Year {
+			return suspicious[i].Year < suspicious[j].Year
+		}
+		if suspicious[i].Month != suspicious[j].Month {
+			return suspicious[i].Month < suspicious[j].Month
+		}
+		return suspicious[i].InstanceID < suspicious[j].InstanceID
+	})
+	return suspicious
+}
+
+// QuarantineInstances stores suspicious instances in the quarantined_instances table, replacing any earlier entries
+// for the same instances and months, and returns how many were quarantined. Instances which have been released are
+// left out, so a false positive stays released when the same reports are checked again.
+func QuarantineInstances(db sq.BaseRunner, instances []SuspiciousInstance) (int, error) {
+	released, err := releasedInstanceIDs(db)
+	if err != nil {
+		return 0, err
+	}
+
+	now := time.Now().UTC()
+	quarantined := 0
+	for _, si := range instances {
+		if released[si.InstanceID] {
+			continue
+		}
+		evidence, err := json.Marshal(si.Evidence)
+		if err != nil {
+			return 0, err
+		}
+		_, err = PSQL(db).Insert(QuarantinedInstancesTable).
+			Columns("instance_id", "year", "month", "reasons", "evidence", "detected_at").
+			Values(si.InstanceID, si.Year, si.Month, pq.StringArray(si.Reasons), evidence, now).
+			Suffix("on conflict (instance_id, year, month) do update set reasons = excluded.reasons, " +
+				"evidence = excluded.evidence, detected_at = excluded.detected_at").
+			Exec()
+		if err != nil {
+			return 0, err
+		}
+		quarantined++
+	}
+	return quarantined, nil
+}
+
+// releasedInstanceIDs returns the instance IDs which have been released from quarantine
+func releasedInstanceIDs(db sq.BaseRunner) (map[string]bool, error) {
+	rows, err := PSQL(db).Select("instance_id").From(ReleasedInstancesTable).Query()
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = rows.Close()
+	}()
+
+	released := make(map[string]bool)
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		released[id] = true
+	}
+	return released, rows.Err()
+}
+
+// GetQuarantinedInstances returns the quarantined instances for a month, or for every month if year and month are 0
+func GetQuarantinedInstances(db sq.BaseRunner, year, month int) ([]SuspiciousInstance, error) {
+	stmt := PSQL(db).Select("instance_id", "year", "month", "reasons", "evidence", "detected_at").
+		From(QuarantinedInstancesTable).
+		OrderBy("year", "month", "instance_id")
+	if year > 0 && month > 0 {
+		stmt = stmt.Where(sq.Eq{"year": year, "month": month})
+	}
+	rows, err := stmt.Query()
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = rows.Close()
+	}()
+
+	var instances []SuspiciousInstance
+	for rows.Next() {
+		var si SuspiciousInstance
+		var reasons pq.StringArray
+		var evidence []byte
+		if err := rows.Scan(&si.InstanceID, &si.Year, &si.Month, &reasons, &evidence, &si.DetectedAt); err != nil {
+			return nil, err
+		}
+		si.Reasons = reasons
+		if err := json.Unmarshal(evidence, &si.Evidence); err != nil {
+			return nil, err
+		}
+		instances = append(instances, si)
+	}
+	return instances, rows.Err()
+}
+
+// ReleaseQuarantinedInstance removes an instance ID from quarantine for every month, returning how many months it was
+// quarantined for. The release is recorded in the released_instances table, so QuarantineInstances won't quarantine
+// the instance again.
+func ReleaseQuarantinedInstance(db sq.BaseRunner, instanceID string) (int64, error) {
+	_, err := PSQL(db).Insert(ReleasedInstancesTable).
+		Columns("instance_id", "released_at").
+		Values(instanceID, time.Now().UTC()).
+		Suffix("on conflict (instance_id) do update set released_at = excluded.released_at").
+		Exec()
+	if err != nil {
+		return 0, err
+	}
+
+	result, err := PSQL(db).Delete(QuarantinedInstancesTable).Where(sq.Eq{"instance_id": instanceID}).Exec()
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+// CountOptions are the options for which instance reports the report functions count
+type CountOptions struct {
+	// ExcludeQuarantined, if set, leaves instances quarantined for a month out of that month's numbers
+	ExcludeQuarantined bool
+	// Location is the timezone the reports were added with reporting periods starting at midnight in, which months are
+	// timestamped with. It's UTC if nil.
+	Location *time.Location
+}
+
+// countedInstances is the criteria for an instance report to be counted: at least two reports in the month, and not
+// quarantined for the month if excludeQuarantined is set. table is the name or alias of the instance_reports table in
+// the query.
+func countedInstances(table string, excludeQuarantined bool) sq.Sqlizer {
+	return countedCriteria(table, "count_for_month", excludeQuarantined)
+}
+
+// countedCriteria is the criteria for a row in a table of instance reports to be counted, given the column with the
+// number of reports it's the latest of. The table needs instance_id, year and month columns.
+func countedCriteria(table, countColumn string, excludeQuarantined bool) sq.Sqlizer {
+	criteria := sq.And{sq.GtOrEq{table + "." + countColumn: 2}}
+	if excludeQuarantined {
+		criteria = append(criteria, sq.Expr("not exists (select 1 from "+QuarantinedInstancesTable+" q where q.instance_id = "+
+			table+".instance_id and q.year = "+table+".year and q.month = "+table+".month)"))
+	}
+	return criteria
+}
+
+// pluginSignature sets a bit for each of the report's plugin names
+func pluginSignature(r *JSONReport) *[pluginSignatureWords]uint64 {
+	var sig [pluginSignatureWords]uint64
+	for _, p := range r.Plugins {
+		h := fnv.New32a()
+		_, _ = h.Write([]byte(p.Name))
+		bit := h.Sum32() % (pluginSignatureWords * 64)
+		sig[bit/64] |= 1 << (bit % 64)
+	}
+	return &sig
+}
+
+// signatureSimilarity is the Jaccard similarity of two plugin signatures, which approximates that of the plugin sets.
+// Two empty sets are identical.
+func signatureSimilarity(a, b *[pluginSignatureWords]uint64) float64 {
+	var intersection, union int
+	for i := range a {
+		intersection += bits.OnesCount64(a[i] & b[i])
+		union += bits.OnesCount64(a[i] | b[i])
+	}
+	if union == 0 {
+		return 1
+	}
+	return float64(intersection) / float64(union)
+}
+
+func sortedKeys(m map[string]bool) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
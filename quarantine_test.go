@@ -0,0 +1,115 @@
+package stats_test
+
+import (
+	"fmt"
+	"testing"
+
+	stats "github.com/jenkins-infra/jenkins-usage-stats"
+	"github.com/jenkins-infra/jenkins-usage-stats/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestInstanceActivity(t *testing.T) {
+	activity := stats.NewInstanceActivity(stats.DefaultQuarantineThresholds(), nil)
+
+	setA := []string{"git", "workflow-job", "credentials", "matrix-auth"}
+	setB := []string{"ldap", "docker-plugin", "kubernetes", "ssh-slaves"}
+	for day := 1; day <= 8; day++ {
+		activity.Add(testReport("stable", day, "2.303.1", "Linux", setA...))
+
+		// Four Jenkins versions, and the plugins switch between two unrelated sets every day.
+		plugins := setA
+		if day%2 == 0 {
+			plugins = setB
+		}
+		activity.Add(testReport("versions-and-plugins", day, fmt.Sprintf("2.30%d.1", day%4), "Linux", plugins...))
+
+		// Three controller configurations
+		activity.Add(testReport("controllers", day, "2.303.1", fmt.Sprintf("Linux %d", day%3), setA...))
+	}
+	// Reports which wouldn't be imported aren't counted.
+	activity.Add(testReport("stable", 9, "2.303.1-SNAPSHOT", "Windows", setB...))
+
+	suspicious := activity.Suspicious()
+	require.Len(t, suspicious, 2)
+
+	assert.Equal(t, "controllers", suspicious[0].InstanceID)
+	assert.Equal(t, 2022, suspicious[0].Year)
+	assert.Equal(t, 6, suspicious[0].Month)
+	assert.Equal(t, []string{stats.QuarantineReasonControllers}, suspicious[0].Reasons)
+	assert.Equal(t, stats.QuarantineEvidence{
+		Reports:         8,
+		JenkinsVersions: []string{"2.303.1"},
+		Controllers:     []string{"Linux 0, Java 11.0.13", "Linux 1, Java 11.0.13", "Linux 2, Java 11.0.13"},
+	}, suspicious[0].Evidence)
+
+	assert.Equal(t, "versions-and-plugins", suspicious[1].InstanceID)
+	assert.Equal(t, []string{stats.QuarantineReasonJenkinsVersions, stats.QuarantineReasonPluginSets}, suspicious[1].Reasons)
+	assert.Equal(t, 7, suspicious[1].Evidence.PluginSetChanges)
+	assert.Len(t, suspicious[1].Evidence.JenkinsVersions, 4)
+}
+
+func TestQuarantineInstances(t *testing.T) {
+	db, closeFunc := testutil.DBForTest(t)
+	defer closeFunc()
+	excluded := stats.CountOptions{ExcludeQuarantined: true}
+
+	cache := stats.NewStatsCache()
+	for _, install := range []string{"cloned", "normal"} {
+		for day := 1; day <= 2; day++ {
+			require.NoError(t, stats.AddIndividualReport(db, cache, testReport(install, day, "2.303.1", "Linux", "git")))
+		}
+	}
+
+	suspicious := stats.SuspiciousInstance{
+		InstanceID: "cloned",
+		Year:       2022,
+		Month:      6,
+		Reasons:    []string{stats.QuarantineReasonJenkinsVersions},
+		Evidence:   stats.QuarantineEvidence{Reports: 10, JenkinsVersions: []string{"2.303.1", "2.304", "2.305", "2.306"}},
+	}
+	quarantinedCount, err := stats.QuarantineInstances(db, []stats.SuspiciousInstance{suspicious})
+	require.NoError(t, err)
+	assert.Equal(t, 1, quarantinedCount)
+	// Quarantining again replaces the earlier entry.
+	suspicious.Evidence.Reports = 12
+	_, err = stats.QuarantineInstances(db, []stats.SuspiciousInstance{suspicious})
+	require.NoError(t, err)
+
+	quarantined, err := stats.GetQuarantinedInstances(db, 2022, 6)
+	require.NoError(t, err)
+	require.Len(t, quarantined, 1)
+	assert.Equal(t, "cloned", quarantined[0].InstanceID)
+	assert.Equal(t, []string{stats.QuarantineReasonJenkinsVersions}, quarantined[0].Reasons)
+	assert.Equal(t, suspicious.Evidence, quarantined[0].Evidence)
+	assert.False(t, quarantined[0].DetectedAt.IsZero())
+
+	quarantined, err = stats.GetQuarantinedInstances(db, 2022, 5)
+	require.NoError(t, err)
+	assert.Empty(t, quarantined)
+
+	installs, err := stats.GetInstallCountForVersions(db, stats.CountOptions{}, 2022, 6)
+	require.NoError(t, err)
+	assert.Equal(t, uint64(2), installs.Installations["2.303.1"])
+
+	installs, err = stats.GetInstallCountForVersions(db, excluded, 2022, 6)
+	require.NoError(t, err)
+	assert.Equal(t, uint64(1), installs.Installations["2.303.1"])
+
+	released, err := stats.ReleaseQuarantinedInstance(db, "cloned")
+	require.NoError(t, err)
+	assert.Equal(t, int64(1), released)
+
+	installs, err = stats.GetInstallCountForVersions(db, excluded, 2022, 6)
+	require.NoError(t, err)
+	assert.Equal(t, uint64(2), installs.Installations["2.303.1"])
+
+	// Released instances aren't quarantined again when the same reports are checked.
+	quarantinedCount, err = stats.QuarantineInstances(db, []stats.SuspiciousInstance{suspicious})
+	require.NoError(t, err)
+	assert.Equal(t, 0, quarantinedCount)
+	quarantined, err = stats.GetQuarantinedInstances(db, 2022, 6)
+	require.NoError(t, err)
+	assert.Empty(t, quarantined)
+}
@@ -0,0 +1,304 @@
+package stats
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/Masterminds/semver"
+	sq "github.com/Masterminds/squirrel"
+	"github.com/lib/pq"
+)
+
+// Dimensions a UsageQuery can group its counts by
+const (
+	GroupByNone          = ""
+	GroupByMonth         = "month"
+	GroupByWeek          = "week"
+	GroupByQuarter       = "quarter"
+	GroupByCore          = "core"
+	GroupByJVM           = "jvm"
+	GroupByOS            = "os"
+	GroupByPlugin        = "plugin"
+	GroupByPluginVersion = "plugin-version"
+)
+
+// GroupByDimensions lists the valid values for UsageQuery.GroupBy, other than GroupByNone
+var GroupByDimensions = []string{GroupByMonth, GroupByWeek, GroupByQuarter, GroupByCore, GroupByJVM, GroupByOS, GroupByPlugin, GroupByPluginVersion}
+
+// UsageQuery describes an ad-hoc count of instances, using the same criteria as the generated reports (i.e., only
+// instances which reported at least twice in a month are counted). Instances are counted once per month they appear in,
+// or once per quarter when grouping by quarter. When grouping by week, instances are counted once per ISO week, from the
+// weekly reports kept with ImportConfig.Weekly, for every week overlapping the months.
+type UsageQuery struct {
+	StartYear  int
+	StartMonth int
+	EndYear    int
+	EndMonth   int
+
+	// Plugin restricts the count to instances with this plugin installed
+	Plugin string
+	// PluginVersion is a semver constraint, such as ">= 4.0", on the version of Plugin
+	PluginVersion string
+	// CoreVersion is a semver constraint, such as ">= 2.303, < 2.400", on the Jenkins version
+	CoreVersion string
+	// JVMVersion restricts the count to instances whose controller runs this normalized JVM version, such as "17"
+	JVMVersion string
+	// OS restricts the count to instances with at least one node on this OS
+	OS string
+
+	// GroupBy is the dimension to group counts by, one of GroupByDimensions, or GroupByNone for a single total
+	GroupBy string
+
+	// CountOptions are which instance reports are counted
+	CountOptions
+}
+
+// UsageQueryRow is a single count in a UsageQueryResult
+type UsageQueryRow struct {
+	Key   string `json:"key"`
+	Count uint64 `json:"count"`
+}
+
+// UsageQueryResult is the result of running a UsageQuery
+type UsageQueryResult struct {
+	GroupBy string          `json:"groupBy,omitempty"`
+	Rows    []UsageQueryRow `json:"rows"`
+}
+
+// ToCSV returns a CSV representation of the UsageQueryResult
+func (u UsageQueryResult) ToCSV() (string, error) {
+	var builder strings.Builder
+
+	for _, r := range u.Rows {
+		_, err := builder.Write([]byte(fmt.Sprintf(`"%s","%d"`+"\n", r.Key, r.Count)))
+		if err != nil {
+			return "", err
+		}
+	}
+
+	return builder.String(), nil
+}
+
+// Validate checks that the UsageQuery is well-formed, without touching the database
+func (q UsageQuery) Validate() error {
+	if q.StartMonth < 1 || q.StartMonth > 12 || q.EndMonth < 1 || q.EndMonth > 12 {
+		return fmt.Errorf("months must be between 1 and 12")
+	}
+	if q.StartYear*12+q.StartMonth > q.EndYear*12+q.EndMonth {
+		return fmt.Errorf("start month %d-%02d is after end month %d-%02d", q.StartYear, q.StartMonth, q.EndYear, q.EndMonth)
+	}
+	if q.PluginVersion != "" && q.Plugin == "" {
+		return fmt.Errorf("a plugin version constraint requires a plugin")
+	}
+	if q.GroupBy == GroupByPluginVersion && q.Plugin == "" {
+		return fmt.Errorf("grouping by %s requires a plugin", GroupByPluginVersion)
+	}
+	if q.GroupBy == GroupByWeek && (q.JVMVersion != "" || q.OS != "") {
+		return fmt.Errorf("grouping by %s can't be combined with a JVM or OS, since weekly reports only keep the Jenkins and plugin versions", GroupByWeek)
+	}
+	if q.GroupBy != GroupByNone {
+		known := false
+		for _, d := range GroupByDimensions {
+			known = known || d == q.GroupBy
+		}
+		if !known {
+			return fmt.Errorf("unknown group-by dimension %s, must be one of %s", q.GroupBy, strings.Join(GroupByDimensions, ", "))
+		}
+	}
+	for _, c := range []string{q.PluginVersion, q.CoreVersion} {
+		if c == "" {
+			continue
+		}
+		if _, err := semver.NewConstraint(c); err != nil {
+			return fmt.Errorf("invalid version constraint %s: %w", c, err)
+		}
+	}
+	return nil
+}
+
+// RunUsageQuery counts the instances matching the query, grouped as requested. Versions which can't be parsed as
+// semver never match a version constraint.
+func RunUsageQuery(db sq.BaseRunner, q UsageQuery) (UsageQueryResult, error) {
+	result := UsageQueryResult{GroupBy: q.GroupBy, Rows: []UsageQueryRow{}}
+	if err := q.Validate(); err != nil {
+		return result, err
+	}
+
+	stmt := PSQL(db).Select()
+	if q.GroupBy == GroupByWeek {
+		weeks, err := weeksOverlappingMonths(q.StartYear, q.StartMonth, q.EndYear, q.EndMonth, q.Location)
+		if err != nil {
+			return result, err
+		}
+		stmt = stmt.From(WeeklyInstanceReportsTable+" i").
+			Where("i.week = any(?)", weeks).
+			Where(countedWeeklyInstances("i", q.ExcludeQuarantined))
+	} else {
+		stmt = stmt.From(InstanceReportsTable + " i").
+			Where(sq.Expr("i.year * 12 + i.month between ? and ?", q.StartYear*12+q.StartMonth, q.EndYear*12+q.EndMonth)).
+			Where(countedInstances("i", q.ExcludeQuarantined))
+	}
+
+	var pluginIDs pq.Int64Array
+	if q.Plugin != "" {
+		ids, err := versionIDsMatching(db, PluginsTable, "version", sq.Eq{"name": q.Plugin}, q.PluginVersion)
+		if err != nil {
+			return result, err
+		}
+		if len(ids) == 0 {
+			return result, nil
+		}
+		pluginIDs = ids
+		stmt = stmt.Where("i.plugins && ?", pluginIDs)
+	}
+	if q.CoreVersion != "" {
+		ids, err := versionIDsMatching(db, JenkinsVersionsTable, "version", nil, q.CoreVersion)
+		if err != nil {
+			return result, err
+		}
+		if len(ids) == 0 {
+			return result, nil
+		}
+		stmt = stmt.Where("i.version = any(?)", ids)
+	}
+	if q.JVMVersion != "" {
+		stmt = stmt.Where(sq.Expr("i.jvm_version_id in (select id from jvm_versions where name = ?)", q.JVMVersion))
+	}
+	if q.OS != "" {
+		stmt = stmt.Where(sq.Expr("exists (select 1 from jsonb_each_text(i.nodes) qn join os_types qo on qo.id = qn.key::int where qo.name = ?)", q.OS))
+	}
+
+	keyExpr := "'total'"
+	countExpr := "count(distinct (i.instance_id, i.year, i.month))"
+	switch q.GroupBy {
+	case GroupByMonth:
+		keyExpr = "i.year || '-' || lpad(i.month::text, 2, '0')"
+	case GroupByWeek:
+		keyExpr = "i.week"
+		countExpr = "count(distinct (i.instance_id, i.week))"
+	case GroupByQuarter:
+		keyExpr = "i.quarter"
+		countExpr = "count(distinct (i.instance_id, i.quarter))"
+	case GroupByCore:
+		stmt = stmt.Join("jenkins_versions jv on jv.id = i.version")
+		keyExpr = "jv.version"
+	case GroupByJVM:
+		stmt = stmt.LeftJoin("jvm_versions jvm on jvm.id = i.jvm_version_id")
+		keyExpr = "coalesce(jvm.name, 'N/A')"
+	case GroupByOS:
+		stmt = stmt.JoinClause("cross join jsonb_each_text(i.nodes) gn").
+			Join("os_types o on o.id = gn.key::int")
+		keyExpr = "o.name"
+	case GroupByPlugin:
+		stmt = stmt.JoinClause("cross join unnest(i.plugins) pr(id)").
+			Join("plugins p on p.id = pr.id")
+		keyExpr = "p.name"
+	case GroupByPluginVersion:
+		stmt = stmt.JoinClause("cross join unnest(i.plugins) pr(id)").
+			Join("plugins p on p.id = pr.id").
+			Where("p.id = any(?)", pluginIDs)
+		keyExpr = "p.version"
+	}
+
+	// Instances are counted once per month, even if grouping by OS or plugin produces multiple rows for them.
+	rows, err := stmt.Columns(keyExpr+" as k", countExpr+" as number").
+		GroupBy("k").
+		Query()
+	if err != nil {
+		return result, err
+	}
+	defer func() {
+		_ = rows.Close()
+	}()
+
+	for rows.Next() {
+		var r UsageQueryRow
+		if err := rows.Scan(&r.Key, &r.Count); err != nil {
+			return result, err
+		}
+		result.Rows = append(result.Rows, r)
+	}
+	if err := rows.Err(); err != nil {
+		return result, err
+	}
+
+	sortUsageQueryRows(q.GroupBy, result.Rows)
+
+	return result, nil
+}
+
+// versionIDsMatching returns the IDs of rows in the table whose version column satisfies the semver constraint. If
+// the constraint is empty, all rows matching the where clause are returned.
+func versionIDsMatching(db sq.BaseRunner, table, column string, where sq.Sqlizer, constraint string) (pq.Int64Array, error) {
+	if constraint == "" {
+		return versionIDsWhere(db, table, column, where, nil)
+	}
+	c, err := semver.NewConstraint(constraint)
+	if err != nil {
+		return nil, err
+	}
+	return versionIDsWhere(db, table, column, where, func(version string) bool {
+		sv, err := semver.NewVersion(version)
+		return err == nil && c.Check(sv)
+	})
+}
+
+// versionIDsWhere returns the IDs of rows in the table matching the where clause whose version column matches, or all
+// of them if matches is nil
+func versionIDsWhere(db sq.BaseRunner, table, column string, where sq.Sqlizer, matches func(string) bool) (pq.Int64Array, error) {
+	stmt := PSQL(db).Select("id", column).From(table)
+	if where != nil {
+		stmt = stmt.Where(where)
+	}
+	rows, err := stmt.Query()
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = rows.Close()
+	}()
+
+	ids := pq.Int64Array{}
+	for rows.Next() {
+		var id int64
+		var version string
+		if err := rows.Scan(&id, &version); err != nil {
+			return nil, err
+		}
+		if matches != nil && !matches(version) {
+			continue
+		}
+		ids = append(ids, id)
+	}
+
+	return ids, rows.Err()
+}
+
+// sortUsageQueryRows sorts months, weeks, quarters and versions in ascending order, and everything else by descending
+// count
+func sortUsageQueryRows(groupBy string, rows []UsageQueryRow) {
+	sort.Slice(rows, func(i, j int) bool {
+		switch groupBy {
+		case GroupByMonth, GroupByWeek, GroupByQuarter:
+			return rows[i].Key < rows[j].Key
+		case GroupByCore:
+			return CompareJenkinsVersions(rows[i].Key, rows[j].Key) < 0
+		case GroupByPluginVersion, GroupByJVM:
+			svI, errI := semver.NewVersion(rows[i].Key)
+			svJ, errJ := semver.NewVersion(rows[j].Key)
+			switch {
+			case errI == nil && errJ == nil:
+				return svI.LessThan(svJ)
+			case errI == nil || errJ == nil:
+				// Unparseable versions go last
+				return errI == nil
+			}
+			return rows[i].Key < rows[j].Key
+		}
+		if rows[i].Count != rows[j].Count {
+			return rows[i].Count > rows[j].Count
+		}
+		return rows[i].Key < rows[j].Key
+	})
+}
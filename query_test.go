@@ -0,0 +1,69 @@
+package stats_test
+
+import (
+	"testing"
+
+	stats "github.com/jenkins-infra/jenkins-usage-stats"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestUsageQueryValidate(t *testing.T) {
+	valid := stats.UsageQuery{StartYear: 2022, StartMonth: 1, EndYear: 2022, EndMonth: 6}
+	assert.NoError(t, valid.Validate())
+
+	for name, tc := range map[string]struct {
+		modify func(q *stats.UsageQuery)
+		err    string
+	}{
+		"end before start": {
+			modify: func(q *stats.UsageQuery) { q.EndYear = 2021 },
+			err:    "start month 2022-01 is after end month 2021-06",
+		},
+		"bad month": {
+			modify: func(q *stats.UsageQuery) { q.StartMonth = 13 },
+			err:    "months must be between 1 and 12",
+		},
+		"plugin version without plugin": {
+			modify: func(q *stats.UsageQuery) { q.PluginVersion = ">= 1.0" },
+			err:    "a plugin version constraint requires a plugin",
+		},
+		"plugin-version grouping without plugin": {
+			modify: func(q *stats.UsageQuery) { q.GroupBy = stats.GroupByPluginVersion },
+			err:    "grouping by plugin-version requires a plugin",
+		},
+		"unknown grouping": {
+			modify: func(q *stats.UsageQuery) { q.GroupBy = "color" },
+			err:    "unknown group-by dimension color, must be one of month, week, quarter, core, jvm, os, plugin, plugin-version",
+		},
+		"week grouping with JVM": {
+			modify: func(q *stats.UsageQuery) { q.GroupBy = stats.GroupByWeek; q.JVMVersion = "17" },
+			err:    "grouping by week can't be combined with a JVM or OS",
+		},
+		"bad constraint": {
+			modify: func(q *stats.UsageQuery) { q.CoreVersion = "newest" },
+			err:    "invalid version constraint newest",
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			q := valid
+			tc.modify(&q)
+			err := q.Validate()
+			if assert.Error(t, err) {
+				assert.Contains(t, err.Error(), tc.err)
+			}
+		})
+	}
+}
+
+func TestUsageQueryResultToCSV(t *testing.T) {
+	result := stats.UsageQueryResult{
+		GroupBy: stats.GroupByCore,
+		Rows: []stats.UsageQueryRow{
+			{Key: "2.99", Count: 3},
+			{Key: "2.100", Count: 5},
+		},
+	}
+	csv, err := result.ToCSV()
+	assert.NoError(t, err)
+	assert.Equal(t, "\"2.99\",\"3\"\n\"2.100\",\"5\"\n", csv)
+}
@@ -10,6 +10,7 @@ import (
 	"math"
 	"os"
 	"path/filepath"
+	"regexp"
 	"sort"
 	"strconv"
 	"strings"
@@ -17,9 +18,9 @@ import (
 
 	"gitlab.com/c0b/go-ordered-json"
 
-	"github.com/Masterminds/semver"
 	sq "github.com/Masterminds/squirrel"
 	"github.com/beevik/etree"
+	"github.com/lib/pq"
 )
 
 var (
@@ -233,6 +234,87 @@ type JVMReport struct {
 	PerMonth2x map[string]map[string]uint64 `json:"jvmStatsPerMonth_2.x"`
 }
 
+// JVMVendorReport is marshalled to create jvm-vendors.json, with counts per month, Java version, and JVM vendor or name
+type JVMVendorReport struct {
+	VendorsPerMonth map[string]map[string]map[string]uint64 `json:"jvmVendorStatsPerMonth"`
+	NamesPerMonth   map[string]map[string]map[string]uint64 `json:"jvmNameStatsPerMonth"`
+}
+
+// AgentJVMReport is marshalled to create agent-jvms.json
+type AgentJVMReport struct {
+	AgentsPerMonth         map[string]map[string]uint64 `json:"agentJvmStatsPerMonth"`
+	InstancesPerMonth      map[string]map[string]uint64 `json:"agentJvmInstancesPerMonth"`
+	WithAgentsPerMonth     map[string]uint64            `json:"instancesWithAgentsPerMonth"`
+	MixedInstancesPerMonth map[string]uint64            `json:"mixedJvmInstancesPerMonth"`
+}
+
+// ServletContainerReport is written out to generate servlet-containers.{json,csv}
+type ServletContainerReport struct {
+	PerMonth map[string]map[string]uint64 `json:"servletContainersPerMonth"`
+}
+
+// ToCSV returns a CSV representation of the ServletContainerReport
+func (s ServletContainerReport) ToCSV() (string, error) {
+	var months []string
+
+	for m := range s.PerMonth {
+		months = append(months, m)
+	}
+	sort.Strings(months)
+
+	var builder strings.Builder
+
+	for _, m := range months {
+		var containers []string
+		for c := range s.PerMonth[m] {
+			containers = append(containers, c)
+		}
+		sort.Strings(containers)
+
+		for _, c := range containers {
+			_, err := builder.Write([]byte(fmt.Sprintf(`"%s","%s","%d"`+"\n", m, c, s.PerMonth[m][c])))
+			if err != nil {
+				return "", err
+			}
+		}
+	}
+
+	return builder.String(), nil
+}
+
+// Trends returns the number of instances running each servlet container, by container and then month
+func (s ServletContainerReport) Trends() map[string]map[string]uint64 {
+	trends := map[string]map[string]uint64{}
+	for m, counts := range s.PerMonth {
+		for c, count := range counts {
+			if _, ok := trends[c]; !ok {
+				trends[c] = map[string]uint64{}
+			}
+			trends[c][m] = count
+		}
+	}
+	return trends
+}
+
+// JobCategoriesReport is written out to generate job-categories.json
+type JobCategoriesReport struct {
+	// JobsPerMonth is the total number of jobs in each category
+	JobsPerMonth map[string]map[string]uint64 `json:"jobsPerMonth"`
+	// InstancesPerMonth is the number of instances with at least one job in each category
+	InstancesPerMonth map[string]map[string]uint64 `json:"instancesPerMonth"`
+	// SharePerMonth is the percentage of all jobs in each category
+	SharePerMonth map[string]map[string]float32 `json:"jobsPercentagePerMonth"`
+	// AveragePerInstancePerMonth is the number of jobs in each category divided by the number of instances
+	AveragePerInstancePerMonth map[string]map[string]float32 `json:"averageJobsPerInstancePerMonth"`
+}
+
+// SizeTiersReport is written out to generate tiers/tiers.json
+type SizeTiersReport struct {
+	Month         int64             `json:"month"`
+	Tiers         []string          `json:"tiers"`
+	Installations map[string]uint64 `json:"installations"`
+}
+
 // InstallationReport is written out to generate installations.{json,csv}
 type InstallationReport struct {
 	Installations map[string]uint64 `json:"installations"`
@@ -245,7 +327,7 @@ func (i InstallationReport) ToCSV() (string, error) {
 	for k := range i.Installations {
 		keys = append(keys, k)
 	}
-	sort.Strings(keys)
+	SortJenkinsVersions(keys)
 
 	var builder strings.Builder
 
@@ -298,7 +380,7 @@ func (i CapabilitiesReport) ToCSV() (string, error) {
 	for k := range i.Installations {
 		keys = append(keys, k)
 	}
-	sort.Strings(keys)
+	SortJenkinsVersions(keys)
 
 	var builder strings.Builder
 
@@ -324,13 +406,58 @@ type monthForHTML struct {
 	AsStr string
 }
 
+// ReportConfig contains optional configuration for GenerateReport. Anything left unset uses the defaults.
+type ReportConfig struct {
+	// CountOptions are which instance reports are counted, such as whether quarantined instances are left out.
+	CountOptions
+
+	JobCategories *JobCategories
+	// SizeTiers, if set, will result in reports being generated for each instance size tier in addition to the usual reports.
+	SizeTiers *SizeTiers
+	// MetricsFile, if set, is where the latest month's numbers are written in the Prometheus text exposition format.
+	MetricsFile string
+	// MetricsPluginThreshold is the minimum number of installs for a plugin to be included in MetricsFile. If it's 0,
+	// DefaultMetricsPluginThreshold is used.
+	MetricsPluginThreshold uint64
+	// AnomaliesFile, if set, is where anomalies found in the latest month, compared to the months before it, are written.
+	AnomaliesFile string
+	// FailOnAnomalies, if set, results in an error before any reports are written if any anomalies are found.
+	FailOnAnomalies bool
+	// AnomalyThresholds are used to find anomalies. The defaults are used if they're not set.
+	AnomalyThresholds AnomalyThresholds
+	// Weeks, if set, is the number of weeks, up to the end of the latest month, to generate weekly reports for, from the
+	// weekly data kept while importing.
+	Weeks int
+	// PluginChurn, if set, will result in a report of the plugins added and removed by instances in the latest month.
+	PluginChurn bool
+	// PluginMetadata, if set, will result in a report of the installs of deprecated, no longer distributed, and old
+	// plugin versions in the latest month, from the plugin metadata stored by enrich.
+	PluginMetadata bool
+	// SecurityAdvisories, if set, will result in a report of how many instances ran versions affected by each advisory in
+	// every month from its publication up to the latest month.
+	SecurityAdvisories *SecurityAdvisories
+	// Frozen, if set, will result in installations, latestNumbers and capabilities, and the Jenkins version, plugin,
+	// node, job and executor charts, for months frozen with FreezeMonth being generated from their latest snapshot rather
+	// than recomputed, so that they match what was published. Everything else, such as the JVM, servlet container and
+	// job category reports and charts and the per-plugin trends, is still recomputed.
+	Frozen bool
+}
+
 // GenerateReport creates the JSON, CSV, SVG, and HTML files for a monthly report
-func GenerateReport(db sq.BaseRunner, specifiedYear, specifiedMonth int, baseDir string) error {
+func GenerateReport(db sq.BaseRunner, specifiedYear, specifiedMonth int, baseDir string, config ReportConfig) error {
+	co := config.CountOptions
 	err := os.MkdirAll(baseDir, 0755) //nolint:gosec
 	if err != nil {
 		return err
 	}
 
+	if config.JobCategories == nil {
+		config.JobCategories, err = LoadJobCategories("")
+		if err != nil {
+			return err
+		}
+	}
+
 	pitDir := filepath.Join(baseDir, "plugin-installation-trend")
 	err = os.MkdirAll(pitDir, 0755) //nolint:gosec
 	if err != nil {
@@ -354,20 +481,40 @@ func GenerateReport(db sq.BaseRunner, specifiedYear, specifiedMonth int, baseDir
 	// If we're given specific year/month, generate through that month. Otherwise, generate through the previous month
 	// from the time we're running.
 	if specifiedYear > 0 && specifiedMonth > 0 {
-		latestMonthToReport = startDateForYearMonth(specifiedYear, specifiedMonth)
+		latestMonthToReport = startDateForYearMonth(specifiedYear, specifiedMonth, co.Location)
 	} else {
-		now := time.Now()
-		latestMonthToReport = startDateForYearMonth(now.Year(), int(now.Month())).AddDate(0, -1, 0)
+		now := time.Now().In(reportingLocation(co.Location))
+		latestMonthToReport = startDateForYearMonth(now.Year(), int(now.Month()), co.Location).AddDate(0, -1, 0)
 	}
 
 	reportYear := latestMonthToReport.Year()
 	reportMonth := int(latestMonthToReport.Month())
 
-	icStart := time.Now()
-	installCount, err := GetInstallCountForVersions(db, reportYear, reportMonth)
+	if config.AnomaliesFile != "" || config.FailOnAnomalies {
+		if config.AnomalyThresholds == (AnomalyThresholds{}) {
+			config.AnomalyThresholds = DefaultAnomalyThresholds()
+		}
+		anomalies, err := DetectMonthAnomalies(db, co, reportYear, reportMonth, config.AnomalyThresholds)
+		if err != nil {
+			return err
+		}
+		if config.AnomaliesFile != "" {
+			if err := WriteAnomaliesFile(config.AnomaliesFile, anomalies); err != nil {
+				return err
+			}
+		}
+		if config.FailOnAnomalies && len(anomalies) > 0 {
+			return fmt.Errorf("found %d anomalies in %04d-%02d, not generating reports", len(anomalies), reportYear, reportMonth)
+		}
+	}
+
+	latestAggregates, err := monthlyAggregatesForReport(db, co, reportYear, reportMonth, config.Frozen)
 	if err != nil {
 		return err
 	}
+
+	icStart := time.Now()
+	installCount := InstallationReport{Installations: latestAggregates.JenkinsVersions}
 	icAsJSON, err := json.MarshalIndent(installCount, "", "    ")
 	if err != nil {
 		return err
@@ -388,7 +535,7 @@ func GenerateReport(db sq.BaseRunner, specifiedYear, specifiedMonth int, baseDir
 	fmt.Printf("installCount time: %s\n", time.Since(icStart))
 
 	vdStart := time.Now()
-	jvpv, err := GenerateVersionDistributions(db, reportYear, reportMonth, pvDir)
+	jvpv, err := GenerateVersionDistributions(db, co, reportYear, reportMonth, pvDir)
 	if err != nil {
 		return err
 	}
@@ -396,7 +543,7 @@ func GenerateReport(db sq.BaseRunner, specifiedYear, specifiedMonth int, baseDir
 
 	prStart := time.Now()
 	// GetPluginReports expects to get the _current_ year/month so it can exclude that from its reports.
-	pluginReports, err := GetPluginReports(db, specifiedYear, specifiedMonth)
+	pluginReports, err := GetPluginReports(db, co, specifiedYear, specifiedMonth)
 	if err != nil {
 		return err
 	}
@@ -413,9 +560,9 @@ func GenerateReport(db sq.BaseRunner, specifiedYear, specifiedMonth int, baseDir
 	fmt.Printf("pluginReport time: %s\n", time.Since(prStart))
 
 	lnStart := time.Now()
-	latestNumbers, err := GetLatestPluginNumbers(db, reportYear, reportMonth)
-	if err != nil {
-		return err
+	latestNumbers := LatestPluginNumbersReport{
+		Month:   startDateForYearMonth(reportYear, reportMonth, co.Location).UnixMilli(),
+		Plugins: latestAggregates.Plugins,
 	}
 	lnAsJSON, err := json.MarshalIndent(latestNumbers, "", "    ")
 	if err != nil {
@@ -436,10 +583,7 @@ func GenerateReport(db sq.BaseRunner, specifiedYear, specifiedMonth int, baseDir
 	fmt.Printf("latestNumbers time: %s\n", time.Since(lnStart))
 
 	capStart := time.Now()
-	capabilities, err := GetCapabilities(db, reportYear, reportMonth)
-	if err != nil {
-		return err
-	}
+	capabilities := capabilitiesForInstallations(latestAggregates.JenkinsVersions)
 	capAsJSON, err := json.MarshalIndent(capabilities, "", "    ")
 	if err != nil {
 		return err
@@ -460,7 +604,7 @@ func GenerateReport(db sq.BaseRunner, specifiedYear, specifiedMonth int, baseDir
 
 	jvmStart := time.Now()
 	// GetJVMsReport expects to get the _current_ year/month so that month can be excluded.
-	jvms, err := GetJVMsReport(db, specifiedYear, specifiedMonth)
+	jvms, err := GetJVMsReport(db, co, specifiedYear, specifiedMonth)
 	if err != nil {
 		return err
 	}
@@ -474,6 +618,150 @@ func GenerateReport(db sq.BaseRunner, specifiedYear, specifiedMonth int, baseDir
 	}
 	fmt.Printf("jvms time: %s\n", time.Since(jvmStart))
 
+	jvmVendorStart := time.Now()
+	// GetJVMVendorsReport expects to get the _current_ year/month so that month can be excluded.
+	jvmVendors, err := GetJVMVendorsReport(db, co, specifiedYear, specifiedMonth)
+	if err != nil {
+		return err
+	}
+	jvmVendorsAsJSON, err := json.MarshalIndent(jvmVendors, "", "    ")
+	if err != nil {
+		return err
+	}
+	err = writeFile(filepath.Join(pitDir, "jvm-vendors.json"), jvmVendorsAsJSON)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("jvm vendors time: %s\n", time.Since(jvmVendorStart))
+
+	agentJVMStart := time.Now()
+	// GetAgentJVMsReport expects to get the _current_ year/month so that month can be excluded.
+	agentJVMs, err := GetAgentJVMsReport(db, co, specifiedYear, specifiedMonth)
+	if err != nil {
+		return err
+	}
+	agentJVMsAsJSON, err := json.MarshalIndent(agentJVMs, "", "    ")
+	if err != nil {
+		return err
+	}
+	err = writeFile(filepath.Join(pitDir, "agent-jvms.json"), agentJVMsAsJSON)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("agent jvms time: %s\n", time.Since(agentJVMStart))
+
+	scStart := time.Now()
+	// GetServletContainersReport expects to get the _current_ year/month so that month can be excluded.
+	servletContainers, err := GetServletContainersReport(db, co, specifiedYear, specifiedMonth)
+	if err != nil {
+		return err
+	}
+	scAsJSON, err := json.MarshalIndent(servletContainers, "", "    ")
+	if err != nil {
+		return err
+	}
+	scAsCSV, err := servletContainers.ToCSV()
+	if err != nil {
+		return err
+	}
+	err = writeFile(filepath.Join(pitDir, "servlet-containers.json"), scAsJSON)
+	if err != nil {
+		return err
+	}
+	err = writeFile(filepath.Join(pitDir, "servlet-containers.csv"), []byte(scAsCSV))
+	if err != nil {
+		return err
+	}
+	fmt.Printf("servlet containers time: %s\n", time.Since(scStart))
+
+	jcStart := time.Now()
+	// GetJobCategoriesReport expects to get the _current_ year/month so that month can be excluded.
+	jobCategories, err := GetJobCategoriesReport(db, co, specifiedYear, specifiedMonth, config.JobCategories)
+	if err != nil {
+		return err
+	}
+	jcAsJSON, err := json.MarshalIndent(jobCategories, "", "    ")
+	if err != nil {
+		return err
+	}
+	err = writeFile(filepath.Join(pitDir, "job-categories.json"), jcAsJSON)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("job categories time: %s\n", time.Since(jcStart))
+
+	if config.SizeTiers != nil {
+		tierStart := time.Now()
+		err = generateSizeTierReports(db, co, specifiedYear, specifiedMonth, reportYear, reportMonth, config.SizeTiers, filepath.Join(baseDir, "tiers"))
+		if err != nil {
+			return err
+		}
+		fmt.Printf("size tiers time: %s\n", time.Since(tierStart))
+	}
+
+	if config.PluginChurn {
+		churnStart := time.Now()
+		churn, err := GetPluginChurn(db, co, reportYear, reportMonth, DefaultChurnTop)
+		if err != nil {
+			return err
+		}
+		err = writeJSONFile(filepath.Join(pitDir, "plugin-churn.json"), churn)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("plugin churn time: %s\n", time.Since(churnStart))
+	}
+
+	if config.PluginMetadata {
+		healthStart := time.Now()
+		health, err := GetPluginHealthReport(db, co, reportYear, reportMonth, DefaultOldPluginVersionAge)
+		if err != nil {
+			return err
+		}
+		err = writeJSONFile(filepath.Join(pitDir, "plugin-health.json"), health)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("plugin health time: %s\n", time.Since(healthStart))
+	}
+
+	if config.SecurityAdvisories != nil {
+		securityStart := time.Now()
+		exposure, err := GetSecurityExposure(db, co, config.SecurityAdvisories, reportYear, reportMonth)
+		if err != nil {
+			return err
+		}
+		err = writeJSONFile(filepath.Join(pitDir, "security-exposure.json"), exposure)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("security exposure time: %s\n", time.Since(securityStart))
+	}
+
+	if config.Weeks > 0 {
+		weeklyStart := time.Now()
+		end := startDateForYearMonth(reportYear, reportMonth, co.Location).AddDate(0, 1, 0)
+		if now := time.Now(); now.Before(end) {
+			end = now
+		}
+		weeks, err := LatestWeeks(config.Weeks, end, co.Location)
+		if err != nil {
+			return err
+		}
+		err = GenerateWeeklyReports(db, co, weeks, filepath.Join(baseDir, "weekly"))
+		if err != nil {
+			return err
+		}
+		fmt.Printf("weekly time: %s\n", time.Since(weeklyStart))
+	}
+
+	if config.MetricsFile != "" {
+		err = WriteMetricsFile(config.MetricsFile, db, co, reportYear, reportMonth, config.MetricsPluginThreshold)
+		if err != nil {
+			return err
+		}
+	}
+
 	allMonths, err := allOrderedMonths(db, specifiedYear, specifiedMonth)
 	if err != nil {
 		return err
@@ -501,11 +789,12 @@ func GenerateReport(db sq.BaseRunner, specifiedYear, specifiedMonth int, baseDir
 		nodeCountByMonth[monthStr] = 0
 		pluginCountByMonth[monthStr] = 0
 
-		ir, err := GetInstallCountForVersions(db, ym.year, ym.month)
+		aggregates, err := monthlyAggregatesForReport(db, co, ym.year, ym.month, config.Frozen)
 		if err != nil {
 			return err
 		}
 
+		ir := InstallationReport{Installations: aggregates.JenkinsVersions}
 		for _, c := range ir.Installations {
 			installCountByMonth[monthStr] += c
 		}
@@ -522,10 +811,7 @@ func GenerateReport(db sq.BaseRunner, specifiedYear, specifiedMonth int, baseDir
 			return err
 		}
 
-		pr, err := GetLatestPluginNumbers(db, ym.year, ym.month)
-		if err != nil {
-			return err
-		}
+		pr := LatestPluginNumbersReport{Plugins: aggregates.Plugins}
 		for _, c := range pr.Plugins {
 			pluginCountByMonth[monthStr] += c
 		}
@@ -556,10 +842,7 @@ func GenerateReport(db sq.BaseRunner, specifiedYear, specifiedMonth int, baseDir
 			}
 		}
 
-		osR, err := OSCountsForMonth(db, ym.year, ym.month)
-		if err != nil {
-			return err
-		}
+		osR := aggregates.Nodes
 
 		var osNames []string
 		var osNumbers []uint64
@@ -597,10 +880,7 @@ func GenerateReport(db sq.BaseRunner, specifiedYear, specifiedMonth int, baseDir
 			return err
 		}
 
-		jr, err := JobCountsForMonth(db, ym.year, ym.month)
-		if err != nil {
-			return err
-		}
+		jr := aggregates.Jobs
 
 		for _, c := range jr {
 			jobCountByMonth[monthStr] += c
@@ -617,10 +897,20 @@ func GenerateReport(db sq.BaseRunner, specifiedYear, specifiedMonth int, baseDir
 			return err
 		}
 
-		execR, err := ExecutorCountsForMonth(db, ym.year, ym.month)
+		jcR := jobCategories.JobsPerMonth[fmt.Sprintf("%d", startDateForYearMonth(ym.year, ym.month, co.Location).UnixMilli())]
+
+		jcSVG, jcCSV, err := CreateBarSVG(fmt.Sprintf("Jobs by category (total: %d)", jobCountByMonth[monthStr]), jcR, 1000, true, false, false, DefaultFilter)
 		if err != nil {
 			return err
 		}
+		if err := writeFile(filepath.Join(svgDir, fmt.Sprintf("%s-jobCategories.svg", monthStr)), jcSVG); err != nil {
+			return err
+		}
+		if err := writeFile(filepath.Join(svgDir, fmt.Sprintf("%s-jobCategories.csv", monthStr)), jcCSV); err != nil {
+			return err
+		}
+
+		execR := aggregates.Executors
 
 		totalExecs := uint64(0)
 		for _, c := range execR {
@@ -637,6 +927,24 @@ func GenerateReport(db sq.BaseRunner, specifiedYear, specifiedMonth int, baseDir
 		if err := writeFile(filepath.Join(svgDir, fmt.Sprintf("%s-total-executors.csv", monthStr)), execCSV); err != nil {
 			return err
 		}
+
+		scR := servletContainers.PerMonth[fmt.Sprintf("%d", startDateForYearMonth(ym.year, ym.month, co.Location).UnixMilli())]
+
+		totalSC := uint64(0)
+		for _, c := range scR {
+			totalSC += c
+		}
+
+		scSVG, scCSV, err := CreateBarSVG(fmt.Sprintf("Servlet containers (total: %d)", totalSC), scR, 10, true, false, false, DefaultFilter)
+		if err != nil {
+			return err
+		}
+		if err := writeFile(filepath.Join(svgDir, fmt.Sprintf("%s-servletContainers.svg", monthStr)), scSVG); err != nil {
+			return err
+		}
+		if err := writeFile(filepath.Join(svgDir, fmt.Sprintf("%s-servletContainers.csv", monthStr)), scCSV); err != nil {
+			return err
+		}
 	}
 
 	totalJenkinsSVG, totalJenkinsCSV, err := CreateBarSVG("Total Jenkins installations", installCountByMonth, 100, false, false, false, DefaultFilter)
@@ -685,6 +993,27 @@ func GenerateReport(db sq.BaseRunner, specifiedYear, specifiedMonth int, baseDir
 
 	totalFiles := []string{"total-plugins", "total-jobs", "total-jenkins", "total-nodes"}
 
+	scTrends := servletContainers.Trends()
+	var scNames []string
+	for name := range scTrends {
+		scNames = append(scNames, name)
+	}
+	sort.Strings(scNames)
+	for _, name := range scNames {
+		scTrendSVG, scTrendCSV, err := CreateBarSVG(fmt.Sprintf("Servlet container %s installations", name), scTrends[name], 10, false, false, false, DefaultFilter)
+		if err != nil {
+			return err
+		}
+		scTrendFile := "total-servletContainers-" + chartFileName(name)
+		if err := writeFile(filepath.Join(svgDir, scTrendFile+".svg"), scTrendSVG); err != nil {
+			return err
+		}
+		if err := writeFile(filepath.Join(svgDir, scTrendFile+".csv"), scTrendCSV); err != nil {
+			return err
+		}
+		totalFiles = append(totalFiles, scTrendFile)
+	}
+
 	idxTmpl, err := template.New("svgs-index").Parse(SVGsIndexTemplate)
 	if err != nil {
 		return err
@@ -735,25 +1064,116 @@ func GenerateReport(db sq.BaseRunner, specifiedYear, specifiedMonth int, baseDir
 	}()
 
 	return pitTmpl.Execute(pitFile, map[string]interface{}{
-		"jsonFiles":   []string{"installations", "latestNumbers", "capabilities", "jenkins-version-per-plugin-version", "jvms"},
+		"jsonFiles":   []string{"installations", "latestNumbers", "capabilities", "jenkins-version-per-plugin-version", "jvms", "jvm-vendors", "agent-jvms", "servlet-containers", "job-categories"},
 		"pluginNames": pluginNames,
 	})
 }
 
+// generateSizeTierReports writes the Jenkins version, plugin, JVM and OS reports for each size tier into a directory per
+// tier. The plugin version distributions are left out, since split by tier as well as plugin and Jenkins version, most of
+// their counts would be too small to mean anything.
+func generateSizeTierReports(db sq.BaseRunner, co CountOptions, specifiedYear, specifiedMonth, reportYear, reportMonth int, tiers *SizeTiers, tiersDir string) error {
+	summary := SizeTiersReport{
+		Month:         startDateForYearMonth(reportYear, reportMonth, co.Location).UnixMilli(),
+		Tiers:         tiers.Names(),
+		Installations: map[string]uint64{},
+	}
+
+	for _, tierName := range tiers.Names() {
+		tierDir := filepath.Join(tiersDir, tierName)
+		err := os.MkdirAll(tierDir, 0755) //nolint:gosec
+		if err != nil {
+			return err
+		}
+
+		filter, err := tiers.Filter(tierName)
+		if err != nil {
+			return err
+		}
+
+		installCount, err := GetInstallCountForVersions(db, co, reportYear, reportMonth, filter)
+		if err != nil {
+			return err
+		}
+		for _, c := range installCount.Installations {
+			summary.Installations[tierName] += c
+		}
+		icAsCSV, err := installCount.ToCSV()
+		if err != nil {
+			return err
+		}
+		if err := writeJSONFile(filepath.Join(tierDir, "installations.json"), installCount); err != nil {
+			return err
+		}
+		if err := writeFile(filepath.Join(tierDir, "installations.csv"), []byte(icAsCSV)); err != nil {
+			return err
+		}
+
+		latestNumbers, err := GetLatestPluginNumbers(db, co, reportYear, reportMonth, filter)
+		if err != nil {
+			return err
+		}
+		lnAsCSV, err := latestNumbers.ToCSV()
+		if err != nil {
+			return err
+		}
+		if err := writeJSONFile(filepath.Join(tierDir, "latestNumbers.json"), latestNumbers); err != nil {
+			return err
+		}
+		if err := writeFile(filepath.Join(tierDir, "latestNumbers.csv"), []byte(lnAsCSV)); err != nil {
+			return err
+		}
+
+		pluginsDir := filepath.Join(tierDir, "plugins")
+		if err := os.MkdirAll(pluginsDir, 0755); err != nil { //nolint:gosec
+			return err
+		}
+		// GetPluginReports expects to get the _current_ year/month so it can exclude that from its reports.
+		pluginReports, err := GetPluginReports(db, co, specifiedYear, specifiedMonth, filter)
+		if err != nil {
+			return err
+		}
+		for _, pr := range pluginReports {
+			if err := writeJSONFile(filepath.Join(pluginsDir, fmt.Sprintf("%s.stats.json", pr.Name)), pr); err != nil {
+				return err
+			}
+		}
+
+		// GetJVMsReport expects to get the _current_ year/month so that month can be excluded.
+		jvms, err := GetJVMsReport(db, co, specifiedYear, specifiedMonth, filter)
+		if err != nil {
+			return err
+		}
+		if err := writeJSONFile(filepath.Join(tierDir, "jvms.json"), jvms); err != nil {
+			return err
+		}
+
+		osCounts, err := OSCountsForMonth(db, co, reportYear, reportMonth, filter)
+		if err != nil {
+			return err
+		}
+		if err := writeJSONFile(filepath.Join(tierDir, "nodes.json"), osCounts); err != nil {
+			return err
+		}
+	}
+
+	return writeJSONFile(filepath.Join(tiersDir, "tiers.json"), summary)
+}
+
 // GetInstallCountForVersions generates a map of Jenkins versions to install counts
 // analogous to Groovy version's generateInstallationsJson
-func GetInstallCountForVersions(db sq.BaseRunner, year, month int) (InstallationReport, error) {
+func GetInstallCountForVersions(db sq.BaseRunner, co CountOptions, year, month int, filters ...sq.Sqlizer) (InstallationReport, error) {
 	report := InstallationReport{Installations: map[string]uint64{}}
-	rows, err := PSQL(db).Select("jv.version as jvv", "count(*) as number").
+	rows, err := withFilters(PSQL(db).Select("jv.version as jvv", "count(*) as number").
 		From("instance_reports i").
 		Join("jenkins_versions jv on i.version = jv.id").
 		Where(sq.Eq{"i.year": year}).
 		Where(sq.Eq{"i.month": month}).
-		Where(sq.GtOrEq{"i.count_for_month": 2}).
+		Where(countedInstances("i", co.ExcludeQuarantined)).
 		Where("jv.version ~ '^\\d'").
 		Where("jv.version not like '%private%'").
-		GroupBy("jvv").
-		OrderBy("jvv").
+		GroupBy("jvv", "jv.sort_key").
+		OrderBy("jv.sort_key"), filters).
 		Query()
 	if err != nil {
 		return report, err
@@ -777,18 +1197,18 @@ func GetInstallCountForVersions(db sq.BaseRunner, year, month int) (Installation
 
 // GetLatestPluginNumbers generates a map of plugin name and install counts
 // analogous to Groovy version's generateLatestNumbersJson
-func GetLatestPluginNumbers(db sq.BaseRunner, year, month int) (LatestPluginNumbersReport, error) {
+func GetLatestPluginNumbers(db sq.BaseRunner, co CountOptions, year, month int, filters ...sq.Sqlizer) (LatestPluginNumbersReport, error) {
 	report := LatestPluginNumbersReport{
-		Month:   startDateForYearMonth(year, month).UnixMilli(),
+		Month:   startDateForYearMonth(year, month, co.Location).UnixMilli(),
 		Plugins: map[string]uint64{},
 	}
-	rows, err := PSQL(db).Select("p.name as pn", "count(*) as number").
+	rows, err := withFilters(PSQL(db).Select("p.name as pn", "count(*) as number").
 		From("instance_reports i, unnest(i.plugins) pr(id)").
 		Join("plugins p on p.id = pr.id").
 		Where(sq.Eq{"i.year": year}).
 		Where(sq.Eq{"i.month": month}).
-		Where(sq.GtOrEq{"i.count_for_month": 2}).
-		GroupBy("pn").
+		Where(countedInstances("i", co.ExcludeQuarantined)).
+		GroupBy("pn"), filters).
 		Query()
 	if err != nil {
 		return report, err
@@ -812,44 +1232,37 @@ func GetLatestPluginNumbers(db sq.BaseRunner, year, month int) (LatestPluginNumb
 
 // GetCapabilities generates a map of Jenkins versions and install counts for that version and all earlier ones
 // analogous to Groovy version's generateCapabilitiesJson
-func GetCapabilities(db sq.BaseRunner, year, month int) (CapabilitiesReport, error) {
-	report := CapabilitiesReport{Installations: map[string]uint64{}}
-	rows, err := PSQL(db).Select("jv.version as jvv", "count(*) as number").
-		From("instance_reports i").
-		Join("jenkins_versions jv on i.version = jv.id").
-		Where(sq.Eq{"i.year": year}).
-		Where(sq.Eq{"i.month": month}).
-		Where(sq.GtOrEq{"i.count_for_month": 2}).
-		Where("jv.version ~ '^\\d'").
-		Where("jv.version not like '%private%'").
-		GroupBy("jvv").
-		OrderBy("jvv DESC").
-		Query()
+func GetCapabilities(db sq.BaseRunner, co CountOptions, year, month int) (CapabilitiesReport, error) {
+	installs, err := GetInstallCountForVersions(db, co, year, month)
 	if err != nil {
-		return report, err
+		return CapabilitiesReport{}, err
+	}
+	return capabilitiesForInstallations(installs.Installations), nil
+}
+
+// capabilitiesForInstallations returns the number of installs of each Jenkins version or later
+func capabilitiesForInstallations(installations map[string]uint64) CapabilitiesReport {
+	report := CapabilitiesReport{Installations: map[string]uint64{}}
+
+	var versions []string
+	for v := range installations {
+		versions = append(versions, v)
 	}
-	defer func() {
-		_ = rows.Close()
-	}()
 
+	// Versions are counted from the latest down, so each count includes the installs of all later versions.
+	SortJenkinsVersions(versions)
 	higherCapabilityCount := uint64(0)
-	for rows.Next() {
-		var p string
-		var c uint64
-		err := rows.Scan(&p, &c)
-		if err != nil {
-			return report, err
-		}
-		higherCapabilityCount += c
-		report.Installations[p] = higherCapabilityCount
+	for i := len(versions) - 1; i >= 0; i-- {
+		higherCapabilityCount += installations[versions[i]]
+		report.Installations[versions[i]] = higherCapabilityCount
 	}
 
-	return report, nil
+	return report
 }
 
 // GetJVMsReport returns the JVM install counts for all months
 // analogous to Groovy version's generateJvmJson
-func GetJVMsReport(db sq.BaseRunner, year, month int) (JVMReport, error) {
+func GetJVMsReport(db sq.BaseRunner, co CountOptions, year, month int, filters ...sq.Sqlizer) (JVMReport, error) {
 	jvr := JVMReport{
 		PerMonth:   map[string]map[string]uint64{},
 		PerMonth2x: map[string]map[string]uint64{},
@@ -868,17 +1281,17 @@ func GetJVMsReport(db sq.BaseRunner, year, month int) (JVMReport, error) {
 		return jvr, err
 	}
 
-	baseStmt := PSQL(db).Select("jv.name as n", "count(*)").
+	baseStmt := withFilters(PSQL(db).Select("jv.name as n", "count(*)").
 		From("instance_reports i").
 		Join("jvm_versions jv on jv.id = i.jvm_version_id").
 		Where(sq.Eq{"jv.id": jvmIDs}).
-		Where(sq.GtOrEq{"i.count_for_month": 2}).
+		Where(countedInstances("i", co.ExcludeQuarantined)).
 		GroupBy("n").
-		OrderBy("n")
+		OrderBy("n"), filters)
 
 	for _, ym := range months {
 		err = func() error {
-			ts := startDateForYearMonth(ym.year, ym.month)
+			ts := startDateForYearMonth(ym.year, ym.month, co.Location)
 			tsStr := fmt.Sprintf("%d", ts.UnixMilli())
 
 			monthStmt := baseStmt.Where(sq.Eq{"i.year": ym.year}).Where(sq.Eq{"i.month": ym.month})
@@ -934,10 +1347,167 @@ func GetJVMsReport(db sq.BaseRunner, year, month int) (JVMReport, error) {
 	return jvr, nil
 }
 
-// GetPluginReports generates reports for each plugin
+// GetJVMVendorsReport returns the install counts for each JVM vendor and JVM name, split by Java version, for all months
+func GetJVMVendorsReport(db sq.BaseRunner, co CountOptions, year, month int) (JVMVendorReport, error) {
+	jvr := JVMVendorReport{
+		VendorsPerMonth: map[string]map[string]map[string]uint64{},
+		NamesPerMonth:   map[string]map[string]map[string]uint64{},
+	}
+
+	months, err := allOrderedMonths(db, year, month)
+	if err != nil {
+		return jvr, err
+	}
+	jvmIDs, err := jvmIDsForJSON(db)
+	if err != nil {
+		return jvr, err
+	}
+
+	// Reports added before vendors were stored have no vendor, so they're counted as N/A.
+	baseStmt := PSQL(db).Select("jv.name as n", "coalesce(jven.vendor, 'N/A') as v", "coalesce(jven.name, 'N/A') as vn", "count(*)").
+		From("instance_reports i").
+		Join("jvm_versions jv on jv.id = i.jvm_version_id").
+		LeftJoin("jvm_vendors jven on jven.id = i.jvm_vendor_id").
+		Where(sq.Eq{"jv.id": jvmIDs}).
+		Where(countedInstances("i", co.ExcludeQuarantined)).
+		GroupBy("n", "v", "vn").
+		OrderBy("n", "v", "vn")
+
+	for _, ym := range months {
+		err = func() error {
+			ts := startDateForYearMonth(ym.year, ym.month, co.Location)
+			tsStr := fmt.Sprintf("%d", ts.UnixMilli())
+
+			rows, err := baseStmt.Where(sq.Eq{"i.year": ym.year}).Where(sq.Eq{"i.month": ym.month}).Query()
+			if err != nil {
+				return err
+			}
+			defer func() {
+				_ = rows.Close()
+			}()
+			for rows.Next() {
+				var javaVersion, vendor, name string
+				var count uint64
+				err = rows.Scan(&javaVersion, &vendor, &name, &count)
+				if err != nil {
+					return err
+				}
+
+				if _, ok := jvr.VendorsPerMonth[tsStr]; !ok {
+					jvr.VendorsPerMonth[tsStr] = map[string]map[string]uint64{}
+					jvr.NamesPerMonth[tsStr] = map[string]map[string]uint64{}
+				}
+				if _, ok := jvr.VendorsPerMonth[tsStr][javaVersion]; !ok {
+					jvr.VendorsPerMonth[tsStr][javaVersion] = map[string]uint64{}
+					jvr.NamesPerMonth[tsStr][javaVersion] = map[string]uint64{}
+				}
+
+				jvr.VendorsPerMonth[tsStr][javaVersion][vendor] += count
+				jvr.NamesPerMonth[tsStr][javaVersion][name] += count
+			}
+
+			return nil
+		}()
+		if err != nil {
+			return jvr, err
+		}
+	}
+
+	return jvr, nil
+}
+
+// GetAgentJVMsReport returns the agent JVM counts for all months, along with how many instances run agents on a different
+// JVM version than the controller
+func GetAgentJVMsReport(db sq.BaseRunner, co CountOptions, year, month int) (AgentJVMReport, error) {
+	ajr := AgentJVMReport{
+		AgentsPerMonth:         map[string]map[string]uint64{},
+		InstancesPerMonth:      map[string]map[string]uint64{},
+		WithAgentsPerMonth:     map[string]uint64{},
+		MixedInstancesPerMonth: map[string]uint64{},
+	}
+
+	months, err := allOrderedMonths(db, year, month)
+	if err != nil {
+		return ajr, err
+	}
+	jvmIDs, err := jvmIDsForJSON(db)
+	if err != nil {
+		return ajr, err
+	}
+	var jvmIDArray pq.Int64Array
+	for _, id := range jvmIDs {
+		jvmIDArray = append(jvmIDArray, int64(id))
+	}
+
+	agentStmt := PSQL(db).Select("jv.name as n", "sum(ar.value::int)", "count(distinct i.id)").
+		From("instance_reports i, jsonb_each_text(i.agent_jvms) ar").
+		Join("jvm_versions jv on jv.id = ar.key::int").
+		Where(sq.Eq{"jv.id": jvmIDs}).
+		Where(countedInstances("i", co.ExcludeQuarantined)).
+		GroupBy("n").
+		OrderBy("n")
+
+	mixedStmt := PSQL(db).Select("count(*)").
+		Column(sq.Expr("count(*) filter (where exists (select 1 from jsonb_object_keys(i.agent_jvms) k where k::int = any(?) and k::int <> i.jvm_version_id))", jvmIDArray)).
+		From("instance_reports i").
+		Where(sq.Eq{"i.jvm_version_id": jvmIDs}).
+		Where(countedInstances("i", co.ExcludeQuarantined)).
+		Where("exists (select 1 from jsonb_object_keys(i.agent_jvms) k where k::int = any(?))", jvmIDArray)
+
+	for _, ym := range months {
+		err = func() error {
+			ts := startDateForYearMonth(ym.year, ym.month, co.Location)
+			tsStr := fmt.Sprintf("%d", ts.UnixMilli())
+
+			rows, err := agentStmt.Where(sq.Eq{"i.year": ym.year}).Where(sq.Eq{"i.month": ym.month}).Query()
+			if err != nil {
+				return err
+			}
+			defer func() {
+				_ = rows.Close()
+			}()
+			for rows.Next() {
+				var name string
+				var agents, instances uint64
+				err = rows.Scan(&name, &agents, &instances)
+				if err != nil {
+					return err
+				}
+
+				if _, ok := ajr.AgentsPerMonth[tsStr]; !ok {
+					ajr.AgentsPerMonth[tsStr] = map[string]uint64{}
+					ajr.InstancesPerMonth[tsStr] = map[string]uint64{}
+				}
+				ajr.AgentsPerMonth[tsStr][name] = agents
+				ajr.InstancesPerMonth[tsStr][name] = instances
+			}
+
+			var withAgents, mixed uint64
+			err = mixedStmt.Where(sq.Eq{"i.year": ym.year}).Where(sq.Eq{"i.month": ym.month}).
+				QueryRow().Scan(&withAgents, &mixed)
+			if err != nil {
+				return err
+			}
+			if withAgents > 0 {
+				ajr.WithAgentsPerMonth[tsStr] = withAgents
+				ajr.MixedInstancesPerMonth[tsStr] = mixed
+			}
+
+			return nil
+		}()
+		if err != nil {
+			return ajr, err
+		}
+	}
+
+	return ajr, nil
+}
+
+// GetPluginReports generates reports for each plugin, only counting instances matching the filters, if any. Percentages
+// are of the instances matching the filters.
 // analogous to Groovy version's generatePluginsJson
-func GetPluginReports(db sq.BaseRunner, currentYear, currentMonth int) ([]PluginReport, error) {
-	previousMonth := startDateForYearMonth(currentYear, currentMonth).AddDate(0, -1, 0)
+func GetPluginReports(db sq.BaseRunner, co CountOptions, currentYear, currentMonth int, filters ...sq.Sqlizer) ([]PluginReport, error) {
+	previousMonth := startDateForYearMonth(currentYear, currentMonth, co.Location).AddDate(0, -1, 0)
 	prevMonthStr := fmt.Sprintf("%d", previousMonth.UnixMilli())
 
 	var reports []PluginReport
@@ -952,17 +1522,17 @@ func GetPluginReports(db sq.BaseRunner, currentYear, currentMonth int) ([]Plugin
 		return nil, err
 	}
 
-	totalInstalls, err := installCountsByMonth(db, currentYear, currentMonth)
+	totalInstalls, err := installCountsByMonth(db, co, currentYear, currentMonth, filters...)
 	if err != nil {
 		return nil, err
 	}
 
-	installsByMonth, err := pluginInstallsByMonthForName(db, currentYear, currentMonth, idsToName)
+	installsByMonth, err := pluginInstallsByMonthForName(db, co, currentYear, currentMonth, idsToName, filters...)
 	if err != nil {
 		return nil, err
 	}
 
-	installsByVersion, err := pluginInstallsByVersionForName(db, previousMonth.Year(), int(previousMonth.Month()), idsToName)
+	installsByVersion, err := pluginInstallsByVersionForName(db, co, previousMonth.Year(), int(previousMonth.Month()), idsToName, filters...)
 	if err != nil {
 		return nil, err
 	}
@@ -995,8 +1565,8 @@ func GetPluginReports(db sq.BaseRunner, currentYear, currentMonth int) ([]Plugin
 }
 
 // GenerateVersionDistributions writes out HTML files for each plugin's version distribution
-func GenerateVersionDistributions(db sq.BaseRunner, year, month int, outputDir string) (map[string]*PVDPluginVersionMap, error) {
-	jvpv, err := JenkinsVersionsForPluginVersions(db, year, month)
+func GenerateVersionDistributions(db sq.BaseRunner, co CountOptions, year, month int, outputDir string) (map[string]*PVDPluginVersionMap, error) {
+	jvpv, err := JenkinsVersionsForPluginVersions(db, co, year, month)
 	if err != nil {
 		return nil, err
 	}
@@ -1086,8 +1656,8 @@ func (pvdp *PVDPluginVersionMap) Version(pv string) *PVDJenkinsVersionMap {
 
 // JenkinsVersionsForPluginVersions generates a report for each plugin's version, with a count of installs for each Jenkins version
 // analogous to Groovy version's generateOldestJenkinsPerPlugin
-func JenkinsVersionsForPluginVersions(db sq.BaseRunner, year, month int) (map[string]*PVDPluginVersionMap, error) {
-	maxVersionsForInstanceIDs, err := maxInstanceVersionForMonth(db, year, month)
+func JenkinsVersionsForPluginVersions(db sq.BaseRunner, co CountOptions, year, month int) (map[string]*PVDPluginVersionMap, error) {
+	maxVersionsForInstanceIDs, err := maxInstanceVersionForMonth(db, co, year, month)
 	if err != nil {
 		return nil, err
 	}
@@ -1097,7 +1667,7 @@ func JenkinsVersionsForPluginVersions(db sq.BaseRunner, year, month int) (map[st
 		Join("plugins p on p.id = pr.id").
 		Where(sq.Eq{"i.year": year}).
 		Where(sq.Eq{"i.month": month}).
-		Where(sq.GtOrEq{"i.count_for_month": 2}).
+		Where(countedInstances("i", co.ExcludeQuarantined)).
 		OrderBy("pn", "pv desc", "iid").
 		Query()
 	if err != nil {
@@ -1121,8 +1691,8 @@ func JenkinsVersionsForPluginVersions(db sq.BaseRunner, year, month int) (map[st
 			continue
 		}
 
-		// If the plugin version is "???", skip.
-		if pv == questionVersion {
+		// Skip plugin versions dropped by the rules.
+		if !countablePluginVersion(pv) {
 			continue
 		}
 
@@ -1140,13 +1710,13 @@ func JenkinsVersionsForPluginVersions(db sq.BaseRunner, year, month int) (map[st
 
 // JobCountsForMonth gets the total number of each known job type in a month
 // analogous to jobtype2Number in generateStats.groovy
-func JobCountsForMonth(db sq.BaseRunner, year, month int) (map[string]uint64, error) {
+func JobCountsForMonth(db sq.BaseRunner, co CountOptions, year, month int) (map[string]uint64, error) {
 	rows, err := PSQL(db).Select("j.name", "sum(jr.value::int) as total").
 		From("instance_reports i, jsonb_each_text(i.jobs) jr").
 		Join("job_types j on j.id = jr.key::int").
 		Where(sq.Eq{"i.year": year}).
 		Where(sq.Eq{"i.month": month}).
-		Where(sq.GtOrEq{"i.count_for_month": 2}).
+		Where(countedInstances("i", co.ExcludeQuarantined)).
 		GroupBy("j.name").
 		OrderBy("total asc").
 		Query()
@@ -1173,14 +1743,140 @@ func JobCountsForMonth(db sq.BaseRunner, year, month int) (map[string]uint64, er
 	return jobMap, nil
 }
 
+// JobCategoryCountsForMonth gets the total number of jobs in each job category in a month, along with the number of
+// instances with at least one job in each category
+func JobCategoryCountsForMonth(db sq.BaseRunner, co CountOptions, year, month int, categories *JobCategories) (map[string]uint64, map[string]uint64, error) {
+	idsForCategory, err := jobTypeIDsForCategories(db, categories)
+	if err != nil {
+		return nil, nil, err
+	}
+	return jobCategoryCountsForMonth(db, co, year, month, categories, idsForCategory)
+}
+
+// jobCategoryCountsForMonth gets the job and instance counts for each job category in a month in a single query, given
+// the job type IDs in each category
+func jobCategoryCountsForMonth(db sq.BaseRunner, co CountOptions, year, month int, categories *JobCategories, idsForCategory map[string][]uint64) (map[string]uint64, map[string]uint64, error) {
+	jobMap := make(map[string]uint64)
+	instanceMap := make(map[string]uint64)
+
+	var categoryCase strings.Builder
+	var args []interface{}
+	allIDs := pq.Int64Array{}
+	categoryCase.WriteString("case")
+	for _, category := range categories.Names() {
+		ids := pq.Int64Array{}
+		for _, id := range idsForCategory[category] {
+			ids = append(ids, int64(id))
+		}
+		if len(ids) == 0 {
+			continue
+		}
+		categoryCase.WriteString(" when jr.key::int = any(?) then ?")
+		args = append(args, ids, category)
+		allIDs = append(allIDs, ids...)
+	}
+	categoryCase.WriteString(" end as category")
+	if len(allIDs) == 0 {
+		return jobMap, instanceMap, nil
+	}
+
+	rows, err := PSQL(db).Select().
+		Column(sq.Expr(categoryCase.String(), args...)).
+		Columns("coalesce(sum(jr.value::int), 0)", "count(distinct i.id)").
+		From("instance_reports i, jsonb_each_text(i.jobs) jr").
+		Where(sq.Eq{"i.year": year}).
+		Where(sq.Eq{"i.month": month}).
+		Where(countedInstances("i", co.ExcludeQuarantined)).
+		Where("jr.key::int = any(?)", allIDs).
+		Where("jr.value::int > 0").
+		GroupBy("category").
+		Query()
+	if err != nil {
+		return nil, nil, err
+	}
+	defer func() {
+		_ = rows.Close()
+	}()
+
+	for rows.Next() {
+		var category string
+		var jobs, instances uint64
+		if err := rows.Scan(&category, &jobs, &instances); err != nil {
+			return nil, nil, err
+		}
+		if jobs > 0 {
+			jobMap[category] = jobs
+			instanceMap[category] = instances
+		}
+	}
+
+	return jobMap, instanceMap, rows.Err()
+}
+
+// GetJobCategoriesReport returns the job category counts, share of all jobs, and average jobs per instance for all months
+func GetJobCategoriesReport(db sq.BaseRunner, co CountOptions, year, month int, categories *JobCategories) (JobCategoriesReport, error) {
+	jcr := JobCategoriesReport{
+		JobsPerMonth:               map[string]map[string]uint64{},
+		InstancesPerMonth:          map[string]map[string]uint64{},
+		SharePerMonth:              map[string]map[string]float32{},
+		AveragePerInstancePerMonth: map[string]map[string]float32{},
+	}
+
+	months, err := allOrderedMonths(db, year, month)
+	if err != nil {
+		return jcr, err
+	}
+
+	totalInstalls, err := installCountsByMonth(db, co, year, month)
+	if err != nil {
+		return jcr, err
+	}
+
+	idsForCategory, err := jobTypeIDsForCategories(db, categories)
+	if err != nil {
+		return jcr, err
+	}
+
+	for _, ym := range months {
+		tsStr := fmt.Sprintf("%d", startDateForYearMonth(ym.year, ym.month, co.Location).UnixMilli())
+
+		jobs, instances, err := jobCategoryCountsForMonth(db, co, ym.year, ym.month, categories, idsForCategory)
+		if err != nil {
+			return jcr, err
+		}
+		if len(jobs) == 0 {
+			continue
+		}
+
+		totalJobs := uint64(0)
+		for _, c := range jobs {
+			totalJobs += c
+		}
+
+		jcr.JobsPerMonth[tsStr] = jobs
+		jcr.InstancesPerMonth[tsStr] = instances
+		jcr.SharePerMonth[tsStr] = map[string]float32{}
+		jcr.AveragePerInstancePerMonth[tsStr] = map[string]float32{}
+
+		for category, c := range jobs {
+			jcr.SharePerMonth[tsStr][category] = float32(c) * 100 / float32(totalJobs)
+			if totalInstalls[tsStr] > 0 {
+				jcr.AveragePerInstancePerMonth[tsStr][category] = float32(c) / float32(totalInstalls[tsStr])
+			}
+		}
+	}
+
+	return jcr, nil
+}
+
 // ExecutorCountsForMonth gets a map of executor count to number of instances with that many executors in a month
 // analogous to executorCount2Number in generateStats.groovy
-func ExecutorCountsForMonth(db sq.BaseRunner, year, month int) (map[string]uint64, error) {
+func ExecutorCountsForMonth(db sq.BaseRunner, co CountOptions, year, month int) (map[string]uint64, error) {
 	rows, err := PSQL(db).Select("executors").
 		From("instance_reports").
 		Where(sq.Eq{"year": year}).
 		Where(sq.Eq{"month": month}).
-		Where(sq.GtOrEq{"count_for_month": 2}).
+		Where(countedInstances(InstanceReportsTable, co.ExcludeQuarantined)).
 		Query()
 	if err != nil {
 		return nil, err
@@ -1208,17 +1904,74 @@ func ExecutorCountsForMonth(db sq.BaseRunner, year, month int) (map[string]uint6
 	return countMap, nil
 }
 
+// ServletContainerCountsForMonth gets the number of instances running each servlet container in a month
+func ServletContainerCountsForMonth(db sq.BaseRunner, co CountOptions, year, month int) (map[string]uint64, error) {
+	// Reports added before servlet containers were stored have no servlet container, so they're counted as N/A.
+	rows, err := PSQL(db).Select("coalesce(sc.name, 'N/A') as name", "count(*) as total").
+		From("instance_reports i").
+		LeftJoin("servlet_containers sc on sc.id = i.servlet_container_id").
+		Where(sq.Eq{"i.year": year}).
+		Where(sq.Eq{"i.month": month}).
+		Where(countedInstances("i", co.ExcludeQuarantined)).
+		GroupBy("name").
+		OrderBy("total asc").
+		Query()
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = rows.Close()
+	}()
+
+	scMap := make(map[string]uint64)
+
+	for rows.Next() {
+		var name string
+		var count uint64
+
+		err = rows.Scan(&name, &count)
+		if err != nil {
+			return nil, err
+		}
+		scMap[name] = count
+	}
+
+	return scMap, nil
+}
+
+// GetServletContainersReport returns the servlet container install counts for all months
+func GetServletContainersReport(db sq.BaseRunner, co CountOptions, year, month int) (ServletContainerReport, error) {
+	scr := ServletContainerReport{PerMonth: map[string]map[string]uint64{}}
+
+	months, err := allOrderedMonths(db, year, month)
+	if err != nil {
+		return scr, err
+	}
+
+	for _, ym := range months {
+		counts, err := ServletContainerCountsForMonth(db, co, ym.year, ym.month)
+		if err != nil {
+			return scr, err
+		}
+		if len(counts) > 0 {
+			scr.PerMonth[fmt.Sprintf("%d", startDateForYearMonth(ym.year, ym.month, co.Location).UnixMilli())] = counts
+		}
+	}
+
+	return scr, nil
+}
+
 // OSCountsForMonth gets the total number of each known OS type in a month
 // analogous to nodesOnOS2Number in generateStats.groovy
-func OSCountsForMonth(db sq.BaseRunner, year, month int) (map[string]uint64, error) {
-	rows, err := PSQL(db).Select("o.name", "sum(nr.value::int) as total").
+func OSCountsForMonth(db sq.BaseRunner, co CountOptions, year, month int, filters ...sq.Sqlizer) (map[string]uint64, error) {
+	rows, err := withFilters(PSQL(db).Select("o.name", "sum(nr.value::int) as total").
 		From("instance_reports i, jsonb_each_text(i.nodes) nr").
 		Join("os_types o on o.id = nr.key::int").
 		Where(sq.Eq{"i.year": year}).
 		Where(sq.Eq{"i.month": month}).
-		Where(sq.GtOrEq{"i.count_for_month": 2}).
+		Where(countedInstances("i", co.ExcludeQuarantined)).
 		GroupBy("o.name").
-		OrderBy("total asc").
+		OrderBy("total asc"), filters).
 		Query()
 	if err != nil {
 		return nil, err
@@ -1243,6 +1996,13 @@ func OSCountsForMonth(db sq.BaseRunner, year, month int) (map[string]uint64, err
 	return osMap, nil
 }
 
+var nonAlphanumericRE = regexp.MustCompile(`[^a-z0-9]+`)
+
+// chartFileName returns a name for use in chart file names, such as "jetty-9" for "Jetty 9" and "n-a" for "N/A"
+func chartFileName(name string) string {
+	return strings.Trim(nonAlphanumericRE.ReplaceAllString(strings.ToLower(name), "-"), "-")
+}
+
 // CreateBarSVG takes a dataset and returns byte slices for the corresponding .svg and .csv files
 func CreateBarSVG(title string, data map[string]uint64, scaleReduction int, sortByValue, asVersion, asNumber bool, filterFunc func(string, uint64) bool) ([]byte, []byte, error) {
 	sortedData, maxVal := asSortedPairsAndMaxValue(data, sortByValue, asVersion, asNumber, filterFunc)
@@ -1436,16 +2196,7 @@ func asSortedPairsAndMaxValue(data map[string]uint64, byValue, asVersion, asNumb
 		})
 	} else if asVersion {
 		sort.Slice(sp, func(i, j int) bool {
-			svI, err := semver.NewVersion(sp[i].key)
-			if err != nil {
-				return sp[i].key < sp[j].key
-			}
-			svJ, err := semver.NewVersion(sp[j].key)
-			if err != nil {
-				return sp[i].key < sp[j].key
-			}
-
-			return svI.LessThan(svJ)
+			return CompareJenkinsVersions(sp[i].key, sp[j].key) < 0
 		})
 	} else if asNumber {
 		sort.Slice(sp, func(i, j int) bool {
@@ -1469,14 +2220,14 @@ func asSortedPairsAndMaxValue(data map[string]uint64, byValue, asVersion, asNumb
 	return sp, maxVal
 }
 
-func pluginInstallsByMonthForName(db sq.BaseRunner, currentYear, currentMonth int, idToPlugin map[uint64]Plugin) (map[string]map[string]uint64, error) {
+func pluginInstallsByMonthForName(db sq.BaseRunner, co CountOptions, currentYear, currentMonth int, idToPlugin map[uint64]Plugin, filters ...sq.Sqlizer) (map[string]map[string]uint64, error) {
 	monthCount := make(map[string]map[string]uint64)
 
-	rows, err := PSQL(db).Select("pr.id", "i.year", "i.month", "count(*)").
+	rows, err := withFilters(PSQL(db).Select("pr.id", "i.year", "i.month", "count(*)").
 		From("instance_reports i, unnest(i.plugins) pr(id)").
-		Where(sq.GtOrEq{"i.count_for_month": 2}).
+		Where(countedInstances("i", co.ExcludeQuarantined)).
 		OrderBy("pr.id", "i.year", "i.month").
-		GroupBy("pr.id", "i.year", "i.month").
+		GroupBy("pr.id", "i.year", "i.month"), filters).
 		Query()
 	if err != nil {
 		return nil, err
@@ -1500,7 +2251,7 @@ func pluginInstallsByMonthForName(db sq.BaseRunner, currentYear, currentMonth in
 			if !ok {
 				return nil, fmt.Errorf("no plugin found for id %d", i)
 			}
-			monthTS := startDateForYearMonth(y, m)
+			monthTS := startDateForYearMonth(y, m, co.Location)
 			if _, ok := monthCount[p.Name]; !ok {
 				monthCount[p.Name] = make(map[string]uint64)
 			}
@@ -1515,16 +2266,16 @@ func pluginInstallsByMonthForName(db sq.BaseRunner, currentYear, currentMonth in
 	return monthCount, nil
 }
 
-func pluginInstallsByVersionForName(db sq.BaseRunner, year, month int, idToPlugin map[uint64]Plugin) (map[string]map[string]uint64, error) {
+func pluginInstallsByVersionForName(db sq.BaseRunner, co CountOptions, year, month int, idToPlugin map[uint64]Plugin, filters ...sq.Sqlizer) (map[string]map[string]uint64, error) {
 	monthCount := make(map[string]map[string]uint64)
 
-	rows, err := PSQL(db).Select("pr.id", "count(*)").
+	rows, err := withFilters(PSQL(db).Select("pr.id", "count(*)").
 		From("instance_reports i, unnest(i.plugins) pr(id)").
 		Where(sq.Eq{"i.year": year}).
 		Where(sq.Eq{"i.month": month}).
-		Where(sq.GtOrEq{"i.count_for_month": 2}).
+		Where(countedInstances("i", co.ExcludeQuarantined)).
 		OrderBy("pr.id").
-		GroupBy("pr.id").
+		GroupBy("pr.id"), filters).
 		Query()
 	if err != nil {
 		return nil, err
@@ -1547,7 +2298,7 @@ func pluginInstallsByVersionForName(db sq.BaseRunner, year, month int, idToPlugi
 			return nil, fmt.Errorf("no plugin found for id %d", i)
 		}
 
-		if p.Version == questionVersion {
+		if !countablePluginVersion(p.Version) {
 			continue
 		}
 
@@ -1609,6 +2360,34 @@ func jenkinsVersions2x(db sq.BaseRunner) ([]uint64, error) {
 	return jvIDs, nil
 }
 
+// jobTypeIDsForCategories gets the IDs of all job types in each job category
+func jobTypeIDsForCategories(db sq.BaseRunner, categories *JobCategories) (map[string][]uint64, error) {
+	idsForCategory := make(map[string][]uint64)
+
+	rows, err := PSQL(db).Select("id", "name").
+		From(JobTypesTable).
+		Query()
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = rows.Close()
+	}()
+
+	for rows.Next() {
+		var id uint64
+		var name string
+		err = rows.Scan(&id, &name)
+		if err != nil {
+			return nil, err
+		}
+		category := categories.CategoryFor(name)
+		idsForCategory[category] = append(idsForCategory[category], id)
+	}
+
+	return idsForCategory, nil
+}
+
 func allOrderedMonths(db sq.BaseRunner, currentYear, currentMonth int) ([]yearMonth, error) {
 	var yearMonths []yearMonth
 	rows, err := PSQL(db).Select("year", "month").
@@ -1636,14 +2415,14 @@ func allOrderedMonths(db sq.BaseRunner, currentYear, currentMonth int) ([]yearMo
 	return yearMonths, nil
 }
 
-func installCountsByMonth(db sq.BaseRunner, currentYear, currentMonth int) (map[string]uint64, error) {
+func installCountsByMonth(db sq.BaseRunner, co CountOptions, currentYear, currentMonth int, filters ...sq.Sqlizer) (map[string]uint64, error) {
 	installs := make(map[string]uint64)
 
-	rows, err := PSQL(db).Select("year", "month", "count(*)").
-		From(InstanceReportsTable).
-		Where(sq.GtOrEq{"count_for_month": 2}).
-		GroupBy("year", "month").
-		OrderBy("year", "month").
+	rows, err := withFilters(PSQL(db).Select("i.year", "i.month", "count(*)").
+		From("instance_reports i").
+		Where(countedInstances("i", co.ExcludeQuarantined)).
+		GroupBy("i.year", "i.month").
+		OrderBy("i.year", "i.month"), filters).
 		Query()
 	if err != nil {
 		return nil, err
@@ -1662,7 +2441,7 @@ func installCountsByMonth(db sq.BaseRunner, currentYear, currentMonth int) (map[
 		}
 
 		if !(y == currentYear && m == currentMonth) {
-			startTS := fmt.Sprintf("%d", startDateForYearMonth(y, m).UnixMilli())
+			startTS := fmt.Sprintf("%d", startDateForYearMonth(y, m, co.Location).UnixMilli())
 			installs[startTS] = c
 		}
 	}
@@ -1670,18 +2449,19 @@ func installCountsByMonth(db sq.BaseRunner, currentYear, currentMonth int) (map[
 	return installs, nil
 }
 
-func maxInstanceVersionForMonth(db sq.BaseRunner, year, month int) (map[string]string, error) {
+// maxInstanceVersionForMonth gets the latest Jenkins version, in sort key order, of each instance in a month
+func maxInstanceVersionForMonth(db sq.BaseRunner, co CountOptions, year, month int) (map[string]string, error) {
 	maxVersions := make(map[string]string)
 
-	rows, err := PSQL(db).Select("i.instance_id", "max(jv.version)").
+	rows, err := PSQL(db).Select("distinct on (i.instance_id) i.instance_id", "jv.version").
 		From("instance_reports i").
 		Join("jenkins_versions jv on jv.id = i.version").
 		Where(sq.Eq{"i.year": year}).
 		Where(sq.Eq{"i.month": month}).
-		Where(sq.GtOrEq{"i.count_for_month": 2}).
+		Where(countedInstances("i", co.ExcludeQuarantined)).
 		Where(`jv.version ~ '^\d'`).
 		Where("jv.version not like '%private%'").
-		GroupBy("i.instance_id").
+		OrderBy("i.instance_id", "jv.sort_key desc").
 		Query()
 	if err != nil {
 		return nil, err
@@ -1699,7 +2479,7 @@ func maxInstanceVersionForMonth(db sq.BaseRunner, year, month int) (map[string]s
 		maxVersions[id] = version
 	}
 
-	return maxVersions, nil
+	return maxVersions, rows.Err()
 }
 
 func allPluginNames(db sq.BaseRunner) ([]string, error) {
@@ -1756,6 +2536,22 @@ func pluginIDsToPlugin(db sq.BaseRunner) (map[uint64]Plugin, error) {
 	return plugins, nil
 }
 
+// withFilters adds each of the filters, which refer to instance_reports as "i", to the statement's conditions
+func withFilters(stmt sq.SelectBuilder, filters []sq.Sqlizer) sq.SelectBuilder {
+	for _, f := range filters {
+		stmt = stmt.Where(f)
+	}
+	return stmt
+}
+
+func writeJSONFile(filename string, data interface{}) error {
+	asJSON, err := json.MarshalIndent(data, "", "    ")
+	if err != nil {
+		return err
+	}
+	return writeFile(filename, asJSON)
+}
+
 func writeFile(filename string, data []byte) error {
 	return ioutil.WriteFile(filename, data, 0644) //nolint:gosec
 }
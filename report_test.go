@@ -1,7 +1,11 @@
 package stats_test
 
 import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
 	"database/sql"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
@@ -16,6 +20,7 @@ import (
 	_ "github.com/golang-migrate/migrate/v4/source/file"
 	stats "github.com/jenkins-infra/jenkins-usage-stats"
 	"github.com/jenkins-infra/jenkins-usage-stats/testutil"
+	"github.com/parquet-go/parquet-go"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 	"gopkg.in/yaml.v2"
@@ -45,7 +50,7 @@ func TestReportFuncs(t *testing.T) {
 	assert.Equal(t, len(allYamlReports), c)
 
 	t.Run("GetInstallCountsForVersions", func(t *testing.T) {
-		ir, err := stats.GetInstallCountForVersions(db, 2009, 12)
+		ir, err := stats.GetInstallCountForVersions(db, stats.CountOptions{}, 2009, 12)
 		require.NoError(t, err)
 
 		goldenBytes := jsonReadGoldenAndUpdateIfDesired(t, ir)
@@ -56,8 +61,40 @@ func TestReportFuncs(t *testing.T) {
 		assert.Equal(t, goldenIR, ir)
 	})
 
+	t.Run("RunUsageQuery", func(t *testing.T) {
+		ir, err := stats.GetInstallCountForVersions(db, stats.CountOptions{}, 2009, 12)
+		require.NoError(t, err)
+
+		byCore, err := stats.RunUsageQuery(db, stats.UsageQuery{StartYear: 2009, StartMonth: 12, EndYear: 2009, EndMonth: 12, GroupBy: stats.GroupByCore})
+		require.NoError(t, err)
+		coreCounts := map[string]uint64{}
+		for _, r := range byCore.Rows {
+			coreCounts[r.Key] = r.Count
+		}
+		assert.Equal(t, ir.Installations, coreCounts)
+
+		pn, err := stats.GetLatestPluginNumbers(db, stats.CountOptions{}, 2009, 12)
+		require.NoError(t, err)
+
+		byPlugin, err := stats.RunUsageQuery(db, stats.UsageQuery{StartYear: 2009, StartMonth: 12, EndYear: 2009, EndMonth: 12, GroupBy: stats.GroupByPlugin})
+		require.NoError(t, err)
+		pluginCounts := map[string]uint64{}
+		for _, r := range byPlugin.Rows {
+			pluginCounts[r.Key] = r.Count
+		}
+		assert.Equal(t, pn.Plugins, pluginCounts)
+
+		var total uint64
+		for _, c := range ir.Installations {
+			total += c
+		}
+		byQuarter, err := stats.RunUsageQuery(db, stats.UsageQuery{StartYear: 2009, StartMonth: 12, EndYear: 2009, EndMonth: 12, GroupBy: stats.GroupByQuarter})
+		require.NoError(t, err)
+		assert.Equal(t, []stats.UsageQueryRow{{Key: "2009-Q4", Count: total}}, byQuarter.Rows)
+	})
+
 	t.Run("GetLatestPluginNumbers", func(t *testing.T) {
-		pn, err := stats.GetLatestPluginNumbers(db, 2009, 12)
+		pn, err := stats.GetLatestPluginNumbers(db, stats.CountOptions{}, 2009, 12)
 		require.NoError(t, err)
 
 		goldenBytes := jsonReadGoldenAndUpdateIfDesired(t, pn)
@@ -69,7 +106,7 @@ func TestReportFuncs(t *testing.T) {
 	})
 
 	t.Run("GetCapabilities", func(t *testing.T) {
-		pn, err := stats.GetCapabilities(db, 2009, 12)
+		pn, err := stats.GetCapabilities(db, stats.CountOptions{}, 2009, 12)
 		require.NoError(t, err)
 
 		goldenBytes := jsonReadGoldenAndUpdateIfDesired(t, pn)
@@ -81,7 +118,22 @@ func TestReportFuncs(t *testing.T) {
 	})
 
 	t.Run("JobCountsForMonth", func(t *testing.T) {
-		pn, err := stats.JobCountsForMonth(db, 2009, 12)
+		pn, err := stats.JobCountsForMonth(db, stats.CountOptions{}, 2009, 12)
+		require.NoError(t, err)
+
+		goldenBytes := jsonReadGoldenAndUpdateIfDesired(t, pn)
+
+		var goldenPN map[string]uint64
+		require.NoError(t, json.Unmarshal(goldenBytes, &goldenPN))
+
+		assert.Equal(t, goldenPN, pn)
+	})
+
+	t.Run("JobCategoryCountsForMonth", func(t *testing.T) {
+		categories, err := stats.LoadJobCategories("")
+		require.NoError(t, err)
+
+		pn, _, err := stats.JobCategoryCountsForMonth(db, stats.CountOptions{}, 2009, 12, categories)
 		require.NoError(t, err)
 
 		goldenBytes := jsonReadGoldenAndUpdateIfDesired(t, pn)
@@ -93,7 +145,7 @@ func TestReportFuncs(t *testing.T) {
 	})
 
 	t.Run("OSCountsForMonth", func(t *testing.T) {
-		pn, err := stats.OSCountsForMonth(db, 2009, 12)
+		pn, err := stats.OSCountsForMonth(db, stats.CountOptions{}, 2009, 12)
 		require.NoError(t, err)
 
 		goldenBytes := jsonReadGoldenAndUpdateIfDesired(t, pn)
@@ -105,7 +157,7 @@ func TestReportFuncs(t *testing.T) {
 	})
 
 	t.Run("GetJVMReports", func(t *testing.T) {
-		pn, err := stats.GetJVMsReport(db, 2010, 2)
+		pn, err := stats.GetJVMsReport(db, stats.CountOptions{}, 2010, 2)
 		require.NoError(t, err)
 
 		goldenBytes := jsonReadGoldenAndUpdateIfDesired(t, pn)
@@ -117,7 +169,7 @@ func TestReportFuncs(t *testing.T) {
 	})
 
 	t.Run("GetPluginReports", func(t *testing.T) {
-		pn, err := stats.GetPluginReports(db, 2010, 2)
+		pn, err := stats.GetPluginReports(db, stats.CountOptions{}, 2010, 2)
 		require.NoError(t, err)
 
 		goldenBytes := jsonReadGoldenAndUpdateIfDesired(t, pn)
@@ -129,7 +181,7 @@ func TestReportFuncs(t *testing.T) {
 	})
 
 	t.Run("JenkinsVersionsForPluginVersions", func(t *testing.T) {
-		orderedPN, err := stats.JenkinsVersionsForPluginVersions(db, 2010, 1)
+		orderedPN, err := stats.JenkinsVersionsForPluginVersions(db, stats.CountOptions{}, 2010, 1)
 		require.NoError(t, err)
 
 		// Need to jump through some hoops to compare the map[string]*stats.PVDPluginVersionMap we get from stats.JenkinsVersionsForPluginVersions
@@ -166,7 +218,7 @@ func TestReportFuncs(t *testing.T) {
 	})
 
 	t.Run("ExecutorCountsForMonth", func(t *testing.T) {
-		pn, err := stats.ExecutorCountsForMonth(db, 2010, 1)
+		pn, err := stats.ExecutorCountsForMonth(db, stats.CountOptions{}, 2010, 1)
 		require.NoError(t, err)
 
 		execSVG, execCSV, err := stats.CreateBarSVG(fmt.Sprintf("Executors per install (total: %d)", 5), pn, 25, false, false, true, stats.DefaultFilter)
@@ -186,16 +238,180 @@ func TestReportFuncs(t *testing.T) {
 			_ = os.RemoveAll(tmpOut)
 		}()
 
-		require.NoError(t, stats.GenerateReport(db, 2010, 1, tmpOut))
+		tiers, err := stats.LoadSizeTiers("")
+		require.NoError(t, err)
+
+		metricsFile := filepath.Join(tmpOut, "jenkins-usage.prom")
+		anomaliesFile := filepath.Join(tmpOut, "anomalies.json")
+		require.NoError(t, stats.GenerateReport(db, 2010, 1, tmpOut, stats.ReportConfig{SizeTiers: tiers, MetricsFile: metricsFile, AnomaliesFile: anomaliesFile}))
+		assert.FileExists(t, filepath.Join(tmpOut, "tiers", "tiers.json"))
+		assert.FileExists(t, filepath.Join(tmpOut, "tiers", "enterprise", "installations.json"))
+		assert.DirExists(t, filepath.Join(tmpOut, "tiers", "enterprise", "plugins"))
+		assert.FileExists(t, metricsFile)
+		assert.FileExists(t, anomaliesFile)
+	})
+
+	t.Run("ExportParquet", func(t *testing.T) {
+		var buf bytes.Buffer
+		count, err := stats.ExportParquet(db, &buf, stats.ExportOptions{StartYear: 2009, StartMonth: 12, EndYear: 2009, EndMonth: 12, HashInstanceIDs: true, Salt: "salt"})
+		require.NoError(t, err)
+
+		var expected int
+		require.NoError(t, stats.PSQL(db).Select("count(*)").From(stats.InstanceReportsTable).
+			Where(sq.Eq{"year": 2009, "month": 12}).
+			Where(sq.GtOrEq{"count_for_month": 2}).
+			QueryRow().Scan(&expected))
+		assert.Equal(t, expected, count)
+
+		rows, err := parquet.Read[stats.ExportRow](bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+		require.NoError(t, err)
+		require.Len(t, rows, count)
+
+		ir, err := stats.GetInstallCountForVersions(db, stats.CountOptions{}, 2009, 12)
+		require.NoError(t, err)
+		versions := map[string]uint64{}
+		hashedIDs := map[string]bool{}
+		for _, r := range rows {
+			versions[r.JenkinsVersion]++
+			hashedIDs[r.InstanceID] = true
+		}
+		assert.Equal(t, ir.Installations, versions)
+
+		var instanceID string
+		require.NoError(t, stats.PSQL(db).Select("instance_id").From(stats.InstanceReportsTable).
+			Where(sq.Eq{"year": 2009, "month": 12}).
+			Where(sq.GtOrEq{"count_for_month": 2}).
+			Limit(1).
+			QueryRow().Scan(&instanceID))
+		mac := hmac.New(sha256.New, []byte("salt"))
+		_, _ = mac.Write([]byte(instanceID))
+		assert.True(t, hashedIDs[hex.EncodeToString(mac.Sum(nil))])
+	})
+
+	t.Run("WriteMetrics", func(t *testing.T) {
+		var buf bytes.Buffer
+		require.NoError(t, stats.WriteMetrics(&buf, db, stats.CountOptions{}, 2009, 12, 100))
+		metrics := buf.String()
+
+		ir, err := stats.GetInstallCountForVersions(db, stats.CountOptions{}, 2009, 12)
+		require.NoError(t, err)
+		for v, c := range ir.Installations {
+			assert.Contains(t, metrics, fmt.Sprintf("jenkins_usage_installations{version=\"%s\"} %d\n", v, c))
+		}
+
+		pn, err := stats.GetLatestPluginNumbers(db, stats.CountOptions{}, 2009, 12)
+		require.NoError(t, err)
+		for p, c := range pn.Plugins {
+			line := fmt.Sprintf("jenkins_usage_plugin_installations{plugin=\"%s\"} %d\n", p, c)
+			if c >= 100 {
+				assert.Contains(t, metrics, line)
+			} else {
+				assert.NotContains(t, metrics, line)
+			}
+		}
+
+		totals, err := stats.TotalsForMonth(db, stats.CountOptions{}, 2009, 12)
+		require.NoError(t, err)
+		assert.Equal(t, uint64(len(ir.Installations)) > 0, totals.Instances > 0)
+		assert.Contains(t, metrics, fmt.Sprintf("jenkins_usage_executors %d\n", totals.Executors))
 	})
 }
 
+// TestNormalizedFieldReports covers the reports of fields which the fixtures predate, from reports added for June 2022.
+func TestNormalizedFieldReports(t *testing.T) {
+	db, closeFunc := dbWithNormalizedFields(t)
+	defer closeFunc()
+
+	t.Run("GetJVMVendorsReport", func(t *testing.T) {
+		pn, err := stats.GetJVMVendorsReport(db, stats.CountOptions{}, 2022, 7)
+		require.NoError(t, err)
+
+		goldenBytes := jsonReadGoldenAndUpdateIfDesired(t, pn)
+
+		var goldenPN stats.JVMVendorReport
+		require.NoError(t, json.Unmarshal(goldenBytes, &goldenPN))
+
+		assert.Equal(t, goldenPN, pn)
+	})
+
+	t.Run("GetAgentJVMsReport", func(t *testing.T) {
+		pn, err := stats.GetAgentJVMsReport(db, stats.CountOptions{}, 2022, 7)
+		require.NoError(t, err)
+
+		goldenBytes := jsonReadGoldenAndUpdateIfDesired(t, pn)
+
+		var goldenPN stats.AgentJVMReport
+		require.NoError(t, json.Unmarshal(goldenBytes, &goldenPN))
+
+		assert.Equal(t, goldenPN, pn)
+	})
+
+	t.Run("ServletContainerCountsForMonth", func(t *testing.T) {
+		pn, err := stats.ServletContainerCountsForMonth(db, stats.CountOptions{}, 2022, 6)
+		require.NoError(t, err)
+
+		goldenBytes := jsonReadGoldenAndUpdateIfDesired(t, pn)
+
+		var goldenPN map[string]uint64
+		require.NoError(t, json.Unmarshal(goldenBytes, &goldenPN))
+
+		assert.Equal(t, goldenPN, pn)
+	})
+
+	t.Run("ServletContainerTrend", func(t *testing.T) {
+		scr, err := stats.GetServletContainersReport(db, stats.CountOptions{}, 2022, 7)
+		require.NoError(t, err)
+		trends := scr.Trends()
+		assert.Equal(t, map[string]uint64{"1654041600000": 1}, trends["Jetty 9"])
+
+		trendSVG, trendCSV, err := stats.CreateBarSVG("Servlet container Jetty 9 installations", trends["Jetty 9"], 10, false, false, false, stats.DefaultFilter)
+		require.NoError(t, err)
+
+		goldenSVG := rawReadGoldenAndUpdateIfDesired(t, trendSVG, "svg")
+		assert.Equal(t, string(goldenSVG), string(trendSVG))
+
+		goldenCSV := rawReadGoldenAndUpdateIfDesired(t, trendCSV, "csv")
+		assert.Equal(t, string(goldenCSV), string(trendCSV))
+	})
+}
+
+func TestOSFamilyCountsForMonth(t *testing.T) {
+	db, closeFunc := testutil.DBForTest(t)
+	defer closeFunc()
+
+	cache := stats.NewStatsCache()
+	for day := 1; day <= 2; day++ {
+		a := testReport("a", day, "2.303.1", "Linux (amd64)", "git")
+		a.Nodes = append(a.Nodes, stats.JSONNode{OS: "Linux (aarch64)", JVMVersion: "11.0.13", Executors: 1})
+		b := testReport("b", day, "2.303.1", "Windows 10 (amd64)", "git")
+		b.Nodes = append(b.Nodes,
+			stats.JSONNode{OS: "Windows Server 2019 (amd64)", JVMVersion: "11.0.13", Executors: 1},
+			stats.JSONNode{OS: "Linux (amd64)", JVMVersion: "11.0.13", Executors: 1})
+		for _, r := range []*stats.JSONReport{a, b} {
+			require.NoError(t, stats.AddIndividualReport(db, cache, r))
+		}
+	}
+
+	// Each instance is counted once for each family it has nodes on, however many nodes or versions.
+	families, err := stats.OSFamilyCountsForMonth(db, stats.CountOptions{}, 2022, 6)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]uint64{"Linux": 2, "Windows": 1}, families)
+
+	// A threshold of 0 means the default, so git, with two installs, isn't included.
+	var buf bytes.Buffer
+	require.NoError(t, stats.WriteMetrics(&buf, db, stats.CountOptions{}, 2022, 6, 0))
+	metrics := buf.String()
+	assert.Contains(t, metrics, "jenkins_usage_os_installations{os=\"Linux\"} 2\n")
+	assert.Contains(t, metrics, "jenkins_usage_os_installations{os=\"Windows\"} 1\n")
+	assert.NotContains(t, metrics, "jenkins_usage_plugin_installations{")
+}
+
 func jsonReadGoldenAndUpdateIfDesired(t *testing.T, input interface{}) []byte {
 	testName := strings.Split(t.Name(), "/")[1]
 
 	goldenFile := filepath.Join("testdata", "reports", fmt.Sprintf("%s.json", testName))
 
-	if os.Getenv("UPDATE_GOLDEN") == "" {
+	if os.Getenv("UPDATE_GOLDEN") != "" {
 		jb, err := json.MarshalIndent(input, "", "  ")
 		require.NoError(t, err)
 		require.NoError(t, ioutil.WriteFile(goldenFile, jb, 0644)) //nolint:gosec
@@ -242,10 +458,58 @@ func dbWithFixtures(t *testing.T) (sq.BaseRunner, func()) {
 		closeFunc()
 		t.Fatal(err)
 	}
+	// The fixtures don't have sort keys, like Jenkins versions added before they existed.
+	if _, err := stats.UpdateJenkinsVersionSortKeys(db); err != nil {
+		closeFunc()
+		t.Fatal(err)
+	}
 
 	return sq.NewStmtCacheProxy(db), closeFunc
 }
 
+// dbWithNormalizedFields adds reports with JVM vendors, agents and servlet containers to a database. Every instance
+// reports twice in June 2022, so it's counted, except d, which only reports once. c was added before vendors and servlet
+// containers were stored, so it has neither. a's agents run a different JVM to its controller, and b's the same one.
+func dbWithNormalizedFields(t *testing.T) (sq.BaseRunner, func()) {
+	db, closeFunc := testutil.DBForTest(t)
+
+	instance := func(install, container, jvm, vendor, name string, agentJVMs ...string) []*stats.JSONReport {
+		var reports []*stats.JSONReport
+		for day := 1; day <= 2; day++ {
+			r := testReport(install, day, "2.303.1", "Linux", "git")
+			r.Nodes[0].JVMVersion = jvm
+			r.Nodes[0].JVMVendor = vendor
+			r.Nodes[0].JVMName = name
+			r.ServletContainer = container
+			for _, agentJVM := range agentJVMs {
+				r.Nodes = append(r.Nodes, stats.JSONNode{OS: "Linux", JVMVersion: agentJVM, Executors: 1})
+			}
+			reports = append(reports, r)
+		}
+		return reports
+	}
+
+	var reports []*stats.JSONReport
+	reports = append(reports, instance("a", "Jetty 9", "11", "Eclipse Adoptium", "HotSpot", "11", "11", "17")...)
+	reports = append(reports, instance("b", "Jetty 10", "17", "Amazon", "HotSpot", "17")...)
+	reports = append(reports, instance("c", "Tomcat 9", "11", "Oracle", "HotSpot")...)
+	reports = append(reports, instance("d", "Tomcat 9", "17", "Azul", "Zing", "11")[0])
+
+	cache := stats.NewStatsCache()
+	for _, r := range reports {
+		if err := stats.AddIndividualReport(db, cache, r); err != nil {
+			closeFunc()
+			t.Fatal(err)
+		}
+	}
+	if _, err := stats.PSQL(db).Update(stats.InstanceReportsTable).Set("jvm_vendor_id", nil).Set("servlet_container_id", nil).Where(sq.Eq{"instance_id": "c"}).Exec(); err != nil {
+		closeFunc()
+		t.Fatal(err)
+	}
+
+	return db, closeFunc
+}
+
 func useITDB(t *testing.T) (sq.BaseRunner, func()) {
 	databaseURL := os.Getenv("DATABASE_URL")
 	if databaseURL == "" {
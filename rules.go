@@ -0,0 +1,207 @@
+package stats
+
+import (
+	"database/sql"
+	_ "embed"
+	"errors"
+	"fmt"
+	"os"
+	"regexp"
+	"sync"
+	"sync/atomic"
+
+	sq "github.com/Masterminds/squirrel"
+	"gopkg.in/yaml.v2"
+)
+
+const (
+	// RuleFieldJVMVersion is the field for the Java version of each node
+	RuleFieldJVMVersion = "jvmVersion"
+	// RuleFieldJenkinsVersion is the field for the Jenkins version of an instance
+	RuleFieldJenkinsVersion = "jenkinsVersion"
+	// RuleFieldPluginVersion is the field for the version of each plugin
+	RuleFieldPluginVersion = "pluginVersion"
+	// RuleFieldJVMVendor is the field for the JVM vendor of each node
+	RuleFieldJVMVendor = "jvmVendor"
+	// RuleFieldJVMName is the field for the JVM name of each node
+	RuleFieldJVMName = "jvmName"
+	// RuleFieldServletContainer is the field for the servlet container of an instance
+	RuleFieldServletContainer = "servletContainer"
+
+	// settingNormalizationRules is the name of the setting the rules reports were last added with are recorded in
+	settingNormalizationRules = "normalization_rules"
+)
+
+var (
+	//go:embed etc/normalization-rules.yml
+	// DefaultNormalizationRulesConfig is the YAML configuration used for normalization rules if no other configuration
+	// is specified.
+	DefaultNormalizationRulesConfig string
+
+	// RuleFields are the fields normalization rules can be configured for
+	RuleFields = []string{RuleFieldJVMVersion, RuleFieldJenkinsVersion, RuleFieldPluginVersion, RuleFieldJVMVendor,
+		RuleFieldJVMName, RuleFieldServletContainer}
+
+	activeNormalizationRules atomic.Pointer[NormalizationRules]
+)
+
+func init() {
+	rules, err := ParseNormalizationRules([]byte(DefaultNormalizationRulesConfig))
+	if err != nil {
+		panic(fmt.Sprintf("invalid default normalization rules: %s", err))
+	}
+	activeNormalizationRules.Store(rules)
+}
+
+// NormalizationRules are the rules for normalizing values in reports, for each field
+type NormalizationRules struct {
+	JVMVersion       []NormalizationRule `yaml:"jvmVersion"`
+	JenkinsVersion   []NormalizationRule `yaml:"jenkinsVersion"`
+	PluginVersion    []NormalizationRule `yaml:"pluginVersion"`
+	JVMVendor        []NormalizationRule `yaml:"jvmVendor"`
+	JVMName          []NormalizationRule `yaml:"jvmName"`
+	ServletContainer []NormalizationRule `yaml:"servletContainer"`
+
+	// results caches the result for each field and value, since there are few distinct values
+	results sync.Map
+	// config is the YAML the rules were parsed from
+	config string
+}
+
+// NormalizationRule replaces or drops values matching a pattern
+type NormalizationRule struct {
+	Match string `yaml:"match"`
+	Value string `yaml:"value"`
+	Drop  bool   `yaml:"drop"`
+
+	compiled *regexp.Regexp
+}
+
+// NormalizationResult is the outcome of normalizing a value
+type NormalizationResult struct {
+	Value   string
+	Dropped bool
+	// Rule is the index of the rule which matched, or -1 if none did
+	Rule int
+}
+
+// ParseNormalizationRules parses and validates YAML normalization rule configuration
+func ParseNormalizationRules(data []byte) (*NormalizationRules, error) {
+	nr := &NormalizationRules{config: string(data)}
+	if err := yaml.UnmarshalStrict(data, nr); err != nil {
+		return nil, err
+	}
+
+	for _, field := range RuleFields {
+		rules := nr.Rules(field)
+		for i, r := range rules {
+			if r.Drop && r.Value != "" {
+				return nil, fmt.Errorf("%s rule %d has both a value and drop", field, i)
+			}
+			re, err := regexp.Compile("^(?:" + r.Match + ")$")
+			if err != nil {
+				return nil, fmt.Errorf("invalid pattern %s for %s rule %d: %w", r.Match, field, i, err)
+			}
+			rules[i].compiled = re
+		}
+	}
+
+	return nr, nil
+}
+
+// LoadNormalizationRules reads normalization rule configuration from a YAML file, or returns the default configuration
+// if the filename is empty
+func LoadNormalizationRules(filename string) (*NormalizationRules, error) {
+	if filename == "" {
+		return ParseNormalizationRules([]byte(DefaultNormalizationRulesConfig))
+	}
+	data, err := os.ReadFile(filename) // #nosec
+	if err != nil {
+		return nil, err
+	}
+	return ParseNormalizationRules(data)
+}
+
+// RecordNormalizationRules records the rules reports are being added with in the database, replacing any recorded
+// before, so that reports generated later leave out the same versions
+func RecordNormalizationRules(db sq.BaseRunner, nr *NormalizationRules) error {
+	_, err := PSQL(db).Insert(SettingsTable).
+		Columns("name", "value").
+		Values(settingNormalizationRules, nr.config).
+		Suffix("on conflict (name) do update set value = excluded.value").
+		Exec()
+	return err
+}
+
+// StoredNormalizationRules returns the rules reports were last added to the database with, or the default rules if
+// none have been recorded, such as for reports added before the rules were recorded
+func StoredNormalizationRules(db sq.BaseRunner) (*NormalizationRules, error) {
+	var config string
+	err := PSQL(db).Select("value").
+		From(SettingsTable).
+		Where(sq.Eq{"name": settingNormalizationRules}).
+		QueryRow().
+		Scan(&config)
+	if errors.Is(err, sql.ErrNoRows) {
+		return ParseNormalizationRules([]byte(DefaultNormalizationRulesConfig))
+	}
+	if err != nil {
+		return nil, err
+	}
+	return ParseNormalizationRules([]byte(config))
+}
+
+// UseNormalizationRules sets the rules used when parsing and adding reports. The default rules are used until this is
+// called.
+func UseNormalizationRules(nr *NormalizationRules) {
+	activeNormalizationRules.Store(nr)
+}
+
+// Normalize applies the first rule for the field which matches the value
+func (nr *NormalizationRules) Normalize(field, value string) NormalizationResult {
+	key := field + "\x00" + value
+	if cached, ok := nr.results.Load(key); ok {
+		return cached.(NormalizationResult)
+	}
+	result := nr.normalize(field, value)
+	nr.results.Store(key, result)
+	return result
+}
+
+func (nr *NormalizationRules) normalize(field, value string) NormalizationResult {
+	for i, r := range nr.Rules(field) {
+		match := r.compiled.FindStringSubmatchIndex(value)
+		if match == nil {
+			continue
+		}
+		if r.Drop {
+			return NormalizationResult{Dropped: true, Rule: i}
+		}
+		return NormalizationResult{Value: string(r.compiled.ExpandString(nil, r.Value, value, match)), Rule: i}
+	}
+	return NormalizationResult{Value: value, Rule: -1}
+}
+
+// Rules returns the rules for a field, or nil for an unknown field
+func (nr *NormalizationRules) Rules(field string) []NormalizationRule {
+	switch field {
+	case RuleFieldJVMVersion:
+		return nr.JVMVersion
+	case RuleFieldJenkinsVersion:
+		return nr.JenkinsVersion
+	case RuleFieldPluginVersion:
+		return nr.PluginVersion
+	case RuleFieldJVMVendor:
+		return nr.JVMVendor
+	case RuleFieldJVMName:
+		return nr.JVMName
+	case RuleFieldServletContainer:
+		return nr.ServletContainer
+	}
+	return nil
+}
+
+// normalizeValue normalizes a value with the active rules
+func normalizeValue(field, value string) NormalizationResult {
+	return activeNormalizationRules.Load().Normalize(field, value)
+}
@@ -0,0 +1,138 @@
+package stats_test
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	stats "github.com/jenkins-infra/jenkins-usage-stats"
+	"github.com/jenkins-infra/jenkins-usage-stats/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDefaultNormalizationRules(t *testing.T) {
+	rules, err := stats.LoadNormalizationRules("")
+	require.NoError(t, err)
+
+	for field, cases := range map[string]map[string]string{
+		stats.RuleFieldJVMVersion: {
+			"1.8.0_292": "1.8",
+			"1.7.0_80":  "1.7",
+			"1.9.0":     "9",
+			"8":         "1.8",
+			"11.0.13":   "11",
+			"17":        "17",
+			"":          "N/A",
+			"14.0-b16":  "1.6",
+			"2.4":       "1.6",
+			"5.1.0909":  "1.6",
+			"14.0-b17":  "14",
+		},
+		stats.RuleFieldJenkinsVersion: {
+			"2.303.1":            "2.303.1",
+			"2.304-SNAPSHOT":     "",
+			"2.304 (private-***": "",
+			"?":                  "",
+		},
+		stats.RuleFieldPluginVersion: {
+			"4.11.0": "4.11.0",
+			"???":    "",
+		},
+		stats.RuleFieldJVMVendor: {
+			"Eclipse Adoptium":   "Eclipse Adoptium",
+			"Temurin":            "Eclipse Adoptium",
+			"IBM Corporation":    "IBM/OpenJ9",
+			`"SAP AG"`:           "SAP",
+			"SAP":                "SAP",
+			"Wasabi Systems":     "Other",
+			`" "`:                "N/A",
+			"Oracle Corporation": "Oracle",
+		},
+		stats.RuleFieldJVMName: {
+			"OpenJDK 64-Bit Server VM": "HotSpot",
+			"Eclipse OpenJ9 VM":        "OpenJ9",
+			"IBM J9 VM":                "J9",
+			"":                         "N/A",
+			"Some VM":                  "Other",
+		},
+		stats.RuleFieldServletContainer: {
+			"jetty/9.4.25.v20191220":  "Jetty 9",
+			"Apache Tomcat/10.1.5":    "Tomcat 10",
+			"Winstone Servlet Engine": "Winstone",
+			"JBoss Web":               "JBoss",
+			"WildFly Full 026":        "WildFly 26",
+			" ":                       "N/A",
+			"Something":               "Other",
+		},
+	} {
+		for input, expected := range cases {
+			result := rules.Normalize(field, input)
+			if expected == "" {
+				assert.True(t, result.Dropped, "%s %q should be dropped", field, input)
+			} else {
+				assert.False(t, result.Dropped, "%s %q should not be dropped", field, input)
+				assert.Equal(t, expected, result.Value, "%s %q", field, input)
+			}
+		}
+	}
+
+	result := rules.Normalize(stats.RuleFieldPluginVersion, "1.0")
+	assert.Equal(t, stats.NormalizationResult{Value: "1.0", Rule: -1}, result)
+}
+
+func TestLoadNormalizationRules(t *testing.T) {
+	dir := t.TempDir()
+
+	rulesFile := filepath.Join(dir, "rules.yml")
+	require.NoError(t, os.WriteFile(rulesFile, []byte(`
+jvmVersion:
+  - match: '(\d+)\.(\d+).*'
+    value: '$1-$2'
+pluginVersion:
+  - match: '.*-rc.*'
+    drop: true
+`), 0600))
+	rules, err := stats.LoadNormalizationRules(rulesFile)
+	require.NoError(t, err)
+	assert.Equal(t, stats.NormalizationResult{Value: "11-0", Rule: 0}, rules.Normalize(stats.RuleFieldJVMVersion, "11.0.13"))
+	assert.Equal(t, stats.NormalizationResult{Dropped: true, Rule: 0}, rules.Normalize(stats.RuleFieldPluginVersion, "2.0-rc1"))
+	assert.Equal(t, stats.NormalizationResult{Value: "2.400", Rule: -1}, rules.Normalize(stats.RuleFieldJenkinsVersion, "2.400"))
+
+	for name, config := range map[string]string{
+		"bad pattern":    "jvmVersion:\n  - match: '('\n    value: x\n",
+		"value and drop": "pluginVersion:\n  - match: x\n    value: y\n    drop: true\n",
+		"unknown field":  "osName:\n  - match: x\n    value: y\n",
+	} {
+		t.Run(name, func(t *testing.T) {
+			_, err := stats.ParseNormalizationRules([]byte(config))
+			assert.Error(t, err)
+		})
+	}
+}
+
+func TestStoredNormalizationRules(t *testing.T) {
+	db, closeFunc := testutil.DBForTest(t)
+	defer closeFunc()
+
+	// The default rules are used until rules are recorded, such as by the first import.
+	rules, err := stats.StoredNormalizationRules(db)
+	require.NoError(t, err)
+	assert.True(t, rules.Normalize(stats.RuleFieldPluginVersion, "???").Dropped)
+
+	custom, err := stats.ParseNormalizationRules([]byte("pluginVersion:\n  - match: '.*-rc.*'\n    drop: true\n"))
+	require.NoError(t, err)
+	require.NoError(t, stats.RecordNormalizationRules(db, custom))
+	rules, err = stats.StoredNormalizationRules(db)
+	require.NoError(t, err)
+	assert.True(t, rules.Normalize(stats.RuleFieldPluginVersion, "2.0-rc1").Dropped)
+	assert.False(t, rules.Normalize(stats.RuleFieldPluginVersion, "???").Dropped)
+
+	// Later imports replace the recorded rules.
+	defaults, err := stats.LoadNormalizationRules("")
+	require.NoError(t, err)
+	require.NoError(t, stats.RecordNormalizationRules(db, defaults))
+	rules, err = stats.StoredNormalizationRules(db)
+	require.NoError(t, err)
+	assert.True(t, rules.Normalize(stats.RuleFieldPluginVersion, "???").Dropped)
+}
@@ -0,0 +1,307 @@
+package stats
+
+import (
+	"bufio"
+	"bytes"
+	"embed"
+	"encoding/json"
+	"fmt"
+	"io"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/santhosh-tekuri/jsonschema/v5"
+)
+
+const schemaBaseURL = "https://stats.jenkins.io/schemas/"
+
+var (
+	//go:embed etc/schemas/*.json
+	reportSchemas embed.FS
+
+	defaultReportFormats     *ReportFormats
+	defaultReportFormatsErr  error
+	defaultReportFormatsOnce sync.Once
+)
+
+// ReportDecoder decodes one version of the usage report format into a JSONReport
+type ReportDecoder func(raw []byte) (*JSONReport, error)
+
+// ReportFormats is a registry of the known versions of the usage report format, each with a JSON schema and a decoder.
+// A report is decoded by the first format, in registration order, whose schema it matches.
+type ReportFormats struct {
+	formats []*reportFormat
+}
+
+type reportFormat struct {
+	version string
+	schema  *jsonschema.Schema
+	decode  ReportDecoder
+}
+
+// FieldError is a single problem with a report, with the JSON pointer to the field it's about, such as
+// "/nodes/0/executors"
+type FieldError struct {
+	Path    string
+	Message string
+}
+
+// ReportValidationError is returned when a report doesn't match any known format, or matches one but can't be decoded
+// with it, such as when a number is too large. It has the problems found when checking the report against the latest
+// format, or the format it matched.
+type ReportValidationError struct {
+	Version string
+	Errors  []FieldError
+}
+
+func (e *ReportValidationError) Error() string {
+	var msgs []string
+	for _, fe := range e.Errors {
+		msgs = append(msgs, fmt.Sprintf("%s: %s", fe.Path, fe.Message))
+	}
+	return fmt.Sprintf("report does not match format %s: %s", e.Version, strings.Join(msgs, "; "))
+}
+
+// DefaultReportFormats returns the registry of the built-in report formats, whose schemas are in etc/schemas
+func DefaultReportFormats() (*ReportFormats, error) {
+	defaultReportFormatsOnce.Do(func() {
+		rf := &ReportFormats{}
+		if err := rf.Register("1", "report-v1.json", decodeReportV1); err != nil {
+			defaultReportFormatsErr = err
+			return
+		}
+		if err := rf.Register("2", "report-v2.json", decodeReportV2); err != nil {
+			defaultReportFormatsErr = err
+			return
+		}
+		defaultReportFormats = rf
+	})
+	return defaultReportFormats, defaultReportFormatsErr
+}
+
+// Register adds a format, using the named schema from etc/schemas
+func (rf *ReportFormats) Register(version, schemaFile string, decode ReportDecoder) error {
+	compiler := jsonschema.NewCompiler()
+	entries, err := reportSchemas.ReadDir("etc/schemas")
+	if err != nil {
+		return err
+	}
+	// Add every schema, so they can refer to each other.
+	for _, e := range entries {
+		data, err := reportSchemas.ReadFile(path.Join("etc/schemas", e.Name()))
+		if err != nil {
+			return err
+		}
+		if err := compiler.AddResource(schemaBaseURL+e.Name(), bytes.NewReader(data)); err != nil {
+			return err
+		}
+	}
+
+	schema, err := compiler.Compile(schemaBaseURL + schemaFile)
+	if err != nil {
+		return fmt.Errorf("compiling schema %s for report format %s: %w", schemaFile, version, err)
+	}
+
+	rf.formats = append(rf.formats, &reportFormat{version: version, schema: schema, decode: decode})
+	return nil
+}
+
+// Versions returns the versions of all registered formats, in the order they're tried
+func (rf *ReportFormats) Versions() []string {
+	var versions []string
+	for _, f := range rf.formats {
+		versions = append(versions, f.version)
+	}
+	return versions
+}
+
+// Decode decodes a single JSON report with the first format whose schema it matches, returning the report and the
+// format version. Any fields which JSONReport and JSONNode don't have are recorded in the report's UnknownFields. If
+// the input isn't valid JSON, the JSON syntax error is returned. If it doesn't match any format, or can't be decoded
+// with the format it matches, a *ReportValidationError is returned.
+//
+// The report is parsed once into a generic document, which is both checked against the schemas and searched for
+// unknown fields, and then decoded into a JSONReport by the format it matched.
+func (rf *ReportFormats) Decode(raw []byte) (*JSONReport, string, error) {
+	if len(rf.formats) == 0 {
+		return nil, "", fmt.Errorf("no report formats registered")
+	}
+
+	doc, err := parseReportDocument(raw)
+	if err != nil {
+		return nil, "", err
+	}
+	f, err := rf.validate(doc)
+	if err != nil {
+		return nil, "", err
+	}
+	r, err := f.decode(raw)
+	if err == nil && r == nil {
+		err = fmt.Errorf("report is empty")
+	}
+	if err != nil {
+		return nil, f.version, &ReportValidationError{Version: f.version, Errors: []FieldError{{Path: "/", Message: err.Error()}}}
+	}
+
+	// Anything but an object will already have failed schema validation.
+	if top, ok := doc.(map[string]interface{}); ok {
+		r.UnknownFields = unknownFields(top)
+	}
+	return r, f.version, nil
+}
+
+// Validate checks a single JSON report against the schema of every format, returning the version of the first one it
+// matches. Unlike Decode, the report is always checked against the schemas in full. The errors are the same as Decode's.
+func (rf *ReportFormats) Validate(raw []byte) (string, error) {
+	if len(rf.formats) == 0 {
+		return "", fmt.Errorf("no report formats registered")
+	}
+	doc, err := parseReportDocument(raw)
+	if err != nil {
+		return "", err
+	}
+	f, err := rf.validate(doc)
+	if err != nil {
+		return "", err
+	}
+	return f.version, nil
+}
+
+// parseReportDocument parses a raw report into the generic form the schemas are checked against. Numbers are kept as
+// json.Number, so large ones aren't rounded before their range is checked.
+func parseReportDocument(raw []byte) (interface{}, error) {
+	var doc interface{}
+	dec := json.NewDecoder(bytes.NewReader(raw))
+	dec.UseNumber()
+	if err := dec.Decode(&doc); err != nil {
+		return nil, err
+	}
+	return doc, nil
+}
+
+func (rf *ReportFormats) validate(doc interface{}) (*reportFormat, error) {
+	var lastErr error
+	for _, f := range rf.formats {
+		if err := f.schema.Validate(doc); err != nil {
+			lastErr = err
+			continue
+		}
+		return f, nil
+	}
+
+	validationErr := &ReportValidationError{Version: rf.formats[len(rf.formats)-1].version}
+	if ve, ok := lastErr.(*jsonschema.ValidationError); ok {
+		validationErr.Errors = leafFieldErrors(ve)
+		sort.Slice(validationErr.Errors, func(i, j int) bool {
+			if validationErr.Errors[i].Path != validationErr.Errors[j].Path {
+				return validationErr.Errors[i].Path < validationErr.Errors[j].Path
+			}
+			return validationErr.Errors[i].Message < validationErr.Errors[j].Message
+		})
+	} else {
+		validationErr.Errors = []FieldError{{Path: "/", Message: lastErr.Error()}}
+	}
+	return nil, validationErr
+}
+
+// ReportLineError is a report, identified by its line number, which couldn't be decoded
+type ReportLineError struct {
+	Line int
+	Err  error
+}
+
+// ReportsValidation is the result of ValidateReports
+type ReportsValidation struct {
+	// Versions is the number of reports matching each format version
+	Versions map[string]int
+	Invalid  []ReportLineError
+}
+
+// ValidateReports checks every line-delimited JSON report, which may be compressed, against the known formats
+func (rf *ReportFormats) ValidateReports(input io.Reader) (*ReportsValidation, error) {
+	reader, closeFunc, err := decompressedReader(input)
+	if err != nil {
+		return nil, err
+	}
+	defer closeFunc()
+
+	result := &ReportsValidation{Versions: map[string]int{}}
+
+	scanner := bufio.NewScanner(reader)
+	sBuffer := make([]byte, 0, bufio.MaxScanTokenSize)
+	scanner.Buffer(sBuffer, bufio.MaxScanTokenSize*50)
+
+	line := 0
+	for scanner.Scan() {
+		line++
+		if len(bytes.TrimSpace(scanner.Bytes())) == 0 {
+			continue
+		}
+		version, err := rf.Validate(scanner.Bytes())
+		if err != nil {
+			result.Invalid = append(result.Invalid, ReportLineError{Line: line, Err: err})
+			continue
+		}
+		result.Versions[version]++
+	}
+
+	return result, scanner.Err()
+}
+
+// leafFieldErrors flattens a validation error into the individual problems at the bottom of its tree
+func leafFieldErrors(ve *jsonschema.ValidationError) []FieldError {
+	if len(ve.Causes) == 0 {
+		p := ve.InstanceLocation
+		if p == "" {
+			p = "/"
+		}
+		return []FieldError{{Path: p, Message: ve.Message}}
+	}
+	var errs []FieldError
+	for _, c := range ve.Causes {
+		errs = append(errs, leafFieldErrors(c)...)
+	}
+	return errs
+}
+
+func decodeReportV1(raw []byte) (*JSONReport, error) {
+	var r *JSONReport
+	if err := json.Unmarshal(raw, &r); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// decodeReportV2 handles job counts which are arrays of counts, adding them up
+func decodeReportV2(raw []byte) (*JSONReport, error) {
+	var v2 struct {
+		JSONReport
+		Jobs map[string]json.RawMessage `json:"jobs"`
+	}
+	if err := json.Unmarshal(raw, &v2); err != nil {
+		return nil, err
+	}
+
+	r := v2.JSONReport
+	r.Jobs = make(map[string]uint64, len(v2.Jobs))
+	for jobType, rawCount := range v2.Jobs {
+		var counts []uint64
+		if bytes.HasPrefix(bytes.TrimSpace(rawCount), []byte("[")) {
+			if err := json.Unmarshal(rawCount, &counts); err != nil {
+				return nil, err
+			}
+		} else {
+			var c uint64
+			if err := json.Unmarshal(rawCount, &c); err != nil {
+				return nil, err
+			}
+			counts = []uint64{c}
+		}
+		for _, c := range counts {
+			r.Jobs[jobType] += c
+		}
+	}
+	return &r, nil
+}
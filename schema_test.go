@@ -0,0 +1,103 @@
+package stats_test
+
+import (
+	"bufio"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	stats "github.com/jenkins-infra/jenkins-usage-stats"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReportFormats(t *testing.T) {
+	formats, err := stats.DefaultReportFormats()
+	require.NoError(t, err)
+	assert.Equal(t, []string{"1", "2"}, formats.Versions())
+
+	t.Run("version 1", func(t *testing.T) {
+		f, err := os.Open(filepath.Join("testdata", "base.json"))
+		require.NoError(t, err)
+		defer func() {
+			_ = f.Close()
+		}()
+
+		scanner := bufio.NewScanner(f)
+		scanner.Buffer(nil, bufio.MaxScanTokenSize*50)
+		for scanner.Scan() {
+			r, version, err := formats.Decode(scanner.Bytes())
+			require.NoError(t, err)
+			assert.Equal(t, "1", version)
+			assert.NotEmpty(t, r.Install)
+			assert.Empty(t, r.UnknownFields)
+		}
+		require.NoError(t, scanner.Err())
+	})
+
+	t.Run("version 2", func(t *testing.T) {
+		r, version, err := formats.Decode([]byte(`{"install":"abc","timestamp":"30/Oct/2021:23:59:54 +0000","version":"2.400",` +
+			`"jobs":{"hudson-model-FreeStyleProject":[3,4],"org-jenkinsci-plugins-workflow-job-WorkflowJob":5}}`))
+		require.NoError(t, err)
+		assert.Equal(t, "2", version)
+		assert.Equal(t, map[string]uint64{
+			"hudson-model-FreeStyleProject":                  7,
+			"org-jenkinsci-plugins-workflow-job-WorkflowJob": 5,
+		}, r.Jobs)
+	})
+
+	t.Run("unknown fields are allowed", func(t *testing.T) {
+		r, version, err := formats.Decode([]byte(`{"install":"abc","timestamp":"30/Oct/2021:23:59:54 +0000","version":"2.400",` +
+			`"newField":{"something":true},"nodes":[{"master":true,"newNodeField":1}]}`))
+		require.NoError(t, err)
+		assert.Equal(t, "1", version)
+		assert.True(t, r.Nodes[0].IsController)
+		assert.Equal(t, []stats.ReportField{
+			{Scope: stats.FieldScopeReport, Name: "newField"},
+			{Scope: stats.FieldScopeNode, Name: "newNodeField"},
+		}, r.UnknownFields)
+	})
+
+	t.Run("invalid", func(t *testing.T) {
+		_, _, err := formats.Decode([]byte(`{"install":"abc","timestamp":"30/Oct/2021:23:59:54 +0000","version":"2.400",` +
+			`"nodes":[{"executors":2},{"executors":-1}],"plugins":[{"name":"git"}]}`))
+		var validationErr *stats.ReportValidationError
+		require.True(t, errors.As(err, &validationErr), "expected a validation error, got %v", err)
+		assert.Equal(t, "2", validationErr.Version)
+		assert.Equal(t, []stats.FieldError{
+			{Path: "/nodes/1/executors", Message: "must be >= 0 but found -1"},
+			{Path: "/plugins/0", Message: "missing properties: 'version'"},
+		}, validationErr.Errors)
+	})
+
+	t.Run("matches but can't be decoded", func(t *testing.T) {
+		_, _, err := formats.Decode([]byte(`{"install":"abc","timestamp":"30/Oct/2021:23:59:54 +0000","version":"2.400",` +
+			`"nodes":[{"executors":100000000000000000000000}]}`))
+		var validationErr *stats.ReportValidationError
+		require.True(t, errors.As(err, &validationErr), "expected a validation error, got %v", err)
+		assert.Equal(t, "1", validationErr.Version)
+	})
+
+	t.Run("not JSON", func(t *testing.T) {
+		_, _, err := formats.Decode([]byte(`{"install":`))
+		require.Error(t, err)
+		var validationErr *stats.ReportValidationError
+		assert.False(t, errors.As(err, &validationErr))
+	})
+
+	t.Run("ValidateReports", func(t *testing.T) {
+		input := `{"install":"abc","timestamp":"30/Oct/2021:23:59:54 +0000","version":"2.400","plugins":[{"name":"git"}]}
+
+{"install":"abc","timestamp":"30/Oct/2021:23:59:54 +0000","version":"2.400","jobs":{"a":[1,2]}}
+{"install":"abc","timestamp":"30/Oct/2021:23:59:54 +0000","version":"2.400"}
+`
+		result, err := formats.ValidateReports(strings.NewReader(input))
+		require.NoError(t, err)
+		assert.Equal(t, map[string]int{"1": 1, "2": 1}, result.Versions)
+		require.Len(t, result.Invalid, 1)
+		assert.Equal(t, 1, result.Invalid[0].Line)
+		assert.EqualError(t, result.Invalid[0].Err, "report does not match format 2: /plugins/0: missing properties: 'version'")
+	})
+}
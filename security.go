@@ -0,0 +1,286 @@
+package stats
+
+import (
+	"fmt"
+	"io/ioutil"
+	"time"
+
+	sq "github.com/Masterminds/squirrel"
+	"github.com/lib/pq"
+	"gopkg.in/yaml.v2"
+)
+
+const (
+	// CoreComponent is the component name used in security advisories for Jenkins itself
+	CoreComponent = "core"
+
+	advisoryDateLayout = "2006-01-02"
+)
+
+// SecurityAdvisories is a list of security advisories and the versions they affect
+type SecurityAdvisories struct {
+	Advisories []SecurityAdvisory `yaml:"advisories"`
+}
+
+// SecurityAdvisory is a single security advisory. An instance is affected if it runs an affected version of any of the
+// affected components.
+type SecurityAdvisory struct {
+	ID        string              `yaml:"id"`
+	Title     string              `yaml:"title"`
+	URL       string              `yaml:"url"`
+	Published string              `yaml:"published"`
+	Affected  []AffectedComponent `yaml:"affected"`
+
+	published time.Time
+}
+
+// AffectedComponent is Jenkins core or a plugin, and the semver range matching its versions affected by an advisory.
+// Versions which aren't semver, such as incrementals like 1148.vcef3ccf1e2a_6, are compared as Jenkins versions, if the
+// range only uses comparisons such as "< 1148.vcef3ccf1e2a_6, >= 1100".
+type AffectedComponent struct {
+	Component string `yaml:"component"`
+	Versions  string `yaml:"versions"`
+
+	versions *versionRange
+}
+
+// AdvisoryExposure is how many instances ran affected versions in each month from when an advisory was published
+type AdvisoryExposure struct {
+	ID        string                  `json:"id"`
+	Title     string                  `json:"title,omitempty"`
+	URL       string                  `json:"url,omitempty"`
+	Published string                  `json:"published"`
+	Months    []AdvisoryExposureMonth `json:"months"`
+}
+
+// AdvisoryExposureMonth is how many instances ran affected versions in a month
+type AdvisoryExposureMonth struct {
+	Month int64 `json:"month"`
+	// MonthsSincePublication is 0 for the month the advisory was published in
+	MonthsSincePublication int    `json:"monthsSincePublication"`
+	Installs               uint64 `json:"installs"`
+	// Share is the fraction of all instances in the month which were affected
+	Share float64 `json:"share"`
+	// Remaining is the fraction of the instances affected in the month the advisory was published in which are still
+	// affected, or 0 if none were
+	Remaining float64 `json:"remaining"`
+	// Components is the number of instances running affected versions of each component
+	Components map[string]uint64 `json:"components"`
+	// Unmatched is the number of instances running versions of the components which couldn't be compared with the
+	// affected versions, so they're counted as neither affected nor unaffected, summed over the components
+	Unmatched uint64 `json:"unmatched"`
+}
+
+// SecurityExposureReport is the exposure of instances to each advisory, up to a month
+type SecurityExposureReport struct {
+	Month      int64              `json:"month"`
+	Advisories []AdvisoryExposure `json:"advisories"`
+}
+
+// ParseSecurityAdvisories parses and validates YAML security advisories
+func ParseSecurityAdvisories(data []byte) (*SecurityAdvisories, error) {
+	sa := &SecurityAdvisories{}
+	if err := yaml.UnmarshalStrict(data, sa); err != nil {
+		return nil, err
+	}
+
+	seen := make(map[string]bool)
+	for i := range sa.Advisories {
+		a := &sa.Advisories[i]
+		if a.ID == "" {
+			return nil, fmt.Errorf("advisory %d has no id", i)
+		}
+		if seen[a.ID] {
+			return nil, fmt.Errorf("advisory %s is listed more than once", a.ID)
+		}
+		seen[a.ID] = true
+
+		published, err := time.Parse(advisoryDateLayout, a.Published)
+		if err != nil {
+			return nil, fmt.Errorf("advisory %s has an invalid published date %q, must be YYYY-MM-DD", a.ID, a.Published)
+		}
+		a.published = published
+
+		if len(a.Affected) == 0 {
+			return nil, fmt.Errorf("advisory %s has no affected components", a.ID)
+		}
+		for j := range a.Affected {
+			ac := &a.Affected[j]
+			if ac.Component == "" {
+				return nil, fmt.Errorf("advisory %s has an affected component with no name", a.ID)
+			}
+			ac.versions, err = parseVersionRange(ac.Versions)
+			if err != nil {
+				return nil, fmt.Errorf("advisory %s has an invalid version range %q for %s: %w", a.ID, ac.Versions, ac.Component, err)
+			}
+		}
+	}
+
+	return sa, nil
+}
+
+// LoadSecurityAdvisories reads security advisories from a YAML file
+func LoadSecurityAdvisories(filename string) (*SecurityAdvisories, error) {
+	data, err := ioutil.ReadFile(filename) // #nosec
+	if err != nil {
+		return nil, err
+	}
+	return ParseSecurityAdvisories(data)
+}
+
+// Affects returns whether a version of the component is affected. Versions which can't be compared with the affected
+// versions are never affected.
+func (ac AffectedComponent) Affects(version string) bool {
+	affected, _ := ac.versions.check(version)
+	return affected
+}
+
+// versionCounts is the number of instances running each Jenkins and plugin version in a month
+type versionCounts struct {
+	total   uint64
+	core    map[string]uint64
+	plugins map[string]map[string]uint64
+}
+
+// affected returns the number of instances running an affected version of the component, and the number running a
+// version which can't be compared with the affected versions
+func (vc versionCounts) affected(ac AffectedComponent) (uint64, uint64) {
+	versions := vc.core
+	if ac.Component != CoreComponent {
+		versions = vc.plugins[ac.Component]
+	}
+	var count, unmatched uint64
+	for v, c := range versions {
+		affected, ok := ac.versions.check(v)
+		if !ok {
+			unmatched += c
+		} else if affected {
+			count += c
+		}
+	}
+	return count, unmatched
+}
+
+// GetSecurityExposure gets the number of instances running affected versions of each advisory in every month from the
+// one it was published in up to the given month. Advisories published after the month are left out.
+func GetSecurityExposure(db sq.BaseRunner, co CountOptions, advisories *SecurityAdvisories, year, month int) (*SecurityExposureReport, error) {
+	report := &SecurityExposureReport{
+		Month:      startDateForYearMonth(year, month, co.Location).UnixMilli(),
+		Advisories: []AdvisoryExposure{},
+	}
+
+	idToPlugin, err := pluginIDsToPlugin(db)
+	if err != nil {
+		return nil, err
+	}
+
+	months := make(map[int]*versionCounts)
+	countsForMonth := func(ym int) (*versionCounts, error) {
+		if vc, ok := months[ym]; ok {
+			return vc, nil
+		}
+		core, err := GetInstallCountForVersions(db, co, ym/12, ym%12+1)
+		if err != nil {
+			return nil, err
+		}
+		plugins, err := pluginInstallsByVersionForName(db, co, ym/12, ym%12+1, idToPlugin)
+		if err != nil {
+			return nil, err
+		}
+		vc := &versionCounts{core: core.Installations, plugins: plugins}
+		for _, c := range core.Installations {
+			vc.total += c
+		}
+		months[ym] = vc
+		return vc, nil
+	}
+
+	last := year*12 + month - 1
+	for _, a := range advisories.Advisories {
+		first := a.published.Year()*12 + int(a.published.Month()) - 1
+		if first > last {
+			continue
+		}
+
+		exposure := AdvisoryExposure{
+			ID:        a.ID,
+			Title:     a.Title,
+			URL:       a.URL,
+			Published: a.Published,
+			Months:    []AdvisoryExposureMonth{},
+		}
+		var initial uint64
+		for ym := first; ym <= last; ym++ {
+			vc, err := countsForMonth(ym)
+			if err != nil {
+				return nil, err
+			}
+
+			em := AdvisoryExposureMonth{
+				Month:                  startDateForYearMonth(ym/12, ym%12+1, co.Location).UnixMilli(),
+				MonthsSincePublication: ym - first,
+				Components:             map[string]uint64{},
+			}
+			for _, ac := range a.Affected {
+				c, unmatched := vc.affected(ac)
+				em.Components[ac.Component] += c
+				em.Installs += c
+				em.Unmatched += unmatched
+			}
+			// An instance can run affected versions of more than one component, so count them directly to only count
+			// each instance once.
+			if len(a.Affected) > 1 && em.Installs > 0 {
+				em.Installs, err = affectedInstanceCount(db, co, ym/12, ym%12+1, a.Affected)
+				if err != nil {
+					return nil, err
+				}
+			}
+
+			if ym == first {
+				initial = em.Installs
+			}
+			if vc.total > 0 {
+				em.Share = float64(em.Installs) / float64(vc.total)
+			}
+			if initial > 0 {
+				em.Remaining = float64(em.Installs) / float64(initial)
+			}
+			exposure.Months = append(exposure.Months, em)
+		}
+		report.Advisories = append(report.Advisories, exposure)
+	}
+
+	return report, nil
+}
+
+// affectedInstanceCount gets the number of instances in a month running an affected version of any of the components
+func affectedInstanceCount(db sq.BaseRunner, co CountOptions, year, month int, affected []AffectedComponent) (uint64, error) {
+	coreIDs := pq.Int64Array{}
+	pluginIDs := pq.Int64Array{}
+	for _, ac := range affected {
+		if ac.Component == CoreComponent {
+			ids, err := versionIDsWhere(db, JenkinsVersionsTable, "version", nil, ac.Affects)
+			if err != nil {
+				return 0, err
+			}
+			coreIDs = append(coreIDs, ids...)
+		} else {
+			ids, err := versionIDsWhere(db, PluginsTable, "version", sq.Eq{"name": ac.Component}, ac.Affects)
+			if err != nil {
+				return 0, err
+			}
+			pluginIDs = append(pluginIDs, ids...)
+		}
+	}
+
+	var count uint64
+	err := PSQL(db).Select("count(*)").
+		From(InstanceReportsTable + " i").
+		Where(sq.Eq{"i.year": year}).
+		Where(sq.Eq{"i.month": month}).
+		Where(countedInstances("i", co.ExcludeQuarantined)).
+		Where(sq.Or{sq.Expr("i.version = any(?)", coreIDs), sq.Expr("i.plugins && ?", pluginIDs)}).
+		QueryRow().
+		Scan(&count)
+	return count, err
+}
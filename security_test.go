@@ -0,0 +1,144 @@
+package stats_test
+
+import (
+	"fmt"
+	"testing"
+
+	stats "github.com/jenkins-infra/jenkins-usage-stats"
+	"github.com/jenkins-infra/jenkins-usage-stats/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const testAdvisories = `
+advisories:
+  - id: SECURITY-1
+    title: Core issue
+    published: 2022-06-10
+    affected:
+      - component: core
+        versions: "< 2.303.2"
+  - id: SECURITY-2
+    published: 2022-06-20
+    affected:
+      - component: core
+        versions: "< 2.303.2"
+      - component: git
+        versions: "<= 1.0"
+  - id: SECURITY-3
+    published: 2022-08-01
+    affected:
+      - component: git
+        versions: "< 2.0"
+  - id: SECURITY-4
+    published: 2022-06-25
+    affected:
+      - component: git
+        versions: "^1.0"
+`
+
+func TestParseSecurityAdvisories(t *testing.T) {
+	advisories, err := stats.ParseSecurityAdvisories([]byte(testAdvisories))
+	require.NoError(t, err)
+	require.Len(t, advisories.Advisories, 4)
+
+	core := advisories.Advisories[0].Affected[0]
+	assert.True(t, core.Affects("2.303.1"))
+	assert.True(t, core.Affects("2.99"))
+	assert.False(t, core.Affects("2.303.2"))
+	assert.False(t, core.Affects("2.361"))
+	// Versions which aren't semver are compared as Jenkins versions.
+	assert.True(t, core.Affects("2.303.1-SNAPSHOT (private-abcdef)"))
+	assert.True(t, core.Affects("2.303.1.1"))
+	assert.False(t, core.Affects("2.303.2.1"))
+	assert.False(t, core.Affects("private"))
+
+	// Ranges can include incrementals versions, which plugins like git use.
+	incrementals, err := stats.ParseSecurityAdvisories([]byte(`
+advisories:
+  - id: SECURITY-5
+    published: 2023-01-01
+    affected:
+      - component: git
+        versions: "<= 1148.vcef3ccf1e2a_6, > 4.0 || 3.0"
+`))
+	require.NoError(t, err)
+	git := incrementals.Advisories[0].Affected[0]
+	assert.True(t, git.Affects("1148.vcef3ccf1e2a_6"))
+	assert.True(t, git.Affects("1100.v0123456789ab"))
+	assert.True(t, git.Affects("4.11.3"))
+	assert.True(t, git.Affects("3.0"))
+	assert.False(t, git.Affects("1149.v0123456789ab"))
+	assert.False(t, git.Affects("3.12.1"))
+
+	// Ranges which aren't only comparisons can't be compared with versions which aren't semver.
+	caret := advisories.Advisories[3].Affected[0]
+	assert.True(t, caret.Affects("1.2.0"))
+	assert.False(t, caret.Affects("1148.vcef3ccf1e2a_6"))
+
+	for name, yml := range map[string]string{
+		"duplicate id":     "advisories: [{id: A, published: 2022-01-01, affected: [{component: core, versions: '< 2'}]}, {id: A, published: 2022-01-01, affected: [{component: core, versions: '< 2'}]}]",
+		"bad date":         "advisories: [{id: A, published: 01/01/2022, affected: [{component: core, versions: '< 2'}]}]",
+		"no affected":      "advisories: [{id: A, published: 2022-01-01}]",
+		"bad range":        "advisories: [{id: A, published: 2022-01-01, affected: [{component: core, versions: 'latest'}]}]",
+		"unknown property": "advisories: [{id: A, published: 2022-01-01, severity: high, affected: [{component: core, versions: '< 2'}]}]",
+	} {
+		_, err := stats.ParseSecurityAdvisories([]byte(yml))
+		assert.Error(t, err, name)
+	}
+}
+
+func TestGetSecurityExposure(t *testing.T) {
+	db, closeFunc := testutil.DBForTest(t)
+	defer closeFunc()
+
+	cache := stats.NewStatsCache()
+	add := func(install string, month string, version string, plugins ...string) {
+		for day := 1; day <= 2; day++ {
+			r := testReport(install, day, version, "Linux", plugins...)
+			r.TimestampString = fmt.Sprintf("%02d/%s/2022:12:00:00 +0000", day, month)
+			require.NoError(t, stats.AddIndividualReport(db, cache, r))
+		}
+	}
+	add("a", "Jun", "2.303.1", "git")
+	add("b", "Jun", "2.303.1")
+	add("a", "Jul", "2.303.2", "git")
+	add("b", "Jul", "2.303.1")
+	// c runs an incrementals version of git, which isn't semver.
+	for _, month := range []string{"Jun", "Jul"} {
+		for day := 1; day <= 2; day++ {
+			r := testReport("c", day, "2.303.2", "Linux", "git")
+			r.TimestampString = fmt.Sprintf("%02d/%s/2022:12:00:00 +0000", day, month)
+			r.Plugins[0].Version = "1148.vcef3ccf1e2a_6"
+			require.NoError(t, stats.AddIndividualReport(db, cache, r))
+		}
+	}
+
+	advisories, err := stats.ParseSecurityAdvisories([]byte(testAdvisories))
+	require.NoError(t, err)
+	report, err := stats.GetSecurityExposure(db, stats.CountOptions{}, advisories, 2022, 7)
+	require.NoError(t, err)
+	require.Len(t, report.Advisories, 3)
+
+	core := report.Advisories[0]
+	assert.Equal(t, "SECURITY-1", core.ID)
+	require.Len(t, core.Months, 2)
+	assert.Equal(t, uint64(2), core.Months[0].Installs)
+	assert.InDelta(t, 2.0/3, core.Months[0].Share, 0.0001)
+	assert.Equal(t, uint64(0), core.Months[0].Unmatched)
+	assert.Equal(t, 1, core.Months[1].MonthsSincePublication)
+	assert.Equal(t, uint64(1), core.Months[1].Installs)
+	assert.Equal(t, 0.5, core.Months[1].Remaining)
+
+	// Instance a runs affected versions of both components in June, but only counts once.
+	both := report.Advisories[1]
+	assert.Equal(t, map[string]uint64{"core": 2, "git": 1}, both.Months[0].Components)
+	assert.Equal(t, uint64(2), both.Months[0].Installs)
+	assert.Equal(t, uint64(2), both.Months[1].Installs)
+
+	// c's git version can't be compared with a caret range, so it's unmatched rather than unaffected.
+	caret := report.Advisories[2]
+	assert.Equal(t, "SECURITY-4", caret.ID)
+	assert.Equal(t, uint64(1), caret.Months[0].Installs)
+	assert.Equal(t, uint64(1), caret.Months[0].Unmatched)
+}
@@ -0,0 +1,332 @@
+package stats
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+
+	sq "github.com/Masterminds/squirrel"
+	"golang.org/x/sync/singleflight"
+)
+
+const (
+	// APIPrefix is the path prefix for all versioned API endpoints
+	APIPrefix = "/api/v1"
+)
+
+var errNotFound = errors.New("not found")
+
+// APIServer serves the report data over HTTP as JSON, straight from the database. Responses are cached in memory, and
+// have ETag and Last-Modified headers so clients can make conditional requests.
+type APIServer struct {
+	db            sq.BaseRunner
+	co            CountOptions
+	cacheTTL      time.Duration
+	jobCategories *JobCategories
+
+	mu    sync.Mutex
+	cache map[string]*cachedResponse
+	// group makes concurrent requests for a response which isn't cached wait for a single computation of it
+	group singleflight.Group
+}
+
+type cachedResponse struct {
+	value        interface{}
+	body         []byte
+	etag         string
+	lastModified time.Time
+	expires      time.Time
+}
+
+// NewAPIServer creates an APIServer counting instance reports as co says, and caching responses for cacheTTL
+func NewAPIServer(db sq.BaseRunner, co CountOptions, cacheTTL time.Duration, jobCategories *JobCategories) *APIServer {
+	return &APIServer{
+		db:            db,
+		co:            co,
+		cacheTTL:      cacheTTL,
+		jobCategories: jobCategories,
+		cache:         map[string]*cachedResponse{},
+	}
+}
+
+// Handler returns the http.Handler for the API endpoints.
+//
+// Endpoints for a single month take optional "year" and "month" query parameters, defaulting to the previous month.
+// Endpoints covering all months take the same parameters for the last month to include, and by default exclude the
+// current month, as the published reports do.
+func (s *APIServer) Handler() http.Handler {
+	mux := http.NewServeMux()
+
+	s.handleMonth(mux, "installations", func(year, month int) (interface{}, error) {
+		return GetInstallCountForVersions(s.db, s.co, year, month)
+	})
+	s.handleMonth(mux, "latest-numbers", func(year, month int) (interface{}, error) {
+		return GetLatestPluginNumbers(s.db, s.co, year, month)
+	})
+	s.handleMonth(mux, "capabilities", func(year, month int) (interface{}, error) {
+		return GetCapabilities(s.db, s.co, year, month)
+	})
+	s.handleMonth(mux, "os", func(year, month int) (interface{}, error) {
+		return OSCountsForMonth(s.db, s.co, year, month)
+	})
+	s.handleMonth(mux, "jobs", func(year, month int) (interface{}, error) {
+		return JobCountsForMonth(s.db, s.co, year, month)
+	})
+	s.handleMonth(mux, "executors", func(year, month int) (interface{}, error) {
+		return ExecutorCountsForMonth(s.db, s.co, year, month)
+	})
+	s.handleMonth(mux, "servlet-containers", func(year, month int) (interface{}, error) {
+		return ServletContainerCountsForMonth(s.db, s.co, year, month)
+	})
+	s.handleMonth(mux, "plugin-versions", func(year, month int) (interface{}, error) {
+		return JenkinsVersionsForPluginVersions(s.db, s.co, year, month)
+	})
+
+	s.handleAllMonths(mux, "jvms", func(year, month int) (interface{}, error) {
+		return GetJVMsReport(s.db, s.co, year, month)
+	})
+	s.handleAllMonths(mux, "jvm-vendors", func(year, month int) (interface{}, error) {
+		return GetJVMVendorsReport(s.db, s.co, year, month)
+	})
+	s.handleAllMonths(mux, "agent-jvms", func(year, month int) (interface{}, error) {
+		return GetAgentJVMsReport(s.db, s.co, year, month)
+	})
+	s.handleAllMonths(mux, "servlet-containers-trend", func(year, month int) (interface{}, error) {
+		return GetServletContainersReport(s.db, s.co, year, month)
+	})
+	s.handleAllMonths(mux, "job-categories", func(year, month int) (interface{}, error) {
+		return GetJobCategoriesReport(s.db, s.co, year, month, s.jobCategories)
+	})
+
+	mux.HandleFunc("GET "+APIPrefix+"/plugins/{name}", func(w http.ResponseWriter, r *http.Request) {
+		name := r.PathValue("name")
+		year, month, err := s.currentYearMonthFromQuery(r.URL.Query())
+		if err != nil {
+			writeAPIError(w, http.StatusBadRequest, err)
+			return
+		}
+		s.serveCached(w, r, fmt.Sprintf("plugins/%s/%d/%d", name, year, month), func() (interface{}, error) {
+			// Cache the reports for all plugins, since they're generated together anyway.
+			reports, err := s.cached(fmt.Sprintf("plugins/%d/%d", year, month), func() (interface{}, error) {
+				return GetPluginReports(s.db, s.co, year, month)
+			})
+			if err != nil {
+				return nil, err
+			}
+			for _, pr := range reports.value.([]PluginReport) {
+				if pr.Name == name {
+					return pr, nil
+				}
+			}
+			return nil, errNotFound
+		})
+	})
+
+	mux.HandleFunc("GET "+APIPrefix+"/plugin-versions/{name}", func(w http.ResponseWriter, r *http.Request) {
+		name := r.PathValue("name")
+		year, month, err := s.yearMonthFromQuery(r.URL.Query())
+		if err != nil {
+			writeAPIError(w, http.StatusBadRequest, err)
+			return
+		}
+		s.serveCached(w, r, fmt.Sprintf("plugin-versions/%s/%d/%d", name, year, month), func() (interface{}, error) {
+			// Share the cached versions for all plugins with the plugin-versions endpoint.
+			jvpv, err := s.cached(fmt.Sprintf("plugin-versions/%d/%d", year, month), func() (interface{}, error) {
+				return JenkinsVersionsForPluginVersions(s.db, s.co, year, month)
+			})
+			if err != nil {
+				return nil, err
+			}
+			pv, ok := jvpv.value.(map[string]*PVDPluginVersionMap)[name]
+			if !ok {
+				return nil, errNotFound
+			}
+			return pv, nil
+		})
+	})
+
+	return mux
+}
+
+// MetricsHandler returns an http.Handler serving the previous month's numbers in the Prometheus text exposition
+// format. Only plugins with at least pluginThreshold installs are included, or DefaultMetricsPluginThreshold if it's 0.
+func (s *APIServer) MetricsHandler(pluginThreshold uint64) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		year, month := PreviousMonth(time.Now(), s.co.Location)
+		resp, err := s.cachedBody(fmt.Sprintf("metrics/%d/%d/%d", pluginThreshold, year, month), func() (interface{}, []byte, error) {
+			var buf bytes.Buffer
+			err := WriteMetrics(&buf, s.db, s.co, year, month, pluginThreshold)
+			return nil, buf.Bytes(), err
+		})
+		s.writeCached(w, r, "text/plain; version=0.0.4; charset=utf-8", resp, err)
+	})
+}
+
+func (s *APIServer) handleMonth(mux *http.ServeMux, name string, f func(year, month int) (interface{}, error)) {
+	mux.HandleFunc("GET "+APIPrefix+"/"+name, func(w http.ResponseWriter, r *http.Request) {
+		year, month, err := s.yearMonthFromQuery(r.URL.Query())
+		if err != nil {
+			writeAPIError(w, http.StatusBadRequest, err)
+			return
+		}
+		s.serveCached(w, r, fmt.Sprintf("%s/%d/%d", name, year, month), func() (interface{}, error) {
+			return f(year, month)
+		})
+	})
+}
+
+func (s *APIServer) handleAllMonths(mux *http.ServeMux, name string, f func(year, month int) (interface{}, error)) {
+	mux.HandleFunc("GET "+APIPrefix+"/"+name, func(w http.ResponseWriter, r *http.Request) {
+		year, month, err := s.currentYearMonthFromQuery(r.URL.Query())
+		if err != nil {
+			writeAPIError(w, http.StatusBadRequest, err)
+			return
+		}
+		s.serveCached(w, r, fmt.Sprintf("%s/%d/%d", name, year, month), func() (interface{}, error) {
+			return f(year, month)
+		})
+	})
+}
+
+// serveCached writes the cached response for key, computing it with f if needed. Conditional requests are handled by
+// http.ServeContent.
+func (s *APIServer) serveCached(w http.ResponseWriter, r *http.Request, key string, f func() (interface{}, error)) {
+	resp, err := s.cached(key, f)
+	s.writeCached(w, r, "application/json", resp, err)
+}
+
+func (s *APIServer) writeCached(w http.ResponseWriter, r *http.Request, contentType string, resp *cachedResponse, err error) {
+	if errors.Is(err, errNotFound) {
+		writeAPIError(w, http.StatusNotFound, fmt.Errorf("%s not found", r.URL.Path))
+		return
+	}
+	if err != nil {
+		writeAPIError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("ETag", resp.etag)
+	w.Header().Set("Cache-Control", fmt.Sprintf("public, max-age=%d", int(time.Until(resp.expires).Seconds())))
+	http.ServeContent(w, r, "", resp.lastModified, bytes.NewReader(resp.body))
+}
+
+func (s *APIServer) cached(key string, f func() (interface{}, error)) (*cachedResponse, error) {
+	return s.cachedBody(key, func() (interface{}, []byte, error) {
+		data, err := f()
+		if err != nil {
+			return nil, nil, err
+		}
+		body, err := json.MarshalIndent(data, "", "    ")
+		return data, body, err
+	})
+}
+
+// cachedBody is like cached, but f returns the response body itself rather than a value to be marshalled to JSON. If
+// the response for key isn't cached, concurrent calls wait for one of them to compute it, rather than all running f.
+func (s *APIServer) cachedBody(key string, f func() (interface{}, []byte, error)) (*cachedResponse, error) {
+	if resp, ok := s.fresh(key); ok {
+		return resp, nil
+	}
+
+	resp, err, _ := s.group.Do(key, func() (interface{}, error) {
+		// The response may have been computed by a call which finished just before this one started.
+		if resp, ok := s.fresh(key); ok {
+			return resp, nil
+		}
+		return s.compute(key, f)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return resp.(*cachedResponse), nil
+}
+
+// fresh returns the cached response for key, if there is one which hasn't expired
+func (s *APIServer) fresh(key string) (*cachedResponse, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	resp, ok := s.cache[key]
+	if !ok || !time.Now().Before(resp.expires) {
+		return nil, false
+	}
+	return resp, true
+}
+
+// compute runs f and caches the response for key
+func (s *APIServer) compute(key string, f func() (interface{}, []byte, error)) (*cachedResponse, error) {
+	data, body, err := f()
+	if err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	prev, ok := s.cache[key]
+	s.mu.Unlock()
+
+	now := time.Now().UTC().Truncate(time.Second)
+	resp := &cachedResponse{
+		value:        data,
+		body:         body,
+		etag:         fmt.Sprintf(`"%x"`, sha256.Sum256(body)),
+		lastModified: now,
+		expires:      now.Add(s.cacheTTL),
+	}
+	// Keep the original Last-Modified if the content hasn't actually changed.
+	if ok && resp.etag == prev.etag {
+		resp.lastModified = prev.lastModified
+	}
+
+	s.mu.Lock()
+	for k, v := range s.cache {
+		if now.After(v.expires) {
+			delete(s.cache, k)
+		}
+	}
+	s.cache[key] = resp
+	s.mu.Unlock()
+
+	return resp, nil
+}
+
+// yearMonthFromQuery gets the year and month from the query parameters, defaulting to the previous month
+func (s *APIServer) yearMonthFromQuery(query url.Values) (int, int, error) {
+	yearStr, monthStr := query.Get("year"), query.Get("month")
+	if yearStr == "" && monthStr == "" {
+		year, month := PreviousMonth(time.Now(), s.co.Location)
+		return year, month, nil
+	}
+	year, err := strconv.Atoi(yearStr)
+	if err != nil || year < 2000 || year > 9999 {
+		return 0, 0, fmt.Errorf("invalid year %q", yearStr)
+	}
+	month, err := strconv.Atoi(monthStr)
+	if err != nil || month < 1 || month > 12 {
+		return 0, 0, fmt.Errorf("invalid month %q", monthStr)
+	}
+	return year, month, nil
+}
+
+// currentYearMonthFromQuery gets the month after the one in the query parameters, which reports covering every month
+// treat as the current month and leave out. It defaults to the current month.
+func (s *APIServer) currentYearMonthFromQuery(query url.Values) (int, int, error) {
+	year, month, err := s.yearMonthFromQuery(query)
+	if err != nil {
+		return 0, 0, err
+	}
+	next := time.Date(year, time.Month(month)+1, 1, 0, 0, 0, 0, time.UTC)
+	return next.Year(), int(next.Month()), nil
+}
+
+func writeAPIError(w http.ResponseWriter, status int, err error) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+}
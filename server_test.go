@@ -0,0 +1,82 @@
+package stats_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	stats "github.com/jenkins-infra/jenkins-usage-stats"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAPIServerRequestErrors(t *testing.T) {
+	jc, err := stats.LoadJobCategories("")
+	require.NoError(t, err)
+	handler := stats.NewAPIServer(nil, stats.CountOptions{}, time.Hour, jc).Handler()
+
+	for _, tc := range []struct {
+		path   string
+		status int
+	}{
+		{path: stats.APIPrefix + "/installations?year=2009&month=13", status: http.StatusBadRequest},
+		{path: stats.APIPrefix + "/installations?year=abc&month=12", status: http.StatusBadRequest},
+		{path: stats.APIPrefix + "/plugin-versions/git?month=5", status: http.StatusBadRequest},
+		{path: stats.APIPrefix + "/plugins/git?year=2009", status: http.StatusBadRequest},
+		{path: stats.APIPrefix + "/jvms?year=2009&month=0", status: http.StatusBadRequest},
+		{path: stats.APIPrefix + "/no-such-report", status: http.StatusNotFound},
+	} {
+		t.Run(tc.path, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, tc.path, nil))
+			assert.Equal(t, tc.status, rec.Code)
+		})
+	}
+}
+
+func TestAPIServer(t *testing.T) {
+	db, closeFunc := dbWithFixtures(t)
+	defer closeFunc()
+
+	jc, err := stats.LoadJobCategories("")
+	require.NoError(t, err)
+	handler := stats.NewAPIServer(db, stats.CountOptions{}, time.Hour, jc).Handler()
+
+	path := stats.APIPrefix + "/installations?year=2009&month=12"
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+	require.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "application/json", rec.Header().Get("Content-Type"))
+	etag := rec.Header().Get("ETag")
+	require.NotEmpty(t, etag)
+	assert.NotEmpty(t, rec.Header().Get("Last-Modified"))
+
+	expected, err := stats.GetInstallCountForVersions(db, stats.CountOptions{}, 2009, 12)
+	require.NoError(t, err)
+	var actual stats.InstallationReport
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &actual))
+	assert.Equal(t, expected, actual)
+
+	req := httptest.NewRequest(http.MethodGet, path, nil)
+	req.Header.Set("If-None-Match", etag)
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusNotModified, rec.Code)
+
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, stats.APIPrefix+"/plugin-versions/no-such-plugin?year=2009&month=12", nil))
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+
+	// A plugin's report covers every month up to and including the one asked for.
+	pluginReports, err := stats.GetPluginReports(db, stats.CountOptions{}, 2010, 1)
+	require.NoError(t, err)
+	require.NotEmpty(t, pluginReports)
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, stats.APIPrefix+"/plugins/"+pluginReports[0].Name+"?year=2009&month=12", nil))
+	require.Equal(t, http.StatusOK, rec.Code)
+	var pluginReport stats.PluginReport
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &pluginReport))
+	assert.Equal(t, pluginReports[0], pluginReport)
+}
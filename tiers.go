@@ -0,0 +1,121 @@
+package stats
+
+import (
+	_ "embed"
+	"fmt"
+	"io/ioutil"
+	"regexp"
+
+	sq "github.com/Masterminds/squirrel"
+	"gopkg.in/yaml.v2"
+)
+
+const (
+	nodeCountExpr = "(select coalesce(sum(tn.value::int), 0) from jsonb_each_text(i.nodes) tn)"
+	jobCountExpr  = "(select coalesce(sum(tj.value::int), 0) from jsonb_each_text(i.jobs) tj)"
+)
+
+var (
+	//go:embed etc/size-tiers.yml
+	// DefaultSizeTiersConfig is the YAML configuration used for instance size tiers if no other configuration is specified.
+	DefaultSizeTiersConfig string
+
+	tierNameRE = regexp.MustCompile(`^[\w-]+$`)
+)
+
+// SizeTiers is the ordered list of instance size tiers, from smallest to largest
+type SizeTiers struct {
+	Tiers []SizeTier `yaml:"tiers"`
+}
+
+// SizeTier is a single instance size tier. An instance is in this tier if it meets any of the minimums, and does not
+// meet any of the minimums of a later tier.
+type SizeTier struct {
+	Name         string `yaml:"name"`
+	MinExecutors uint64 `yaml:"minExecutors"`
+	MinNodes     uint64 `yaml:"minNodes"`
+	MinJobs      uint64 `yaml:"minJobs"`
+}
+
+// ParseSizeTiers parses and validates YAML size tier configuration
+func ParseSizeTiers(data []byte) (*SizeTiers, error) {
+	st := &SizeTiers{}
+	if err := yaml.UnmarshalStrict(data, st); err != nil {
+		return nil, err
+	}
+	if len(st.Tiers) == 0 {
+		return nil, fmt.Errorf("at least one size tier must be configured")
+	}
+
+	seen := make(map[string]bool)
+	for i, t := range st.Tiers {
+		if !tierNameRE.MatchString(t.Name) {
+			return nil, fmt.Errorf("size tier %d has an invalid name %q", i, t.Name)
+		}
+		if seen[t.Name] {
+			return nil, fmt.Errorf("size tier %s is configured more than once", t.Name)
+		}
+		seen[t.Name] = true
+		// A tier with no minimums matches every instance, so any tier before it would always be empty.
+		if i > 0 && t.MinExecutors == 0 && t.MinNodes == 0 && t.MinJobs == 0 {
+			return nil, fmt.Errorf("size tier %s has no minimums, which is only allowed for the first tier", t.Name)
+		}
+	}
+
+	return st, nil
+}
+
+// LoadSizeTiers reads size tier configuration from a YAML file, or returns the default configuration if the filename is
+// empty
+func LoadSizeTiers(filename string) (*SizeTiers, error) {
+	if filename == "" {
+		return ParseSizeTiers([]byte(DefaultSizeTiersConfig))
+	}
+	data, err := ioutil.ReadFile(filename) // #nosec
+	if err != nil {
+		return nil, err
+	}
+	return ParseSizeTiers(data)
+}
+
+// Names returns the names of all tiers, from smallest to largest
+func (st *SizeTiers) Names() []string {
+	var names []string
+	for _, t := range st.Tiers {
+		names = append(names, t.Name)
+	}
+	return names
+}
+
+// Filter returns a condition on instance_reports, aliased as "i", matching instances in the named tier. It can be
+// passed to the report functions which accept filters.
+func (st *SizeTiers) Filter(name string) (sq.Sqlizer, error) {
+	for idx, t := range st.Tiers {
+		if t.Name != name {
+			continue
+		}
+		cond := sq.And{t.condition()}
+		for _, larger := range st.Tiers[idx+1:] {
+			cond = append(cond, sq.Expr("NOT (?)", larger.condition()))
+		}
+		return cond, nil
+	}
+	return nil, fmt.Errorf("no size tier named %s", name)
+}
+
+func (t SizeTier) condition() sq.Sqlizer {
+	var cond sq.Or
+	if t.MinExecutors > 0 {
+		cond = append(cond, sq.GtOrEq{"i.executors": t.MinExecutors})
+	}
+	if t.MinNodes > 0 {
+		cond = append(cond, sq.Expr(nodeCountExpr+" >= ?", t.MinNodes))
+	}
+	if t.MinJobs > 0 {
+		cond = append(cond, sq.Expr(jobCountExpr+" >= ?", t.MinJobs))
+	}
+	if len(cond) == 0 {
+		return sq.Expr("true")
+	}
+	return cond
+}
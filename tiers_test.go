@@ -0,0 +1,122 @@
+package stats_test
+
+import (
+	"testing"
+
+	stats "github.com/jenkins-infra/jenkins-usage-stats"
+	"github.com/jenkins-infra/jenkins-usage-stats/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSizeTiers(t *testing.T) {
+	tiers, err := stats.LoadSizeTiers("")
+	require.NoError(t, err)
+
+	assert.Equal(t, []string{"hobby", "small", "medium", "large", "enterprise"}, tiers.Names())
+}
+
+func TestSizeTierReports(t *testing.T) {
+	db, closeFunc := testutil.DBForTest(t)
+	defer closeFunc()
+
+	tiers, err := stats.LoadSizeTiers("")
+	require.NoError(t, err)
+
+	testCases := []struct {
+		name      string
+		executors uint64
+		nodes     int
+		jobs      uint64
+		expected  string
+	}{
+		// Reports without any jobs aren't imported, so the smallest instance has one.
+		{name: "one-job", nodes: 1, jobs: 1, expected: "hobby"},
+		{name: "few-jobs", executors: 2, nodes: 1, jobs: 5, expected: "hobby"},
+		{name: "small-by-jobs", executors: 2, nodes: 1, jobs: 20, expected: "small"},
+		{name: "medium-by-nodes", executors: 2, nodes: 5, jobs: 5, expected: "medium"},
+		{name: "large-by-executors", executors: 150, nodes: 1, jobs: 5, expected: "large"},
+		{name: "enterprise-by-jobs", executors: 10, nodes: 3, jobs: 10000, expected: "enterprise"},
+	}
+
+	cache := stats.NewStatsCache()
+	for _, tc := range testCases {
+		for day := 1; day <= 2; day++ {
+			r := testReport(tc.name, day, "2.303.1", "Linux", "git")
+			r.Nodes[0].Executors = tc.executors
+			for n := 1; n < tc.nodes; n++ {
+				r.Nodes = append(r.Nodes, stats.JSONNode{OS: "Linux", JVMVersion: "11.0.13"})
+			}
+			r.Jobs = map[string]uint64{"hudson-model-FreeStyleProject": tc.jobs}
+			require.NoError(t, stats.AddIndividualReport(db, cache, r))
+		}
+	}
+
+	expected := map[string]uint64{}
+	for _, tc := range testCases {
+		expected[tc.expected]++
+	}
+
+	for _, tierName := range tiers.Names() {
+		t.Run(tierName, func(t *testing.T) {
+			filter, err := tiers.Filter(tierName)
+			require.NoError(t, err)
+
+			ir, err := stats.GetInstallCountForVersions(db, stats.CountOptions{}, 2022, 6, filter)
+			require.NoError(t, err)
+			assert.Equal(t, map[string]uint64{"2.303.1": expected[tierName]}, ir.Installations)
+
+			// Every instance in the tier has git, so it's on all of them.
+			pluginReports, err := stats.GetPluginReports(db, stats.CountOptions{}, 2022, 7, filter)
+			require.NoError(t, err)
+			require.Len(t, pluginReports, 1)
+			assert.Equal(t, "git", pluginReports[0].Name)
+			assert.Equal(t, map[string]uint64{"1654041600000": expected[tierName]}, pluginReports[0].Installations)
+			assert.Equal(t, map[string]float32{"1654041600000": 100}, pluginReports[0].MonthPercentages)
+		})
+	}
+}
+
+func TestSizeTierFilter(t *testing.T) {
+	tiers, err := stats.ParseSizeTiers([]byte(`tiers:
+  - name: small
+  - name: big
+    minExecutors: 10
+    minJobs: 100
+`))
+	require.NoError(t, err)
+
+	smallFilter, err := tiers.Filter("small")
+	require.NoError(t, err)
+	smallSQL, smallArgs, err := smallFilter.ToSql()
+	require.NoError(t, err)
+	assert.Equal(t, "(true AND NOT ((i.executors >= ? OR (select coalesce(sum(tj.value::int), 0) from jsonb_each_text(i.jobs) tj) >= ?)))", smallSQL)
+	assert.Equal(t, []interface{}{uint64(10), uint64(100)}, smallArgs)
+
+	bigFilter, err := tiers.Filter("big")
+	require.NoError(t, err)
+	bigSQL, bigArgs, err := bigFilter.ToSql()
+	require.NoError(t, err)
+	assert.Equal(t, "((i.executors >= ? OR (select coalesce(sum(tj.value::int), 0) from jsonb_each_text(i.jobs) tj) >= ?))", bigSQL)
+	assert.Equal(t, []interface{}{uint64(10), uint64(100)}, bigArgs)
+
+	_, err = tiers.Filter("missing")
+	assert.Error(t, err)
+}
+
+func TestParseSizeTiersErrors(t *testing.T) {
+	testCases := map[string]string{
+		"no tiers":       "tiers: []\n",
+		"duplicate name": "tiers:\n  - name: small\n  - name: small\n",
+		"invalid name":   "tiers:\n  - name: ../small\n",
+		"unknown field":  "tiers:\n  - name: small\n    minPlugins: 3\n",
+		"late catch-all": "tiers:\n  - name: small\n  - name: big\n",
+	}
+
+	for name, config := range testCases {
+		t.Run(name, func(t *testing.T) {
+			_, err := stats.ParseSizeTiers([]byte(config))
+			assert.Error(t, err)
+		})
+	}
+}
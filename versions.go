@@ -0,0 +1,216 @@
+package stats
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/Masterminds/semver"
+	sq "github.com/Masterminds/squirrel"
+)
+
+const (
+	// versionPartWidth is the number of digits each numeric version part is padded to in sort keys. Longer parts are
+	// treated as part of the qualifier.
+	versionPartWidth = 10
+
+	// Sort key markers, chosen so that a qualified version sorts before the same version without a qualifier, which
+	// sorts before any version with more numeric parts.
+	versionQualifierMarker = "!"
+	versionEndMarker       = "#"
+	versionPartMarker      = "."
+)
+
+// JenkinsVersionSortKey returns a key for a Jenkins version which sorts in version order when compared byte by byte,
+// as the C collation does. The numeric parts are compared as numbers, so 2.99 < 2.100, and a version with more parts
+// comes after one it extends, so the weekly release 2.303 < the LTS release 2.303.1 < 2.304. Anything after the first
+// dash, or the first part which isn't a number, is a qualifier, and a qualified version such as 2.303.1-rc comes before
+// the release. Versions which don't start with a number sort before all others.
+func JenkinsVersionSortKey(version string) string {
+	numeric, qualifier := version, ""
+	if i := strings.Index(version, "-"); i >= 0 {
+		numeric, qualifier = version[:i], version[i+1:]
+	}
+
+	var key strings.Builder
+	parts := strings.Split(numeric, ".")
+	for i, p := range parts {
+		if p == "" || len(p) > versionPartWidth || strings.TrimLeft(p, "0123456789") != "" {
+			rest := strings.Join(parts[i:], ".")
+			if qualifier != "" {
+				rest += "-" + qualifier
+			}
+			qualifier = rest
+			break
+		}
+		key.WriteString(versionPartMarker)
+		key.WriteString(strings.Repeat("0", versionPartWidth-len(p)))
+		key.WriteString(p)
+	}
+
+	if qualifier != "" {
+		key.WriteString(versionQualifierMarker)
+		key.WriteString(qualifier)
+	} else {
+		key.WriteString(versionEndMarker)
+	}
+	return key.String()
+}
+
+// CompareJenkinsVersions returns -1 if a is an earlier Jenkins version than b, 1 if it's a later one, and 0 if they're
+// the same, in the order of JenkinsVersionSortKey
+func CompareJenkinsVersions(a, b string) int {
+	if c := strings.Compare(JenkinsVersionSortKey(a), JenkinsVersionSortKey(b)); c != 0 {
+		return c
+	}
+	return strings.Compare(a, b)
+}
+
+// SortJenkinsVersions sorts Jenkins versions from earliest to latest
+func SortJenkinsVersions(versions []string) {
+	sort.SliceStable(versions, func(i, j int) bool {
+		return CompareJenkinsVersions(versions[i], versions[j]) < 0
+	})
+}
+
+// UpdateJenkinsVersionSortKeys sets the sort_key of Jenkins versions added before it existed, returning how many were
+// updated
+func UpdateJenkinsVersionSortKeys(db sq.BaseRunner) (int, error) {
+	rows, err := PSQL(db).Select("id", "version").
+		From(JenkinsVersionsTable).
+		Where(sq.Eq{"sort_key": nil}).
+		Query()
+	if err != nil {
+		return 0, err
+	}
+	defer func() {
+		_ = rows.Close()
+	}()
+
+	var versions []JenkinsVersion
+	for rows.Next() {
+		var jv JenkinsVersion
+		if err := rows.Scan(&jv.ID, &jv.Version); err != nil {
+			return 0, err
+		}
+		versions = append(versions, jv)
+	}
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	for _, jv := range versions {
+		_, err := PSQL(db).Update(JenkinsVersionsTable).
+			Set("sort_key", JenkinsVersionSortKey(jv.Version)).
+			Where(sq.Eq{"id": jv.ID}).
+			Exec()
+		if err != nil {
+			return 0, fmt.Errorf("couldn't set sort key for Jenkins version %s: %w", jv.Version, err)
+		}
+	}
+
+	return len(versions), nil
+}
+
+// versionComparisonRE matches a single comparison in a version range, such as "<= 1148.vcef3ccf1e2a_6"
+var versionComparisonRE = regexp.MustCompile(`^(<=|>=|!=|=|<|>)?\s*([0-9][^\s,|]*)$`)
+
+// versionComparison is a comparison operator and the version it compares with
+type versionComparison struct {
+	op      string
+	version string
+}
+
+// versionRange is a semver range of versions, such as "< 2.303.2". Versions which aren't semver, such as Jenkins
+// LTS releases like 2.303.1.1 or incrementals like 1148.vcef3ccf1e2a_6, are compared with CompareJenkinsVersions
+// instead, as long as the range only uses comparisons (<, <=, >, >=, = and !=) joined by commas and ||. The range can
+// then also include versions which aren't semver.
+type versionRange struct {
+	constraint *semver.Constraints
+	// comparisons are the alternatives of the range, each of which all need to match, or nil if it uses anything else
+	comparisons [][]versionComparison
+}
+
+// parseVersionRange parses a semver range, or a range of comparisons with versions which aren't semver
+func parseVersionRange(s string) (*versionRange, error) {
+	vr := &versionRange{comparisons: parseVersionComparisons(s)}
+	var err error
+	vr.constraint, err = semver.NewConstraint(s)
+	if err != nil && vr.comparisons == nil {
+		return nil, err
+	}
+	return vr, nil
+}
+
+// parseVersionComparisons parses the alternatives of comparisons of a range, returning nil if the range uses anything
+// other than comparisons, such as ^1.2 or 1.x
+func parseVersionComparisons(s string) [][]versionComparison {
+	var alternatives [][]versionComparison
+	for _, alternative := range strings.Split(s, "||") {
+		var comparisons []versionComparison
+		for _, c := range strings.Split(alternative, ",") {
+			m := versionComparisonRE.FindStringSubmatch(strings.TrimSpace(c))
+			if m == nil {
+				return nil
+			}
+			for _, part := range strings.Split(m[2], ".") {
+				if part == "x" || part == "X" || part == "*" {
+					return nil
+				}
+			}
+			op := m[1]
+			if op == "" {
+				op = "="
+			}
+			comparisons = append(comparisons, versionComparison{op: op, version: m[2]})
+		}
+		alternatives = append(alternatives, comparisons)
+	}
+	return alternatives
+}
+
+// check returns whether the version is in the range. ok is false if the version can't be compared with the range,
+// such as when it isn't semver and doesn't start with a number, or the range isn't only comparisons.
+func (vr *versionRange) check(version string) (matches, ok bool) {
+	if vr.constraint != nil {
+		if sv, err := semver.NewVersion(version); err == nil {
+			return vr.constraint.Check(sv), true
+		}
+	}
+	if vr.comparisons == nil || !strings.HasPrefix(JenkinsVersionSortKey(version), versionPartMarker) {
+		return false, false
+	}
+	for _, alternative := range vr.comparisons {
+		if versionMatchesAll(version, alternative) {
+			return true, true
+		}
+	}
+	return false, true
+}
+
+// versionMatchesAll returns whether the version matches all the comparisons
+func versionMatchesAll(version string, comparisons []versionComparison) bool {
+	for _, c := range comparisons {
+		cmp := CompareJenkinsVersions(version, c.version)
+		var matches bool
+		switch c.op {
+		case "<":
+			matches = cmp < 0
+		case "<=":
+			matches = cmp <= 0
+		case ">":
+			matches = cmp > 0
+		case ">=":
+			matches = cmp >= 0
+		case "!=":
+			matches = cmp != 0
+		default:
+			matches = cmp == 0
+		}
+		if !matches {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,58 @@
+package stats_test
+
+import (
+	"testing"
+
+	stats "github.com/jenkins-infra/jenkins-usage-stats"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSortJenkinsVersions(t *testing.T) {
+	versions := []string{
+		"2.100",
+		"2.99",
+		"1.651.3",
+		"2.303.1",
+		"2.303",
+		"2.303.1-rc31234.abc123",
+		"2.304",
+		"1.99",
+		"2.0-beta-1",
+		"2.0",
+		"1.651",
+		"2.0-alpha-4",
+		"2.303.10",
+		"2.303.2",
+		"unknown",
+	}
+	stats.SortJenkinsVersions(versions)
+	assert.Equal(t, []string{
+		"unknown",
+		"1.99",
+		"1.651",
+		"1.651.3",
+		"2.0-alpha-4",
+		"2.0-beta-1",
+		"2.0",
+		"2.99",
+		"2.100",
+		"2.303",
+		"2.303.1-rc31234.abc123",
+		"2.303.1",
+		"2.303.2",
+		"2.303.10",
+		"2.304",
+	}, versions)
+
+	assert.Equal(t, 0, stats.CompareJenkinsVersions("2.303.1", "2.303.1"))
+	assert.Equal(t, 1, stats.CompareJenkinsVersions("2.100", "2.99"))
+	assert.Equal(t, -1, stats.CompareJenkinsVersions("2.303", "2.303.1"))
+}
+
+func TestJenkinsVersionSortKey(t *testing.T) {
+	// Keys are compared byte by byte, so their order must match the comparator's.
+	versions := []string{"1.99", "1.651.3", "2.99", "2.100", "2.303.1-rc", "2.303.1", "2.303.1.1", "2.304-SNAPSHOT", "2.304"}
+	for i := 1; i < len(versions); i++ {
+		assert.Less(t, stats.JenkinsVersionSortKey(versions[i-1]), stats.JenkinsVersionSortKey(versions[i]), versions[i])
+	}
+}
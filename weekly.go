@@ -0,0 +1,252 @@
+package stats
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	sq "github.com/Masterminds/squirrel"
+	"github.com/lib/pq"
+)
+
+// WeeklyInstanceReportsTable is the weekly_instance_reports table name
+const WeeklyInstanceReportsTable = "weekly_instance_reports"
+
+// weeklyReportColumns are the columns of weekly_instance_reports which are replaced by newer reports in the same week
+var weeklyReportColumns = []string{"year", "month", "version", "plugins"}
+
+// WeeklyReport is the Jenkins and plugin version numbers for the most recent weeks, written to the weekly directory
+type WeeklyReport struct {
+	// Weeks are the keys of the weeks included, oldest first
+	Weeks []string `json:"weeks"`
+	// WeekStarts are the start times of each week, in milliseconds
+	WeekStarts map[string]int64 `json:"weekStarts"`
+	// Installations are the number of instances on each Jenkins version, by week
+	Installations map[string]map[string]uint64 `json:"installations"`
+	// PluginVersions are the number of instances with each plugin version installed, by plugin and then week
+	PluginVersions map[string]map[string]map[string]uint64 `json:"pluginVersions"`
+}
+
+// addWeeklyReport adds a report to the weekly_instance_reports table. The count for the week is incremented unless the
+// report was already added, but it only replaces the instance's report for the week if it's newer.
+func addWeeklyReport(db sq.BaseRunner, report *InstanceReport, loc *time.Location) error {
+	week, err := PeriodKey(PeriodWeek, report.ReportTime, loc)
+	if err != nil {
+		return err
+	}
+
+	updates := []string{
+		"count_for_week = w.count_for_week + case when excluded.report_time = w.report_time then 0 else 1 end",
+		"report_time = greatest(w.report_time, excluded.report_time)",
+	}
+	for _, c := range weeklyReportColumns {
+		updates = append(updates, fmt.Sprintf("%s = case when excluded.report_time > w.report_time then excluded.%s else w.%s end", c, c, c))
+	}
+
+	_, err = PSQL(db).Insert(WeeklyInstanceReportsTable+" as w").
+		Columns("instance_id", "week", "year", "month", "count_for_week", "report_time", "version", "plugins").
+		Values(report.InstanceID, week, report.Year, report.Month, 1, report.ReportTime, report.Version, report.Plugins).
+		Suffix("on conflict (instance_id, week) do update set " + strings.Join(updates, ", ")).
+		Exec()
+	return err
+}
+
+// countedWeeklyInstances is the criteria for a weekly instance report to be counted, like countedInstances for the
+// monthly ones
+func countedWeeklyInstances(table string, excludeQuarantined bool) sq.Sqlizer {
+	return countedCriteria(table, "count_for_week", excludeQuarantined)
+}
+
+// LatestWeeks returns the keys of the n most recent weeks which have ended by the given time, oldest first, with weeks
+// starting at midnight in loc
+func LatestWeeks(n int, end time.Time, loc *time.Location) ([]string, error) {
+	key, err := PeriodKey(PeriodWeek, end, loc)
+	if err != nil {
+		return nil, err
+	}
+	// Count back from the start of the week the end time is in, since that week hasn't ended yet.
+	weekStart, err := PeriodStart(PeriodWeek, key, loc)
+	if err != nil {
+		return nil, err
+	}
+
+	weeks := make([]string, n)
+	for i := n - 1; i >= 0; i-- {
+		weekStart = weekStart.AddDate(0, 0, -7)
+		if weeks[i], err = PeriodKey(PeriodWeek, weekStart, loc); err != nil {
+			return nil, err
+		}
+	}
+	return weeks, nil
+}
+
+// weeksOverlappingMonths returns the keys of the ISO weeks which overlap the months from the start month to the end
+// month, inclusive, oldest first, with weeks and months starting at midnight in loc
+func weeksOverlappingMonths(startYear, startMonth, endYear, endMonth int, loc *time.Location) (pq.StringArray, error) {
+	end := startDateForYearMonth(endYear, endMonth, loc).AddDate(0, 1, 0)
+	key, err := PeriodKey(PeriodWeek, startDateForYearMonth(startYear, startMonth, loc), loc)
+	if err != nil {
+		return nil, err
+	}
+
+	weeks := pq.StringArray{}
+	for {
+		weeks = append(weeks, key)
+		next, err := PeriodEnd(PeriodWeek, key, loc)
+		if err != nil {
+			return nil, err
+		}
+		if !next.Before(end) {
+			return weeks, nil
+		}
+		if key, err = PeriodKey(PeriodWeek, next, loc); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// GetWeeklyInstallCountForVersions generates a map of Jenkins versions to install counts for a week, like
+// GetInstallCountForVersions does for a month
+func GetWeeklyInstallCountForVersions(db sq.BaseRunner, co CountOptions, week string) (map[string]uint64, error) {
+	counts := map[string]uint64{}
+	rows, err := PSQL(db).Select("jv.version as jvv", "count(*) as number").
+		From(WeeklyInstanceReportsTable + " w").
+		Join("jenkins_versions jv on w.version = jv.id").
+		Where(sq.Eq{"w.week": week}).
+		Where(countedWeeklyInstances("w", co.ExcludeQuarantined)).
+		Where("jv.version ~ '^\\d'").
+		Where("jv.version not like '%private%'").
+		GroupBy("jvv").
+		Query()
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = rows.Close()
+	}()
+
+	for rows.Next() {
+		var v string
+		var c uint64
+		if err := rows.Scan(&v, &c); err != nil {
+			return nil, err
+		}
+		counts[v] = c
+	}
+
+	return counts, rows.Err()
+}
+
+// GetWeeklyPluginVersionCounts generates a map of plugin names to the install counts of each of their versions for a
+// week
+func GetWeeklyPluginVersionCounts(db sq.BaseRunner, co CountOptions, week string) (map[string]map[string]uint64, error) {
+	counts := map[string]map[string]uint64{}
+	rows, err := PSQL(db).Select("p.name", "p.version", "count(*)").
+		From(WeeklyInstanceReportsTable+" w, unnest(w.plugins) pr(id)").
+		Join("plugins p on p.id = pr.id").
+		Where(sq.Eq{"w.week": week}).
+		Where(countedWeeklyInstances("w", co.ExcludeQuarantined)).
+		GroupBy("p.name", "p.version").
+		Query()
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = rows.Close()
+	}()
+
+	for rows.Next() {
+		var name, version string
+		var c uint64
+		if err := rows.Scan(&name, &version, &c); err != nil {
+			return nil, err
+		}
+		if !countablePluginVersion(version) {
+			continue
+		}
+		if _, ok := counts[name]; !ok {
+			counts[name] = map[string]uint64{}
+		}
+		counts[name][version] = c
+	}
+
+	return counts, rows.Err()
+}
+
+// GetWeeklyReport gets the Jenkins and plugin version numbers for the weeks
+func GetWeeklyReport(db sq.BaseRunner, co CountOptions, weeks []string) (*WeeklyReport, error) {
+	report := &WeeklyReport{
+		Weeks:          append([]string{}, weeks...),
+		WeekStarts:     map[string]int64{},
+		Installations:  map[string]map[string]uint64{},
+		PluginVersions: map[string]map[string]map[string]uint64{},
+	}
+	sort.Strings(report.Weeks)
+
+	for _, week := range report.Weeks {
+		start, err := PeriodStart(PeriodWeek, week, co.Location)
+		if err != nil {
+			return nil, err
+		}
+		report.WeekStarts[week] = start.UnixMilli()
+
+		report.Installations[week], err = GetWeeklyInstallCountForVersions(db, co, week)
+		if err != nil {
+			return nil, err
+		}
+
+		pluginCounts, err := GetWeeklyPluginVersionCounts(db, co, week)
+		if err != nil {
+			return nil, err
+		}
+		for name, versions := range pluginCounts {
+			if _, ok := report.PluginVersions[name]; !ok {
+				report.PluginVersions[name] = map[string]map[string]uint64{}
+			}
+			report.PluginVersions[name][week] = versions
+		}
+	}
+
+	return report, nil
+}
+
+// GenerateWeeklyReports writes the Jenkins version numbers for the weeks to jenkins-versions.json in the output
+// directory, and the plugin version numbers to a (plugin name).json file for each plugin in its plugins subdirectory
+func GenerateWeeklyReports(db sq.BaseRunner, co CountOptions, weeks []string, outputDir string) error {
+	report, err := GetWeeklyReport(db, co, weeks)
+	if err != nil {
+		return err
+	}
+
+	pluginsDir := filepath.Join(outputDir, "plugins")
+	err = os.MkdirAll(pluginsDir, 0755) //nolint:gosec
+	if err != nil {
+		return err
+	}
+
+	err = writeJSONFile(filepath.Join(outputDir, "jenkins-versions.json"), map[string]interface{}{
+		"weeks":         report.Weeks,
+		"weekStarts":    report.WeekStarts,
+		"installations": report.Installations,
+	})
+	if err != nil {
+		return err
+	}
+
+	for name, byWeek := range report.PluginVersions {
+		err = writeJSONFile(filepath.Join(pluginsDir, fmt.Sprintf("%s.json", name)), map[string]interface{}{
+			"name":       name,
+			"weeks":      report.Weeks,
+			"weekStarts": report.WeekStarts,
+			"versions":   byWeek,
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
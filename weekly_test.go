@@ -0,0 +1,79 @@
+package stats_test
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	stats "github.com/jenkins-infra/jenkins-usage-stats"
+	"github.com/jenkins-infra/jenkins-usage-stats/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLatestWeeks(t *testing.T) {
+	// Wednesday, so the week it's in hasn't ended yet.
+	weeks, err := stats.LatestWeeks(3, time.Date(2022, time.June, 15, 12, 0, 0, 0, time.UTC), nil)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"2022-W21", "2022-W22", "2022-W23"}, weeks)
+
+	// The very start of a week, so the week before it has ended.
+	weeks, err = stats.LatestWeeks(2, time.Date(2022, time.June, 13, 0, 0, 0, 0, time.UTC), nil)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"2022-W22", "2022-W23"}, weeks)
+
+	weeks, err = stats.LatestWeeks(2, time.Date(2021, time.January, 5, 0, 0, 0, 0, time.UTC), nil)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"2020-W52", "2020-W53"}, weeks)
+}
+
+func TestWeeklyReports(t *testing.T) {
+	db, closeFunc := testutil.DBForTest(t)
+	defer closeFunc()
+	cache := stats.NewStatsCacheWithConfig(stats.ImportConfig{Weekly: true})
+	for _, r := range []struct {
+		install string
+		day     int
+		version string
+	}{
+		// 2022-W22 is May 30th to June 5th, and 2022-W23 is June 6th to 12th.
+		{"a", 1, "2.303.1"},
+		{"a", 2, "2.303.1"},
+		{"b", 3, "2.303.1"},
+		{"a", 6, "2.303.1"},
+		{"a", 7, "2.303.2"},
+		{"b", 8, "2.303.1"},
+		{"b", 9, "2.303.1"},
+		// c's reports from the first week arrive after its report from the second week, which is the month's latest.
+		{"c", 10, "2.303.2"},
+		{"c", 4, "2.303.1"},
+		{"c", 5, "2.303.1"},
+	} {
+		require.NoError(t, stats.AddIndividualReport(db, cache, testReport(r.install, r.day, r.version, "Linux", "git")))
+	}
+
+	// b only reported once in the first week, so it isn't counted.
+	installs, err := stats.GetWeeklyInstallCountForVersions(db, stats.CountOptions{}, "2022-W22")
+	require.NoError(t, err)
+	assert.Equal(t, map[string]uint64{"2.303.1": 2}, installs)
+
+	installs, err = stats.GetWeeklyInstallCountForVersions(db, stats.CountOptions{}, "2022-W23")
+	require.NoError(t, err)
+	assert.Equal(t, map[string]uint64{"2.303.1": 1, "2.303.2": 1}, installs)
+
+	plugins, err := stats.GetWeeklyPluginVersionCounts(db, stats.CountOptions{}, "2022-W23")
+	require.NoError(t, err)
+	assert.Equal(t, map[string]map[string]uint64{"git": {"1.0": 2}}, plugins)
+
+	byWeek, err := stats.RunUsageQuery(db, stats.UsageQuery{StartYear: 2022, StartMonth: 6, EndYear: 2022, EndMonth: 6, GroupBy: stats.GroupByWeek})
+	require.NoError(t, err)
+	assert.Equal(t, []stats.UsageQueryRow{{Key: "2022-W22", Count: 2}, {Key: "2022-W23", Count: 2}}, byWeek.Rows)
+
+	dir := t.TempDir()
+	require.NoError(t, stats.GenerateWeeklyReports(db, stats.CountOptions{}, []string{"2022-W22", "2022-W23"}, dir))
+	assert.FileExists(t, filepath.Join(dir, "jenkins-versions.json"))
+	pluginReport, err := os.ReadFile(filepath.Join(dir, "plugins", "git.json"))
+	require.NoError(t, err)
+	assert.Contains(t, string(pluginReport), `"2022-W23"`)
+}